@@ -0,0 +1,162 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"flyssh/core"
+)
+
+// accessPoll is how often a waiting request is checked on
+const accessPoll = 5 * time.Second
+
+// AccessCommand requests temporary access to launchers and waits for an
+// admin to decide, printing the token if it's approved
+func AccessCommand(args []string) error {
+	fs := flag.NewFlagSet("access", flag.ExitOnError)
+	serverURL := fs.String("url", os.Getenv("WSS_URL"), "Server URL")
+	name := fs.String("name", os.Getenv("USER"), "Your name, as approvers will see it")
+	launch := fs.String("launch", "", "Comma separated launchers to request access to")
+	hours := fs.Int("hours", 1, "Hours of access to request")
+	reason := fs.String("reason", "", "Why you need access")
+	wait := fs.Duration("wait", 30*time.Minute, "How long to wait for a decision")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *serverURL == "" || *launch == "" {
+		return fmt.Errorf("-url and -launch are required")
+	}
+
+	base := adminBase(*serverURL)
+	client := &http.Client{Timeout: 10 * time.Second}
+	body, err := json.Marshal(core.AccessRequest{Name: *name, Launchers: strings.Split(*launch, ","), Hours: *hours, Reason: *reason})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+	resp, err := client.Post(base+"/api/v1/access", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to request access: %v", err)
+	}
+	req, err := decodeAccess(resp, http.StatusCreated)
+	if err != nil {
+		return fmt.Errorf("failed to request access: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Requested access (request %s), waiting for approval...\n", req.ID)
+
+	endpoint := fmt.Sprintf("%s/api/v1/access/%s?claim=%s", base, url.PathEscape(req.ID), url.QueryEscape(req.Claim))
+	for deadline := time.Now().Add(*wait); req.Status == core.AccessPending; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no decision on request %s after %s", req.ID, *wait)
+		}
+		time.Sleep(accessPoll)
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to check request: %v", err)
+		}
+		if req, err = decodeAccess(resp, http.StatusOK); err != nil {
+			return fmt.Errorf("failed to check request: %v", err)
+		}
+	}
+	if req.Status != core.AccessApproved {
+		return fmt.Errorf("request %s was %s by %s", req.ID, req.Status, req.Approver)
+	}
+	fmt.Fprintf(os.Stderr, "Approved by %s until %s\n", req.Approver, req.Expires.Local().Format(time.Kitchen))
+	fmt.Println(req.Token)
+	return nil
+}
+
+// ServerAccessCommand lists access requests on a running server, or
+// approves or denies one
+func ServerAccessCommand(args []string) error {
+	fs := flag.NewFlagSet("access", flag.ExitOnError)
+	serverURL := fs.String("url", "http://localhost:8081", "Server admin URL")
+	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token")
+	approve := fs.String("approve", "", "Request ID to approve")
+	deny := fs.String("deny", "", "Request ID to deny")
+	by := fs.String("by", os.Getenv("USER"), "Your name, recorded as who the decision is on behalf of")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *token == "" {
+		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN or use -token flag")
+	}
+
+	base := adminBase(*serverURL)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if *approve != "" || *deny != "" {
+		id, action := *approve, "approve"
+		if *deny != "" {
+			id, action = *deny, "deny"
+		}
+		endpoint := fmt.Sprintf("%s/api/v1/access/%s/%s?token=%s&by=%s", base, url.PathEscape(id), action, url.QueryEscape(*token), url.QueryEscape(*by))
+		resp, err := client.Post(endpoint, "application/json", nil)
+		if err != nil {
+			return fmt.Errorf("failed to %s request: %v", action, err)
+		}
+		req, err := decodeAccess(resp, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("failed to %s request %s: %v", action, id, err)
+		}
+		if req.Status == core.AccessApproved {
+			fmt.Printf("Approved request %s: %s may use %s until %s\n", req.ID, req.Name, strings.Join(req.Launchers, ", "), req.Expires.Local().Format(time.RFC3339))
+		} else {
+			fmt.Printf("Denied request %s\n", req.ID)
+		}
+		return nil
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s/api/v1/access?token=%s", base, url.QueryEscape(*token)))
+	if err != nil {
+		return fmt.Errorf("failed to list requests: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list requests: %s", resp.Status)
+	}
+	var requests []core.AccessRequest
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		return fmt.Errorf("failed to decode requests: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tLAUNCHERS\tHOURS\tSTATUS\tREQUESTED\tREASON")
+	for _, req := range requests {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			req.ID, req.Name, strings.Join(req.Launchers, ","), req.Hours,
+			req.Status, req.Requested.Format(time.RFC3339), req.Reason)
+	}
+	return tw.Flush()
+}
+
+// adminBase turns a server URL into the base of its HTTP API. ws:// and
+// wss:// URLs are accepted since that's what clients use.
+func adminBase(serverURL string) string {
+	base := strings.TrimSuffix(serverURL, "/")
+	base = strings.Replace(base, "ws://", "http://", 1)
+	return strings.Replace(base, "wss://", "https://", 1)
+}
+
+// decodeAccess reads an access request from a response with the expected
+// status, or the server's error
+func decodeAccess(resp *http.Response, status int) (core.AccessRequest, error) {
+	defer resp.Body.Close()
+	var req core.AccessRequest
+	if resp.StatusCode != status {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return req, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(msg.String()))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&req); err != nil {
+		return req, fmt.Errorf("invalid response: %v", err)
+	}
+	return req, nil
+}
@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"flyssh/core"
+)
+
+// ActivateCommand opens the port of a server started with -activate-addr,
+// as a hub would
+func ActivateCommand(args []string) error {
+	fs := flag.NewFlagSet("activate", flag.ExitOnError)
+	addr := fs.String("addr", os.Getenv("WSS_ACTIVATE_ADDR"), "Address the server takes activation requests on")
+	keyFile := fs.String("key-file", os.Getenv("WSS_ACTIVATE_KEY_FILE"), "File holding the activation key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *addr == "" || *keyFile == "" {
+		return fmt.Errorf("-addr and -key-file are required")
+	}
+
+	key, err := core.LoadActivationKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	if err := core.Activate(*addr, key); err != nil {
+		return err
+	}
+	fmt.Printf("Activated %s\n", *addr)
+	return nil
+}
@@ -0,0 +1,35 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// printAnsibleVars prints the inventory variables that run Ansible's ssh
+// connection through flyssh ssh. Ansible runs its ssh executable without
+// arguments of its own, so it's flyssh linked as flyssh-ssh. Files are
+// piped through the command, since flyssh doesn't serve SFTP.
+func printAnsibleVars(w io.Writer) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find flyssh: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	ssh := filepath.Join(filepath.Dir(exe), "flyssh-ssh")
+
+	fmt.Fprintln(w, "# Ansible variables for hosts reached through flyssh, for group_vars or")
+	fmt.Fprintln(w, "# an inventory. Give each host a Host entry with its URL and token in")
+	fmt.Fprintln(w, "# the flyssh config file, or set WSS_URL and WSS_AUTH_TOKEN.")
+	if _, err := os.Stat(ssh); err != nil {
+		fmt.Fprintf(w, "# First link flyssh as flyssh-ssh: ln -s %s %s\n", exe, ssh)
+	}
+	fmt.Fprintln(w, "ansible_connection: ssh")
+	fmt.Fprintf(w, "ansible_ssh_executable: %s\n", ssh)
+	fmt.Fprintln(w, "ansible_ssh_transfer_method: piped")
+	fmt.Fprintln(w, "ansible_pipelining: true")
+	return nil
+}
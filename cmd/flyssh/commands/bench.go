@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	"flyssh/core"
+	wsslog "flyssh/core/log"
+)
+
+// BenchCommand measures latency, throughput and session start rate
+// against a server, or a server of its own on localhost
+func BenchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	serverURL := fs.String("url", "", "Server to benchmark (default: start one on localhost)")
+	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token, for -url")
+	protocol := fs.String("protocol", "all", "Protocol to benchmark: v2, v3 or all")
+	rounds := fs.Int("rounds", 1000, "Echo round trips to time")
+	size := fs.Int64("bytes", 64<<20, "Bytes to send each way for throughput")
+	sessions := fs.Int("sessions", 100, "Sessions to start")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var protocols []string
+	switch *protocol {
+	case "v2":
+		protocols = []string{core.ProtocolV2}
+	case "v3":
+		protocols = []string{core.ProtocolV3}
+	case "all":
+		protocols = []string{core.ProtocolV2, core.ProtocolV3}
+	default:
+		return fmt.Errorf("unknown protocol %q: use v2, v3 or all", *protocol)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *serverURL == "" {
+		// The server's log would drown the results
+		wsslog.Info.SetOutput(io.Discard)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("failed to start server: %v", err)
+		}
+		*token = core.GenerateDevToken()
+		s := core.NewServer(0)
+		s.SetAuthToken(*token)
+		go s.Serve(ctx, ln)
+		*serverURL = "ws://" + ln.Addr().String()
+	} else if *token == "" {
+		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN or use -token flag")
+	}
+
+	fmt.Printf("Benchmarking %s: %d echoes, %d MB each way, %d sessions\n", *serverURL, *rounds, *size>>20, *sessions)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTOCOL\tECHO P50\tECHO P99\tUPLOAD\tDOWNLOAD\tSESSIONS")
+	for _, p := range protocols {
+		res, err := core.Bench(ctx, *serverURL, *token, core.BenchOptions{Protocol: p, Rounds: *rounds, Bytes: *size, Sessions: *sessions})
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		fmt.Fprintf(w, "%s\t%v\t%v\t%.1f MB/s\t%.1f MB/s\t%.1f/s\n", res.Protocol, res.LatencyP50, res.LatencyP99, res.UploadMBps, res.DownloadMBps, res.SessionsPerSec)
+	}
+	return w.Flush()
+}
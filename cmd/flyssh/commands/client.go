@@ -1,61 +1,255 @@
 package commands
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
+	"time"
 
 	"flyssh/core"
+	wsslog "flyssh/core/log"
+
+	"golang.org/x/term"
 )
 
 func ClientCommand(args []string) error {
-	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	return clientCommand("client", args)
+}
+
+// ConnectCommand connects to a server named by a Host in the config file,
+// with its settings
+func ConnectCommand(args []string) error {
+	return clientCommand("connect", args)
+}
 
-	// Command line flags
-	url := fs.String("url", os.Getenv("WSS_URL"), "WebSocket server URL")
-	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token")
-	dev := fs.Bool("dev", false, "Run in development mode with local server")
-	debug := fs.Bool("debug", false, "Enable debug logging")
+// clientFlags holds the client's options, which the config file can set too
+type clientFlags struct {
+	url          *string
+	token        *string
+	tokenFile    *string
+	tokenCommand *string
+	dev          *bool
+	debug        *bool
+	launch       *string
+	command      *string
+	login        *string
+	dir          *string
+	shell        *string
+	dotfiles     *string
+	sendEnv      *string
+	termType     *string
+	resume       *string
+	observe      *string
+	keepalive    *time.Duration
+	forwardAgent *bool
+	forwardX11   *bool
+	noPTY        *bool
+	hostKeyCheck *string
+	controlPath  *string
+	reconnect    *time.Duration
+	escapeChar   *string
+	record       *string
+	logOutput    *string
+}
+
+// newClientFlags defines the client's flags, for the named command
+func newClientFlags(name string) (*flag.FlagSet, *clientFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return fs, &clientFlags{
+		url:          fs.String("url", os.Getenv("WSS_URL"), "WebSocket server URL"),
+		token:        fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token"),
+		tokenFile:    fs.String("token-file", os.Getenv("WSS_TOKEN_FILE"), "Read the auth token from this file"),
+		tokenCommand: fs.String("token-command", os.Getenv("WSS_TOKEN_COMMAND"), "Run this command to get the auth token, e.g. from a password manager"),
+		dev:          fs.Bool("dev", false, "Run in development mode with local server"),
+		debug:        fs.Bool("debug", false, "Enable debug logging"),
+		launch:       fs.String("launch", "", "Run a named server-side launcher instead of a shell"),
+		command:      fs.String("c", "", "Run this command through the remote shell and exit with its status"),
+		login:        fs.String("login", "", "Start the session as this user on the server (the server must run as root)"),
+		dir:          fs.String("dir", "", "Start the session in this directory on the server"),
+		shell:        fs.String("shell", os.Getenv("WSS_SHELL"), "Shell to run the session or command in, instead of the server's default: sh or pwsh on Unix servers, cmd, powershell or pwsh on Windows"),
+		dotfiles:     fs.String("dotfiles", os.Getenv("WSS_DOTFILES"), "Comma separated local dotfiles (.inputrc, .vimrc, .shrc and others) to bring to the session"),
+		sendEnv:      fs.String("send-env", os.Getenv("WSS_SEND_ENV"), "Comma separated local environment variables to pass to the session (wildcards allowed)"),
+		termType:     fs.String("term", os.Getenv("WSS_TERM"), "Terminal type for the session, instead of $TERM"),
+		resume:       fs.String("resume", "", "Attach to a detached session by ID, replaying its recent output"),
+		observe:      fs.String("observe", "", "Watch another user's dual-control session by ID (q or ^C stops)"),
+		keepalive:    fs.Duration("keepalive", core.DefaultKeepalive, "Ping the server this often and reconnect when it stops answering (0 disables)"),
+		forwardAgent: fs.Bool("A", false, "Forward the local SSH agent (SSH_AUTH_SOCK) to the session"),
+		forwardX11:   fs.Bool("X", false, "Forward the local X display (DISPLAY) to the session"),
+		noPTY:        fs.Bool("T", false, "Run the -c command without a PTY even from a terminal, passing its input and output through unaltered"),
+		hostKeyCheck: fs.String("host-key-check", os.Getenv("WSS_HOST_KEY_CHECK"), "How to treat wss:// servers whose key isn't known: ask (default), accept-new, yes (refuse) or no (don't check)"),
+		controlPath:  fs.String("control-path", os.Getenv("WSS_CONTROL_PATH"), "Share one server connection between clients using this local socket"),
+		reconnect:    fs.Duration("reconnect", time.Minute, "Keep trying to resume the session this long after the connection drops (0 disables)"),
+		escapeChar:   fs.String("e", "~", "Escape character for commands typed at the start of a line, such as ~b to bookmark the output (none disables)"),
+		record:       fs.String("record", os.Getenv("WSS_RECORD"), "Record the session's output to this asciicast file, with its bookmarks"),
+		logOutput:    fs.String("log-output", os.Getenv("WSS_LOG_OUTPUT"), "Append a plain text, timestamped transcript of the session's output to this file (search with flyssh transcript grep)"),
+	}
+}
 
-	// Parse flags
+func clientCommand(name string, args []string) error {
+	fs, o := newClientFlags(name)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 
+	// connect takes the server's name before the command
+	cmdArgs := fs.Args()
+	if name == "connect" {
+		if len(cmdArgs) == 0 {
+			return fmt.Errorf("usage: flyssh connect [options] NAME [COMMAND...]")
+		}
+		if flagGiven(fs, "url") {
+			return fmt.Errorf("Give the server by name or with -url, not both")
+		}
+		*o.url, cmdArgs = cmdArgs[0], cmdArgs[1:]
+	}
+	if len(cmdArgs) > 0 && flagGiven(fs, "c") {
+		return fmt.Errorf("Give a command with -c or as arguments, not both")
+	}
+
+	// The server may be a Host from the config file, whose settings
+	// apply where flags and environment variables don't
+	cfg, err := core.LoadClientConfig()
+	if err != nil {
+		return err
+	}
+	host, alias := configHost(*o.url)
+	settings := cfg.Settings(host)
+	if name == "connect" && (!alias || settings["url"] == "") {
+		path, err := core.ClientConfigPath()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s is not a Host with a URL in %s", *o.url, path)
+	}
+	if alias {
+		*o.url = hostURL(host, settings)
+	}
+	if err := applySettings(fs, settings, "config", false); err != nil {
+		return err
+	}
+
+	// Arguments after the flags are a command, as with ssh, replacing the
+	// config file's
+	if len(cmdArgs) > 0 {
+		*o.command = strings.Join(cmdArgs, " ")
+	}
+	if *o.token == "" {
+		if *o.token, err = readToken(*o.tokenFile, *o.tokenCommand); err != nil {
+			return err
+		}
+	}
+
 	// Enable debug logging if flag is set
-	if *debug {
+	if *o.debug {
 		os.Setenv("WSS_DEBUG", "1")
 	}
 
 	// In dev mode, start server in background and set URL/token
-	if *dev {
+	if *o.dev {
 		// Use random high port (49152-65535)
 		port := rand.Intn(65535-49152) + 49152
 		devToken := core.GenerateDevToken()
-		os.Setenv("WSS_AUTH_TOKEN", devToken)
-		*url = fmt.Sprintf("ws://localhost:%d", port)
-		*token = devToken // Set the token flag value too
+		*o.url = fmt.Sprintf("ws://localhost:%d", port)
+		*o.token = devToken
 
 		// Start server in background
 		s := core.NewServer(port)
+		s.SetAuthToken(devToken)
 		go s.Start()
 
 		fmt.Printf("\n=== Development Mode ===\n")
-		fmt.Printf("WebSocket URL: %s\n", *url)
-		fmt.Printf("Auth Token: %s\n", *token)
+		fmt.Printf("WebSocket URL: %s\n", *o.url)
+		fmt.Printf("Auth Token: %s\n", *o.token)
 		fmt.Printf("====================\n\n")
 	}
 
+	// With no server given, offer the recently used ones
+	if *o.url == "" {
+		recent, err := core.LoadRecent()
+		if err != nil {
+			return err
+		}
+		if len(recent) > 0 && term.IsTerminal(int(os.Stdin.Fd())) {
+			target, err := pickRecent(os.Stdin, os.Stdout, recent)
+			if err != nil {
+				return err
+			}
+			*o.url = target.URL
+			if *o.launch == "" {
+				*o.launch = target.Launcher
+			}
+		}
+	}
+
+	check, err := core.ParseHostKeyCheck(*o.hostKeyCheck)
+	if err != nil {
+		return err
+	}
+
 	// Validate required flags
-	if *url == "" {
+	if *o.url == "" {
 		return fmt.Errorf("WebSocket URL is required. Set WSS_URL or use -url flag")
 	}
-	if *token == "" {
+	if *o.token == "" {
 		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN or use -token flag")
 	}
 
 	// Create and start client
-	c := core.NewClient(*url, *token)
-	return c.Connect()
+	c := core.NewClient(context.Background(), *o.url, *o.token)
+	c.SetLauncher(*o.launch)
+	c.SetCommand(*o.command)
+	c.SetLogin(*o.login)
+	c.SetDir(*o.dir)
+	c.SetShell(*o.shell)
+	if *o.dotfiles != "" {
+		var paths []string
+		for _, path := range strings.Split(*o.dotfiles, ",") {
+			path, err := expandHome(strings.TrimSpace(path))
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+		if err := c.SetDotfiles(paths); err != nil {
+			return err
+		}
+	}
+	c.SetSendEnv(core.ParseEnvPatterns(*o.sendEnv))
+	c.SetTerm(*o.termType)
+	c.SetReconnect(*o.reconnect)
+	c.SetResume(*o.resume)
+	c.SetObserve(*o.observe)
+	c.SetKeepalive(*o.keepalive)
+	c.SetControlPath(*o.controlPath)
+	c.SetForwardAgent(*o.forwardAgent)
+	c.SetForwardX11(*o.forwardX11)
+	c.SetNoPTY(*o.noPTY)
+	c.SetHostKeyCheck(check)
+	switch {
+	case *o.escapeChar == "none":
+		c.SetEscapeChar(0)
+	case len(*o.escapeChar) == 1:
+		c.SetEscapeChar((*o.escapeChar)[0])
+	default:
+		return fmt.Errorf("invalid escape character %q: want one character or none", *o.escapeChar)
+	}
+	c.SetRecording(*o.record)
+	c.SetTranscript(*o.logOutput)
+	err = c.Connect()
+	var exitErr *core.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return err
+	}
+
+	// Dev servers use random ports, so they aren't worth remembering
+	if !*o.dev {
+		if err := core.RecordRecent(*o.url, *o.launch); err != nil {
+			wsslog.Debug.Printf("Failed to record recent target: %v", err)
+		}
+	}
+	return err
 }
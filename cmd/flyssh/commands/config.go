@@ -0,0 +1,203 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"flyssh/core"
+	wsslog "flyssh/core/log"
+)
+
+// settingAliases maps ssh_config names to the flags they set
+var settingAliases = map[string]string{
+	"command":               "c",
+	"remotecommand":         "c",
+	"forwardagent":          "A",
+	"forwardx11":            "X",
+	"stricthostkeychecking": "host-key-check",
+	"user":                  "login",
+}
+
+// applySettings sets flags from a config file's settings, named as flags
+// are, in any case and with or without dashes. Flags given on the command
+// line or through their environment variable win. Settings the command
+// has no flag for are an error if strict, and otherwise left for other
+// commands.
+func applySettings(fs *flag.FlagSet, settings map[string]string, source string, strict bool) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := lookupSetting(fs, name)
+		if f == nil {
+			if strict {
+				return fmt.Errorf("%s: unknown setting %s", source, name)
+			}
+			wsslog.Debug.Printf("%s: %s setting doesn't apply to %s", source, name, fs.Name())
+			continue
+		}
+		if given[f.Name] || os.Getenv(flagEnv(f.Name)) != "" {
+			continue
+		}
+		value := settings[name]
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			value = settingBool(value)
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			return fmt.Errorf("%s: invalid %s: %v", source, name, err)
+		}
+	}
+	return nil
+}
+
+// flagGiven reports whether a flag was given on the command line
+func flagGiven(fs *flag.FlagSet, name string) bool {
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// expandHome expands a leading ~/ to the home directory
+func expandHome(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %v", err)
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// readToken gets the auth token from a file, or from what a command
+// prints, such as a password manager's CLI. It returns "" if neither is
+// given.
+func readToken(file, command string) (string, error) {
+	switch {
+	case file != "":
+		file, err := expandHome(file)
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	case command != "":
+		cmd := core.ShellCommand(command)
+		// It may need to ask for a password
+		cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run token command: %v", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", nil
+}
+
+// lookupSetting finds the flag a setting sets
+func lookupSetting(fs *flag.FlagSet, name string) *flag.Flag {
+	name = strings.ToLower(strings.ReplaceAll(name, "-", ""))
+	if alias, ok := settingAliases[name]; ok {
+		return fs.Lookup(alias)
+	}
+	var found *flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		if strings.ToLower(strings.ReplaceAll(f.Name, "-", "")) == name {
+			found = f
+		}
+	})
+	return found
+}
+
+// flagEnv returns the environment variable a flag can also be given by
+func flagEnv(name string) string {
+	if name == "token" {
+		return "WSS_AUTH_TOKEN"
+	}
+	return "WSS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// settingBool accepts ssh_config's yes and no for true and false
+func settingBool(value string) string {
+	switch strings.ToLower(value) {
+	case "yes":
+		return "true"
+	case "no":
+		return "false"
+	}
+	return value
+}
+
+// settingTrue reports whether a boolean setting is on; an empty one is off
+func settingTrue(name, value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(settingBool(value))
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: use yes or no", name, value)
+	}
+	return b, nil
+}
+
+// configHost returns the host a server's settings are found by: the host
+// in its URL, or the server itself if it's a name rather than a URL, in
+// which case alias is true
+func configHost(server string) (host string, alias bool) {
+	if !strings.Contains(server, "://") {
+		return server, server != ""
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", false
+	}
+	return u.Hostname(), false
+}
+
+// hostURL returns the URL of a server named by host: the one its settings
+// give, or wss://host, with IPv6 addresses bracketed
+func hostURL(host string, settings map[string]string) string {
+	if u := settings["url"]; u != "" {
+		return u
+	}
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		if _, err := netip.ParseAddr(host); err == nil {
+			host = "[" + host + "]"
+		}
+	}
+	return "wss://" + host
+}
+
+// setting returns the value of the setting for a flag, by its own name or
+// an alias
+func setting(settings map[string]string, flagName string) string {
+	if v, ok := settings[strings.ToLower(strings.ReplaceAll(flagName, "-", ""))]; ok {
+		return v
+	}
+	for alias, name := range settingAliases {
+		if v, ok := settings[alias]; ok && name == flagName {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"flyssh/core"
+
+	"golang.org/x/term"
+)
+
+// CpCommand copies files between this machine and a server, one side
+// given as host:path or :path
+func CpCommand(args []string) error {
+	fs := flag.NewFlagSet("cp", flag.ExitOnError)
+	serverURL := fs.String("url", os.Getenv("WSS_URL"), "WebSocket server URL (default wss://host)")
+	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token")
+	tokenFile := fs.String("token-file", os.Getenv("WSS_TOKEN_FILE"), "Read the auth token from this file")
+	tokenCommand := fs.String("token-command", os.Getenv("WSS_TOKEN_COMMAND"), "Run this command to get the auth token")
+	recursive := fs.Bool("r", false, "Copy directories and everything in them")
+	quiet := fs.Bool("q", false, "Don't show progress")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: flyssh cp [-r] [-q] [-url URL] [-token TOKEN] SOURCE DEST")
+		fmt.Fprintln(fs.Output(), "One of SOURCE and DEST is on the server, written host:path, or :path with -url")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src, dst := fs.Arg(0), fs.Arg(1)
+	srcHost, srcPath, srcRemote := splitRemote(src)
+	dstHost, dstPath, dstRemote := splitRemote(dst)
+	if srcRemote == dstRemote {
+		return fmt.Errorf("one of %s and %s must be on the server, as host:path", src, dst)
+	}
+	host := srcHost + dstHost
+
+	// The host may be a Host from the config file, whose settings apply
+	// where flags and environment variables don't
+	cfg, err := core.LoadClientConfig()
+	if err != nil {
+		return err
+	}
+	settingsHost := host
+	if settingsHost == "" {
+		settingsHost, _ = configHost(*serverURL)
+	}
+	settings := cfg.Settings(settingsHost)
+	if *serverURL == "" && host != "" {
+		*serverURL = hostURL(host, settings)
+	}
+	if err := applySettings(fs, settings, "config", false); err != nil {
+		return err
+	}
+	if *serverURL == "" {
+		return fmt.Errorf("WebSocket URL is required for :path. Set WSS_URL or use -url flag")
+	}
+	if *token == "" {
+		if *token, err = readToken(*tokenFile, *tokenCommand); err != nil {
+			return err
+		}
+	}
+	if *token == "" {
+		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN or use -token flag")
+	}
+
+	mux, err := core.DialMux(context.Background(), *serverURL, *token)
+	if err != nil {
+		return err
+	}
+	defer mux.Close()
+	t := core.NewTransfer(mux)
+	t.SetRecursive(*recursive)
+	if !*quiet && term.IsTerminal(int(os.Stderr.Fd())) {
+		t.SetProgress(os.Stderr)
+	}
+	if srcRemote {
+		return t.Download(srcPath, dst)
+	}
+	return t.Upload(src, dstPath)
+}
+
+// splitRemote splits a host:path argument, where an IPv6 host is
+// bracketed as in [fdaa::3]:path. Paths with a slash before the first
+// colon, and Windows drive letters, are local.
+func splitRemote(arg string) (host, path string, remote bool) {
+	if strings.HasPrefix(arg, "[") {
+		if end := strings.Index(arg, "]:"); end > 0 {
+			host, path = arg[1:end], arg[end+2:]
+			if path == "" {
+				path = "."
+			}
+			return host, path, true
+		}
+	}
+	host, path, ok := strings.Cut(arg, ":")
+	if !ok || strings.ContainsAny(host, `/\`) {
+		return "", arg, false
+	}
+	if runtime.GOOS == "windows" && len(host) == 1 {
+		return "", arg, false
+	}
+	if path == "" {
+		path = "."
+	}
+	return host, path, true
+}
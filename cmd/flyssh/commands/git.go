@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"flyssh/core"
+)
+
+// GitWrapperCommand runs git's ssh connections, set once as
+// GIT_SSH_COMMAND or core.sshCommand. Hosts with a Host entry in the
+// config file, which gives their URL and token, are reached through
+// flyssh ssh, and all others through ssh, so every repository works
+// without setup of its own.
+func GitWrapperCommand(args []string) error {
+	if a, err := parseSSHArgs(args); err == nil {
+		cfg, err := core.LoadClientConfig()
+		if err != nil {
+			return err
+		}
+		if cfg.HasHost(a.host) {
+			return SSHCommand(args)
+		}
+	}
+
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return fmt.Errorf("failed to find ssh for hosts not in the config file: %v", err)
+	}
+	cmd := exec.Command(ssh, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exitErr) {
+		return &core.ExitError{Code: exitErr.ExitCode()}
+	} else if err != nil {
+		return fmt.Errorf("failed to run ssh: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"flyssh/core"
+)
+
+// KeyscanCommand prints servers' keys in known hosts format, to check
+// and add to ~/.flyssh/known_hosts
+func KeyscanCommand(args []string) error {
+	fs := flag.NewFlagSet("keyscan", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: flyssh keyscan URL...")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, url := range fs.Args() {
+		line, err := core.ScanHostKey(url)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		fmt.Println(line)
+	}
+	if failed {
+		return fmt.Errorf("some servers could not be scanned")
+	}
+	return nil
+}
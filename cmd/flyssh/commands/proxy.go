@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"flyssh/core"
+	wsslog "flyssh/core/log"
+)
+
+// StdioProxyCommand relays stdin and stdout to the SSH server a flyssh
+// server proxies to, for use as ssh's ProxyCommand
+func StdioProxyCommand(args []string) error {
+	// Stdout carries the SSH connection
+	wsslog.Info.SetOutput(os.Stderr)
+
+	fs := flag.NewFlagSet("stdio-proxy", flag.ExitOnError)
+	serverURL := fs.String("s", os.Getenv("WSS_URL"), "Server URL, or a Host from the config file (a bare host is reached at wss://host)")
+	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token")
+	tokenFile := fs.String("token-file", os.Getenv("WSS_TOKEN_FILE"), "Read the auth token from this file")
+	tokenCommand := fs.String("token-command", os.Getenv("WSS_TOKEN_COMMAND"), "Run this command to get the auth token")
+	hostKeyCheck := fs.String("host-key-check", os.Getenv("WSS_HOST_KEY_CHECK"), "How to treat wss:// servers whose key isn't known: ask (trust only keys a certificate authority vouches for, since there's no one to ask), accept-new, yes (refuse) or no (don't check)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: flyssh stdio-proxy -s URL")
+		fmt.Fprintln(fs.Output(), "In ssh_config: ProxyCommand flyssh stdio-proxy -s wss://%h")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *serverURL == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// The server may be a Host from the config file, whose settings apply
+	// where flags and environment variables don't
+	cfg, err := core.LoadClientConfig()
+	if err != nil {
+		return err
+	}
+	host, alias := configHost(*serverURL)
+	settings := cfg.Settings(host)
+	if alias {
+		*serverURL = hostURL(host, settings)
+	}
+	if err := applySettings(fs, settings, "config", false); err != nil {
+		return err
+	}
+	if *token == "" {
+		if *token, err = readToken(*tokenFile, *tokenCommand); err != nil {
+			return err
+		}
+	}
+	if *token == "" {
+		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN or use -token flag")
+	}
+	check, err := core.ParseHostKeyCheck(*hostKeyCheck)
+	if err != nil {
+		return err
+	}
+	return core.ProxyStdio(context.Background(), *serverURL, *token, check, os.Stdin, os.Stdout)
+}
@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"flyssh/core"
+)
+
+// RecentCommand lists recently used servers
+func RecentCommand(args []string) error {
+	fs := flag.NewFlagSet("recent", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	recent, err := core.LoadRecent()
+	if err != nil {
+		return err
+	}
+	if len(recent) == 0 {
+		fmt.Println("No recent connections")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tTARGET\tLAST USED\tCOUNT")
+	for i, t := range recent {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\n", i+1, t.Label(), t.LastUsed.Format(time.RFC3339), t.Count)
+	}
+	return tw.Flush()
+}
+
+// pickRecent shows recent targets and lets the user pick one by number, or
+// type part of a name to narrow the list down
+func pickRecent(in io.Reader, out io.Writer, recent []core.RecentTarget) (core.RecentTarget, error) {
+	reader := bufio.NewReader(in)
+	matches := recent
+	for {
+		for i, t := range matches {
+			fmt.Fprintf(out, "  %2d) %s\n", i+1, t.Label())
+		}
+		fmt.Fprintf(out, "Select a server [1-%d] or type to filter: ", len(matches))
+
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return core.RecentTarget{}, fmt.Errorf("no server selected")
+		}
+		line = strings.TrimSpace(line)
+
+		if n, err := strconv.Atoi(line); err == nil && n >= 1 && n <= len(matches) {
+			return matches[n-1], nil
+		}
+
+		var filtered []core.RecentTarget
+		for _, t := range recent {
+			if core.FuzzyMatch(line, t.Label()) {
+				filtered = append(filtered, t)
+			}
+		}
+		switch len(filtered) {
+		case 0:
+			fmt.Fprintf(out, "No servers match %q\n", line)
+		case 1:
+			return filtered[0], nil
+		default:
+			matches = filtered
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"flyssh/core"
+)
+
+// RecordingCommand works with recorded sessions
+func RecordingCommand(args []string) error {
+	if len(args) == 2 && args[0] == "bookmarks" {
+		return listBookmarks(args[1])
+	}
+	fmt.Fprintln(os.Stderr, "Usage: flyssh recording bookmarks FILE")
+	fmt.Fprintln(os.Stderr, "Play from a bookmark with flyssh replay -from BOOKMARK FILE")
+	os.Exit(2)
+	return nil
+}
+
+// listBookmarks prints a recording's bookmarks, with how far into it each is
+func listBookmarks(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+
+	bookmarks, err := core.Bookmarks(f)
+	if err != nil {
+		return err
+	}
+	if len(bookmarks) == 0 {
+		fmt.Println("No bookmarks")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tAT\tLABEL")
+	for _, b := range bookmarks {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", b.Number, b.At.Round(time.Second), b.Label)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"flyssh/core"
+)
+
+// RendezvousCommand runs a public relay that servers behind NAT register
+// with, so clients can reach them by name
+func RendezvousCommand(args []string) error {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	port := fs.Int("port", 8083, "Relay port")
+	token := fs.String("token", os.Getenv("WSS_RENDEZVOUS_TOKEN"), "Token servers register with, unless the targets file gives them their own")
+	targets := fs.String("targets", os.Getenv("WSS_RELAY_TARGETS"), "Path to a targets file (JSON) naming the servers that may register and the clients that may reach each")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *token == "" && *targets == "" {
+		return fmt.Errorf("Agent token is required. Set WSS_RENDEZVOUS_TOKEN or use -token or -targets flag")
+	}
+	rv := core.NewRendezvous(*port, *token)
+	if *targets != "" {
+		cfg, err := core.LoadRendezvousConfig(*targets)
+		if err != nil {
+			return err
+		}
+		// A target without a token of its own could never register
+		if *token == "" {
+			for name, target := range cfg.Targets {
+				if target.AgentToken == "" {
+					return fmt.Errorf("target %q has no agent_token. Give it one, or set WSS_RENDEZVOUS_TOKEN or use -token flag", name)
+				}
+			}
+		}
+		rv.SetTargets(cfg)
+	}
+	return rv.Start()
+}
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"flyssh/core"
+)
+
+// ReplayCommand plays back a recorded session in the local terminal
+func ReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("x", 1, "Playback speed multiplier")
+	idleLimit := fs.Duration("idle-limit", 0, "Cap pauses between output at this duration (0 disables)")
+	from := fs.String("from", "", "Start at this bookmark, by number or label (see flyssh recording bookmarks)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: flyssh replay [-x SPEED] [-idle-limit DURATION] [-from BOOKMARK] FILE")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+
+	// Raw mode keeps keystrokes from echoing over the playback and lets
+	// q or Ctrl+C stop it
+	restore, err := core.MakeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	stop := make(chan struct{})
+	go func(stop chan struct{}) {
+		defer core.RecoverTerminal()
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				return
+			}
+			if buf[0] == 'q' || buf[0] == 3 {
+				close(stop)
+				return
+			}
+		}
+	}(stop)
+
+	return core.Replay(f, os.Stdout, core.ReplayOptions{
+		Speed:     *speed,
+		IdleLimit: *idleLimit,
+		From:      *from,
+	}, stop)
+}
@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"flyssh/core"
+)
+
+// ReplicaCommand serves a read-only copy of a server's sessions and
+// metrics API, fed by the server's event stream
+func ReplicaCommand(args []string) error {
+	fs := flag.NewFlagSet("replica", flag.ExitOnError)
+	port := fs.Int("port", 8082, "Replica port")
+	upstream := fs.String("upstream", "http://localhost:8081", "Server admin URL to replicate")
+	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token, for the server and replica clients")
+	idle := fs.Duration("idle-timeout", core.DefaultReplicaIdleTimeout, "Reconnect when the server sends nothing, not even a heartbeat, for this long (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *token == "" {
+		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN or use -token flag")
+	}
+
+	// Accept ws:// and wss:// URLs as well since that's what clients use
+	base := strings.Replace(*upstream, "ws://", "http://", 1)
+	base = strings.Replace(base, "wss://", "https://", 1)
+
+	rp := core.NewReplica(context.Background(), *port, base, *token)
+	rp.SetIdleTimeout(*idle)
+	return rp.Start()
+}
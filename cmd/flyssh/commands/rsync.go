@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"flyssh/core"
+)
+
+// RsyncCommand runs rsync with flyssh ssh as its remote shell. Hosts are
+// found as flyssh ssh finds them, from the config file, unless -url names
+// the server.
+func RsyncCommand(args []string) error {
+	fs := flag.NewFlagSet("rsync", flag.ExitOnError)
+	serverURL := fs.String("url", os.Getenv("WSS_URL"), "WebSocket server URL, for every host (default wss://host, or the host's URL in the config file)")
+	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token (default the host's token in the config file)")
+	tokenFile := fs.String("token-file", os.Getenv("WSS_TOKEN_FILE"), "Read the auth token from this file")
+	tokenCommand := fs.String("token-command", os.Getenv("WSS_TOKEN_COMMAND"), "Run this command to get the auth token")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: flyssh rsync [-url URL] [-token TOKEN] -- RSYNC ARGS...")
+		fmt.Fprintln(fs.Output(), "Remote paths are host:path, or host::module for an rsync daemon")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if *token == "" {
+		if *token, err = readToken(*tokenFile, *tokenCommand); err != nil {
+			return err
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find flyssh: %v", err)
+	}
+	// rsync splits the remote shell's command on spaces, unless quoted
+	if strings.Contains(exe, " ") {
+		exe = `"` + exe + `"`
+	}
+	rsync, err := exec.LookPath("rsync")
+	if err != nil {
+		return fmt.Errorf("failed to find rsync: %v", err)
+	}
+
+	cmd := exec.Command(rsync, append([]string{"-e", exe + " ssh"}, fs.Args()...)...)
+	cmd.Env = os.Environ()
+	if *serverURL != "" {
+		cmd.Env = append(cmd.Env, "WSS_URL="+*serverURL)
+	}
+	if *token != "" {
+		cmd.Env = append(cmd.Env, "WSS_AUTH_TOKEN="+*token)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exitErr) {
+		return &core.ExitError{Code: exitErr.ExitCode()}
+	} else if err != nil {
+		return fmt.Errorf("failed to run rsync: %v", err)
+	}
+	return nil
+}
@@ -1,38 +1,347 @@
 package commands
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"flyssh/core"
 )
 
-func ServerCommand(args []string) error {
+// serverFlags holds the server's options, which the config file can set too
+type serverFlags struct {
+	port            *int
+	wsAddr          *string
+	devMode         *bool
+	debug           *bool
+	idleTimeout     *time.Duration
+	maxSession      *time.Duration
+	resumeTimeout   *time.Duration
+	keepalive       *time.Duration
+	writeTimeout    *time.Duration
+	scrollback      *int
+	maxSessions     *int
+	memoryLimit     *int
+	rateLimit       *float64
+	rateBurst       *int
+	tmpDir          *string
+	tmpRetention    *time.Duration
+	recordDir       *string
+	recordName      *string
+	recordInput     *bool
+	auditLog        *string
+	traceLog        *string
+	onStart         *string
+	onEnd           *string
+	quotaSessions   *int
+	quotaMinutes    *int
+	quotaFile       *string
+	acceptEnv       *string
+	agentForwarding *bool
+	x11Forwarding   *bool
+	sshTarget       *string
+	shell           *string
+	pasteGuard      *int
+	sandboxDir      *string
+	sandboxCPUs     *float64
+	sandboxMemory   *int
+	chroot          *string
+	policy          *string
+	policyPreview   *string
+	clusterDir      *string
+	instance        *string
+	clusterAddr     *string
+	launchers       *string
+	activateAddr    *string
+	activateKey     *string
+	activateIdle    *time.Duration
+	accessRequests  *bool
+	accessMax       *time.Duration
+	accessWebhook   *string
+	manage          *bool
+	notify          *string
+	manageFile      *string
+	rendezvous      *string
+	rendezvousName  *string
+	rendezvousToken *string
+	config          *string
+}
+
+// newServerFlags defines the server's flags
+func newServerFlags() (*flag.FlagSet, *serverFlags) {
 	fs := flag.NewFlagSet("server", flag.ExitOnError)
-	port := fs.Int("port", 8081, "Server port")
-	devMode := fs.Bool("dev", false, "Run in development mode with auto-generated token")
-	debug := fs.Bool("debug", false, "Enable debug logging")
+	return fs, &serverFlags{
+		port:            fs.Int("port", 8081, "Server port"),
+		wsAddr:          fs.String("ws-addr", os.Getenv("WSS_WS_ADDR"), "Listen on this host:port, or Unix socket path (unix:/path), instead of -port on every interface"),
+		devMode:         fs.Bool("dev", false, "Run in development mode with auto-generated token"),
+		debug:           fs.Bool("debug", false, "Enable debug logging"),
+		idleTimeout:     fs.Duration("idle-timeout", 0, "Close sessions idle for this long (0 disables)"),
+		maxSession:      fs.Duration("max-session", 0, "Maximum session duration (0 disables)"),
+		resumeTimeout:   fs.Duration("resume-timeout", time.Minute, "Keep sessions running this long after a dropped connection so clients can resume (0 disables)"),
+		keepalive:       fs.Duration("keepalive", core.DefaultKeepalive, "Ping clients this often and drop connections that stop answering (0 disables)"),
+		writeTimeout:    fs.Duration("write-timeout", core.DefaultWriteTimeout, "Disconnect clients that take longer than this to accept output, leaving their sessions to be resumed (0 disables)"),
+		scrollback:      fs.Int("scrollback", core.DefaultScrollback, "Bytes of recent output kept per session for resuming clients and -tail"),
+		maxSessions:     fs.Int("max-sessions", 0, "Maximum concurrent sessions (0 disables)"),
+		memoryLimit:     fs.Int("memory-limit", 0, "Refuse new sessions while the server's cgroup (or the server, outside one) uses more than this many MiB (0 disables)"),
+		rateLimit:       fs.Float64("rate-limit", 0, "New connections per second allowed per source IP (0 disables)"),
+		rateBurst:       fs.Int("rate-burst", 10, "Connection burst allowed per source IP"),
+		tmpDir:          fs.String("tmp-dir", os.Getenv("WSS_TMP_DIR"), "Make each session's own temporary directory (its TMPDIR) in this directory, instead of the system's"),
+		tmpRetention:    fs.Duration("tmp-retention", 0, "Keep sessions' temporary directories this long after they end (0 removes them at once)"),
+		recordDir:       fs.String("record-dir", os.Getenv("WSS_RECORD_DIR"), "Record sessions as asciicast files in this directory"),
+		recordName:      fs.String("record-name", core.DefaultRecordingName, "Recording filename template ({id}, {user}, {launcher}, {time})"),
+		recordInput:     fs.Bool("record-input", false, "Include client input in recordings"),
+		auditLog:        fs.String("audit-log", os.Getenv("WSS_AUDIT_LOG"), "Write JSON audit events to this file, or \"syslog\""),
+		traceLog:        fs.String("trace-log", os.Getenv("WSS_TRACE_LOG"), "Write connection lifecycle spans as JSON lines to this file"),
+		onStart:         fs.String("on-session-start", os.Getenv("WSS_ON_SESSION_START"), "Script run before each session starts; failing refuses the session"),
+		onEnd:           fs.String("on-session-end", os.Getenv("WSS_ON_SESSION_END"), "Script run after each session ends"),
+		quotaSessions:   fs.Int("quota-sessions", 0, "Sessions each scoped token may start per day (0 disables)"),
+		quotaMinutes:    fs.Int("quota-minutes", 0, "Session minutes each scoped token may use per day (0 disables)"),
+		quotaFile:       fs.String("quota-file", os.Getenv("WSS_QUOTA_FILE"), "Persist quota usage in this file"),
+		acceptEnv:       fs.String("accept-env", strings.Join(core.DefaultAcceptEnv, ","), "Comma separated environment variables clients may pass to sessions (wildcards allowed)"),
+		agentForwarding: fs.Bool("agent-forwarding", true, "Let clients forward their SSH agent to sessions"),
+		x11Forwarding:   fs.Bool("x11-forwarding", false, "Let clients forward their X display to sessions"),
+		shell:           fs.String("shell", os.Getenv("WSS_SHELL"), "Shell sessions run in unless they ask for another: sh (default) or pwsh on Unix, cmd (default), powershell or pwsh on Windows"),
+		sshTarget:       fs.String("ssh-target", os.Getenv("WSS_SSH_TARGET"), "Relay flyssh stdio-proxy connections to the SSH server at this address, e.g. localhost:22"),
+		pasteGuard:      fs.Int("paste-guard", 0, "Hold pastes of this many bytes or more into shells until confirmed, or bracket them if the shell supports it (0 disables)"),
+		sandboxDir:      fs.String("sandbox-dir", os.Getenv("WSS_SANDBOX_DIR"), "Run sessions in a Linux sandbox, with scratch directories under this directory"),
+		sandboxCPUs:     fs.Float64("sandbox-cpus", 0, "CPU cores each sandboxed session may use (0 disables)"),
+		sandboxMemory:   fs.Int("sandbox-memory", 0, "Memory each sandboxed session may use, in MiB (0 disables)"),
+		chroot:          fs.String("chroot", os.Getenv("WSS_CHROOT"), "Confine sessions to this directory, which must hold their shell (Linux only)"),
+		policy:          fs.String("policy", os.Getenv("WSS_POLICY"), "Path to a policy restricting shells and commands (JSON)"),
+		policyPreview:   fs.String("policy-preview", os.Getenv("WSS_POLICY_PREVIEW"), "Path to a policy to try out: what it would refuse is logged and audited, not refused"),
+		clusterDir:      fs.String("cluster-dir", os.Getenv("WSS_CLUSTER_DIR"), "Directory shared by all instances of a cluster, to route resumed sessions"),
+		instance:        fs.String("instance", defaultInstance(), "Name of this instance in the cluster"),
+		clusterAddr:     fs.String("cluster-addr", os.Getenv("WSS_CLUSTER_ADDR"), "WebSocket URL other instances use to proxy clients to this one"),
+		launchers:       fs.String("launchers", os.Getenv("WSS_LAUNCHERS"), "Path to launcher config (JSON)"),
+		activateAddr:    fs.String("activate-addr", os.Getenv("WSS_ACTIVATE_ADDR"), "Keep the port closed until a signed request to this private address, from a hub or flyssh server activate, opens it"),
+		activateKey:     fs.String("activate-key-file", os.Getenv("WSS_ACTIVATE_KEY_FILE"), "File holding the key activation requests are signed with"),
+		activateIdle:    fs.Duration("activate-idle", core.DefaultActivationIdle, "Close an activated port after this long without new connections"),
+		accessRequests:  fs.Bool("access-requests", false, "Let users request temporary access to launchers, which an admin approves"),
+		accessMax:       fs.Duration("access-max", core.DefaultAccessMax, "Longest access a request may ask for"),
+		accessWebhook:   fs.String("access-webhook", os.Getenv("WSS_ACCESS_WEBHOOK"), "Post access requests and decisions to this URL, to tell approvers"),
+		notify:          fs.String("notify", os.Getenv("WSS_NOTIFY"), "Path to notifier config (JSON), to send events to Slack, PagerDuty, email or webhooks"),
+		manage:          fs.Bool("manage", false, "Serve the management API, which sets scoped tokens and the command policy, for infrastructure-as-code tools"),
+		manageFile:      fs.String("manage-file", os.Getenv("WSS_MANAGE_FILE"), "Persist what the management API sets in this file"),
+		rendezvous:      fs.String("rendezvous", os.Getenv("WSS_RENDEZVOUS"), "Listen through the rendezvous at this URL instead of a port, dialing out from behind NAT; clients connect to URL/to/NAME"),
+		rendezvousName:  fs.String("rendezvous-name", defaultInstance(), "Name to register with the rendezvous"),
+		rendezvousToken: fs.String("rendezvous-token", os.Getenv("WSS_RENDEZVOUS_TOKEN"), "Token the rendezvous admits agents with"),
+		config:          fs.String("config", os.Getenv("WSS_CONFIG"), "Path to a config file setting these flags (default "+core.DefaultServerConfig+")"),
+	}
+}
+
+func ServerCommand(args []string) error {
+	if len(args) > 0 && args[0] == "sessions" {
+		return SessionsCommand(args[1:])
+	}
+	if len(args) > 0 && args[0] == "replica" {
+		return ReplicaCommand(args[1:])
+	}
+	if len(args) > 0 && args[0] == "rendezvous" {
+		return RendezvousCommand(args[1:])
+	}
+	if len(args) > 0 && args[0] == "access" {
+		return ServerAccessCommand(args[1:])
+	}
+	if len(args) > 0 && args[0] == "activate" {
+		return ActivateCommand(args[1:])
+	}
+	return runServer(context.Background(), args)
+}
+
+// runServer runs the server with the given flags until ctx is done
+func runServer(ctx context.Context, args []string) error {
+	fs, o := newServerFlags()
 	fs.Parse(args)
 
+	// Settings from the config file apply where flags and environment
+	// variables don't
+	configFile := *o.config
+	if configFile == "" {
+		configFile = core.DefaultServerConfig
+	} else if _, err := os.Stat(configFile); err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+	settings, err := core.LoadServerConfig(configFile)
+	if err != nil {
+		return err
+	}
+	authToken := os.Getenv("WSS_AUTH_TOKEN")
+	if token, ok := settings["token"]; ok {
+		if authToken == "" {
+			authToken = token
+		}
+		delete(settings, "token")
+	}
+	if err := applySettings(fs, settings, configFile, true); err != nil {
+		return err
+	}
+
 	// Enable debug logging if flag is set
-	if *debug {
+	if *o.debug {
 		os.Setenv("WSS_DEBUG", "1")
 	}
 
-	// In dev mode, generate a token and set it in the environment
-	if *devMode {
-		token := core.GenerateDevToken()
-		os.Setenv("WSS_AUTH_TOKEN", token)
+	// In dev mode, generate a token
+	if *o.devMode {
+		authToken = core.GenerateDevToken()
 		fmt.Printf("\n=== Development Mode ===\n")
-		fmt.Printf("WebSocket URL: ws://localhost:%d\n", *port)
-		fmt.Printf("Auth Token: %s\n", token)
+		fmt.Printf("WebSocket URL: ws://localhost:%d\n", *o.port)
+		fmt.Printf("Auth Token: %s\n", authToken)
 		fmt.Printf("====================\n\n")
 	}
 
 	// Create and start server
-	s := core.NewServer(*port)
-	return s.Start()
+	s := core.NewServer(*o.port)
+	s.SetAuthToken(authToken)
+	s.SetListenAddr(*o.wsAddr)
+	s.SetSessionTimeouts(*o.idleTimeout, *o.maxSession)
+	s.SetResumeTimeout(*o.resumeTimeout)
+	s.SetKeepalive(*o.keepalive)
+	s.SetWriteTimeout(*o.writeTimeout)
+	s.SetScrollback(*o.scrollback)
+	s.SetAcceptEnv(core.ParseEnvPatterns(*o.acceptEnv))
+	s.SetAgentForwarding(*o.agentForwarding)
+	s.SetX11Forwarding(*o.x11Forwarding)
+	s.SetPasteGuard(*o.pasteGuard)
+	s.SetSSHTarget(*o.sshTarget)
+	if *o.shell != "" {
+		if err := s.SetShell(*o.shell); err != nil {
+			return err
+		}
+	}
+	s.SetConnectionLimits(*o.maxSessions, *o.rateLimit, *o.rateBurst)
+	s.SetMemoryLimit(uint64(*o.memoryLimit) << 20)
+	s.SetSessionTmp(*o.tmpDir, *o.tmpRetention)
+	s.SetRecording(*o.recordDir, *o.recordName, *o.recordInput)
+	s.SetSessionHooks(*o.onStart, *o.onEnd)
+	q, err := core.OpenQuotas(*o.quotaFile, core.Quota{SessionsPerDay: *o.quotaSessions, MinutesPerDay: *o.quotaMinutes})
+	if err != nil {
+		return err
+	}
+	s.SetQuotas(q)
+	if *o.sandboxDir != "" {
+		sb, err := core.NewSandbox(*o.sandboxDir, *o.sandboxCPUs, *o.sandboxMemory)
+		if err != nil {
+			return err
+		}
+		s.SetSandbox(sb)
+	}
+	if *o.chroot != "" {
+		j, err := core.NewJail(*o.chroot)
+		if err != nil {
+			return err
+		}
+		s.SetJail(j)
+	}
+	if *o.policy != "" {
+		p, err := core.LoadPolicy(*o.policy)
+		if err != nil {
+			return err
+		}
+		s.SetPolicy(p)
+	}
+	if *o.policyPreview != "" {
+		p, err := core.LoadPolicy(*o.policyPreview)
+		if err != nil {
+			return err
+		}
+		s.SetPolicyPreview(p)
+	}
+	if *o.clusterDir != "" {
+		c, err := core.OpenCluster(*o.clusterDir, *o.instance, *o.clusterAddr)
+		if err != nil {
+			return err
+		}
+		s.SetCluster(c)
+	}
+	if *o.auditLog != "" {
+		a, err := core.OpenAuditLog(*o.auditLog)
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+		s.SetAuditLog(a)
+	}
+	if *o.traceLog != "" {
+		t, err := core.OpenTracer(*o.traceLog)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		s.SetTracer(t)
+	}
+	if *o.launchers != "" {
+		cfg, err := core.LoadLauncherConfig(*o.launchers)
+		if err != nil {
+			return err
+		}
+		s.SetLaunchers(cfg)
+	}
+	if *o.accessRequests {
+		if *o.launchers == "" {
+			return fmt.Errorf("-access-requests needs -launchers")
+		}
+		s.SetAccessRequests(core.NewAccessRequests(*o.accessMax, *o.accessWebhook))
+	}
+	if *o.notify != "" {
+		n, err := core.LoadNotifiers(*o.notify)
+		if err != nil {
+			return err
+		}
+		s.SetNotifiers(n)
+	}
+	if *o.manage {
+		m, err := core.OpenManaged(*o.manageFile)
+		if err != nil {
+			return err
+		}
+		s.SetManaged(m)
+	}
+	if *o.activateAddr != "" {
+		if *o.activateKey == "" {
+			return fmt.Errorf("-activate-addr needs -activate-key-file")
+		}
+		key, err := core.LoadActivationKey(*o.activateKey)
+		if err != nil {
+			return err
+		}
+		a, err := core.NewActivation(*o.activateAddr, key, *o.activateIdle)
+		if err != nil {
+			return err
+		}
+		s.SetActivation(a)
+	}
+	if err := core.PreflightReport(os.Stderr, s.Preflight()); err != nil {
+		return err
+	}
+	if *o.rendezvous != "" {
+		// A rendezvous listener can't be handed to a new binary
+		ln, err := core.ListenRendezvous(ctx, *o.rendezvous, *o.rendezvousName, *o.rendezvousToken, core.HostKeyAcceptNew)
+		if err != nil {
+			return err
+		}
+		return s.Serve(ctx, ln)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	// SIGUSR2 upgrades to a new binary without dropping sessions
+	s.UpgradeOnSignal(ctx, ln)
+	return s.Serve(ctx, ln)
+}
+
+// defaultInstance names this instance after its Fly machine, so requests
+// can be replayed to it, or else its hostname
+func defaultInstance() string {
+	if id := os.Getenv("FLY_MACHINE_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return host
 }
 
 // generateToken creates a random token for development mode
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package commands
+
+import "fmt"
+
+// ServiceCommand installs the server as a Windows service, so elsewhere
+// there's nothing to do
+func ServiceCommand(args []string) error {
+	return fmt.Errorf("flyssh service is only available on Windows; run flyssh server under systemd or another service manager")
+}
@@ -0,0 +1,206 @@
+//go:build windows
+// +build windows
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	wsslog "flyssh/core/log"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name the server is installed as, and logs to the
+// event log under
+const serviceName = "flyssh"
+
+// ServiceCommand installs the server as a Windows service and manages it
+func ServiceCommand(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "install":
+			return installService(args[1:])
+		case "uninstall":
+			return uninstallService()
+		case "start":
+			return withService(func(s *mgr.Service) error { return s.Start() })
+		case "stop":
+			return withService(stopService)
+		case "run":
+			// How the service control manager starts the server
+			return runService(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: flyssh service install [server options]")
+	fmt.Fprintln(os.Stderr, "       flyssh service start|stop|uninstall")
+	os.Exit(2)
+	return nil
+}
+
+// installService installs the server as a service started at boot with
+// the given server options, and restarted if it fails
+func installService(args []string) error {
+	// Options are checked now rather than when the service starts
+	fs, _ := newServerFlags()
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find flyssh: %v", err)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "flyssh server",
+		Description: "Terminal sessions over WebSocket",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to install service: %v", err)
+	}
+	defer s.Close()
+
+	// Restart after crashes and after the server exits with an error,
+	// backing off, and forget failures after a day
+	restarts := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 2 * time.Minute},
+	}
+	if err := s.SetRecoveryActions(restarts, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("failed to set service restarts: %v", err)
+	}
+	if err := s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		return fmt.Errorf("failed to set service restarts: %v", err)
+	}
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil && !strings.Contains(err.Error(), "exists") {
+		return fmt.Errorf("failed to set up event log: %v", err)
+	}
+	fmt.Printf("Installed the %s service; start it with flyssh service start\n", serviceName)
+	return nil
+}
+
+// uninstallService stops and removes the service
+func uninstallService() error {
+	err := withService(func(s *mgr.Service) error {
+		if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+			if err := stopService(s); err != nil {
+				return err
+			}
+		}
+		return s.Delete()
+	})
+	if err != nil {
+		return err
+	}
+	eventlog.Remove(serviceName)
+	fmt.Printf("Removed the %s service\n", serviceName)
+	return nil
+}
+
+// withService runs f on the installed service
+func withService(f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("the %s service is not installed: %v", serviceName, err)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// stopService stops the service, waiting for it to finish
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("failed to stop service: %v", err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service didn't stop within 30s")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("failed to query service: %v", err)
+		}
+	}
+	return nil
+}
+
+// runService runs the server under the service control manager, logging
+// to the event log
+func runService(args []string) error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+	wsslog.Info.SetOutput(eventLogWriter{elog})
+	wsslog.Info.SetFlags(0)
+	return svc.Run(serviceName, &serverService{args: args, elog: elog})
+}
+
+// serverService runs the server as a service
+type serverService struct {
+	args []string
+	elog *eventlog.Log
+}
+
+func (s *serverService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, s.args) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			// Failing is a non-zero exit, which the service manager
+			// restarts the server after
+			if err != nil {
+				s.elog.Error(1, fmt.Sprintf("Server failed: %v", err))
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				stop()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogWriter writes log lines to the event log as information events
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.elog.Info(1, strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
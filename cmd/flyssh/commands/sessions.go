@@ -0,0 +1,145 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"flyssh/core"
+)
+
+// SessionsCommand lists, inspects or kills sessions on a running server via
+// its admin API
+func SessionsCommand(args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	serverURL := fs.String("url", "http://localhost:8081", "Server admin URL")
+	token := fs.String("token", os.Getenv("WSS_AUTH_TOKEN"), "Auth token")
+	kill := fs.String("kill", "", "Session ID to terminate")
+	tail := fs.String("tail", "", "Session ID to show recent output of")
+	drain := fs.String("drain", "", "Stop the server taking sessions, sending clients to this replacement URL (\"-\" for none)")
+	undrain := fs.Bool("undrain", false, "Let a draining server take sessions again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *token == "" {
+		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN or use -token flag")
+	}
+
+	// Accept ws:// and wss:// URLs as well since that's what clients use
+	base := strings.TrimSuffix(*serverURL, "/")
+	base = strings.Replace(base, "ws://", "http://", 1)
+	base = strings.Replace(base, "wss://", "https://", 1)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if *kill != "" {
+		endpoint := fmt.Sprintf("%s/api/v1/sessions/%s?token=%s", base, url.PathEscape(*kill), url.QueryEscape(*token))
+		req, err := http.NewRequest(http.MethodDelete, endpoint, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to kill session: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("failed to kill session %s: %s", *kill, resp.Status)
+		}
+		fmt.Printf("Killed session %s\n", *kill)
+		return nil
+	}
+
+	if *drain != "" || *undrain {
+		return setDraining(client, base, *token, *drain, *undrain)
+	}
+
+	if *tail != "" {
+		endpoint := fmt.Sprintf("%s/api/v1/sessions/%s/output?token=%s", base, url.PathEscape(*tail), url.QueryEscape(*token))
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to get session output: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to get output of session %s: %s", *tail, resp.Status)
+		}
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			return fmt.Errorf("failed to read session output: %v", err)
+		}
+		return nil
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s/api/v1/sessions?token=%s", base, url.QueryEscape(*token)))
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list sessions: %s", resp.Status)
+	}
+
+	var sessions []core.Session
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		return fmt.Errorf("failed to decode sessions: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tREMOTE\tSTARTED\tCOMMAND\tSIZE")
+	for _, sess := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%dx%d\n",
+			sess.ID, sess.User, sess.RemoteAddr,
+			sess.StartTime.Format(time.RFC3339), sess.Command,
+			sess.Cols, sess.Rows)
+	}
+	return tw.Flush()
+}
+
+// setDraining starts or stops draining a server and reports its status
+func setDraining(client *http.Client, base, token, replacement string, undrain bool) error {
+	endpoint := fmt.Sprintf("%s/api/v1/drain?token=%s", base, url.QueryEscape(token))
+	method, body := http.MethodPost, ""
+	if undrain {
+		method = http.MethodDelete
+	} else if replacement != "-" {
+		data, err := json.Marshal(core.DrainStatus{Replacement: replacement})
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+		body = string(data)
+	}
+	req, err := http.NewRequest(method, endpoint, strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to set draining: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to set draining: %s", resp.Status)
+	}
+
+	var status core.DrainStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("failed to decode drain status: %v", err)
+	}
+	switch {
+	case !status.Draining:
+		fmt.Printf("Taking new sessions, %d active\n", status.SessionsActive)
+	case status.Replacement != "":
+		fmt.Printf("Draining to %s, %d sessions active\n", status.Replacement, status.SessionsActive)
+	default:
+		fmt.Printf("Draining, %d sessions active\n", status.SessionsActive)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"flyssh/core"
+	wsslog "flyssh/core/log"
+)
+
+// sshArgOptions are the ssh options that take an argument
+const sshArgOptions = "bceilmopBDEFIJLOQRSwW"
+
+// sshArgs are the ssh arguments flyssh acts on. Forwarding is "yes" or
+// "no" when given, so the config file can decide otherwise.
+type sshArgs struct {
+	host, command                         string
+	login, port, hostKeyCheck, agent, x11 string
+	subsystem, noPTY                      bool
+}
+
+// parseSSHArgs parses ssh's arguments, ignoring options that don't apply
+func parseSSHArgs(args []string) (*sshArgs, error) {
+	a := &sshArgs{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		// Options can be combined, as in -xT, and take their argument
+		// attached or as the next word
+		for i := 1; i < len(arg); i++ {
+			opt := arg[i]
+			if !strings.ContainsRune(sshArgOptions, rune(opt)) {
+				switch opt {
+				case 's':
+					a.subsystem = true
+				case 'A':
+					a.agent = "yes"
+				case 'a':
+					a.agent = "no"
+				case 'X', 'Y':
+					a.x11 = "yes"
+				case 'x':
+					a.x11 = "no"
+				case 'T':
+					a.noPTY = true
+				}
+				continue
+			}
+			value := arg[i+1:]
+			if value == "" {
+				if len(args) == 0 {
+					return nil, fmt.Errorf("option -%c needs an argument", opt)
+				}
+				value, args = args[0], args[1:]
+			}
+			switch opt {
+			case 'l':
+				a.login = value
+			case 'p':
+				a.port = value
+			case 'o':
+				key, v, ok := strings.Cut(value, "=")
+				if !ok {
+					key, v, _ = strings.Cut(value, " ")
+				}
+				// Ansible quotes values, as in User="deploy"
+				v = strings.Trim(strings.TrimSpace(v), `"`)
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "user":
+					a.login = v
+				case "port":
+					a.port = v
+				case "stricthostkeychecking":
+					a.hostKeyCheck = strings.ToLower(v)
+				case "requesttty":
+					a.noPTY = strings.EqualFold(v, "no")
+				}
+			}
+			break
+		}
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("usage: flyssh ssh [options] host [command...]")
+	}
+	a.host, a.command = args[0], strings.Join(args[1:], " ")
+	if user, h, ok := strings.Cut(a.host, "@"); ok {
+		a.login, a.host = user, h
+	}
+	return a, nil
+}
+
+// SSHCommand runs a command the way ssh would, so programs that drive ssh,
+// such as scp and rsync, can use flyssh instead. It accepts ssh's options,
+// ignoring those that don't apply. The host names the server, reached at
+// wss://host unless WSS_URL is set.
+func SSHCommand(args []string) error {
+	// Stdout carries the command's output, which may be a protocol
+	wsslog.Info.SetOutput(os.Stderr)
+
+	a, err := parseSSHArgs(args)
+	if err != nil {
+		return err
+	}
+	host, command, login, port := a.host, a.command, a.login, a.port
+	hostKeyCheck, agent, x11 := a.hostKeyCheck, a.agent, a.x11
+	if a.subsystem {
+		return fmt.Errorf("subsystems such as %s aren't supported; use scp -O for the original scp protocol", command)
+	}
+
+	// The host may be a Host from the config file, whose settings apply
+	// where options and environment variables don't
+	cfg, err := core.LoadClientConfig()
+	if err != nil {
+		return err
+	}
+	settings := cfg.Settings(host)
+	url := os.Getenv("WSS_URL")
+	if url == "" {
+		if port != "" && settings["url"] == "" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		url = hostURL(host, settings)
+	}
+	token := os.Getenv("WSS_AUTH_TOKEN")
+	if token == "" {
+		token = setting(settings, "token")
+	}
+	if token == "" {
+		if token, err = readToken(setting(settings, "token-file"), setting(settings, "token-command")); err != nil {
+			return err
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("Auth token is required. Set WSS_AUTH_TOKEN")
+	}
+	if login == "" {
+		login = setting(settings, "login")
+	}
+	if agent == "" {
+		agent = setting(settings, "A")
+	}
+	if x11 == "" {
+		x11 = setting(settings, "X")
+	}
+	if hostKeyCheck == "" {
+		hostKeyCheck = os.Getenv("WSS_HOST_KEY_CHECK")
+	}
+	if hostKeyCheck == "" {
+		hostKeyCheck = strings.ToLower(setting(settings, "host-key-check"))
+	}
+	if hostKeyCheck == "off" {
+		hostKeyCheck = string(core.HostKeyOff)
+	}
+	check, err := core.ParseHostKeyCheck(hostKeyCheck)
+	if err != nil {
+		return err
+	}
+	forwardAgent, err := settingTrue("A", agent)
+	if err != nil {
+		return err
+	}
+	forwardX11, err := settingTrue("X", x11)
+	if err != nil {
+		return err
+	}
+
+	c := core.NewClient(context.Background(), url, token)
+	c.SetCommand(command)
+	c.SetLogin(login)
+	c.SetForwardAgent(forwardAgent)
+	c.SetForwardX11(forwardX11)
+	c.SetNoPTY(a.noPTY)
+	c.SetHostKeyCheck(check)
+	return c.Connect()
+}
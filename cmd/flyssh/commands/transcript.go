@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"flyssh/core"
+)
+
+// TranscriptCommand works with the transcripts clients keep with
+// -log-output
+func TranscriptCommand(args []string) error {
+	if len(args) > 0 && args[0] == "grep" {
+		return grepTranscripts(args[1:])
+	}
+	fmt.Fprintln(os.Stderr, "Usage: flyssh transcript grep [-i] PATTERN FILE...")
+	os.Exit(2)
+	return nil
+}
+
+// grepTranscripts prints the transcript lines matching a regular
+// expression, with when they were output
+func grepTranscripts(args []string) error {
+	fs := flag.NewFlagSet("transcript grep", flag.ExitOnError)
+	ignoreCase := fs.Bool("i", false, "Ignore case")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: flyssh transcript grep [-i] PATTERN FILE...")
+	}
+
+	pattern := fs.Arg(0)
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	matches, err := core.GrepTranscripts(os.Stdout, re, fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	// As grep does, finding nothing fails
+	if matches == 0 {
+		os.Exit(1)
+	}
+	return nil
+}
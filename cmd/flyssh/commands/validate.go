@@ -0,0 +1,329 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"flyssh/core"
+)
+
+// serverRequires lists server options that do nothing without another
+var serverRequires = map[string]string{
+	"record-name":       "record-dir",
+	"record-input":      "record-dir",
+	"sandbox-cpus":      "sandbox-dir",
+	"sandbox-memory":    "sandbox-dir",
+	"cluster-addr":      "cluster-dir",
+	"instance":          "cluster-dir",
+	"rate-burst":        "rate-limit",
+	"activate-idle":     "activate-addr",
+	"activate-key-file": "activate-addr",
+	"access-max":        "access-requests",
+	"access-webhook":    "access-requests",
+	"manage-file":       "manage",
+	"rendezvous-name":   "rendezvous",
+	"rendezvous-token":  "rendezvous",
+}
+
+// ConfigCommand checks config files before they're deployed, or prints
+// the server config's JSON schema, the management API's OpenAPI spec or
+// Ansible's settings for flyssh
+func ConfigCommand(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "validate":
+			return validateCommand(args[1:])
+		case "schema":
+			return printServerSchema(os.Stdout)
+		case "openapi":
+			return printJSON(os.Stdout, core.OpenAPI())
+		case "ansible":
+			return printAnsibleVars(os.Stdout)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: flyssh config validate [-server FILE] [-client FILE]")
+	fmt.Fprintln(os.Stderr, "       flyssh config schema")
+	fmt.Fprintln(os.Stderr, "       flyssh config openapi")
+	fmt.Fprintln(os.Stderr, "       flyssh config ansible")
+	os.Exit(2)
+	return nil
+}
+
+// validateCommand checks the server and client config files for unknown
+// or misspelled options, invalid values and options that conflict
+func validateCommand(args []string) error {
+	clientFile, err := core.ClientConfigPath()
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	serverFile := fs.String("server", os.Getenv("WSS_CONFIG"), "Server config file to check (default "+core.DefaultServerConfig+", if it exists)")
+	fs.StringVar(&clientFile, "client", clientFile, "Client config file to check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var problems []string
+	if *serverFile == "" {
+		*serverFile = core.DefaultServerConfig
+		if _, err := os.Stat(*serverFile); err != nil {
+			*serverFile = ""
+		}
+	}
+	if *serverFile != "" {
+		found, err := validateServerConfig(*serverFile)
+		if err != nil {
+			return err
+		}
+		report(*serverFile, found)
+		problems = append(problems, found...)
+	}
+	if _, err := os.Stat(clientFile); err == nil || flagGiven(fs, "client") {
+		found, err := validateClientConfig(clientFile)
+		if err != nil {
+			return err
+		}
+		report(clientFile, found)
+		problems = append(problems, found...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s)", len(problems))
+	}
+	return nil
+}
+
+// report prints a file's problems, or that it has none
+func report(file string, problems []string) {
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", file)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+}
+
+// validateServerConfig checks a server config file
+func validateServerConfig(file string) ([]string, error) {
+	settings, err := core.LoadServerConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		return nil, fmt.Errorf("%s doesn't exist", file)
+	}
+	fs, _ := newServerFlags()
+	fs.SetOutput(io.Discard)
+
+	var problems []string
+	given := make(map[string]string) // settings by flag name
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "token" {
+			given[name] = settings[name]
+			continue
+		}
+		f := lookupSetting(fs, name)
+		if f == nil || f.Name == "config" {
+			problems = append(problems, fmt.Sprintf("%s: unknown option %s%s", file, name, suggest(fs, name)))
+			continue
+		}
+		if err := setFlag(fs, f, settings[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid %s: %v", file, name, err))
+		}
+		given[f.Name] = settings[name]
+	}
+
+	for _, name := range sortedKeys(given) {
+		if needs, ok := serverRequires[name]; ok && given[needs] == "" {
+			problems = append(problems, fmt.Sprintf("%s: %s does nothing without %s", file, name, needs))
+		}
+	}
+	// An invalid dev is already among the problems
+	if dev, err := settingTrue("dev", given["dev"]); err == nil && dev && given["token"] != "" {
+		problems = append(problems, fmt.Sprintf("%s: dev replaces token with a generated one", file))
+	}
+	if p := given["policy"]; p != "" && p == given["policy-preview"] {
+		problems = append(problems, fmt.Sprintf("%s: policy-preview is the enforced policy, so previews nothing", file))
+	}
+	return problems, nil
+}
+
+// validateClientConfig checks a client config file, each Host's settings
+// on their own
+func validateClientConfig(file string) ([]string, error) {
+	cfg, err := core.LoadClientConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fs, _ := newClientFlags("client")
+	fs.SetOutput(io.Discard)
+
+	var problems []string
+	// The current Host's settings, by flag name, as first given
+	var hosts []string
+	given := make(map[string]core.ConfigSetting)
+	conflict := func(a, b, why string) {
+		if s, ok := given[b]; ok && given[a].Name != "" {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s %s", file, s.Line, s.Name, why))
+		}
+	}
+	checkBlock := func() {
+		conflict("launch", "c", "can't be used with a launcher")
+		conflict("launch", "login", "can't be used with a launcher")
+		conflict("launch", "dir", "can't be used with a launcher")
+		conflict("launch", "shell", "can't be used with a launcher")
+		conflict("token", "token-file", "is ignored, since a token is given")
+		conflict("token", "token-command", "is ignored, since a token is given")
+		conflict("token-file", "token-command", "is ignored, since a token file is given")
+		given = make(map[string]core.ConfigSetting)
+	}
+
+	for _, s := range cfg.All() {
+		if !reflect.DeepEqual(hosts, s.Hosts) {
+			checkBlock()
+			hosts = s.Hosts
+		}
+		at := fmt.Sprintf("%s:%d", file, s.Line)
+		if strings.EqualFold(s.Name, "url") {
+			if u, err := url.Parse(s.Value); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("%s: URL %s is not a ws:// or wss:// URL", at, s.Value))
+			}
+		}
+		f := lookupSetting(fs, s.Name)
+		if f == nil {
+			problems = append(problems, fmt.Sprintf("%s: unknown option %s%s", at, s.Name, suggest(fs, s.Name)))
+			continue
+		}
+		value := s.Value
+		if f.Name == "host-key-check" {
+			value = strings.ToLower(value)
+			if value == "off" {
+				value = string(core.HostKeyOff)
+			}
+			if _, err := core.ParseHostKeyCheck(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", at, err))
+			}
+		}
+		if err := setFlag(fs, f, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid %s: %v", at, s.Name, err))
+		}
+		if _, ok := given[f.Name]; !ok {
+			given[f.Name] = s
+		}
+	}
+	checkBlock()
+	return problems, nil
+}
+
+// setFlag sets a flag from a setting, as applySettings would
+func setFlag(fs *flag.FlagSet, f *flag.Flag, value string) error {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		value = settingBool(value)
+	}
+	return fs.Set(f.Name, value)
+}
+
+// suggest names the option a misspelled one most likely meant
+func suggest(fs *flag.FlagSet, name string) string {
+	name = strings.ToLower(strings.ReplaceAll(name, "-", ""))
+	best, bestDistance := "", 3
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, strings.ReplaceAll(f.Name, "-", "")); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %s?)", best)
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := []int{i}
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur = append(cur, min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// printServerSchema prints a JSON schema for the server config file, made
+// from the server's flags, for editors that check YAML against one
+func printServerSchema(w io.Writer) error {
+	fs, _ := newServerFlags()
+	properties := map[string]any{
+		"token": map[string]any{"type": "string", "description": "Auth token, used unless WSS_AUTH_TOKEN is set"},
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		prop := map[string]any{"description": f.Usage}
+		// String defaults come from the environment, so aren't given
+		switch v := f.Value.(flag.Getter).Get().(type) {
+		case bool:
+			prop["type"], prop["default"] = "boolean", v
+		case int:
+			prop["type"], prop["default"] = "integer", v
+		case float64:
+			prop["type"], prop["default"] = "number", v
+		case time.Duration:
+			prop["type"], prop["default"] = "string", v.String()
+			prop["pattern"] = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`
+		default:
+			prop["type"] = "string"
+		}
+		properties[f.Name] = prop
+	})
+	schema := map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "flyssh server config",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties":           properties,
+	}
+	return printJSON(w, schema)
+}
+
+// printJSON prints v as indented JSON
+func printJSON(w io.Writer, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// sortedKeys returns a map's keys in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,36 +1,136 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 
 	"flyssh/cmd/flyssh/commands"
+	"flyssh/core"
 	wsslog "flyssh/core/log"
 )
 
 func main() {
+	// A crash must not leave the terminal in raw mode
+	defer core.RecoverTerminal()
+
 	// Initialize logging
 	wsslog.Init()
 
+	// Installed as flyssh-ssh, it stands in for ssh, as in scp -S flyssh-ssh
+	if filepath.Base(os.Args[0]) == "flyssh-ssh" {
+		os.Args = append([]string{os.Args[0], "ssh"}, os.Args[1:]...)
+	}
+
 	if len(os.Args) < 2 {
-		fmt.Println("Usage:")
-		fmt.Println("  flyssh server [-port PORT] [-dev] [-debug]")
-		fmt.Println("  flyssh client [-url WS_URL] [-token TOKEN] [-dev] [-debug]")
+		usage(os.Stderr)
 		os.Exit(1)
 	}
 
+	// help COMMAND is COMMAND -h
+	switch os.Args[1] {
+	case "help", "-h", "-help", "--help":
+		if len(os.Args) < 3 || os.Args[1] != "help" {
+			usage(os.Stdout)
+			return
+		}
+		os.Args = []string{os.Args[0], os.Args[2], "-h"}
+	}
+
 	var err error
 	switch os.Args[1] {
 	case "server":
 		err = commands.ServerCommand(os.Args[2:])
 	case "client":
 		err = commands.ClientCommand(os.Args[2:])
+	case "cp":
+		err = commands.CpCommand(os.Args[2:])
+	case "connect":
+		err = commands.ConnectCommand(os.Args[2:])
+	case "ssh":
+		err = commands.SSHCommand(os.Args[2:])
+	case "rsync":
+		err = commands.RsyncCommand(os.Args[2:])
+	case "git-wrapper":
+		err = commands.GitWrapperCommand(os.Args[2:])
+	case "stdio-proxy":
+		err = commands.StdioProxyCommand(os.Args[2:])
+	case "service":
+		err = commands.ServiceCommand(os.Args[2:])
+	case "config":
+		err = commands.ConfigCommand(os.Args[2:])
+	case "keyscan":
+		err = commands.KeyscanCommand(os.Args[2:])
+	case "recent":
+		err = commands.RecentCommand(os.Args[2:])
+	case "replay":
+		err = commands.ReplayCommand(os.Args[2:])
+	case "recording":
+		err = commands.RecordingCommand(os.Args[2:])
+	case "transcript":
+		err = commands.TranscriptCommand(os.Args[2:])
+	case "relay":
+		err = commands.RendezvousCommand(os.Args[2:])
+	case "access":
+		err = commands.AccessCommand(os.Args[2:])
+	case "bench":
+		err = commands.BenchCommand(os.Args[2:])
 	default:
-		fmt.Printf("Unknown command: %s\n", os.Args[1])
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+		usage(os.Stderr)
 		os.Exit(1)
 	}
 
+	// Exiting skips deferred calls, so anything still raw is restored now
+	core.RestoreTerminal()
+
+	// Remote commands' exit status becomes ours
+	var exitErr *core.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.Code)
+	}
+	// Standing in for ssh, failures of flyssh's own exit 255 as ssh's do,
+	// so programs driving it, such as Ansible, can tell them from the
+	// command's
 	if err != nil {
+		switch os.Args[1] {
+		case "ssh", "git-wrapper", "stdio-proxy":
+			wsslog.Info.Print(err)
+			os.Exit(255)
+		}
 		wsslog.Info.Fatal(err)
 	}
 }
+
+// usage lists the commands. Each takes -h for its options.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintln(w, "  flyssh server [-port PORT] [-dev] [-debug]")
+	fmt.Fprintln(w, "  flyssh server sessions [-url URL] [-token TOKEN] [-kill ID]")
+	fmt.Fprintln(w, "  flyssh server replica [-upstream URL] [-port PORT] [-token TOKEN]")
+	fmt.Fprintln(w, "  flyssh relay [-port PORT] [-token TOKEN] [-targets FILE]   (also flyssh server rendezvous)")
+	fmt.Fprintln(w, "  flyssh server activate -addr ADDR -key-file FILE")
+	fmt.Fprintln(w, "  flyssh server access [-url URL] [-token TOKEN] [-approve ID | -deny ID]")
+	fmt.Fprintln(w, "  flyssh service install [SERVER OPTIONS] | start | stop | uninstall   (Windows)")
+	fmt.Fprintln(w, "  flyssh client [-url WS_URL] [-token TOKEN] [-launch NAME] [-c COMMAND] [-e CHAR] [-record FILE] [-log-output FILE] [-dev] [-debug] [COMMAND...]")
+	fmt.Fprintln(w, "  flyssh connect [OPTIONS] NAME [COMMAND...]")
+	fmt.Fprintln(w, "  flyssh cp [-r] [-url WS_URL] [-token TOKEN] SOURCE DEST")
+	fmt.Fprintln(w, "  flyssh ssh [SSH OPTIONS] HOST [COMMAND...]")
+	fmt.Fprintln(w, "  flyssh rsync [-url URL] [-token TOKEN] -- RSYNC ARGS...")
+	fmt.Fprintln(w, "  flyssh git-wrapper [SSH OPTIONS] HOST COMMAND   (as GIT_SSH_COMMAND)")
+	fmt.Fprintln(w, "  flyssh stdio-proxy -s URL")
+	fmt.Fprintln(w, "  flyssh keyscan URL...")
+	fmt.Fprintln(w, "  flyssh config validate [-server FILE] [-client FILE]")
+	fmt.Fprintln(w, "  flyssh config schema")
+	fmt.Fprintln(w, "  flyssh config openapi")
+	fmt.Fprintln(w, "  flyssh config ansible")
+	fmt.Fprintln(w, "  flyssh recent")
+	fmt.Fprintln(w, "  flyssh replay [-x SPEED] [-idle-limit DURATION] [-from BOOKMARK] FILE")
+	fmt.Fprintln(w, "  flyssh recording bookmarks FILE")
+	fmt.Fprintln(w, "  flyssh transcript grep [-i] PATTERN FILE...")
+	fmt.Fprintln(w, "  flyssh access -url URL -launch NAMES [-hours N] [-reason TEXT]")
+	fmt.Fprintln(w, "  flyssh bench [-url URL] [-token TOKEN] [-protocol v2|v3|all]")
+	fmt.Fprintln(w, "Run flyssh help COMMAND, or COMMAND -h, for a command's options.")
+}
@@ -0,0 +1,354 @@
+package core
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// accessPath is the prefix for the access request API
+const accessPath = "/api/v1/access"
+
+// DefaultAccessMax is the longest access a request can ask for unless the
+// server says otherwise
+const DefaultAccessMax = 8 * time.Hour
+
+const (
+	// maxPendingAccess bounds requests awaiting a decision, since anyone
+	// who can reach the server may make them
+	maxPendingAccess = 100
+	// accessRetention is how long undecided and denied requests are kept
+	accessRetention = 24 * time.Hour
+	// webhookTimeout bounds each webhook delivery
+	webhookTimeout = 10 * time.Second
+)
+
+// Access request states
+const (
+	AccessPending  = "pending"
+	AccessApproved = "approved"
+	AccessDenied   = "denied"
+)
+
+// AccessRequest is a user's request for temporary access to launchers. Once
+// approved, it holds a token scoped to them that expires with the access.
+type AccessRequest struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Launchers []string   `json:"launchers"`
+	Hours     int        `json:"hours"`
+	Reason    string     `json:"reason,omitempty"`
+	Status    string     `json:"status"`
+	Requested time.Time  `json:"requested"`
+	Decided   *time.Time `json:"decided,omitempty"`
+	Approver  string     `json:"approver,omitempty"`
+	// OnBehalfOf is who the approver said they decided for, if anyone
+	OnBehalfOf string     `json:"on_behalf_of,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+
+	// Token is only shown to the requester, who collects it with Claim
+	Token string `json:"token,omitempty"`
+	Claim string `json:"claim,omitempty"`
+}
+
+// AccessRequests holds access requests awaiting and after approval, and
+// the tokens minted for them. They're kept in memory, so restarting the
+// server revokes all temporary access.
+type AccessRequests struct {
+	max     time.Duration
+	webhook string
+	now     func() time.Time
+	client  *http.Client
+
+	mu       sync.Mutex
+	next     int
+	requests map[string]*AccessRequest
+}
+
+// NewAccessRequests takes requests for up to max of access, posting each
+// new request and decision to webhook, if given, to tell approvers
+func NewAccessRequests(max time.Duration, webhook string) *AccessRequests {
+	if max <= 0 {
+		max = DefaultAccessMax
+	}
+	return &AccessRequests{
+		max:      max,
+		webhook:  webhook,
+		now:      time.Now,
+		client:   &http.Client{Timeout: webhookTimeout},
+		requests: make(map[string]*AccessRequest),
+	}
+}
+
+// SetAccessRequests lets users request temporary access to launchers,
+// which an admin approves
+func (s *Server) SetAccessRequests(a *AccessRequests) {
+	s.access = a
+}
+
+// request files a new request, returning it with the claim the requester
+// collects its token with
+func (a *AccessRequests) request(req AccessRequest, launchers map[string]Launcher) (AccessRequest, error) {
+	if req.Name == "" {
+		return AccessRequest{}, fmt.Errorf("name is required")
+	}
+	if len(req.Launchers) == 0 {
+		return AccessRequest{}, fmt.Errorf("at least one launcher is required")
+	}
+	for _, name := range req.Launchers {
+		if _, ok := launchers[name]; !ok {
+			return AccessRequest{}, fmt.Errorf("unknown launcher %q", name)
+		}
+	}
+	if req.Hours <= 0 || time.Duration(req.Hours)*time.Hour > a.max {
+		return AccessRequest{}, fmt.Errorf("hours must be between 1 and %d", int(a.max/time.Hour))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	a.prune(now)
+	pending := 0
+	for _, r := range a.requests {
+		if r.Status == AccessPending {
+			pending++
+		}
+	}
+	if pending >= maxPendingAccess {
+		return AccessRequest{}, fmt.Errorf("too many requests awaiting approval")
+	}
+	a.next++
+	r := &AccessRequest{
+		ID:        strconv.Itoa(a.next),
+		Name:      req.Name,
+		Launchers: req.Launchers,
+		Hours:     req.Hours,
+		Reason:    req.Reason,
+		Status:    AccessPending,
+		Requested: now,
+		Claim:     randomID(16),
+	}
+	a.requests[r.ID] = r
+	return *r, nil
+}
+
+// decide approves or denies a pending request, for onBehalfOf if that
+// isn't "". Approval mints its token, valid for the hours requested from
+// now.
+func (a *AccessRequests) decide(id, approver, onBehalfOf string, approve bool) (AccessRequest, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	a.prune(now)
+	r, ok := a.requests[id]
+	if !ok {
+		return AccessRequest{}, errAccessNotFound
+	}
+	if r.Status != AccessPending {
+		return AccessRequest{}, fmt.Errorf("request %s is already %s", id, r.Status)
+	}
+	r.Decided, r.Approver, r.OnBehalfOf = &now, approver, onBehalfOf
+	r.Status = AccessDenied
+	if approve {
+		r.Status = AccessApproved
+		expires := now.Add(time.Duration(r.Hours) * time.Hour)
+		r.Expires = &expires
+		r.Token = randomID(16)
+	}
+	return *r, nil
+}
+
+var errAccessNotFound = fmt.Errorf("access request not found")
+
+// claim returns a request for its requester, who may see its token
+func (a *AccessRequests) claim(id, claim string) (AccessRequest, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune(a.now())
+	r, ok := a.requests[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(claim), []byte(r.Claim)) != 1 {
+		return AccessRequest{}, errAccessNotFound
+	}
+	return *r, nil
+}
+
+// list returns every request, oldest first, without secrets
+func (a *AccessRequests) list() []AccessRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune(a.now())
+	list := make([]AccessRequest, 0, len(a.requests))
+	for _, r := range a.requests {
+		list = append(list, r.public())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Requested.Before(list[j].Requested) })
+	return list
+}
+
+// authenticate returns the grant of an unexpired minted token, or nil
+func (a *AccessRequests) authenticate(token string) *grant {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for _, r := range a.requests {
+		if r.Status == AccessApproved && r.Token != "" && now.Before(*r.Expires) &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(r.Token)) == 1 {
+			return &grant{name: r.tokenName(), launchers: r.Launchers, expires: *r.Expires}
+		}
+	}
+	return nil
+}
+
+// prune drops expired access and stale requests. Callers hold a.mu.
+func (a *AccessRequests) prune(now time.Time) {
+	for id, r := range a.requests {
+		switch {
+		case r.Status == AccessApproved && !now.Before(*r.Expires):
+			delete(a.requests, id)
+		case r.Status != AccessApproved && now.Sub(r.Requested) > accessRetention:
+			delete(a.requests, id)
+		}
+	}
+}
+
+// public returns r without its token and claim
+func (r AccessRequest) public() AccessRequest {
+	r.Token, r.Claim = "", ""
+	return r
+}
+
+// tokenName names a minted token in logs, audit events and quotas
+func (r *AccessRequest) tokenName() string {
+	return fmt.Sprintf("%s (access %s)", r.Name, r.ID)
+}
+
+// accessEvent is posted to the webhook
+type accessEvent struct {
+	Event   string        `json:"event"` // access_requested, access_approved or access_denied
+	Request AccessRequest `json:"request"`
+}
+
+// notify posts an event about r to the webhook, if there is one, without
+// waiting for it
+func (a *AccessRequests) notify(event string, r AccessRequest) {
+	if a.webhook == "" {
+		return
+	}
+	body, err := json.Marshal(accessEvent{Event: event, Request: r.public()})
+	if err != nil {
+		log.Info.Printf("Failed to encode access webhook: %v", err)
+		return
+	}
+	go func() {
+		resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Info.Printf("Failed to post access webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Info.Printf("Access webhook returned %s", resp.Status)
+		}
+	}()
+}
+
+// handleAccess serves the access request API. Anyone may file a request
+// (POST /api/v1/access) and, with its claim, check on it and collect its
+// token (GET /api/v1/access/{id}?claim=...). Admins list requests (GET
+// /api/v1/access) and decide them (POST /api/v1/access/{id}/approve or
+// /deny).
+func (s *Server) handleAccess(w http.ResponseWriter, r *http.Request) {
+	if s.access == nil || s.launchers == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, accessPath), "/")
+	id, sub, _ := strings.Cut(id, "/")
+
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		if s.limiter != nil && !s.limiter.allow(remoteIP(r.RemoteAddr), time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		var req AccessRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		created, err := s.access.request(req, s.launchers.Launchers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info.Printf("Access request %s from %s (%s): %s for %dh", created.ID, created.Name, r.RemoteAddr, strings.Join(created.Launchers, ", "), created.Hours)
+		s.audit.Log(AuditEvent{Event: AuditAccessRequest, RemoteAddr: r.RemoteAddr, User: created.Name, Launcher: strings.Join(created.Launchers, ","), Reason: created.Reason, TraceID: traceID(r.Context())})
+		s.access.notify("access_requested", created)
+		writeJSON(w, http.StatusCreated, created)
+
+	case r.Method == http.MethodGet && id != "" && sub == "" && r.URL.Query().Get("claim") != "":
+		req, err := s.access.claim(id, r.URL.Query().Get("claim"))
+		if err != nil {
+			http.Error(w, "Access request not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, req)
+
+	default:
+		s.withAdminAuth(http.HandlerFunc(s.handleAccessAdmin)).ServeHTTP(w, r)
+	}
+}
+
+// handleAccessAdmin lists and decides access requests
+func (s *Server) handleAccessAdmin(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, accessPath), "/")
+	id, sub, _ := strings.Cut(id, "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, s.access.list())
+
+	case r.Method == http.MethodPost && (sub == "approve" || sub == "deny"):
+		// The approver is who authenticated; a name they give is only
+		// recorded alongside
+		approver := "admin"
+		if g := grantFrom(r.Context()); g != nil {
+			approver = g.name
+		}
+		by := r.URL.Query().Get("by")
+		req, err := s.access.decide(id, approver, by, sub == "approve")
+		if err == errAccessNotFound {
+			http.Error(w, "Access request not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		decided := "by " + approver
+		if by != "" {
+			decided += " on behalf of " + by
+		}
+		log.Info.Printf("Access request %s %s %s", req.ID, req.Status, decided)
+		event := AuditAccessApprove
+		if req.Status == AccessDenied {
+			event = AuditAccessDeny
+		}
+		s.audit.Log(AuditEvent{Event: event, RemoteAddr: r.RemoteAddr, User: req.Name, Token: req.tokenName(), Launcher: strings.Join(req.Launchers, ","), Reason: decided, TraceID: traceID(r.Context())})
+		s.access.notify("access_"+req.Status, req)
+		writeJSON(w, http.StatusOK, req.public())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
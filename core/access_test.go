@@ -0,0 +1,155 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAccessLaunchers = map[string]Launcher{"psql": {Command: []string{"psql"}}}
+
+func TestAccessRequestLifecycle(t *testing.T) {
+	a := NewAccessRequests(8*time.Hour, "")
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	for _, tt := range []struct {
+		name string
+		req  AccessRequest
+	}{
+		{"no name", AccessRequest{Launchers: []string{"psql"}, Hours: 1}},
+		{"no launchers", AccessRequest{Name: "alice", Hours: 1}},
+		{"unknown launcher", AccessRequest{Name: "alice", Launchers: []string{"root-shell"}, Hours: 1}},
+		{"no hours", AccessRequest{Name: "alice", Launchers: []string{"psql"}}},
+		{"too many hours", AccessRequest{Name: "alice", Launchers: []string{"psql"}, Hours: 9}},
+	} {
+		if _, err := a.request(tt.req, testAccessLaunchers); err == nil {
+			t.Errorf("Expected a request with %s to be refused", tt.name)
+		}
+	}
+
+	req, err := a.request(AccessRequest{Name: "alice", Launchers: []string{"psql"}, Hours: 2, Token: "chosen"}, testAccessLaunchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Status != AccessPending || req.Claim == "" || req.Token != "" {
+		t.Fatalf("Unexpected new request: %+v", req)
+	}
+	if a.authenticate("chosen") != nil {
+		t.Error("Expected a requester not to choose their own token")
+	}
+	if _, err := a.claim(req.ID, "wrong"); err == nil {
+		t.Error("Expected the wrong claim to be refused")
+	}
+	if list := a.list(); len(list) != 1 || list[0].Claim != "" {
+		t.Errorf("Expected the list to hide claims, got %+v", list)
+	}
+
+	approved, err := a.decide(req.ID, "bob", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.decide(req.ID, "bob", "", false); err == nil {
+		t.Error("Expected a decided request not to be decided again")
+	}
+	got, err := a.claim(req.ID, req.Claim)
+	if err != nil || got.Token != approved.Token || got.Token == "" {
+		t.Fatalf("Expected the requester to collect the token, got %+v, %v", got, err)
+	}
+
+	g := a.authenticate(got.Token)
+	if g == nil || g.full || !g.allows("psql") || !g.expires.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("Unexpected grant: %+v", g)
+	}
+	now = now.Add(2 * time.Hour)
+	if a.authenticate(got.Token) != nil {
+		t.Error("Expected the token to stop working when access expires")
+	}
+	if len(a.list()) != 0 {
+		t.Error("Expected expired access to be dropped")
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+	a := NewAccessRequests(0, "")
+	req, err := a.request(AccessRequest{Name: "alice", Launchers: []string{"psql"}, Hours: 1}, testAccessLaunchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.decide(req.ID, "bob", "", false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.claim(req.ID, req.Claim)
+	if err != nil || got.Status != AccessDenied || got.Token != "" {
+		t.Errorf("Expected a denied request without a token, got %+v, %v", got, err)
+	}
+	if _, err := a.decide("99", "bob", "", true); err != errAccessNotFound {
+		t.Errorf("Expected an unknown request not to be found, got %v", err)
+	}
+}
+
+func TestAccessWebhook(t *testing.T) {
+	events := make(chan accessEvent, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e accessEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer hook.Close()
+
+	s := NewServer(0)
+	s.SetAuthToken("admin-token")
+	s.SetLaunchers(&LauncherConfig{Launchers: testAccessLaunchers})
+	s.SetAccessRequests(NewAccessRequests(time.Hour, hook.URL))
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+accessPath, "application/json", strings.NewReader(`{"name": "alice", "launchers": ["psql"], "hours": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req AccessRequest
+	json.NewDecoder(resp.Body).Decode(&req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the request to be filed, got %s", resp.Status)
+	}
+
+	// Only admins may approve
+	resp, err = http.Post(srv.URL+accessPath+"/"+req.ID+"/approve?token="+req.Claim, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected approval without the admin token to be refused, got %s", resp.Status)
+	}
+	resp, err = http.Post(srv.URL+accessPath+"/"+req.ID+"/approve?token=admin-token&by=bob", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var approved AccessRequest
+	json.NewDecoder(resp.Body).Decode(&approved)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected approval to succeed, got %s", resp.Status)
+	}
+	// A name given with by= can't stand in for who approved
+	if approved.Approver == "bob" || approved.OnBehalfOf != "bob" {
+		t.Errorf("Expected the admin to approve on behalf of bob, got %q for %q", approved.Approver, approved.OnBehalfOf)
+	}
+
+	for _, want := range []string{"access_requested", "access_approved"} {
+		select {
+		case e := <-events:
+			if e.Event != want || e.Request.Name != "alice" || e.Request.Token != "" || e.Request.Claim != "" {
+				t.Errorf("Expected a %s event without secrets, got %+v", want, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s webhook", want)
+		}
+	}
+}
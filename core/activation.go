@@ -0,0 +1,286 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// DefaultActivationIdle is how long an activated port stays open with no
+// new connections
+const DefaultActivationIdle = 10 * time.Minute
+
+// activationSkew is how far an activation request's timestamp may be from
+// the server's clock. Signatures are only accepted once within it.
+const activationSkew = time.Minute
+
+// activationPath and activationHeader are where activation requests are
+// sent and the header carrying their signature
+const (
+	activationPath   = "/api/v1/activate"
+	activationHeader = "X-Flyssh-Activation"
+)
+
+// Activation keeps the server's port closed until a signed activation
+// request opens it, and closes it again once no client has connected for
+// the idle period, so an edge machine isn't exposed while nobody is using
+// it. Connections already made carry on when the port closes. Requests
+// are served on a separate, private address, such as one on a network
+// only the hub and admins can reach.
+type Activation struct {
+	addr string        // where activation requests are served
+	key  []byte        // requests are signed with HMAC-SHA256 under this
+	idle time.Duration // how long the port stays open with no new connections
+}
+
+// NewActivation serves activation requests on addr, signed with key
+func NewActivation(addr string, key []byte, idle time.Duration) (*Activation, error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("activation key must be at least 16 bytes")
+	}
+	if idle <= 0 {
+		return nil, fmt.Errorf("activation idle period must be positive")
+	}
+	return &Activation{addr: addr, key: key, idle: idle}, nil
+}
+
+// LoadActivationKey reads an activation key from a file, ignoring
+// surrounding whitespace
+func LoadActivationKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read activation key: %v", err)
+	}
+	return bytes.TrimSpace(data), nil
+}
+
+// SetActivation keeps the server's port closed until activated
+func (s *Server) SetActivation(a *Activation) {
+	s.activation = a
+}
+
+// SignActivation returns the activation header's value for a request made
+// at t: the Unix time and the hex HMAC-SHA256 of "activate:<time>",
+// separated by a colon
+func SignActivation(key []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + ":" + activationMAC(key, ts)
+}
+
+func activationMAC(key []byte, ts string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("activate:" + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Activate asks the server serving activation requests at addr to open
+// its port
+func Activate(addr string, key []byte) error {
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+activationPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set(activationHeader, SignActivation(key, time.Now()))
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to activate: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to activate: %s", resp.Status)
+	}
+	return nil
+}
+
+// listen returns a listener for address that only listens while
+// activated, and starts serving activation requests
+func (a *Activation) listen(address string) (*activationListener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", address, err)
+	}
+	api, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for activation requests: %v", err)
+	}
+	l := &activationListener{
+		a:       a,
+		addr:    addr,
+		apiAddr: api.Addr().String(),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+		seen:    make(map[string]time.Time),
+	}
+	l.api = &http.Server{Handler: http.HandlerFunc(l.handleActivate)}
+	go l.api.Serve(api)
+	log.Info.Printf("Port %d closed until activated; serving activation requests on %s", addr.Port, l.apiAddr)
+	return l, nil
+}
+
+// activationListener accepts connections from the server's port while
+// it's activated, and waits while it's closed
+type activationListener struct {
+	a       *Activation
+	addr    *net.TCPAddr
+	apiAddr string // where activation requests are served
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	api     *http.Server
+
+	mu   sync.Mutex
+	ln   net.Listener         // the open port, nil while closed
+	idle *time.Timer          // closes the port
+	seen map[string]time.Time // signatures accepted, until they expire
+}
+
+func (l *activationListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *activationListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.api.Close()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.ln != nil {
+			l.ln.Close()
+			l.ln = nil
+			l.idle.Stop()
+		}
+	})
+	return nil
+}
+
+func (l *activationListener) Addr() net.Addr { return l.addr }
+
+// handleActivate opens the port for a request with a valid signature
+func (l *activationListener) handleActivate(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != activationPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := l.verify(r.Header.Get(activationHeader), time.Now()); err != nil {
+		log.Info.Printf("Refused activation from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := l.activate(); err != nil {
+		log.Info.Printf("Failed to activate: %v", err)
+		http.Error(w, "Failed to open port", http.StatusInternalServerError)
+		return
+	}
+	log.Info.Printf("Activated by %s", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verify checks a signature made within activationSkew of now, and not
+// used before
+func (l *activationListener) verify(header string, now time.Time) error {
+	ts, mac, ok := strings.Cut(header, ":")
+	if !ok {
+		return fmt.Errorf("missing signature")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid time %q", ts)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > activationSkew || d < -activationSkew {
+		return fmt.Errorf("signed %v from the server's time", d.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(mac), []byte(activationMAC(l.a.key, ts))) {
+		return fmt.Errorf("bad signature")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for seen, at := range l.seen {
+		if now.Sub(at) > 2*activationSkew {
+			delete(l.seen, seen)
+		}
+	}
+	if _, ok := l.seen[header]; ok {
+		return fmt.Errorf("signature replayed")
+	}
+	l.seen[header] = now
+	return nil
+}
+
+// activate opens the port, if it isn't open, and restarts its idle period
+func (l *activationListener) activate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+		return net.ErrClosed
+	default:
+	}
+	if l.ln != nil {
+		l.idle.Reset(l.a.idle)
+		return nil
+	}
+	ln, err := net.Listen("tcp", l.addr.String())
+	if err != nil {
+		return err
+	}
+	l.ln = ln
+	l.idle = time.AfterFunc(l.a.idle, func() { l.deactivate(ln) })
+	log.Info.Printf("Opened port %d for %v", l.addr.Port, l.a.idle)
+	go l.acceptFrom(ln)
+	return nil
+}
+
+// acceptFrom passes on ln's connections until it's closed, each one
+// restarting the idle period
+func (l *activationListener) acceptFrom(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		if l.ln == ln {
+			l.idle.Reset(l.a.idle)
+		}
+		l.mu.Unlock()
+		select {
+		case l.conns <- c:
+		case <-l.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+// deactivate closes ln, if it's still the open port
+func (l *activationListener) deactivate(ln net.Listener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln != ln {
+		return
+	}
+	ln.Close()
+	l.ln = nil
+	log.Info.Printf("Closed port %d after %v without connections", l.addr.Port, l.a.idle)
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testActivationKey = []byte("0123456789abcdef")
+
+func TestActivationVerify(t *testing.T) {
+	a, err := NewActivation("127.0.0.1:0", testActivationKey, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &activationListener{a: a, seen: make(map[string]time.Time)}
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name   string
+		header string
+	}{
+		{"missing", ""},
+		{"wrong key", SignActivation([]byte("fedcba9876543210"), now)},
+		{"too old", SignActivation(testActivationKey, now.Add(-2*activationSkew))},
+		{"from the future", SignActivation(testActivationKey, now.Add(2*activationSkew))},
+	} {
+		if err := l.verify(tt.header, now); err == nil {
+			t.Errorf("Expected a %s signature to be refused", tt.name)
+		}
+	}
+
+	header := SignActivation(testActivationKey, now.Add(-10*time.Second))
+	if err := l.verify(header, now); err != nil {
+		t.Fatalf("Expected a valid signature to be accepted, got %v", err)
+	}
+	if err := l.verify(header, now.Add(time.Second)); err == nil {
+		t.Error("Expected a replayed signature to be refused")
+	}
+}
+
+func TestActivationOpensAndClosesPort(t *testing.T) {
+	// Find a free port for the server
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	a, err := NewActivation("127.0.0.1:0", testActivationKey, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	l, err := a.listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	dial := func() error {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if dial() == nil {
+		t.Fatal("Port open before activation")
+	}
+
+	// The activation API is on the address the listener chose
+	if err := Activate(l.apiAddr, testActivationKey); err != nil {
+		t.Fatalf("Activate failed: %v", err)
+	}
+	if err := dial(); err != nil {
+		t.Fatalf("Port closed after activation: %v", err)
+	}
+	if err := Activate(l.apiAddr, []byte("fedcba9876543210")); err == nil {
+		t.Error("Expected activation with the wrong key to fail")
+	}
+
+	time.Sleep(time.Second)
+	if dial() == nil {
+		t.Error("Port still open after its idle period")
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"flyssh/core/log"
+)
+
+// adminSessionsPath is the prefix for the session admin API
+const adminSessionsPath = "/api/v1/sessions"
+
+// handleSessions lists sessions (GET), shows a session's recent output
+// (GET /api/v1/sessions/{id}/output) or terminates one (DELETE
+// /api/v1/sessions/{id})
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, adminSessionsPath), "/")
+	id, sub, _ := strings.Cut(id, "/")
+
+	switch {
+	case sub != "" && sub != "output":
+		http.Error(w, "Not found", http.StatusNotFound)
+
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, s.sessions.List())
+
+	case r.Method == http.MethodGet && sub == "output":
+		sess, ok := s.sessions.Get(id)
+		if !ok || sess.ctl == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := w.Write(sess.ctl.output()); err != nil {
+			log.Debug.Printf("Failed to write session output: %v", err)
+		}
+
+	case r.Method == http.MethodGet:
+		sess, ok := s.sessions.Get(id)
+		if !ok {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, sess.Snapshot())
+
+	case r.Method == http.MethodDelete && id != "" && sub == "":
+		sess, ok := s.sessions.Get(id)
+		if !ok {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err := sess.Kill(); err != nil {
+			log.Info.Printf("Failed to kill session %s: %v", sess.ID, err)
+			http.Error(w, "Failed to kill session", http.StatusInternalServerError)
+			return
+		}
+		log.Info.Printf("Session %s killed by admin request from %s", sess.ID, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Metrics is a snapshot of server counters
+type Metrics struct {
+	SessionsActive        int    `json:"sessions_active"`
+	SessionsTotal         uint64 `json:"sessions_total"`
+	Goroutines            int    `json:"goroutines"`
+	RelayGoroutines       int64  `json:"relay_goroutines"`
+	RelayGoroutinesLeaked int64  `json:"relay_goroutines_leaked"`
+}
+
+// handleMetrics reports session and goroutine counters. Relay goroutines
+// should stay at two per active session; a growing leaked count means copy
+// loops are outliving their sessions.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Metrics{
+		SessionsActive:        len(s.sessions.List()),
+		SessionsTotal:         atomic.LoadUint64(&s.sessionCount),
+		Goroutines:            runtime.NumGoroutine(),
+		RelayGoroutines:       relayGoroutines.Load(),
+		RelayGoroutinesLeaked: relayLeaked.Load(),
+	})
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug.Printf("Failed to write JSON response: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// agentEnv names the socket of an SSH agent
+const agentEnv = "SSH_AUTH_SOCK"
+
+// forwardAgent gives cmd an SSH agent socket relayed to the client
+// attached to ctl. The returned function removes it.
+func (s *Server) forwardAgent(cmd *exec.Cmd, ctl *sessionControl) (*forwardRelay, func(), error) {
+	ln, dir, err := listenAgent(cmd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create agent socket: %v", err)
+	}
+	relay := newForwardRelay("agent", sendForward(ctl), nil)
+	go relay.serve(ln)
+	cmd.Env = setEnv(cmd.Env, agentEnv+"="+ln.Addr().String())
+	return relay, func() {
+		ln.Close()
+		relay.closeAll()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// dialAgent connects to the local SSH agent
+func dialAgent() (net.Conn, error) {
+	path := os.Getenv(agentEnv)
+	if path == "" {
+		return nil, fmt.Errorf("%s is not set", agentEnv)
+	}
+	return net.Dial("unix", path)
+}
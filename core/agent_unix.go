@@ -0,0 +1,31 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// listenAgent listens for agent connections on a socket in a new private
+// directory, owned by the user cmd runs as so only they can reach it
+func listenAgent(cmd *exec.Cmd) (net.Listener, string, error) {
+	dir, err := os.MkdirTemp("", "flyssh-agent-")
+	if err != nil {
+		return nil, "", err
+	}
+	ln, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", err
+	}
+	if err := chownForSession(cmd, dir, ln.Addr().String()); err != nil {
+		ln.Close()
+		os.RemoveAll(dir)
+		return nil, "", err
+	}
+	return ln, dir, nil
+}
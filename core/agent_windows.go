@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// listenAgent is not available on Windows
+func listenAgent(cmd *exec.Cmd) (net.Listener, string, error) {
+	return nil, "", fmt.Errorf("agent forwarding is not supported on Windows servers")
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Audit event names
+const (
+	AuditConnect     = "connect"
+	AuditAuthSuccess = "auth_success"
+	AuditAuthFailure = "auth_failure"
+	AuditDenied      = "denied"
+	AuditWouldDeny   = "would_deny" // by a policy being previewed
+	AuditExec        = "exec"
+	AuditResume      = "resume"
+	AuditTransfer    = "transfer"
+	AuditProxy       = "proxy"
+	AuditExit        = "exit"
+	AuditDisconnect  = "disconnect"
+	AuditObserve     = "observe" // a second person joined a dual-control session
+
+	AuditAccessRequest = "access_request"
+	AuditAccessApprove = "access_approve"
+	AuditAccessDeny    = "access_deny"
+
+	AuditTokenSet     = "token_set"
+	AuditTokenDelete  = "token_delete"
+	AuditPolicySet    = "policy_set"
+	AuditPolicyRemove = "policy_remove"
+)
+
+// AuditEvent is a single structured audit record
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	SessionID  string    `json:"session_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Token      string    `json:"token,omitempty"` // name of the token, never its value
+	Command    string    `json:"command,omitempty"`
+	Launcher   string    `json:"launcher,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Target     string    `json:"target,omitempty"` // where a proxy connection went
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	Signal     string    `json:"signal,omitempty"`
+	Duration   float64   `json:"duration_seconds,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	TraceID    string    `json:"trace_id,omitempty"`
+}
+
+// AuditLog writes audit events as JSON lines. It's kept apart from the
+// debug logging in core/log so it can be shipped and retained separately.
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// OpenAuditLog opens an audit log. The target is either a file path, which
+// is appended to, or "syslog" to send events to the local syslog daemon.
+func OpenAuditLog(target string) (*AuditLog, error) {
+	if target == "syslog" || strings.HasPrefix(target, "syslog:") {
+		w, err := openSyslog(strings.TrimPrefix(strings.TrimPrefix(target, "syslog"), ":"))
+		if err != nil {
+			return nil, err
+		}
+		return &AuditLog{w: w}, nil
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	return &AuditLog{w: f}, nil
+}
+
+// NewAuditLog writes audit events to w
+func NewAuditLog(w io.WriteCloser) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// Log records an event. Failures are reported on the info log but never
+// interrupt the session being audited.
+func (a *AuditLog) Log(ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Info.Printf("Failed to encode audit event: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Info.Printf("Failed to write audit event: %v", err)
+	}
+}
+
+// Close closes the underlying writer
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewAuditLog(nopWriteCloser{&buf})
+
+	code := 1
+	a.Log(AuditEvent{Event: AuditExec, SessionID: "#1", Command: "/bin/sh"})
+	a.Log(AuditEvent{Event: AuditExit, SessionID: "#1", ExitCode: &code})
+
+	dec := json.NewDecoder(&buf)
+	var exec, exit AuditEvent
+	if err := dec.Decode(&exec); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&exit); err != nil {
+		t.Fatal(err)
+	}
+	if exec.Event != AuditExec || exec.Command != "/bin/sh" || exec.Time.IsZero() {
+		t.Errorf("Unexpected exec event: %+v", exec)
+	}
+	if exit.ExitCode == nil || *exit.ExitCode != 1 {
+		t.Errorf("Unexpected exit event: %+v", exit)
+	}
+
+	// A nil audit log is a no-op so callers needn't check
+	var disabled *AuditLog
+	disabled.Log(AuditEvent{Event: AuditConnect})
+}
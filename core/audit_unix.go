@@ -0,0 +1,22 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to syslog with the given tag (default "flyssh")
+func openSyslog(tag string) (io.WriteCloser, error) {
+	if tag == "" {
+		tag = "flyssh"
+	}
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	return w, nil
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"fmt"
+	"io"
+)
+
+// openSyslog is not available on Windows
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog audit logging is not supported on Windows")
+}
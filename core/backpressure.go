@@ -0,0 +1,46 @@
+package core
+
+import (
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// DefaultWriteTimeout is how long a client may take to accept a chunk of
+// output before it's disconnected.
+//
+// Output isn't queued on the server: a session's output is read from its
+// PTY only as fast as the client accepts it, so a command writing faster
+// than the client reads blocks in the kernel, with at most a chunk per
+// session held in memory. A client that stops reading would hold up the
+// session, and everything sharing its connection, forever, so a write that
+// takes longer than the write timeout fails. The connection is then closed
+// and the session detached, its output going to the scrollback until the
+// client resumes it.
+const DefaultWriteTimeout = time.Minute
+
+// sendMessage sends msg as one binary message, failing if it takes longer
+// than timeout. Zero waits as long as it takes. The deadline is cleared
+// afterwards, so it can't fail writes that don't set their own.
+func sendMessage(ws *websocket.Conn, msg []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		ws.SetWriteDeadline(time.Now().Add(timeout))
+		defer ws.SetWriteDeadline(time.Time{})
+	}
+	return websocket.Message.Send(ws, msg)
+}
+
+// deadlineWriter writes to a WebSocket, failing writes that take longer
+// than timeout, and clearing the deadline like sendMessage
+type deadlineWriter struct {
+	ws      *websocket.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		w.ws.SetWriteDeadline(time.Now().Add(w.timeout))
+		defer w.ws.SetWriteDeadline(time.Time{})
+	}
+	return w.ws.Write(p)
+}
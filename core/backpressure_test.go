@@ -0,0 +1,38 @@
+package core
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestTimedWritesClearDeadline(t *testing.T) {
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(io.Discard, ws)
+	}))
+	defer ts.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	tr := &rawTransport{ws: ws, timeout: 50 * time.Millisecond}
+	if _, err := tr.output().Write([]byte("output")); err != nil {
+		t.Fatalf("Output write failed: %v", err)
+	}
+	if err := sendMessage(ws, []byte("frame"), 50*time.Millisecond); err != nil {
+		t.Fatalf("Message send failed: %v", err)
+	}
+
+	// Writes that set no deadline, like v1's idle and drain notices, still
+	// go through long after the timed ones
+	time.Sleep(100 * time.Millisecond)
+	if err := tr.send(controlMessage{Type: "error", Message: "draining"}); err != nil {
+		t.Errorf("Expected a later message to be sent, got %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Commands the benchmarks run on the server, which needs a POSIX shell
+const (
+	benchEcho     = "cat"
+	benchUpload   = "cat > /dev/null"
+	benchDownload = "head -c %d /dev/zero"
+	benchSession  = "true"
+)
+
+// BenchOptions sizes a benchmark run
+type BenchOptions struct {
+	Protocol string // ProtocolV2 or ProtocolV3
+	Rounds   int    // echo round trips timed
+	Bytes    int64  // bytes sent each way for throughput
+	Sessions int    // sessions started, one after another
+}
+
+// BenchResult is what a benchmark run measured
+type BenchResult struct {
+	Protocol       string
+	LatencyP50     time.Duration // echo round trip
+	LatencyP99     time.Duration
+	UploadMBps     float64 // client to server, in MB (10^6 bytes) per second
+	DownloadMBps   float64 // server to client
+	SessionsPerSec float64 // sessions started and run to completion
+}
+
+// Bench measures a server's echo round trip latency, throughput in each
+// direction and session start rate over one wire protocol, to catch
+// performance regressions in the transports. Every session runs a
+// command without a PTY, so the numbers don't include terminal handling.
+func Bench(ctx context.Context, serverURL, authToken string, opts BenchOptions) (BenchResult, error) {
+	res := BenchResult{Protocol: opts.Protocol}
+	open, closeAll, err := benchOpener(ctx, serverURL, authToken, opts.Protocol)
+	if err != nil {
+		return res, err
+	}
+	defer closeAll()
+
+	rtts, err := benchEchoes(open, opts.Rounds)
+	if err != nil {
+		return res, fmt.Errorf("echo: %v", err)
+	}
+	res.LatencyP50, res.LatencyP99 = percentile(rtts, 50), percentile(rtts, 99)
+	d, err := benchUploadOnce(open, opts.Bytes)
+	if err != nil {
+		return res, fmt.Errorf("upload: %v", err)
+	}
+	res.UploadMBps = float64(opts.Bytes) / 1e6 / d.Seconds()
+	if d, err = benchDownloadOnce(open, opts.Bytes); err != nil {
+		return res, fmt.Errorf("download: %v", err)
+	}
+	res.DownloadMBps = float64(opts.Bytes) / 1e6 / d.Seconds()
+	if d, err = benchSessions(open, opts.Sessions); err != nil {
+		return res, fmt.Errorf("sessions: %v", err)
+	}
+	res.SessionsPerSec = float64(opts.Sessions) / d.Seconds()
+	return res, nil
+}
+
+// benchConn is a session a benchmark runs a command in. Reads end with
+// io.EOF when the command has exited.
+type benchConn interface {
+	io.ReadWriter
+	closeInput() error // the command sees the end of its input
+	Close() error
+}
+
+// benchOpener returns a function starting sessions that run a command
+// over protocol, and one closing any connection they share
+func benchOpener(ctx context.Context, serverURL, authToken, protocol string) (func(command string) (benchConn, error), func(), error) {
+	switch protocol {
+	case ProtocolV2:
+		return func(command string) (benchConn, error) {
+			return dialBenchV2(ctx, serverURL, authToken, command)
+		}, func() {}, nil
+	case ProtocolV3:
+		mux, err := DialMux(ctx, serverURL, authToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(command string) (benchConn, error) {
+			sess, err := mux.open(controlMessage{Type: "open", Command: command, NoPTY: true})
+			if err != nil {
+				return nil, err
+			}
+			return benchMuxSession{sess}, nil
+		}, func() { mux.Close() }, nil
+	}
+	return nil, nil, fmt.Errorf("can't benchmark protocol %q", protocol)
+}
+
+// benchV2 is a session on a connection of its own
+type benchV2 struct {
+	conn transport
+	r    io.Reader
+}
+
+func dialBenchV2(ctx context.Context, serverURL, authToken, command string) (*benchV2, error) {
+	dialURL := fmt.Sprintf("%s?token=%s&exec=%s&pty=0", serverURL, url.QueryEscape(authToken), url.QueryEscape(command))
+	config, err := websocket.NewConfig(dialURL, "http://localhost")
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %v", err)
+	}
+	config.Protocol = []string{ProtocolV2}
+	verifier := &hostKeyVerifier{check: HostKeyAsk}
+	if config.TlsConfig, err = verifier.tlsConfig(serverURL); err != nil {
+		return nil, err
+	}
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %v", err)
+	}
+	conn := newTransport(ws)
+	msg, err := conn.receive()
+	if err != nil || msg.Type != "session" {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("%s", msg.Message)
+		}
+		return nil, fmt.Errorf("failed to start session: %v", err)
+	}
+	// The connection closes once the command exits
+	return &benchV2{conn: conn, r: conn.input(func(controlMessage) {})}, nil
+}
+
+func (b *benchV2) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && isConnectionClosed(err) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *benchV2) Write(p []byte) (int, error) { return b.conn.output().Write(p) }
+
+func (b *benchV2) closeInput() error { return b.conn.send(controlMessage{Type: "eof"}) }
+
+// Close ends the session, rather than leaving it to be resumed
+func (b *benchV2) Close() error {
+	b.conn.send(controlMessage{Type: "close"})
+	return b.conn.Close()
+}
+
+// benchMuxSession is a session on a shared flyssh.v3 connection
+type benchMuxSession struct {
+	*MuxSession
+}
+
+func (b benchMuxSession) closeInput() error { return b.ch.send(controlMessage{Type: "eof"}) }
+
+// benchEchoes times rounds round trips of a byte through cat
+func benchEchoes(open func(string) (benchConn, error), rounds int) ([]time.Duration, error) {
+	conn, err := open(benchEcho)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rtts := make([]time.Duration, 0, rounds)
+	buf := make([]byte, 1)
+	for i := 0; i < rounds; i++ {
+		start := time.Now()
+		if _, err := conn.Write([]byte{'x'}); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	return rtts, nil
+}
+
+// benchUploadOnce times sending n bytes to a command that discards them,
+// until it has exited
+func benchUploadOnce(open func(string) (benchConn, error), n int64) (time.Duration, error) {
+	conn, err := open(benchUpload)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := io.CopyN(conn, zeros{}, n); err != nil {
+		return 0, err
+	}
+	if err := conn.closeInput(); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// benchDownloadOnce times receiving n bytes from a command
+func benchDownloadOnce(open func(string) (benchConn, error), n int64) (time.Duration, error) {
+	conn, err := open(fmt.Sprintf(benchDownload, n))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	got, err := io.Copy(io.Discard, conn)
+	if err != nil {
+		return 0, err
+	}
+	if got != n {
+		return 0, fmt.Errorf("received %d bytes, expected %d", got, n)
+	}
+	return time.Since(start), nil
+}
+
+// benchSessions times starting n sessions one after another, each
+// running to completion
+func benchSessions(open func(string) (benchConn, error), n int) (time.Duration, error) {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		conn, err := open(benchSession)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(io.Discard, conn)
+		conn.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+// zeros reads as endless zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// percentile returns the pth percentile of durations
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// benchServer starts a server for the benchmarks, returning a function
+// that opens sessions on it over each protocol
+func benchServer(b *testing.B) map[string]func(string) (benchConn, error) {
+	if runtime.GOOS == "windows" {
+		b.Skip("the benchmarks' commands need a POSIX shell")
+	}
+	out := log.Info.Writer()
+	log.Info.SetOutput(io.Discard)
+	b.Cleanup(func() { log.Info.SetOutput(out) })
+
+	s := NewServer(0)
+	s.SetAuthToken("bench-token")
+	ts := httptest.NewServer(s.Handler())
+	b.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	openers := make(map[string]func(string) (benchConn, error))
+	for _, p := range []string{ProtocolV2, ProtocolV3} {
+		open, closeAll, err := benchOpener(context.Background(), url, "bench-token", p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(closeAll)
+		openers[p] = open
+	}
+	return openers
+}
+
+func BenchmarkEcho(b *testing.B) {
+	for p, open := range benchServer(b) {
+		b.Run(p, func(b *testing.B) {
+			rtts, err := benchEchoes(open, b.N)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(percentile(rtts, 99).Microseconds()), "p99-µs")
+		})
+	}
+}
+
+func BenchmarkUpload(b *testing.B) {
+	const size = 16 << 20
+	for p, open := range benchServer(b) {
+		b.Run(p, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := benchUploadOnce(open, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	const size = 16 << 20
+	for p, open := range benchServer(b) {
+		b.Run(p, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := benchDownloadOnce(open, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSessionStart(b *testing.B) {
+	for p, open := range benchServer(b) {
+		b.Run(p, func(b *testing.B) {
+			if _, err := benchSessions(open, b.N); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i > 0; i-- {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	if got := percentile(ds, 50); got != 50*time.Millisecond {
+		t.Errorf("percentile(50) = %v, want 50ms", got)
+	}
+	if got := percentile(ds, 99); got != 99*time.Millisecond {
+		t.Errorf("percentile(99) = %v, want 99ms", got)
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of nothing = %v, want 0", got)
+	}
+}
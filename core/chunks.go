@@ -0,0 +1,118 @@
+package core
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sizes of the chunks output is relayed in. Each chunk is a frame, so small
+// ones get the first bytes of a burst to the client sooner, and large ones
+// spend less on framing and per-write overhead.
+const (
+	minChunk     = 4 << 10
+	maxChunk     = 64 << 10
+	defaultChunk = 32 << 10 // until the link has been measured, as io.Copy
+)
+
+// Below this many bytes per second a link is slow, whatever its round
+// trip time, and gets the largest chunks
+const slowLink = 1 << 20
+
+// linkStats measures a connection to the client: its round trip time from
+// keepalive pings, and its throughput from output sent back to back. It
+// sizes the chunks output is relayed in, small on fast nearby links and
+// large on distant or slow ones. A nil linkStats measures nothing.
+type linkStats struct {
+	rtt        atomic.Int64 // smoothed round trip time in nanoseconds, 0 until measured
+	throughput atomic.Int64 // smoothed bytes per second of bulk output, 0 until measured
+
+	// bulk is set for output that isn't a terminal's, such as a command
+	// streaming an archive, which always gets the largest chunks: there's
+	// no one watching for its first bytes, and fewer frames cost less
+	bulk bool
+}
+
+// smooth folds a sample into a moving average, weighting it 1/4
+func smooth(avg *atomic.Int64, sample int64) {
+	if old := avg.Load(); old != 0 {
+		sample = old + (sample-old)/4
+	}
+	avg.Store(sample)
+}
+
+// addRTT records a round trip time
+func (l *linkStats) addRTT(d time.Duration) {
+	if l != nil && d > 0 {
+		smooth(&l.rtt, int64(d))
+	}
+}
+
+// addWrite records how long a full chunk of output took to send. Writes
+// block once the network's buffers fill, so back to back chunks are sent
+// at about the link's throughput.
+func (l *linkStats) addWrite(n int, d time.Duration) {
+	if l != nil && d > 0 {
+		smooth(&l.throughput, int64(float64(n)/d.Seconds()))
+	}
+}
+
+// reset forgets the measurements, when the client reconnects
+func (l *linkStats) reset() {
+	if l != nil {
+		l.rtt.Store(0)
+		l.throughput.Store(0)
+	}
+}
+
+// chunkSize returns how much output to send at once: minChunk on links
+// with a round trip of 2ms or less, doubling as the round trip doubles, up
+// to maxChunk, which slow links and bulk output always get
+func (l *linkStats) chunkSize() int {
+	if l != nil && l.bulk {
+		return maxChunk
+	}
+	if l == nil || l.rtt.Load() == 0 {
+		return defaultChunk
+	}
+	if tp := l.throughput.Load(); tp != 0 && tp < slowLink {
+		return maxChunk
+	}
+	size := minChunk
+	for rtt := time.Duration(l.rtt.Load()); rtt > 2*time.Millisecond && size < maxChunk; rtt /= 2 {
+		size *= 2
+	}
+	return size
+}
+
+// chunkBuffers holds copyChunks' buffers, reused from session to session
+// rather than allocated for each
+var chunkBuffers = sync.Pool{New: func() any { return new([maxChunk]byte) }}
+
+// copyChunks copies src to dst like io.Copy, in chunks sized to link
+func copyChunks(dst io.Writer, src io.Reader, link *linkStats) error {
+	pooled := chunkBuffers.Get().(*[maxChunk]byte)
+	defer chunkBuffers.Put(pooled)
+	buf := pooled[:]
+	for {
+		size := link.chunkSize()
+		n, err := src.Read(buf[:size])
+		if n > 0 {
+			start := time.Now()
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			// Only a full chunk means more output was waiting
+			if n == size {
+				link.addWrite(n, time.Since(start))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
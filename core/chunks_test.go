@@ -0,0 +1,95 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkSize(t *testing.T) {
+	var unmeasured *linkStats
+	if got := unmeasured.chunkSize(); got != defaultChunk {
+		t.Errorf("Expected unmeasured links to get %d, got %d", defaultChunk, got)
+	}
+
+	for _, tt := range []struct {
+		rtt  time.Duration
+		want int
+	}{
+		{500 * time.Microsecond, minChunk},
+		{2 * time.Millisecond, minChunk},
+		{5 * time.Millisecond, 16 << 10},
+		{20 * time.Millisecond, maxChunk},
+		{300 * time.Millisecond, maxChunk},
+	} {
+		link := &linkStats{}
+		link.addRTT(tt.rtt)
+		if got := link.chunkSize(); got != tt.want {
+			t.Errorf("chunkSize() with a %v round trip = %d, want %d", tt.rtt, got, tt.want)
+		}
+	}
+
+	// A slow link gets the largest chunks, however near
+	link := &linkStats{}
+	link.addRTT(time.Millisecond)
+	link.addWrite(minChunk, 100*time.Millisecond)
+	if got := link.chunkSize(); got != maxChunk {
+		t.Errorf("Expected a slow link to get %d, got %d", maxChunk, got)
+	}
+	link.reset()
+	if got := link.chunkSize(); got != defaultChunk {
+		t.Errorf("Expected a reset link to get %d, got %d", defaultChunk, got)
+	}
+
+	// Bulk output gets the largest chunks, however near
+	bulk := &linkStats{bulk: true}
+	bulk.addRTT(time.Millisecond)
+	if got := bulk.chunkSize(); got != maxChunk {
+		t.Errorf("Expected bulk output to get %d, got %d", maxChunk, got)
+	}
+}
+
+// chunkRecorder records the size of each write
+type chunkRecorder struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.Buffer.Write(p)
+}
+
+func TestCopyChunks(t *testing.T) {
+	data := strings.Repeat("x", 20<<10)
+	link := &linkStats{}
+	link.addRTT(time.Millisecond)
+
+	var out chunkRecorder
+	if err := copyChunks(&out, strings.NewReader(data), link); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != data {
+		t.Fatalf("Copied %d bytes, want %d", out.Len(), len(data))
+	}
+	for _, n := range out.sizes {
+		if n > minChunk {
+			t.Fatalf("Expected chunks of at most %d on a nearby link, got %v", minChunk, out.sizes)
+		}
+	}
+}
+
+func BenchmarkCopyChunks(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	link := &linkStats{}
+	link.addRTT(20 * time.Millisecond)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := copyChunks(io.Discard, bytes.NewReader(data), link); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
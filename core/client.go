@@ -1,9 +1,22 @@
 package core
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"os/user"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"flyssh/core/log"
 
@@ -15,18 +28,61 @@ import (
 type Client struct {
 	url       string
 	authToken string
+	user      string
+	launcher  string
+	command   string
+	login     string
+	dir       string
+	shell     string
+	dotfiles  []string // encoded for sending
+	sendEnv   []string
+	term      string // overrides $TERM for the session
+	agent     bool
+	x11       []byte // made-up cookie for forwarding the X display, if enabled
 	stdin     io.Reader
 	stdout    io.Writer
+	stderr    io.Writer
 	sessionID string
+
+	reconnectTimeout time.Duration
+	keepalive        time.Duration
+	resumeID         string
+	observeID        string
+	termFd           int  // -1 unless stdin is a terminal
+	noPTY            bool // command input is piped, not typed
+	forceNoPTY       bool // run the command without a PTY even when typed
+	controlPath      string
+	master           *controlMaster // set when this client serves controlPath
+	hostKeys         hostKeyVerifier
+	escapeChar       byte   // starts escape commands typed at a terminal; 0 disables them
+	recordPath       string // asciicast file the session's output is recorded to
+	recorder         *recorder
+	transcriptPath   string // plain text transcript the session's output is appended to
+	transcript       *transcript
+
+	ctx        context.Context // ends dials and the session
+	mu         sync.Mutex
+	conn       transport // current connection
+	redirected bool      // moved to a replacement server
+	cancelled  bool      // ctx is done
+	bookmarks  int       // made so far
 }
 
-// NewClient creates a new terminal client
-func NewClient(url string, authToken string) *Client {
+// NewClient creates a new terminal client, whose session ends once ctx is
+// done
+func NewClient(ctx context.Context, url string, authToken string) *Client {
 	return &Client{
-		url:       url,
-		authToken: authToken,
-		stdin:     os.Stdin,
-		stdout:    os.Stdout,
+		url:        url,
+		authToken:  authToken,
+		user:       currentUser(),
+		stdin:      os.Stdin,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		termFd:     -1,
+		keepalive:  DefaultKeepalive,
+		escapeChar: DefaultEscapeChar,
+		ctx:        ctx,
+		hostKeys:   hostKeyVerifier{check: HostKeyAsk},
 	}
 }
 
@@ -36,63 +92,804 @@ func (c *Client) SetIO(stdin io.Reader, stdout io.Writer) {
 	c.stdout = stdout
 }
 
-// Connect connects to a WebSocket server and starts the terminal session
+// SetStderr sets where the errors of commands run without a PTY go
+func (c *Client) SetStderr(stderr io.Writer) {
+	c.stderr = stderr
+}
+
+// SetReconnect makes the client reconnect and resume its session when the
+// connection drops, retrying with backoff for up to timeout. Zero disables
+// reconnecting.
+func (c *Client) SetReconnect(timeout time.Duration) {
+	c.reconnectTimeout = timeout
+}
+
+// SetKeepalive pings the server every interval and treats the connection
+// as lost when the server stops answering. Zero disables pinging.
+func (c *Client) SetKeepalive(interval time.Duration) {
+	c.keepalive = interval
+}
+
+// SetResume attaches to an existing detached session instead of starting
+// a new one. The session's scrollback is replayed first.
+func (c *Client) SetResume(sessionID string) {
+	c.resumeID = sessionID
+}
+
+// SetObserve watches another user's dual-control session instead of
+// starting one. Input is ignored except q or ^C, which stop watching.
+func (c *Client) SetObserve(sessionID string) {
+	c.observeID = sessionID
+}
+
+// SetControlPath shares one server connection between clients using the
+// same control socket. The first client serves the socket and keeps the
+// connection until every session using it has ended; later clients run
+// their sessions over it instead of dialing the server.
+func (c *Client) SetControlPath(path string) {
+	c.controlPath = path
+}
+
+// SetLauncher requests a named server-side launcher instead of a shell
+func (c *Client) SetLauncher(name string) {
+	c.launcher = name
+}
+
+// SetCommand runs command through the remote shell instead of starting an
+// interactive shell. Connect returns once it exits.
+func (c *Client) SetCommand(command string) {
+	c.command = command
+}
+
+// SetNoPTY runs the command without a PTY even when its input is a
+// terminal, like ssh -T, so its input and output pass through unaltered
+func (c *Client) SetNoPTY(noPTY bool) {
+	c.forceNoPTY = noPTY
+}
+
+// SetLogin starts the session as the named account on the server, which
+// must be running as root to switch users
+func (c *Client) SetLogin(name string) {
+	c.login = name
+}
+
+// SetDir starts the session in dir on the server. Relative paths are
+// taken from the session's home directory.
+func (c *Client) SetDir(dir string) {
+	c.dir = dir
+}
+
+// SetShell asks for the session's shell, or command, to run in the named
+// shell, one of those the server's platform has
+func (c *Client) SetShell(name string) {
+	c.shell = name
+}
+
+// SetDotfiles brings local dotfiles, such as .inputrc, .vimrc and .shrc,
+// to the session, whose shell and editor use them. They're removed when
+// the session ends.
+func (c *Client) SetDotfiles(paths []string) error {
+	dotfiles, err := encodeDotfiles(paths)
+	if err != nil {
+		return err
+	}
+	c.dotfiles = dotfiles
+	return nil
+}
+
+// SetSendEnv passes the local environment variables matching patterns to
+// the session, by name with * and ? wildcards. The server only sets those
+// it accepts.
+func (c *Client) SetSendEnv(patterns []string) {
+	c.sendEnv = patterns
+}
+
+// SetTerm gives the session the terminal type term instead of the local
+// $TERM, for terminals the server knows by another name
+func (c *Client) SetTerm(term string) {
+	c.term = term
+}
+
+// sessionEnv returns the variables to pass to the session
+func (c *Client) sessionEnv() []string {
+	env := collectEnv(c.sendEnv)
+	if c.term != "" {
+		env = setEnv(env, "TERM="+c.term)
+	}
+	return env
+}
+
+// SetForwardAgent lets the session use the local SSH agent named by
+// SSH_AUTH_SOCK, as ssh -A does, if the server allows it
+func (c *Client) SetForwardAgent(forward bool) {
+	c.agent = forward
+}
+
+// SetForwardX11 lets programs in the session open windows on the local X
+// display named by DISPLAY, as ssh -X does, if the server allows it
+func (c *Client) SetForwardX11(forward bool) {
+	c.x11 = nil
+	if forward && os.Getenv("DISPLAY") == "" {
+		log.Info.Printf("X11 forwarding requested but DISPLAY is not set")
+		return
+	}
+	if forward {
+		c.x11 = make([]byte, 16)
+		rand.Read(c.x11)
+	}
+}
+
+// SetEscapeChar sets the character that starts escape commands, typed at
+// the start of a line at a terminal, as in ssh. It's ~ by default; 0 turns
+// escape commands off.
+func (c *Client) SetEscapeChar(ch byte) {
+	c.escapeChar = ch
+}
+
+// SetRecording records the session's output, as shown in the terminal, to
+// an asciicast file, which bookmarks are marked in
+func (c *Client) SetRecording(path string) {
+	c.recordPath = path
+}
+
+// SetTranscript appends the session's output, as plain text with each line
+// timestamped, to a transcript file, for searching later
+func (c *Client) SetTranscript(path string) {
+	c.transcriptPath = path
+}
+
+// SetHostKeyCheck sets how a wss:// server whose key isn't known yet is
+// treated. The default asks on the terminal.
+func (c *Client) SetHostKeyCheck(check HostKeyCheck) {
+	c.hostKeys.check = check
+}
+
+// ExitError is returned by Connect when the remote shell or command exits
+// with a non-zero status. Commands killed by a signal report 128 plus the
+// signal number, as shells do, and the signal's name as in SSH, such as
+// KILL.
+type ExitError struct {
+	Code       int
+	Signal     string // empty unless a signal killed the command
+	CoreDumped bool
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal == "" {
+		return fmt.Sprintf("remote command exited with status %d", e.Code)
+	}
+	if e.CoreDumped {
+		return fmt.Sprintf("remote command killed by signal %s (core dumped)", e.Signal)
+	}
+	return fmt.Sprintf("remote command killed by signal %s", e.Signal)
+}
+
+// errSessionRejected is returned when the server refuses a session, which
+// retrying won't fix
+var errSessionRejected = errors.New("server rejected session")
+
+// maxRedirects bounds how many servers a dial follows to a replacement
+const maxRedirects = 3
+
+// rejectedError carries the reason the server gave for refusing a session,
+// and the server to try instead if it's being replaced
+type rejectedError struct {
+	reason   string
+	redirect string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("%v: %s", errSessionRejected, e.reason)
+}
+
+func (e *rejectedError) Unwrap() error { return errSessionRejected }
+
+// Connect connects to a WebSocket server and runs the terminal session.
+// Once the client's context is done, it gives up connecting, ends the
+// session's connection and doesn't reconnect, returning the context's
+// error.
 func (c *Client) Connect() error {
+	stop := context.AfterFunc(c.ctx, c.cancel)
+	defer stop()
+	err := c.connect()
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return err
+}
+
+// connect runs the session for Connect
+func (c *Client) connect() error {
+	if c.controlPath != "" && c.observeID == "" {
+		master, err := listenControl(c.ctx, c.controlPath, c.url, c.authToken)
+		switch {
+		case err == nil:
+			c.master = master
+			defer c.closeControl()
+		case err != errControlInUse:
+			log.Info.Printf("Not sharing connection: %v", err)
+		}
+	}
+
+	// A command fed from a pipe or file runs without a PTY, so its input
+	// arrives unaltered and can end
+	c.noPTY = c.command != "" && (c.forceNoPTY || !isTerminal(c.stdin))
+
+	// A server with a new key can only be asked about before the session
+	// takes over the terminal
+	if isTerminal(c.stdin) {
+		c.hostKeys.ask = func(name, fingerprint, previous string, verifyErr error) (bool, bool) {
+			return promptHostKey(c.stdin, c.stderr, name, fingerprint, previous, verifyErr), true
+		}
+	}
+	conn, err := c.dial(c.resumeID, c.resumeID != "")
+	c.hostKeys.ask = nil
+	if err != nil {
+		return err
+	}
+	defer func() { c.current().Close() }()
+
+	// Put terminal in raw mode if it's a real terminal
+	restore, err := MakeRaw(c.stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	// A full screen program that dies, or whose connection does, mustn't
+	// leave the terminal in its modes
+	if f, ok := c.stdout.(*os.File); ok && !c.noPTY && term.IsTerminal(int(f.Fd())) {
+		screen := newScreenTracker(c.stdout)
+		c.stdout = screen
+		defer rawTerminals.add(screen.reset)()
+	}
+
+	// Window size changes need a control channel
+	if isTerminal(c.stdin) && conn.hasControl() {
+		c.termFd = int(c.stdin.(*os.File).Fd())
+		c.setupWindowResize(c.termFd)
+	}
+
+	if c.recordPath != "" {
+		if err := c.startRecording(); err != nil {
+			return err
+		}
+		defer c.recorder.Close()
+	}
+	if c.transcriptPath != "" {
+		if err := c.startTranscript(); err != nil {
+			return err
+		}
+		defer c.transcript.Close()
+	}
+
+	// Stdin is read for the whole session, across reconnects. Escape
+	// commands are only for people typing into a session.
+	input := c.stdin
+	if c.escapeChar != 0 && isTerminal(c.stdin) && !c.noPTY && c.observeID == "" {
+		input = newEscapeReader(input, c.escapeChar, c.escapeCommands())
+	}
+	stdin := newInputPump(input)
+
+	for {
+		ended, err := c.relay(conn, stdin)
+		if ended || c.reconnectTimeout <= 0 || !conn.hasControl() || c.isCancelled() || c.observeID != "" {
+			return err
+		}
+
+		c.status("connection lost, reconnecting...")
+		conn, err = c.reconnect()
+		if err != nil {
+			return fmt.Errorf("connection lost: %v", err)
+		}
+		c.status("reconnected")
+		c.sendCurrentSize()
+	}
+}
+
+// cancel closes the connection and stops the client making new ones
+func (c *Client) cancel() {
+	c.mu.Lock()
+	c.cancelled = true
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// isCancelled reports whether the client's context is done
+func (c *Client) isCancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled
+}
+
+// dial connects to the server and waits for the session to start. A
+// non-empty resume ID reattaches to that session instead of starting one,
+// and replay asks for its scrollback rather than just missed output. A
+// server being replaced sends the client on to its replacement.
+func (c *Client) dial(resume string, replay bool) (transport, error) {
+	if c.master != nil {
+		return c.dialShared(resume)
+	}
+	for hops := 0; ; hops++ {
+		conn, err := c.dialServer(resume, replay)
+		var rejected *rejectedError
+		if hops < maxRedirects && errors.As(err, &rejected) && rejected.redirect != "" {
+			log.Debug.Printf("Redirected to %s: %s", rejected.redirect, rejected.reason)
+			c.redirect(rejected.redirect)
+			continue
+		}
+		return conn, err
+	}
+}
+
+// dialServer makes one attempt at dial
+func (c *Client) dialServer(resume string, replay bool) (transport, error) {
 	// Connect to WebSocket server
 	origin := "http://localhost"
-	url := fmt.Sprintf("%s?token=%s", c.url, c.authToken)
-	ws, err := websocket.Dial(url, "", origin)
+	dialURL := fmt.Sprintf("%s?token=%s&user=%s", c.serverURL(), c.authToken, url.QueryEscape(c.user))
+	if c.launcher != "" {
+		dialURL += "&launch=" + url.QueryEscape(c.launcher)
+	}
+	if c.command != "" {
+		dialURL += "&exec=" + url.QueryEscape(c.command)
+	}
+	if c.login != "" {
+		dialURL += "&login=" + url.QueryEscape(c.login)
+	}
+	if c.dir != "" {
+		dialURL += "&dir=" + url.QueryEscape(c.dir)
+	}
+	if c.shell != "" {
+		dialURL += "&shell=" + url.QueryEscape(c.shell)
+	}
+	for _, file := range c.dotfiles {
+		dialURL += "&dotfile=" + url.QueryEscape(file)
+	}
+	if c.noPTY {
+		// Errors come separately, so output stays exactly as written
+		dialURL += "&pty=0&stderr=1"
+	}
+	for _, kv := range c.sessionEnv() {
+		dialURL += "&env=" + url.QueryEscape(kv)
+	}
+	if c.agent {
+		dialURL += "&agent=1"
+	}
+	if c.x11 != nil {
+		dialURL += "&x11=" + url.QueryEscape(x11AuthProto+":"+hex.EncodeToString(c.x11))
+	}
+	if resume != "" {
+		dialURL += "&resume=" + url.QueryEscape(resume)
+	}
+	if replay {
+		dialURL += "&replay=1"
+	}
+	if c.observeID != "" {
+		dialURL += "&observe=" + url.QueryEscape(c.observeID)
+	}
+	config, err := websocket.NewConfig(dialURL, origin)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
+		return nil, fmt.Errorf("invalid server URL: %v", err)
+	}
+	// Offer the framed protocol first; servers that predate subprotocol
+	// negotiation ignore the header and speak v1
+	config.Protocol = []string{ProtocolV2, ProtocolV1}
+	if config.TlsConfig, err = c.hostKeys.tlsConfig(c.serverURL()); err != nil {
+		return nil, err
+	}
+	var ws *websocket.Conn
+	if c.controlPath != "" {
+		if ws, err = dialControl(c.controlPath, config); err != nil {
+			log.Debug.Printf("Control socket unavailable, dialing server: %v", err)
+		}
+	}
+	if ws == nil {
+		if ws, err = config.DialContext(c.ctx); err != nil {
+			return nil, fmt.Errorf("failed to connect to server: %v", err)
+		}
 	}
-	defer ws.Close()
 
-	log.Debug.Printf("Connected to server at %s", ws.RemoteAddr())
+	conn := newTransport(ws)
+	log.Debug.Printf("Connected to server at %s (%s)", ws.RemoteAddr(), conn.protocol())
 
-	// Wait for session ID
-	var msg struct {
-		Type      string `json:"type"`
-		SessionID string `json:"session_id"`
+	// Wait for session ID, which may need the user's security key or
+	// someone watching first
+	msg, err := conn.receive()
+	for err == nil && (msg.Type == "step_up" || msg.Type == "notice") {
+		c.stepUp(msg)
+		msg, err = conn.receive()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to receive session ID: %v", err)
 	}
-	if err := websocket.JSON.Receive(ws, &msg); err != nil {
-		return fmt.Errorf("failed to receive session ID: %v", err)
+	if msg.Type == "error" {
+		conn.Close()
+		return nil, &rejectedError{reason: msg.Message, redirect: msg.URL}
 	}
 	if msg.Type != "session" {
-		return fmt.Errorf("expected session message, got %s", msg.Type)
+		conn.Close()
+		return nil, fmt.Errorf("expected session message, got %s", msg.Type)
 	}
 	c.sessionID = msg.SessionID
 
 	log.Debug.Printf("Session established %s with %s", c.sessionID, ws.RemoteAddr())
+	c.setCurrent(conn)
+	return conn, nil
+}
 
-	// Put terminal in raw mode if it's a real terminal
-	if f, ok := c.stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
-		oldState, err := term.MakeRaw(int(f.Fd()))
-		if err != nil {
-			return fmt.Errorf("failed to set up terminal: %v", err)
+// dialShared starts or resumes the session on the connection this client
+// shares through its control socket
+func (c *Client) dialShared(resume string) (transport, error) {
+	conn, id, err := c.master.open(c.stepUp, controlMessage{
+		Type:      "open",
+		Launcher:  c.launcher,
+		Command:   c.command,
+		Login:     c.login,
+		Dir:       c.dir,
+		Shell:     c.shell,
+		SessionID: resume,
+		NoPTY:     c.noPTY,
+		Env:       c.sessionEnv(),
+		Dotfiles:  c.dotfiles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.sessionID = id
+	log.Debug.Printf("Session established %s on shared connection", c.sessionID)
+	c.setCurrent(conn)
+	return conn, nil
+}
+
+// closeControl stops sharing the connection once the sessions using it
+// have ended
+func (c *Client) closeControl() {
+	if n := c.master.active(); n > 0 {
+		c.status(fmt.Sprintf("waiting for %d shared session(s) to end", n))
+	}
+	c.master.close()
+}
+
+// relay forwards data over conn until it closes. It reports whether the
+// session ended, as opposed to the connection dropping.
+func (c *Client) relay(conn transport, stdin *inputPump) (bool, error) {
+	var exited atomic.Bool
+	var exitErr atomic.Pointer[ExitError] // set for a non-zero exit code
+
+	// A server that stops answering pings is treated as a dropped
+	// connection. Its answers measure the link, to size input chunks.
+	link := &linkStats{}
+	ka := startKeepalive(conn, c.keepalive, link)
+	defer ka.Stop()
+
+	// Forwarded connections last as long as the connection they're
+	// relayed over
+	forwards := c.forwards(conn)
+	defer func() {
+		for _, relay := range forwards {
+			relay.closeAll()
 		}
-		defer term.Restore(int(f.Fd()), oldState)
+	}()
+
+	// Without a PTY the server has no ^C to turn into SIGINT, so the
+	// client's own interrupts are passed on to the command
+	if c.noPTY && conn.hasControl() {
+		stop := forwardInterrupts(conn)
+		defer stop()
 	}
 
-	// Forward data in both directions
-	errc := make(chan error, 1)
+	// Server notices are shown inline in the terminal
+	onControl := func(msg controlMessage) {
+		if ka.control(msg) {
+			return
+		}
+		for _, relay := range forwards {
+			if relay.handle(msg) {
+				return
+			}
+		}
+		switch msg.Type {
+		case "notice":
+			c.status(msg.Message)
+		case "stderr":
+			c.stderr.Write(msg.Data)
+		case "redirect":
+			// Takes effect when the connection drops
+			c.redirect(msg.URL)
+		case "exit":
+			if msg.ExitCode != nil && *msg.ExitCode != 0 {
+				exitErr.Store(&ExitError{Code: *msg.ExitCode, Signal: msg.Signal, CoreDumped: msg.Core})
+			}
+			exited.Store(true)
+		}
+	}
 
-	// stdin -> WebSocket
-	go func(ws *websocket.Conn, stdin io.Reader) {
-		_, err := io.Copy(ws, stdin)
-		errc <- err
-	}(ws, c.stdin)
+	// A command runs to completion after stdin ends so its exit code can
+	// be collected, while an interactive session ends with its input
+	leaving := func() bool {
+		return stdin.ended() && c.command == ""
+	}
 
-	// WebSocket -> stdout
-	go func(stdout io.Writer, ws *websocket.Conn) {
-		_, err := io.Copy(stdout, ws)
-		errc <- err
-	}(c.stdout, ws)
+	// A command's input ending doesn't end the session. Without a PTY the
+	// server passes the end on, so the command sees EOF.
+	var onEnd func()
+	if c.command != "" {
+		onEnd = func() {
+			if !c.noPTY || !conn.hasControl() {
+				return
+			}
+			if err := conn.send(controlMessage{Type: "eof"}); err != nil {
+				log.Debug.Printf("Failed to send eof: %v", err)
+			}
+		}
+	}
+
+	// Forward data in both directions. Finishing either direction closes
+	// the connection, which ends the other. When stdin ends the server is
+	// told the client is leaving, so it doesn't keep the session around.
+	stop := make(chan struct{})
+	relay := newRelayGroup(func() {
+		close(stop)
+		if leaving() && conn.hasControl() {
+			if err := conn.send(controlMessage{Type: "close"}); err != nil {
+				log.Debug.Printf("Failed to send close: %v", err)
+			}
+		}
+		conn.Close()
+	})
+	relay.copyChunks(conn.output(), stdin.reader(stop, onEnd), link) // stdin -> WebSocket
+	relay.copy(c.stdout, ka.reader(conn.input(onControl)))           // WebSocket -> stdout
 
 	// Wait for either direction to finish
-	if err := <-errc; err != nil && err != io.EOF {
-		log.Debug.Printf("IO error %s with %s: %v", c.sessionID, ws.RemoteAddr(), err)
-		return fmt.Errorf("IO error: %v", err)
+	err := relay.wait()
+	relay.drain(5*time.Second, c.sessionID)
+	if exited.Load() || leaving() {
+		log.Debug.Printf("Connection closed %s", c.sessionID)
+		if err := exitErr.Load(); err != nil {
+			return true, err
+		}
+		return true, nil
+	}
+	if err != nil && err != io.EOF && !isConnectionClosed(err) {
+		log.Debug.Printf("IO error %s: %v", c.sessionID, err)
+		return false, fmt.Errorf("IO error: %v", err)
 	}
-	log.Debug.Printf("Connection closed %s with %s", c.sessionID, ws.RemoteAddr())
+	log.Debug.Printf("Connection lost %s", c.sessionID)
+	return false, nil
+}
+
+// forwardInterrupts sends the command an INT signal whenever the client is
+// interrupted, as by ^C typed at its terminal, until stopped
+func forwardInterrupts(conn transport) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				if err := conn.send(controlMessage{Type: "signal", Signal: "INT"}); err != nil {
+					log.Debug.Printf("Failed to send signal: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// forwards returns relays for the local services forwarded over conn
+func (c *Client) forwards(conn transport) []*forwardRelay {
+	var relays []*forwardRelay
+	if c.agent {
+		relays = append(relays, newForwardRelay("agent", conn.send, dialAgent))
+	}
+	if c.x11 != nil {
+		display := os.Getenv("DISPLAY")
+		relays = append(relays, newForwardRelay("x11", conn.send, func() (net.Conn, error) {
+			local, err := dialX11(display)
+			if err != nil {
+				return nil, err
+			}
+			proto, cookie := localX11Auth(display)
+			return &x11AuthConn{Conn: local, fake: c.x11, proto: proto, cookie: cookie}, nil
+		}))
+	}
+	return relays
+}
+
+// startRecording starts recording output to the client's recording file
+func (c *Client) startRecording() error {
+	width, height := 0, 0
+	if c.termFd >= 0 {
+		width, height, _ = term.GetSize(c.termFd)
+	}
+	sess := &Session{ID: c.sessionID, User: c.user, RemoteAddr: c.serverURL(), StartTime: time.Now(), Command: c.command}
+	rec, err := newRecorder(c.recordPath, width, height, sess, c.sessionEnv())
+	if err != nil {
+		return err
+	}
+	c.recorder = rec
+	c.stdout = io.MultiWriter(c.stdout, rec.output())
+	return nil
+}
+
+// startTranscript starts appending output to the client's transcript
+func (c *Client) startTranscript() error {
+	sess := &Session{ID: c.sessionID, RemoteAddr: c.serverURL(), StartTime: time.Now()}
+	t, err := newTranscript(c.transcriptPath, sess)
+	if err != nil {
+		return err
+	}
+	c.transcript = t
+	c.stdout = io.MultiWriter(c.stdout, t)
 	return nil
 }
+
+// status shows a message from flyssh itself. The output of a command
+// without a PTY may be data that it mustn't mix with, so its messages go
+// to stderr.
+func (c *Client) status(message string) {
+	w := c.stdout
+	if c.noPTY {
+		w = c.stderr
+	}
+	fmt.Fprintf(w, "\r\n[flyssh] %s\r\n", message)
+}
+
+// stepUp shows what a session is waiting for before it starts. A page
+// confirming it with a security key is opened in the user's browser if
+// possible.
+func (c *Client) stepUp(msg controlMessage) {
+	c.status(msg.Message)
+	if msg.Type != "step_up" {
+		return
+	}
+	if err := openBrowser(msg.URL); err != nil {
+		log.Debug.Printf("Failed to open browser: %v", err)
+	}
+}
+
+// serverURL returns the URL the client connects to
+func (c *Client) serverURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.url
+}
+
+// redirect makes the client connect to a replacement server from now on
+func (c *Client) redirect(serverURL string) {
+	if serverURL == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.url = serverURL
+	c.redirected = true
+}
+
+// currentUser returns the local username reported to the server
+func currentUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// isTerminal reports whether stdin is a real terminal
+func isTerminal(stdin io.Reader) bool {
+	f, ok := stdin.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// MakeRaw puts stdin into raw mode if it's a real terminal. The returned
+// function restores the previous state and is safe to call when stdin
+// isn't a terminal, and more than once. Until it's called, a panic caught
+// by RecoverTerminal, an exit through RestoreTerminal or a signal that
+// ends the program restores the terminal too.
+func MakeRaw(stdin io.Reader) (func(), error) {
+	if !isTerminal(stdin) {
+		return func() {}, nil
+	}
+	restore, err := makeRaw(stdin.(*os.File))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up terminal: %v", err)
+	}
+	return rawTerminals.add(restore), nil
+}
+
+// rawTerminals tracks the terminals in raw mode, so every way out of the
+// program can put them back
+var rawTerminals terminalRestores
+
+type terminalRestores struct {
+	mu       sync.Mutex
+	restores map[int]func()
+	nextID   int
+	watching bool
+}
+
+// add registers a terminal's restore function, returning one that runs it
+// once and forgets it
+func (t *terminalRestores) add(restore func()) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.restores == nil {
+		t.restores = make(map[int]func())
+	}
+	t.nextID++
+	id := t.nextID
+	var once sync.Once
+	t.restores[id] = func() { once.Do(restore) }
+	if !t.watching {
+		t.watching = true
+		go t.watchSignals()
+	}
+	return func() {
+		t.mu.Lock()
+		r := t.restores[id]
+		delete(t.restores, id)
+		t.mu.Unlock()
+		if r != nil {
+			r()
+		}
+	}
+}
+
+// restoreAll restores every terminal still in raw mode, reporting whether
+// there were any
+func (t *terminalRestores) restoreAll() bool {
+	t.mu.Lock()
+	restores := t.restores
+	t.restores = nil
+	t.mu.Unlock()
+	for _, r := range restores {
+		r()
+	}
+	return len(restores) > 0
+}
+
+// watchSignals restores the terminals before a termination signal ends
+// the program, exiting the way the signal would have
+func (t *terminalRestores) watchSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-sigs
+	t.restoreAll()
+	code := 1
+	if s, ok := sig.(syscall.Signal); ok {
+		code = 128 + int(s)
+	}
+	os.Exit(code)
+}
+
+// RestoreTerminal puts any terminal MakeRaw changed back the way it was.
+// Call it before exiting in a way that skips deferred calls, like os.Exit.
+func RestoreTerminal() {
+	rawTerminals.restoreAll()
+}
+
+// RecoverTerminal is deferred at the top of main and of goroutines that
+// can run while the terminal is raw. A panic that would leave the
+// terminal raw restores it first, then is reported the way Go would, where
+// it can be read. Other panics carry on unchanged.
+func RecoverTerminal() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if !rawTerminals.restoreAll() {
+		panic(r)
+	}
+	fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", r, debug.Stack())
+	os.Exit(2)
+}
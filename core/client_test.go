@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"strings"
 	"testing"
 )
@@ -9,7 +10,7 @@ import (
 func TestNewClient(t *testing.T) {
 	url := "ws://localhost:8080"
 	token := "test-token"
-	client := NewClient(url, token)
+	client := NewClient(context.Background(), url, token)
 
 	if client.url != url {
 		t.Errorf("Expected URL %s, got %s", url, client.url)
@@ -20,7 +21,7 @@ func TestNewClient(t *testing.T) {
 }
 
 func TestSetIO(t *testing.T) {
-	client := NewClient("ws://localhost:8080", "test-token")
+	client := NewClient(context.Background(), "ws://localhost:8080", "test-token")
 	stdin := strings.NewReader("test input")
 	stdout := &bytes.Buffer{}
 
@@ -33,3 +34,21 @@ func TestSetIO(t *testing.T) {
 		t.Error("stdout not set correctly")
 	}
 }
+
+func TestTerminalRestores(t *testing.T) {
+	var restores terminalRestores
+	restores.watching = true // no signal handling in tests
+	calls := 0
+	restore := restores.add(func() { calls++ })
+
+	if !restores.restoreAll() || calls != 1 {
+		t.Fatalf("Expected restoreAll to restore the terminal once, got %d calls", calls)
+	}
+	restore()
+	if calls != 1 {
+		t.Errorf("Expected an already restored terminal to be left alone, got %d calls", calls)
+	}
+	if restores.restoreAll() {
+		t.Error("Expected nothing left to restore")
+	}
+}
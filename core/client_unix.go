@@ -5,30 +5,54 @@ package core
 
 import (
 	"os"
+	"os/exec"
 	"os/signal"
+	"runtime"
 	"syscall"
 
-	"golang.org/x/net/websocket"
 	"golang.org/x/term"
 )
 
+// makeRaw puts a terminal into raw mode, returning a function that
+// restores it
+func makeRaw(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() { term.Restore(fd, oldState) }, nil
+}
+
 // setupWindowResize sets up window resize handling for Unix systems
-func (c *Client) setupWindowResize(ws *websocket.Conn, fd int) {
+func (c *Client) setupWindowResize(fd int) {
 	// Handle window resize
 	sigwinch := make(chan os.Signal, 1)
 	signal.Notify(sigwinch, syscall.SIGWINCH)
 	go func() {
+		defer RecoverTerminal()
 		for range sigwinch {
-			if width, height, err := term.GetSize(fd); err == nil {
-				if err := sendWindowSize(ws, width, height); err != nil {
-					return
-				}
-			}
+			c.sendCurrentSize()
 		}
 	}()
 
 	// Send initial window size
-	if width, height, err := term.GetSize(fd); err == nil {
-		sendWindowSize(ws, width, height)
+	c.sendCurrentSize()
+}
+
+// openBrowser opens url with $BROWSER, or the desktop's default browser
+func openBrowser(url string) error {
+	browser := os.Getenv("BROWSER")
+	if browser == "" {
+		browser = "xdg-open"
+		if runtime.GOOS == "darwin" {
+			browser = "open"
+		}
+	}
+	cmd := exec.Command(browser, url)
+	if err := cmd.Start(); err != nil {
+		return err
 	}
+	go cmd.Wait()
+	return nil
 }
@@ -4,14 +4,74 @@
 package core
 
 import (
+	"os"
+	"os/exec"
 	"time"
 
-	"golang.org/x/net/websocket"
+	"flyssh/core/log"
+
+	"golang.org/x/sys/windows"
 	"golang.org/x/term"
 )
 
+// utf8CodePage is the console code page for UTF-8
+const utf8CodePage = 65001
+
+// makeRaw sets the console up for a remote terminal: keys arrive
+// unprocessed, as VT sequences where the console supports them, output is
+// interpreted as VT sequences, and both directions use UTF-8. Legacy
+// consoles that refuse VT modes get as close as they allow. The returned
+// function puts every setting back.
+func makeRaw(f *os.File) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+
+	in := windows.Handle(f.Fd())
+	var inMode uint32
+	if err := windows.GetConsoleMode(in, &inMode); err != nil {
+		return nil, err
+	}
+	raw := inMode &^ (windows.ENABLE_ECHO_INPUT | windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_LINE_INPUT)
+	if err := windows.SetConsoleMode(in, raw|windows.ENABLE_VIRTUAL_TERMINAL_INPUT); err != nil {
+		log.Debug.Printf("Console doesn't support VT input: %v", err)
+		if err := windows.SetConsoleMode(in, raw); err != nil {
+			return nil, err
+		}
+	}
+	restores = append(restores, func() { windows.SetConsoleMode(in, inMode) })
+
+	out := windows.Handle(os.Stdout.Fd())
+	var outMode uint32
+	if windows.GetConsoleMode(out, &outMode) == nil {
+		vt := outMode | windows.ENABLE_PROCESSED_OUTPUT | windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING | windows.DISABLE_NEWLINE_AUTO_RETURN
+		if err := windows.SetConsoleMode(out, vt); err != nil {
+			log.Debug.Printf("Console doesn't support VT output: %v", err)
+		} else {
+			restores = append(restores, func() { windows.SetConsoleMode(out, outMode) })
+		}
+	}
+
+	if cp, err := windows.GetConsoleCP(); err == nil && cp != utf8CodePage && windows.SetConsoleCP(utf8CodePage) == nil {
+		restores = append(restores, func() { windows.SetConsoleCP(cp) })
+	}
+	if cp, err := windows.GetConsoleOutputCP(); err == nil && cp != utf8CodePage && windows.SetConsoleOutputCP(utf8CodePage) == nil {
+		restores = append(restores, func() { windows.SetConsoleOutputCP(cp) })
+	}
+	return restore, nil
+}
+
 // setupWindowResize sets up window resize handling for Windows systems
-func (c *Client) setupWindowResize(ws *websocket.Conn, fd int) {
+func (c *Client) setupWindowResize(fd int) {
+	// Only the output handle knows the window's size
+	if out := int(os.Stdout.Fd()); term.IsTerminal(out) {
+		fd = out
+		c.termFd = out
+	}
+
 	// Get initial size
 	lastWidth, lastHeight, err := term.GetSize(fd)
 	if err != nil {
@@ -19,12 +79,11 @@ func (c *Client) setupWindowResize(ws *websocket.Conn, fd int) {
 	}
 
 	// Send initial window size
-	if err := sendWindowSize(ws, lastWidth, lastHeight); err != nil {
-		return
-	}
+	c.sendWindowSize(lastWidth, lastHeight)
 
 	// Start a goroutine to handle window resizing
-	go func(ws *websocket.Conn, fd int) {
+	go func(fd int) {
+		defer RecoverTerminal()
 		ticker := time.NewTicker(time.Second)
 		defer ticker.Stop()
 
@@ -34,9 +93,20 @@ func (c *Client) setupWindowResize(ws *websocket.Conn, fd int) {
 				return
 			}
 
-			if err := sendWindowSize(ws, width, height); err != nil {
-				return
+			if width != lastWidth || height != lastHeight {
+				c.sendWindowSize(width, height)
+				lastWidth, lastHeight = width, height
 			}
 		}
-	}(ws, fd)
+	}(fd)
+}
+
+// openBrowser opens url in the default browser
+func openBrowser(url string) error {
+	cmd := exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
 }
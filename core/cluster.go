@@ -0,0 +1,268 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+
+	"golang.org/x/net/websocket"
+)
+
+// clusterHeartbeat is how often an instance rewrites its state even when
+// nothing changed. Instances silent for clusterExpiry are presumed gone.
+const (
+	clusterHeartbeat = 15 * time.Second
+	clusterExpiry    = 3 * clusterHeartbeat
+)
+
+// clusterState is what one instance publishes about itself
+type clusterState struct {
+	Instance string    `json:"instance"`
+	Address  string    `json:"address,omitempty"` // WebSocket URL other instances proxy to
+	Updated  time.Time `json:"updated"`
+	Sessions []string  `json:"sessions"`
+}
+
+// Cluster lets several server instances behind one load balancer find
+// each other's sessions. Every instance writes the sessions it holds to a
+// directory they all share, such as a LiteFS or NFS mount, and requests to
+// resume a session held elsewhere are routed to the instance holding it.
+type Cluster struct {
+	dir      string
+	instance string
+	address  string
+	now      func() time.Time
+
+	done chan struct{}
+	once sync.Once
+}
+
+// OpenCluster joins the cluster sharing dir as the named instance. Other
+// instances proxy clients to address, a WebSocket URL on the private
+// network, if one is given. Otherwise they ask Fly's proxy to replay
+// requests here, which needs the instance to be named after its machine ID.
+func OpenCluster(dir, instance, address string) (*Cluster, error) {
+	if instance == "" || sanitizeFilename(instance) != instance {
+		return nil, fmt.Errorf("invalid instance name %q", instance)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cluster directory: %v", err)
+	}
+	return &Cluster{
+		dir:      dir,
+		instance: instance,
+		address:  strings.TrimSuffix(address, "/"),
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Instance returns the name of this instance
+func (c *Cluster) Instance() string {
+	return c.instance
+}
+
+// save publishes the sessions this instance holds
+func (c *Cluster) save(ids []string) error {
+	data, err := json.Marshal(clusterState{Instance: c.instance, Address: c.address, Updated: c.now(), Sessions: ids})
+	if err != nil {
+		return fmt.Errorf("failed to encode cluster state: %v", err)
+	}
+	// Write then rename so other instances never read a partial file
+	path := filepath.Join(c.dir, c.instance+".json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write cluster state: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write cluster state: %v", err)
+	}
+	return nil
+}
+
+// locate returns the other live instance holding a session
+func (c *Cluster) locate(id string) (clusterState, bool) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return clusterState{}, false
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var state clusterState
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Debug.Printf("Ignoring invalid cluster state %s: %v", path, err)
+			continue
+		}
+		if state.Instance == c.instance || c.now().Sub(state.Updated) > clusterExpiry {
+			continue
+		}
+		for _, sid := range state.Sessions {
+			if sid == id {
+				return state, true
+			}
+		}
+	}
+	return clusterState{}, false
+}
+
+// close stops publishing and withdraws this instance's state
+func (c *Cluster) close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// syncCluster keeps this instance's published sessions current until the
+// cluster is closed
+func (s *Server) syncCluster() {
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+
+	save := func() {
+		var ids []string
+		for _, sess := range s.sessions.List() {
+			ids = append(ids, sess.ID)
+		}
+		if err := s.cluster.save(ids); err != nil {
+			log.Info.Printf("Failed to publish sessions to cluster: %v", err)
+		}
+	}
+	save()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				// Fell behind; the next save catches up
+				events = s.events.subscribe()
+			}
+			save()
+		case <-ticker.C:
+			save()
+		case <-s.cluster.done:
+			os.Remove(filepath.Join(s.cluster.dir, s.cluster.instance+".json"))
+			return
+		}
+	}
+}
+
+// withCluster routes requests to resume a session held by another
+// instance there. Instances with an address are proxied to; others are
+// reached with Fly's replay header, and behind other load balancers the
+// request fails with a message naming the instance.
+func (s *Server) withCluster(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("resume")
+		if s.cluster == nil || id == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !strings.HasPrefix(id, "#") {
+			id = "#" + id
+		}
+		if _, ok := s.sessions.Get(id); ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		peer, ok := s.cluster.locate(id)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if peer.Address != "" {
+			websocket.Server{
+				Handshake: negotiateProtocol,
+				Handler:   func(ws *websocket.Conn) { s.proxySession(ws, peer) },
+			}.ServeHTTP(w, r)
+			return
+		}
+		log.Info.Printf("Routing resume of %s from %s to instance %s", id, r.RemoteAddr, peer.Instance)
+		w.Header().Set("Fly-Replay", "instance="+peer.Instance)
+		http.Error(w, fmt.Sprintf("Session %s is on instance %s", id, peer.Instance), http.StatusConflict)
+	})
+}
+
+// wsFrame is one WebSocket message, relayed with its payload type so the
+// peer sees exactly what the client sent
+type wsFrame struct {
+	data []byte
+	typ  byte
+}
+
+var frameCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		f := v.(wsFrame)
+		return f.data, f.typ, nil
+	},
+	Unmarshal: func(data []byte, typ byte, v any) error {
+		*v.(*wsFrame) = wsFrame{data: data, typ: typ}
+		return nil
+	},
+}
+
+// proxySession relays a client's connection to the instance holding the
+// session it is resuming. The request is passed on as it came, token and
+// all, so the peer authenticates and authorizes it as usual.
+func (s *Server) proxySession(ws *websocket.Conn, peer clusterState) {
+	defer ws.Close()
+	r := ws.Request()
+	log.Info.Printf("Proxying resume from %s to instance %s", r.RemoteAddr, peer.Instance)
+
+	config, err := websocket.NewConfig(peer.Address+"/?"+r.URL.RawQuery, "http://localhost")
+	if err == nil {
+		config.Protocol = ws.Config().Protocol
+		if tp := r.Header.Get("traceparent"); tp != "" {
+			config.Header.Set("traceparent", tp)
+		}
+		var upstream *websocket.Conn
+		if upstream, err = websocket.DialConfig(config); err == nil {
+			relayFrames(ws, upstream)
+			log.Info.Printf("Proxied connection from %s to instance %s closed", r.RemoteAddr, peer.Instance)
+			return
+		}
+	}
+	log.Info.Printf("Failed to proxy to instance %s: %v", peer.Instance, err)
+	if conn := newTransport(ws); conn.hasControl() {
+		conn.send(controlMessage{Type: "error", Message: fmt.Sprintf("session is on instance %s, which can't be reached", peer.Instance)})
+	}
+}
+
+// relayFrames copies messages between two connections until either closes
+func relayFrames(a, b *websocket.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	copyFrames := func(dst, src *websocket.Conn) {
+		defer closeBoth()
+		for {
+			var f wsFrame
+			if err := frameCodec.Receive(src, &f); err != nil {
+				return
+			}
+			if err := frameCodec.Send(dst, f); err != nil {
+				return
+			}
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		copyFrames(b, a)
+		close(done)
+	}()
+	copyFrames(a, b)
+	<-done
+}
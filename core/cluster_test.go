@@ -0,0 +1,73 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClusterLocatesSessions(t *testing.T) {
+	dir := t.TempDir()
+	a, err := OpenCluster(dir, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenCluster(dir, "b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.save([]string{"#a-1", "#a-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if peer, ok := b.locate("#a-2"); !ok || peer.Instance != "a" {
+		t.Errorf("locate() = %q, %v, want a", peer.Instance, ok)
+	}
+	if _, ok := a.locate("#a-2"); ok {
+		t.Error("Instances shouldn't route to themselves")
+	}
+	if _, ok := b.locate("#a-3"); ok {
+		t.Error("Located a session no instance holds")
+	}
+
+	// Instances that stop publishing are presumed gone
+	b.now = func() time.Time { return time.Now().Add(clusterExpiry + time.Second) }
+	if _, ok := b.locate("#a-1"); ok {
+		t.Error("Located a session on an expired instance")
+	}
+}
+
+func TestOpenClusterRejectsBadInstance(t *testing.T) {
+	for _, name := range []string{"", "../a", "a/b"} {
+		if _, err := OpenCluster(t.TempDir(), name, ""); err == nil {
+			t.Errorf("OpenCluster(%q) succeeded", name)
+		}
+	}
+}
+
+func TestClusterRoutesResume(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := OpenCluster(dir, "a", "")
+	b, _ := OpenCluster(dir, "b", "")
+	a.save([]string{"#a-1"})
+
+	s := NewServer(0)
+	s.SetCluster(b)
+	local := s.withCluster(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	w := httptest.NewRecorder()
+	local.ServeHTTP(w, httptest.NewRequest("GET", "/?resume=a-1", nil))
+	if w.Code != http.StatusConflict || w.Header().Get("Fly-Replay") != "instance=a" {
+		t.Errorf("Got %d with Fly-Replay %q, want a replay to instance a", w.Code, w.Header().Get("Fly-Replay"))
+	}
+
+	// Unknown sessions are left for the local server to refuse
+	w = httptest.NewRecorder()
+	local.ServeHTTP(w, httptest.NewRequest("GET", "/?resume=a-9", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("Got %d, want the request handled locally", w.Code)
+	}
+}
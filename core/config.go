@@ -0,0 +1,223 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultServerConfig is where the server looks for its config file
+const DefaultServerConfig = "/etc/flyssh/server.yaml"
+
+// LoadServerConfig reads a server config file: YAML holding a single
+// mapping of flag names to values, e.g. "port: 8081". A missing file
+// holds no settings.
+func LoadServerConfig(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	defer f.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(stripComment(scanner.Text()), " \t")
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+		name, value, ok := strings.Cut(text, ":")
+		if !ok || name != strings.TrimSpace(name) || strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("%s:%d: settings must be written name: value", file, line)
+		}
+		if settings[name], err = yamlScalar(strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	return settings, nil
+}
+
+// stripComment removes a # comment from a line, leaving quoted #s
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlScalar returns the string a plain or quoted YAML scalar holds
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid quoted value %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsAny(s[:1], "[{&*!|>%@`"):
+		return "", fmt.Errorf("only plain and quoted values are supported, not %s", s)
+	}
+	return s, nil
+}
+
+// ClientConfigPath returns the path of the client's config file
+func ClientConfigPath() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config"), nil
+}
+
+// ClientConfig holds the client's settings, read from a file written like
+// ssh_config: "Name value" lines, which below a "Host pattern..." line
+// apply only to the hosts it matches.
+type ClientConfig struct {
+	blocks []configBlock
+}
+
+type configBlock struct {
+	patterns []string // nil for settings before any Host line
+	settings []ConfigSetting
+}
+
+// ConfigSetting is one setting in the client's config file
+type ConfigSetting struct {
+	Hosts []string // the patterns of the Host line it's below, if any
+	Name  string
+	Value string
+	Line  int
+}
+
+// LoadClientConfig reads the client's config file. A missing file holds
+// no settings.
+func LoadClientConfig() (*ClientConfig, error) {
+	file, err := ClientConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	return LoadClientConfigFile(file)
+}
+
+// LoadClientConfigFile reads a client config file other than the usual one
+func LoadClientConfigFile(file string) (*ClientConfig, error) {
+	cfg := &ClientConfig{blocks: []configBlock{{}}}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Written "Name value" or "Name=value"
+		name, value := text, ""
+		if i := strings.IndexAny(text, " \t="); i >= 0 {
+			name = text[:i]
+			value = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text[i:]), "="))
+			value = strings.Trim(value, `"`)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("%s:%d: %s has no value", file, line, name)
+		}
+		if strings.EqualFold(name, "Host") {
+			cfg.blocks = append(cfg.blocks, configBlock{patterns: strings.Fields(value)})
+			continue
+		}
+		block := &cfg.blocks[len(cfg.blocks)-1]
+		block.settings = append(block.settings, ConfigSetting{Hosts: block.patterns, Name: name, Value: value, Line: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	return cfg, nil
+}
+
+// Settings returns the settings for host, by name in lower case without
+// dashes, so HostKeyCheck and host-key-check are the same. As in
+// ssh_config, the first value found for a setting wins, so specific hosts
+// go before general patterns such as "Host *".
+func (c *ClientConfig) Settings(host string) map[string]string {
+	settings := make(map[string]string)
+	for _, block := range c.blocks {
+		if block.patterns != nil && !matchHost(block.patterns, host) {
+			continue
+		}
+		for _, s := range block.settings {
+			key := strings.ToLower(strings.ReplaceAll(s.Name, "-", ""))
+			if _, ok := settings[key]; !ok {
+				settings[key] = s.Value
+			}
+		}
+	}
+	return settings
+}
+
+// HasHost reports whether a Host line names host, other than one matching
+// every host, such as "Host *"
+func (c *ClientConfig) HasHost(host string) bool {
+	for _, block := range c.blocks {
+		// Patterns that match even no name match every host
+		if block.patterns != nil && !matchHost(block.patterns, "") && matchHost(block.patterns, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns every setting in the file, in order
+func (c *ClientConfig) All() []ConfigSetting {
+	var all []ConfigSetting
+	for _, block := range c.blocks {
+		all = append(all, block.settings...)
+	}
+	return all
+}
+
+// matchHost reports whether host matches a Host line's patterns. A
+// pattern starting with ! excludes the hosts it matches.
+func matchHost(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		if ok, _ := path.Match(strings.ToLower(strings.TrimPrefix(p, "!")), strings.ToLower(host)); ok {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
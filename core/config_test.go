@@ -0,0 +1,95 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	path := writeConfig(t, "server.yaml", `---
+# flyssh server
+port: 8443
+record-dir: "/var/log/flyssh # sessions"
+cluster-addr: wss://a.internal:8081  # this instance
+on-session-end: 'it''s done'
+`)
+	settings, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"port":           "8443",
+		"record-dir":     "/var/log/flyssh # sessions",
+		"cluster-addr":   "wss://a.internal:8081",
+		"on-session-end": "it's done",
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("settings = %v, want %v", settings, want)
+	}
+
+	if settings, err := LoadServerConfig(filepath.Join(t.TempDir(), "missing.yaml")); err != nil || len(settings) != 0 {
+		t.Errorf("missing file = %v, %v; want no settings", settings, err)
+	}
+	for _, bad := range []string{"port 8443\n", "limits:\n  sessions: 5\n", "accept-env: [LANG, TERM]\n"} {
+		if _, err := LoadServerConfig(writeConfig(t, "bad.yaml", bad)); err == nil {
+			t.Errorf("LoadServerConfig(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestClientConfigSettings(t *testing.T) {
+	cfg, err := LoadClientConfigFile(writeConfig(t, "config", `
+# Defaults
+HostKeyCheck accept-new
+
+Host prod
+    URL wss://myapp.fly.dev
+    Login deploy
+    ForwardAgent=yes
+
+Host *.fly.dev !legacy.fly.dev
+    Token = fly-token
+
+Host *
+    login nobody
+    host-key-check yes
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want map[string]string
+	}{
+		{"prod", map[string]string{"hostkeycheck": "accept-new", "url": "wss://myapp.fly.dev", "login": "deploy", "forwardagent": "yes"}},
+		{"myapp.fly.dev", map[string]string{"hostkeycheck": "accept-new", "token": "fly-token", "login": "nobody"}},
+		{"legacy.fly.dev", map[string]string{"hostkeycheck": "accept-new", "login": "nobody"}},
+		{"", map[string]string{"hostkeycheck": "accept-new", "login": "nobody"}},
+	}
+	for _, tt := range tests {
+		if got := cfg.Settings(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Settings(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	for host, want := range map[string]bool{"prod": true, "myapp.fly.dev": true, "legacy.fly.dev": false, "github.com": false} {
+		if got := cfg.HasHost(host); got != want {
+			t.Errorf("HasHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	if _, err := LoadClientConfigFile(writeConfig(t, "config", "Host prod\n  URL\n")); err == nil {
+		t.Error("setting without a value was accepted")
+	}
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+
+	"golang.org/x/net/websocket"
+)
+
+// errControlInUse is returned when another client already serves a
+// control socket
+var errControlInUse = errors.New("control socket in use")
+
+// controlDialTimeout bounds how long a shared session waits for the
+// server connection to be dialed
+const controlDialTimeout = 30 * time.Second
+
+// controlMaster shares one multiplexed server connection with other
+// clients through a local socket, like OpenSSH's ControlMaster. Clients
+// connect to the socket with the usual flyssh.v2 handshake and each one
+// becomes a channel on the shared connection, skipping the dial and auth
+// round trips.
+type controlMaster struct {
+	ctx       context.Context
+	url       string
+	authToken string
+	ln        net.Listener
+
+	mu      sync.Mutex
+	mux     *MuxClient // nil until the first session
+	shared  int        // sessions served for other clients
+	closing bool
+
+	wg sync.WaitGroup
+}
+
+// listenControl serves a control socket at path. A socket left behind by
+// a client that died is replaced; a live one returns errControlInUse.
+// Dialing the server gives up once ctx is done.
+func listenControl(ctx context.Context, path, serverURL, authToken string) (*controlMaster, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, errControlInUse
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %v", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %v", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+	// The socket carries an authenticated connection, so only its owner
+	// may use it
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to secure control socket: %v", err)
+	}
+
+	m := &controlMaster{ctx: ctx, url: serverURL, authToken: authToken, ln: ln}
+	go http.Serve(ln, websocket.Server{Handshake: negotiateProtocol, Handler: m.serve})
+	log.Debug.Printf("Sharing connection to %s on %s", serverURL, path)
+	return m, nil
+}
+
+// dialControl connects to a control socket using config's handshake
+func dialControl(path string, config *websocket.Config) (*websocket.Conn, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// open starts or resumes a session on the shared connection, dialing the
+// server first if the connection isn't up. Step-up requests go to stepUp.
+func (m *controlMaster) open(stepUp func(controlMessage), msg controlMessage) (*muxChannel, string, error) {
+	mux := m.connection()
+	if mux == nil {
+		// Other clients keep using the connection while this one dials
+		ctx, cancel := context.WithTimeout(m.ctx, controlDialTimeout)
+		defer cancel()
+		dialed, err := DialMux(ctx, m.url, m.authToken)
+		if err != nil {
+			return nil, "", err
+		}
+		mux = m.share(dialed)
+	}
+	return mux.openChannel(msg, stepUp)
+}
+
+// connection returns the shared server connection, or nil if it isn't up
+func (m *controlMaster) connection() *MuxClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mux == nil || m.mux.closed() {
+		return nil
+	}
+	return m.mux
+}
+
+// share makes mux the shared server connection and returns it, unless
+// another client dialed one first, which is returned instead
+func (m *controlMaster) share(mux *MuxClient) *MuxClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mux != nil && !m.mux.closed() {
+		mux.Close()
+		return m.mux
+	}
+	m.mux = mux
+	return mux
+}
+
+// join counts a local client's session, unless the master is closing
+func (m *controlMaster) join() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closing {
+		return false
+	}
+	m.shared++
+	m.wg.Add(1)
+	return true
+}
+
+// leave counts a local client's session as ended
+func (m *controlMaster) leave() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shared--
+	m.wg.Done()
+}
+
+// serve relays one local client's session over the shared connection
+func (m *controlMaster) serve(ws *websocket.Conn) {
+	if !m.join() {
+		ws.Close()
+		return
+	}
+	defer m.leave()
+
+	local := newTransport(ws)
+	defer local.Close()
+	if !local.hasControl() {
+		return
+	}
+	reject := func(reason string) {
+		if err := local.send(controlMessage{Type: "error", Message: reason}); err != nil {
+			log.Debug.Printf("Failed to send error: %v", err)
+		}
+	}
+
+	q := ws.Request().URL.Query()
+	if subtle.ConstantTimeCompare([]byte(q.Get("token")), []byte(m.authToken)) != 1 {
+		reject("control socket is shared by a different token")
+		return
+	}
+
+	forward := func(to transport) func(controlMessage) {
+		return func(msg controlMessage) {
+			if err := to.send(msg); err != nil {
+				log.Debug.Printf("Failed to forward %s message: %v", msg.Type, err)
+			}
+		}
+	}
+
+	// The local client shows step-up requests to its user
+	remote, id, err := m.open(forward(local), controlMessage{
+		Type:      "open",
+		Launcher:  q.Get("launch"),
+		Command:   q.Get("exec"),
+		Login:     q.Get("login"),
+		Dir:       q.Get("dir"),
+		Shell:     q.Get("shell"),
+		SessionID: q.Get("resume"),
+		NoPTY:     q.Get("pty") == "0",
+		Env:       q["env"],
+		Dotfiles:  q["dotfile"],
+	})
+	if err != nil {
+		// Refusals are passed on; anything else just drops the local
+		// client, which retries like after any failed dial
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			reject(rejected.reason)
+		}
+		log.Debug.Printf("Failed to open shared session: %v", err)
+		return
+	}
+	if err := local.send(controlMessage{Type: "session", SessionID: id}); err != nil {
+		remote.Close()
+		return
+	}
+
+	relay := newRelayGroup(func() {
+		local.Close()
+		remote.Close()
+	})
+	relay.copy(remote.output(), local.input(forward(remote)))
+	relay.copy(local.output(), remote.input(forward(local)))
+	relay.wait()
+	relay.drain(5*time.Second, id)
+}
+
+// active returns the number of sessions served for other clients
+func (m *controlMaster) active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.shared
+}
+
+// close stops accepting clients, waits for their sessions to end and
+// closes the server connection
+func (m *controlMaster) close() {
+	m.stop()
+	m.ln.Close()
+	m.wg.Wait()
+
+	if mux := m.connection(); mux != nil {
+		mux.Close()
+	}
+}
+
+// stop turns away local clients from now on
+func (m *controlMaster) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closing = true
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Dotfiles are the client's own shell and editor settings, brought along
+// to servers that don't have them, such as ephemeral machines. Each is
+// sent with the session request as "name:base64 content" and written to a
+// directory of the session's own, which the variables the programs read
+// are pointed at. The directory goes when the session ends.
+const (
+	maxDotfiles     = 16
+	maxDotfileBytes = 64 << 10 // in all
+)
+
+// dotfileEnv says how each program is pointed at its file. Others are
+// only written, for the shell to use through $FLYSSH_DOTFILES.
+var dotfileEnv = map[string]func(path string) string{
+	".inputrc": func(path string) string { return "INPUTRC=" + path },
+	".vimrc":   func(path string) string { return "VIMINIT=source " + path },
+	".shrc":    func(path string) string { return "ENV=" + path }, // interactive sh runs it, so it can set PS1
+}
+
+// encodeDotfiles reads local dotfiles for sending
+func encodeDotfiles(paths []string) ([]string, error) {
+	if len(paths) > maxDotfiles {
+		return nil, fmt.Errorf("too many dotfiles, at most %d can be sent", maxDotfiles)
+	}
+	var encoded []string
+	total := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dotfile: %v", err)
+		}
+		if total += len(data); total > maxDotfileBytes {
+			return nil, fmt.Errorf("dotfiles are too large, at most %dKB can be sent", maxDotfileBytes>>10)
+		}
+		encoded = append(encoded, filepath.Base(path)+":"+base64.StdEncoding.EncodeToString(data))
+	}
+	return encoded, nil
+}
+
+// installDotfiles writes the session's dotfiles in a directory under base,
+// "" for the system's temporary directory, and points cmd at them. A
+// session that sees base somewhere else, such as a sandboxed one seeing
+// its scratch directory as /tmp, is given seen. The returned function
+// removes them.
+func installDotfiles(cmd *exec.Cmd, encoded []string, base, seen string) (func(), error) {
+	if len(encoded) > maxDotfiles {
+		return nil, fmt.Errorf("too many dotfiles")
+	}
+	dir, err := os.MkdirTemp(base, "flyssh-dotfiles-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dotfiles directory: %v", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	visible := dir
+	if seen != "" {
+		visible = filepath.Join(seen, filepath.Base(dir))
+	}
+	paths := []string{dir}
+	total := 0
+	for _, file := range encoded {
+		name, content, _ := strings.Cut(file, ":")
+		data, err := base64.StdEncoding.DecodeString(content)
+		if err != nil || !strings.HasPrefix(name, ".") || name != filepath.Base(name) || name == "." || name == ".." {
+			cleanup()
+			return nil, fmt.Errorf("invalid dotfile %q", name)
+		}
+		if total += len(data); total > maxDotfileBytes {
+			cleanup()
+			return nil, fmt.Errorf("dotfiles are too large")
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to write dotfile: %v", err)
+		}
+		paths = append(paths, path)
+		if env, ok := dotfileEnv[name]; ok {
+			cmd.Env = setEnv(cmd.Env, env(filepath.Join(visible, name)))
+		}
+	}
+	if err := chownForSession(cmd, paths...); err != nil {
+		cleanup()
+		return nil, err
+	}
+	cmd.Env = setEnv(cmd.Env, "FLYSSH_DOTFILES="+visible)
+	return cleanup, nil
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstallDotfiles(t *testing.T) {
+	local := t.TempDir()
+	inputrc := filepath.Join(local, ".inputrc")
+	os.WriteFile(inputrc, []byte("set editing-mode vi\n"), 0600)
+	gitconfig := filepath.Join(local, ".gitconfig")
+	os.WriteFile(gitconfig, []byte("[user]\n"), 0600)
+	encoded, err := encodeDotfiles([]string{inputrc, gitconfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("true")
+	cleanup, err := installDotfiles(cmd, encoded, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := strings.Join(cmd.Env, "\n")
+	var path, dir string
+	for _, kv := range cmd.Env {
+		if v, ok := strings.CutPrefix(kv, "INPUTRC="); ok {
+			path = v
+		}
+		if v, ok := strings.CutPrefix(kv, "FLYSSH_DOTFILES="); ok {
+			dir = v
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "set editing-mode vi\n" {
+		t.Errorf("Expected INPUTRC to point at the .inputrc, got %q in %s", data, env)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gitconfig")); err != nil {
+		t.Errorf("Expected other dotfiles in $FLYSSH_DOTFILES: %v", err)
+	}
+	cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the dotfiles to be removed, got %v", err)
+	}
+
+	for _, bad := range []string{"../.profile:", ".ssh/authorized_keys:", "profile:", ".vimrc:not base64!"} {
+		if _, err := installDotfiles(exec.Command("true"), []string{bad}, "", ""); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestInstallDotfilesSeenElsewhere(t *testing.T) {
+	local := filepath.Join(t.TempDir(), ".shrc")
+	os.WriteFile(local, []byte("PS1='$ '\n"), 0600)
+	encoded, err := encodeDotfiles([]string{local})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sandboxed session sees its scratch directory as /tmp
+	scratch := t.TempDir()
+	cmd := exec.Command("true")
+	cleanup, err := installDotfiles(cmd, encoded, scratch, "/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	dir := getEnv(cmd.Env, "FLYSSH_DOTFILES")
+	if !strings.HasPrefix(dir, "/tmp/flyssh-dotfiles-") || getEnv(cmd.Env, "ENV") != dir+"/.shrc" {
+		t.Fatalf("Expected the dotfiles under /tmp, got %q", cmd.Env)
+	}
+	if _, err := os.Stat(filepath.Join(scratch, strings.TrimPrefix(dir, "/tmp"), ".shrc")); err != nil {
+		t.Errorf("Expected the dotfile in the scratch directory: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"flyssh/core/log"
+)
+
+// errDraining refuses new sessions on a draining server
+var errDraining = errors.New("server is draining")
+
+// drainState tracks whether the server is being replaced, and by what
+type drainState struct {
+	mu          sync.Mutex
+	draining    bool
+	replacement string // WebSocket URL clients should move to, if known
+}
+
+// DrainStatus is the state reported and set by the drain API
+type DrainStatus struct {
+	Draining       bool   `json:"draining"`
+	Replacement    string `json:"replacement,omitempty"`
+	SessionsActive int    `json:"sessions_active"`
+}
+
+// Drain stops the server taking new sessions, for a blue/green deploy.
+// Running sessions carry on, and their clients are told to reconnect to
+// replacement, if given, when their connection drops. New clients are sent
+// there straight away.
+func (s *Server) Drain(replacement string) {
+	s.drain.mu.Lock()
+	s.drain.draining = true
+	s.drain.replacement = replacement
+	s.drain.mu.Unlock()
+	log.Info.Printf("Draining, replacement %q", replacement)
+
+	s.sessions.each(func(sess *Session) {
+		if sess.ctl == nil {
+			return
+		}
+		if conn, _ := sess.ctl.current(); conn != nil {
+			s.sendRedirect(conn)
+		}
+	})
+}
+
+// Undrain takes new sessions again
+func (s *Server) Undrain() {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	s.drain.draining = false
+	s.drain.replacement = ""
+	log.Info.Printf("No longer draining")
+}
+
+// draining reports whether the server is draining, and its replacement
+func (s *Server) draining() (bool, string) {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	return s.drain.draining, s.drain.replacement
+}
+
+// sendRedirect tells a client attached to a session on a draining server
+// where to reconnect
+func (s *Server) sendRedirect(conn transport) {
+	draining, replacement := s.draining()
+	if !draining || !conn.hasControl() {
+		return
+	}
+	if replacement == "" {
+		conn.notice("server is shutting down soon")
+		return
+	}
+	conn.notice("server is being replaced, reconnects go to " + replacement)
+	if err := conn.send(controlMessage{Type: "redirect", URL: replacement}); err != nil {
+		log.Debug.Printf("Failed to send redirect: %v", err)
+	}
+}
+
+// handleDrain reports (GET), starts (POST, with an optional JSON body
+// naming the replacement) or stops (DELETE) draining
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req DrainStatus
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		log.Info.Printf("Drain requested by %s", r.RemoteAddr)
+		s.Drain(req.Replacement)
+	case http.MethodDelete:
+		s.Undrain()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	draining, replacement := s.draining()
+	writeJSON(w, http.StatusOK, DrainStatus{
+		Draining:       draining,
+		Replacement:    replacement,
+		SessionsActive: len(s.sessions.List()),
+	})
+}
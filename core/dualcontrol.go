@@ -0,0 +1,190 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// dualControlTimeout is how long a dual-control session waits for its
+// observer before it's refused
+const dualControlTimeout = 5 * time.Minute
+
+// dualControl is a session that needs a second person watching. It's
+// tracked from before the session starts, while it waits for an observer,
+// until it ends.
+type dualControl struct {
+	owner    string // token that started the session
+	launcher string
+	joined   chan string   // observers' token names, to start the session
+	done     chan struct{} // closed when the session is over
+
+	mu      sync.Mutex
+	ctl     *sessionControl // set once the session has started
+	pending []transport     // observers that joined before it did
+}
+
+// dualControls are the dual-control sessions, by session ID
+type dualControls struct {
+	mu       sync.Mutex
+	sessions map[string]*dualControl
+}
+
+func (d *dualControls) add(id string, dc *dualControl) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sessions == nil {
+		d.sessions = make(map[string]*dualControl)
+	}
+	d.sessions[id] = dc
+}
+
+func (d *dualControls) get(id string) *dualControl {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sessions[id]
+}
+
+// remove forgets a session and disconnects its observers
+func (d *dualControls) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dc, ok := d.sessions[id]; ok {
+		delete(d.sessions, id)
+		close(dc.done)
+	}
+}
+
+// start sends the session's output to its observers from now on
+func (dc *dualControl) start(ctl *sessionControl) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.ctl = ctl
+	for _, conn := range dc.pending {
+		if err := ctl.observe(conn, conn.output()); err != nil {
+			conn.Close()
+		}
+	}
+	dc.pending = nil
+}
+
+// join adds an observer, who sees the session's output once it starts
+func (dc *dualControl) join(conn transport, name string) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.ctl != nil {
+		if err := dc.ctl.observe(conn, conn.output()); err != nil {
+			return err
+		}
+	} else {
+		dc.pending = append(dc.pending, conn)
+	}
+	select {
+	case dc.joined <- name:
+	default:
+	}
+	return nil
+}
+
+// leave removes an observer
+func (dc *dualControl) leave(conn transport) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.ctl != nil {
+		dc.ctl.unobserve(conn)
+	}
+	for i, c := range dc.pending {
+		if c == conn {
+			dc.pending = append(dc.pending[:i], dc.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// awaitObserver holds a dual-control session until someone other than its
+// owner joins to watch it, telling the client how they can
+func (s *Server) awaitObserver(conn transport, sessionID string, dc *dualControl) error {
+	msg := fmt.Sprintf("launcher %s needs a second person watching; waiting for them to run: flyssh client -observe %s", dc.launcher, sessionID)
+	if err := conn.send(controlMessage{Type: "notice", Message: msg}); err != nil {
+		return fmt.Errorf("failed to send notice: %v", err)
+	}
+	log.Info.Printf("Session %s waiting for an observer", sessionID)
+
+	select {
+	case name := <-dc.joined:
+		log.Info.Printf("Session %s observed by %s", sessionID, name)
+		return nil
+	case <-time.After(dualControlTimeout):
+		return fmt.Errorf("no observer joined within %s", dualControlTimeout)
+	}
+}
+
+// observeSession lets a second person watch a dual-control session. They
+// see its output but can't type into it; q or ^C stops watching.
+func (s *Server) observeSession(id string, conn transport, r *http.Request) {
+	reject := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		log.Info.Printf("Rejected observer of %s from %s: %s", id, r.RemoteAddr, msg)
+		if err := conn.send(controlMessage{Type: "error", Message: msg}); err != nil {
+			log.Debug.Printf("Failed to send error: %v", err)
+		}
+	}
+
+	dc := s.dualControls.get(id)
+	if dc == nil || !conn.hasControl() {
+		reject("session %s not found", id)
+		return
+	}
+	// The observer must be someone else, who could run the launcher
+	// themselves
+	g := grantFrom(r.Context())
+	if g == nil || g.name == dc.owner || !g.allows(dc.launcher) {
+		reject("not permitted to observe session %s", id)
+		return
+	}
+	if err := conn.send(controlMessage{Type: "session", SessionID: id}); err != nil {
+		log.Debug.Printf("Failed to send session ID: %v", err)
+		return
+	}
+	if err := dc.join(conn, g.name); err != nil {
+		conn.Close()
+		return
+	}
+	defer conn.Close()
+	defer dc.leave(conn)
+	s.audit.Log(AuditEvent{
+		Event:      AuditObserve,
+		SessionID:  id,
+		RemoteAddr: r.RemoteAddr,
+		User:       r.URL.Query().Get("user"),
+		Token:      g.name,
+		Launcher:   dc.launcher,
+		TraceID:    traceID(r.Context()),
+	})
+
+	ka := startKeepalive(conn, s.keepalive, nil)
+	defer ka.Stop()
+	input := ka.reader(conn.input(func(msg controlMessage) { ka.control(msg) }))
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		buf := make([]byte, 256)
+		for {
+			n, err := input.Read(buf)
+			if err != nil || bytes.ContainsAny(buf[:n], defaultReadOnlyInput) {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-left:
+		log.Info.Printf("Observer %s stopped watching %s", g.name, id)
+	case <-dc.done:
+		conn.notice("session ended")
+	}
+}
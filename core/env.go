@@ -0,0 +1,99 @@
+package core
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"flyssh/core/log"
+)
+
+// DefaultAcceptEnv is the variables the server takes from clients unless
+// configured otherwise: the terminal type and locale
+var DefaultAcceptEnv = []string{"TERM", "LANG", "LC_*"}
+
+// ParseEnvPatterns splits a comma separated list of variable names, which
+// may contain * and ? wildcards
+func ParseEnvPatterns(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// matchEnv reports whether a variable name matches any of patterns
+func matchEnv(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validEnvName reports whether name is a portable variable name
+func validEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// collectEnv returns the variables of this process matching patterns, as
+// NAME=value
+func collectEnv(patterns []string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if matchEnv(patterns, name) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// clientEnv returns the variables a client sent with its request that the
+// server accepts. Others are dropped, as sshd does with AcceptEnv.
+func (s *Server) clientEnv(r *http.Request) []string {
+	var env []string
+	for _, kv := range r.URL.Query()["env"] {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok || !validEnvName(name) || !matchEnv(s.acceptEnv, name) {
+			log.Debug.Printf("Ignoring environment variable %q from %s", name, r.RemoteAddr)
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// getEnv returns the value of a variable in env, "" if it isn't set
+func getEnv(env []string, name string) string {
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, name+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// setEnv sets a NAME=value variable in env, replacing any existing value
+func setEnv(env []string, kv string) []string {
+	name, _, _ := strings.Cut(kv, "=")
+	for i, existing := range env {
+		if strings.HasPrefix(existing, name+"=") {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
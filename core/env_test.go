@@ -0,0 +1,35 @@
+package core
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestClientEnv(t *testing.T) {
+	s := NewServer(0)
+	s.SetAcceptEnv(ParseEnvPatterns(" LANG, LC_*,MY_? "))
+
+	q := url.Values{}
+	for _, kv := range []string{"LANG=en_US.UTF-8", "LC_ALL=C", "MY_X=1=2", "MY_XY=no", "PATH=/evil", "LC_*=bad", "LANG"} {
+		q.Add("env", kv)
+	}
+	r := httptest.NewRequest("GET", "/?"+q.Encode(), nil)
+
+	got := s.clientEnv(r)
+	want := []string{"LANG=en_US.UTF-8", "LC_ALL=C", "MY_X=1=2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("clientEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	env := []string{"TERM=xterm", "TERMINFO=/x"}
+	env = setEnv(env, "TERM=screen")
+	env = setEnv(env, "LANG=C")
+	want := []string{"TERM=screen", "TERMINFO=/x", "LANG=C"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("setEnv() = %q, want %q", env, want)
+	}
+}
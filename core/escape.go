@@ -0,0 +1,110 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// DefaultEscapeChar starts the client's escape commands, as in ssh
+const DefaultEscapeChar = '~'
+
+// escapeReader passes typed input through, acting on escape commands: the
+// escape character typed at the start of a line, then a command
+// character. Typing the escape character twice sends it once, and any
+// other character sends both.
+type escapeReader struct {
+	r         io.Reader
+	esc       byte
+	commands  map[byte]func()
+	lineStart bool
+	escaped   bool // the escape character started the line
+
+	buf []byte
+	out []byte
+	err error
+}
+
+func newEscapeReader(r io.Reader, esc byte, commands map[byte]func()) *escapeReader {
+	return &escapeReader{r: r, esc: esc, commands: commands, lineStart: true, buf: make([]byte, 32*1024)}
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 && e.err == nil {
+		n, err := e.r.Read(e.buf)
+		e.filter(e.buf[:n])
+		e.err = err
+	}
+	if len(e.out) == 0 {
+		return 0, e.err
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// filter appends the input to send to out, running the commands typed
+func (e *escapeReader) filter(data []byte) {
+	for _, b := range data {
+		switch {
+		case e.escaped:
+			e.escaped = false
+			if cmd, ok := e.commands[b]; ok {
+				cmd()
+				continue
+			}
+			if b != e.esc {
+				e.out = append(e.out, e.esc)
+			}
+		case e.lineStart && b == e.esc:
+			e.escaped = true
+			continue
+		}
+		e.out = append(e.out, b)
+		e.lineStart = b == '\r' || b == '\n'
+	}
+}
+
+// escapeCommands are the client's escape commands
+func (c *Client) escapeCommands() map[byte]func() {
+	esc := string(c.escapeChar)
+	return map[byte]func(){
+		'b': c.bookmark,
+		'?': func() {
+			c.notify(fmt.Sprintf("escape commands:\r\n  %sb  bookmark the output here\r\n  %s?  this list\r\n  %s%s  send %s", esc, esc, esc, esc, esc))
+		},
+	}
+}
+
+// notify shows a message from flyssh while the session runs. It goes to
+// stderr, which nothing else writes to then.
+func (c *Client) notify(message string) {
+	fmt.Fprintf(c.stderr, "\r\n[flyssh] %s\r\n", message)
+}
+
+// bookmark marks the output at this moment in the client's recording and
+// transcript and the server's recording, if they're kept, labelled with
+// the time
+func (c *Client) bookmark() {
+	now := time.Now()
+	label := now.Format(time.RFC3339)
+	c.mu.Lock()
+	c.bookmarks++
+	n := c.bookmarks
+	c.mu.Unlock()
+
+	if c.recorder != nil {
+		c.recorder.marker(label)
+	}
+	if c.transcript != nil {
+		c.transcript.note(fmt.Sprintf("bookmark %d", n))
+	}
+	if conn := c.current(); conn != nil && conn.hasControl() {
+		if err := conn.send(controlMessage{Type: "bookmark", Message: label}); err != nil {
+			log.Debug.Printf("Failed to send bookmark: %v", err)
+		}
+	}
+	c.notify(fmt.Sprintf("bookmark %d at %s", n, now.Format(time.TimeOnly)))
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEscapeReader(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+		commands       int
+	}{
+		{"plain input", "ls -l\r", "ls -l\r", 0},
+		{"command at the start", "~bls\r", "ls\r", 1},
+		{"command after a newline", "ls\r~b", "ls\r", 1},
+		{"mid-line", "echo ~b\r", "echo ~b\r", 0},
+		{"doubled escape", "~~b\r", "~b\r", 0},
+		{"unknown command", "~x\r", "~x\r", 0},
+		{"two commands", "~b\r~b", "\r", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := 0
+			r := newEscapeReader(strings.NewReader(tt.in), '~', map[byte]func(){'b': func() { ran++ }})
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Expected %q to send %q, got %q", tt.in, tt.want, got)
+			}
+			if ran != tt.commands {
+				t.Errorf("Expected %d commands to run, got %d", tt.commands, ran)
+			}
+		})
+	}
+}
+
+func TestEscapeReaderSplitReads(t *testing.T) {
+	// The escape and command may arrive in separate reads
+	pr, pw := io.Pipe()
+	ran := 0
+	r := newEscapeReader(pr, '~', map[byte]func(){'b': func() { ran++ }})
+	go func() {
+		pw.Write([]byte("~"))
+		pw.Write([]byte("b"))
+		pw.Write([]byte("x"))
+		pw.Close()
+	}()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "x" || ran != 1 {
+		t.Errorf("Expected the command to run once and x to be sent, got %q and %d runs", got, ran)
+	}
+}
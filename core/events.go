@@ -0,0 +1,212 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Event types on the server's event stream
+const (
+	EventSnapshot      = "snapshot"       // sent first, with every active session
+	EventSessionStart  = "session_start"  // a session started
+	EventSessionUpdate = "session_update" // a session detached, resumed or resized
+	EventSessionEnd    = "session_end"    // a session ended
+	EventAuthSuccess   = "auth_success"   // a request authenticated
+	EventAuthFailure   = "auth_failure"   // a request was refused for its token
+	EventServerStart   = "server_start"   // the server started serving
+	EventServerPanic   = "server_panic"   // a connection's handler panicked
+	EventPing          = "ping"           // a quiet JSON stream is still open
+)
+
+// eventQueue is the number of events buffered per subscriber. Subscribers
+// that fall further behind are disconnected rather than slowing sessions.
+const eventQueue = 256
+
+// Event is a change in server state, streamed from /api/v1/events to
+// replicas and dashboards
+type Event struct {
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	Session       *Session  `json:"session,omitempty"`
+	Sessions      []Session `json:"sessions,omitempty"`
+	SessionsTotal uint64    `json:"sessions_total,omitempty"`
+
+	// Auth events
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Token      string `json:"token,omitempty"` // name of the token, never its value
+	Reason     string `json:"reason,omitempty"`
+}
+
+// eventBus fans events out to subscribers without ever blocking the
+// publisher
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// subscribe returns a channel receiving events published from now on. It
+// is closed if the subscriber falls behind.
+func (b *eventBus) subscribe() chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, eventQueue)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe stops delivering events to ch
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish delivers e to every subscriber
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Info.Printf("Event subscriber fell behind, disconnecting it")
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishSession publishes a session event with the session's current state
+func (s *Server) publishSession(typ string, sess *Session) {
+	snapshot := sess.Snapshot()
+	s.events.publish(Event{
+		Type:          typ,
+		Time:          time.Now(),
+		Session:       &snapshot,
+		SessionsTotal: atomic.LoadUint64(&s.sessionCount),
+	})
+}
+
+// publishAuth publishes the outcome of authenticating a request
+func (s *Server) publishAuth(typ string, r *http.Request, token, reason string) {
+	s.events.publish(Event{
+		Type:       typ,
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		Path:       r.URL.Path,
+		Token:      token,
+		Reason:     reason,
+	})
+}
+
+// publishServer publishes a change in the server itself
+func (s *Server) publishServer(typ, reason string) {
+	s.events.publish(Event{
+		Type:          typ,
+		Time:          time.Now(),
+		SessionsTotal: atomic.LoadUint64(&s.sessionCount),
+		Reason:        reason,
+	})
+}
+
+// handleEvents streams events as newline delimited JSON, or as server-sent
+// events to clients that accept text/event-stream, starting with a
+// snapshot of the active sessions. Events that happened while the
+// snapshot was taken may repeat it, so consumers should apply them as
+// upserts and deletes.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(e Event) bool {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Info.Printf("Failed to encode event: %v", err)
+			return true
+		}
+		if sse {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		} else {
+			_, err = w.Write(append(data, '\n'))
+		}
+		if err != nil {
+			log.Debug.Printf("Failed to write event: %v", err)
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	// Quiet streams get a heartbeat now and then so proxies don't time
+	// them out and consumers can tell they're still open: a comment, which
+	// EventSource ignores, or a ping event
+	var ping <-chan time.Time
+	if s.keepalive > 0 {
+		ticker := time.NewTicker(s.keepalive)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	log.Info.Printf("Event stream opened by %s", r.RemoteAddr)
+	defer log.Info.Printf("Event stream closed by %s", r.RemoteAddr)
+	if !send(Event{
+		Type:          EventSnapshot,
+		Time:          time.Now(),
+		Sessions:      s.sessions.List(),
+		SessionsTotal: atomic.LoadUint64(&s.sessionCount),
+	}) {
+		return
+	}
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok || !send(e) {
+				return
+			}
+		case <-ping:
+			if !sse {
+				if !send(Event{Type: EventPing, Time: time.Now()}) {
+					return
+				}
+				continue
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
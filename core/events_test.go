@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBusDropsSlowSubscribers(t *testing.T) {
+	var bus eventBus
+	slow := bus.subscribe()
+	fast := bus.subscribe()
+	defer bus.unsubscribe(fast)
+
+	for i := 0; i < eventQueue+1; i++ {
+		bus.publish(Event{Type: EventSessionUpdate})
+		<-fast
+	}
+
+	// The slow subscriber's queue overflowed, so its channel was closed
+	// after the events that fit
+	for i := 0; i < eventQueue; i++ {
+		if _, ok := <-slow; !ok {
+			t.Fatalf("Slow subscriber lost event %d", i)
+		}
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("Expected slow subscriber to be disconnected")
+	}
+	bus.unsubscribe(slow) // safe after being dropped
+}
+
+func TestEventsServerSentEvents(t *testing.T) {
+	s := NewServer(0)
+	ts := httptest.NewServer(http.HandlerFunc(s.handleEvents))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q, want text/event-stream", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() (string, string) {
+		var typ, data string
+		for lines.Scan() && lines.Text() != "" {
+			if v, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+				typ = v
+			}
+			if v, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+				data = v
+			}
+		}
+		return typ, data
+	}
+
+	if typ, _ := next(); typ != EventSnapshot {
+		t.Fatalf("First event %q, want %q", typ, EventSnapshot)
+	}
+	s.publishAuth(EventAuthFailure, httptest.NewRequest("GET", "/api/v1/sessions", nil), "", "invalid token")
+	typ, data := next()
+	if typ != EventAuthFailure || !strings.Contains(data, `"reason":"invalid token"`) {
+		t.Errorf("Got event %q with %s, want an auth failure", typ, data)
+	}
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	s := NewServer(0)
+	s.SetKeepalive(20 * time.Millisecond)
+	ts := httptest.NewServer(http.HandlerFunc(s.handleEvents))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// A quiet JSON stream gets ping events after its snapshot
+	dec := json.NewDecoder(resp.Body)
+	for _, want := range []string{EventSnapshot, EventPing, EventPing} {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		if e.Type != want || e.Time.IsZero() {
+			t.Fatalf("Got event %+v, want %q", e, want)
+		}
+	}
+}
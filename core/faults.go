@@ -0,0 +1,117 @@
+//go:build faults
+// +build faults
+
+package core
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Faults are failures a server built with the faults tag injects on
+// request, to test how clients cope with a bad network and sessions that
+// die. Chances are between 0 and 1.
+type Faults struct {
+	// DropFrames is the chance each frame sent to a client is dropped
+	DropFrames float64 `json:"drop_frames,omitempty"`
+	// DelayWritesMs delays each frame sent to a client
+	DelayWritesMs int `json:"delay_writes_ms,omitempty"`
+	// CutConnections is the chance each second that a session's client
+	// connection is closed, as a network failure would
+	CutConnections float64 `json:"cut_connections,omitempty"`
+	// KillSessions is the chance each second that a session is killed, as
+	// the admin API does
+	KillSessions float64 `json:"kill_sessions,omitempty"`
+}
+
+// faultInjector holds the faults currently being injected
+type faultInjector struct {
+	mu     sync.Mutex
+	faults Faults
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{}
+}
+
+func (fi *faultInjector) get() Faults {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.faults
+}
+
+func (fi *faultInjector) set(f Faults) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults = f
+}
+
+// beforeWrite delays a frame about to be sent and reports whether to drop
+// it instead
+func (fi *faultInjector) beforeWrite() bool {
+	if fi == nil {
+		return false
+	}
+	f := fi.get()
+	if f.DelayWritesMs > 0 {
+		time.Sleep(time.Duration(f.DelayWritesMs) * time.Millisecond)
+	}
+	return f.DropFrames > 0 && rand.Float64() < f.DropFrames
+}
+
+// watch cuts off and kills sess at random until done is closed
+func (fi *faultInjector) watch(sess *Session, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		f := fi.get()
+		if f.KillSessions > 0 && rand.Float64() < f.KillSessions {
+			log.Info.Printf("Injected fault: killing session %s", sess.ID)
+			if err := sess.Kill(); err != nil {
+				log.Info.Printf("Failed to kill session: %v", err)
+			}
+		}
+		if f.CutConnections > 0 && rand.Float64() < f.CutConnections {
+			log.Info.Printf("Injected fault: cutting off session %s", sess.ID)
+			sess.ctl.closeConn()
+		}
+	}
+}
+
+// registerFaults serves the faults admin endpoint
+func (s *Server) registerFaults() {
+	s.mux.Handle("/api/v1/faults", s.withAdminAuth(http.HandlerFunc(s.handleFaults)))
+}
+
+// handleFaults shows the faults being injected on GET, replaces them on
+// PUT, and stops them on DELETE
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var f Faults
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		log.Info.Printf("Injecting faults %+v, requested by %s", f, r.RemoteAddr)
+		s.faults.set(f)
+	case http.MethodDelete:
+		log.Info.Printf("Stopping injected faults, requested by %s", r.RemoteAddr)
+		s.faults.set(Faults{})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.faults.get())
+}
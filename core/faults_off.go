@@ -0,0 +1,15 @@
+//go:build !faults
+// +build !faults
+
+package core
+
+// faultInjector injects nothing unless built with the faults tag
+type faultInjector struct{}
+
+func newFaultInjector() *faultInjector { return nil }
+
+func (fi *faultInjector) beforeWrite() bool { return false }
+
+func (fi *faultInjector) watch(sess *Session, done <-chan struct{}) {}
+
+func (s *Server) registerFaults() {}
@@ -0,0 +1,53 @@
+//go:build faults
+// +build faults
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultsEndpoint(t *testing.T) {
+	s := NewServer(0)
+	do := func(method, body string) Faults {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.handleFaults(w, httptest.NewRequest(method, "/api/v1/faults", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d: %s", method, w.Code, w.Body)
+		}
+		var f Faults
+		if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	if f := do(http.MethodGet, ""); f != (Faults{}) {
+		t.Errorf("Faults injected by default: %+v", f)
+	}
+	want := Faults{DropFrames: 1, DelayWritesMs: 20, KillSessions: 0.5}
+	if f := do(http.MethodPut, `{"drop_frames": 1, "delay_writes_ms": 20, "kill_sessions": 0.5}`); f != want {
+		t.Errorf("PUT returned %+v, want %+v", f, want)
+	}
+
+	start := time.Now()
+	if !s.faults.beforeWrite() {
+		t.Error("Frame wasn't dropped")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Write was delayed %v, want 20ms", elapsed)
+	}
+
+	if f := do(http.MethodDelete, ""); f != (Faults{}) {
+		t.Errorf("DELETE left %+v", f)
+	}
+	if s.faults.beforeWrite() {
+		t.Error("Frame dropped with no faults")
+	}
+}
@@ -0,0 +1,233 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+
+	"flyssh/core/log"
+)
+
+// forwardRelay carries connections forwarded from a session back to the
+// client, such as its SSH agent or X display, over the session's control
+// messages. The server listens where the session's processes can connect
+// and announces each connection with <kind>-open; the client connects it
+// to the local service. <kind> messages carry the data either way and
+// <kind>-close ends a connection.
+type forwardRelay struct {
+	kind string
+	send func(controlMessage) error
+	dial func() (net.Conn, error) // the local service; nil on the server
+
+	mu     sync.Mutex
+	conns  map[uint32]net.Conn
+	nextID uint32
+}
+
+func newForwardRelay(kind string, send func(controlMessage) error, dial func() (net.Conn, error)) *forwardRelay {
+	return &forwardRelay{kind: kind, send: send, dial: dial, conns: make(map[uint32]net.Conn)}
+}
+
+// serve relays each connection accepted by ln until it's closed
+func (r *forwardRelay) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		id := r.add(conn)
+		if err := r.send(controlMessage{Type: r.kind + "-open", Forward: id}); err != nil {
+			log.Debug.Printf("Failed to forward %s connection: %v", r.kind, err)
+			r.remove(id)
+			continue
+		}
+		go r.pump(id, conn)
+	}
+}
+
+// handle takes a control message for this relay, reporting whether it
+// was one
+func (r *forwardRelay) handle(msg controlMessage) bool {
+	switch msg.Type {
+	case r.kind + "-open":
+		if r.dial == nil {
+			return true
+		}
+		conn, err := r.dial()
+		if err != nil {
+			log.Debug.Printf("Failed to connect forwarded %s: %v", r.kind, err)
+			r.send(controlMessage{Type: r.kind + "-close", Forward: msg.Forward})
+			return true
+		}
+		r.put(msg.Forward, conn)
+		go r.pump(msg.Forward, conn)
+	case r.kind:
+		conn := r.get(msg.Forward)
+		if conn == nil {
+			return true
+		}
+		if _, err := conn.Write(msg.Data); err != nil {
+			r.remove(msg.Forward)
+		}
+	case r.kind + "-close":
+		r.remove(msg.Forward)
+	default:
+		return false
+	}
+	return true
+}
+
+// pump sends what a connection's local end writes to the peer, then tells
+// the peer it closed
+func (r *forwardRelay) pump(id uint32, conn net.Conn) {
+	defer RecoverTerminal()
+	buf := make([]byte, 16<<10)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			if r.send(controlMessage{Type: r.kind, Forward: id, Data: data}) != nil {
+				break
+			}
+		}
+		if err != nil {
+			if err != io.EOF && !isConnectionClosed(err) {
+				log.Debug.Printf("Forwarded %s connection %d failed: %v", r.kind, id, err)
+			}
+			break
+		}
+	}
+	if r.remove(id) {
+		r.send(controlMessage{Type: r.kind + "-close", Forward: id})
+	}
+}
+
+// add records a connection accepted here, returning its new ID
+func (r *forwardRelay) add(conn net.Conn) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.conns[r.nextID] = conn
+	return r.nextID
+}
+
+// put records a connection the peer opened, under the peer's ID
+func (r *forwardRelay) put(id uint32, conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[id] = conn
+}
+
+// get returns a connection, or nil if it's closed
+func (r *forwardRelay) get(id uint32) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[id]
+}
+
+// take removes a connection, returning it or nil if it was already gone
+func (r *forwardRelay) take(id uint32) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn := r.conns[id]
+	delete(r.conns, id)
+	return conn
+}
+
+// remove closes a connection, reporting whether it was still open
+func (r *forwardRelay) remove(id uint32) bool {
+	conn := r.take(id)
+	if conn == nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// closeAll closes every connection. Those relayed over a connection that
+// dropped can't be resumed, since requests may be half sent.
+func (r *forwardRelay) closeAll() {
+	for _, conn := range r.takeAll() {
+		conn.Close()
+	}
+}
+
+// takeAll removes every connection, returning them
+func (r *forwardRelay) takeAll() map[uint32]net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := r.conns
+	r.conns = make(map[uint32]net.Conn)
+	return conns
+}
+
+// forwardingAllowed returns an error if a session may not forward what
+// it asked for: forwarding must be enabled, the token must have full
+// access, and the session can't be confined, since forwarded sockets live
+// outside any jail or sandbox
+func (s *Server) forwardingAllowed(what string, enabled bool, g *grant) error {
+	if !enabled {
+		return fmt.Errorf("%s forwarding is disabled", what)
+	}
+	if g == nil || !g.full {
+		return fmt.Errorf("%s forwarding needs a full access token", what)
+	}
+	if s.jail != nil || s.sandbox != nil {
+		return fmt.Errorf("%s forwarding is not available on confined servers", what)
+	}
+	return nil
+}
+
+// startForwards sets up the forwarding a session's client asked for. It
+// returns the relays, a function that removes them, and the reasons for
+// refusing any, which don't stop the session.
+func (s *Server) startForwards(r *http.Request, cmd *exec.Cmd, ctl *sessionControl) ([]*forwardRelay, func(), []error) {
+	var relays []*forwardRelay
+	var cleanups []func()
+	var refused []error
+	start := func(what string, enabled bool, forward func() (*forwardRelay, func(), error)) {
+		err := s.forwardingAllowed(what, enabled, grantFrom(r.Context()))
+		if err == nil {
+			var relay *forwardRelay
+			var cleanup func()
+			if relay, cleanup, err = forward(); err == nil {
+				relays = append(relays, relay)
+				cleanups = append(cleanups, cleanup)
+				return
+			}
+		}
+		refused = append(refused, err)
+	}
+
+	q := r.URL.Query()
+	if q.Get("agent") == "1" {
+		start("agent", s.agentForward, func() (*forwardRelay, func(), error) {
+			return s.forwardAgent(cmd, ctl)
+		})
+	}
+	if auth := q.Get("x11"); auth != "" {
+		start("X11", s.x11Forward, func() (*forwardRelay, func(), error) {
+			return s.forwardX11(cmd, ctl, auth)
+		})
+	}
+	return relays, func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}, refused
+}
+
+// sendForward returns a relay's send function for the client attached to
+// ctl
+func sendForward(ctl *sessionControl) func(controlMessage) error {
+	return func(msg controlMessage) error {
+		conn, _ := ctl.current()
+		if conn == nil {
+			return fmt.Errorf("no client attached")
+		}
+		return conn.send(msg)
+	}
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestForwardRelay(t *testing.T) {
+	// The client's service echoes what it's sent
+	dial := func() (net.Conn, error) {
+		agent, conn := net.Pipe()
+		go io.Copy(agent, agent)
+		return conn, nil
+	}
+	var server, client *forwardRelay
+	server = newForwardRelay("agent", func(msg controlMessage) error {
+		client.handle(msg)
+		return nil
+	}, nil)
+	client = newForwardRelay("agent", func(msg controlMessage) error {
+		server.handle(msg)
+		return nil
+	}, dial)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len("request"))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "request" {
+		t.Fatalf("Expected the request echoed through the relay, got %q, %v", reply, err)
+	}
+
+	// A dropped connection closes the relayed ones
+	server.closeAll()
+	defer client.closeAll()
+	if _, err := conn.Read(reply); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Health endpoints, for load balancer health checks and Kubernetes probes.
+// They need no token.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// Health is the response of the health endpoints. Checks maps each
+// readiness check to "ok" or what's wrong.
+type Health struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// handleHealthz reports that the server is running and answering requests
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Health{Status: "ok"})
+}
+
+// handleReadyz reports whether the server can start sessions: clients can
+// authenticate, its shell exists, a PTY can be opened and it isn't
+// draining. It answers 503 when it can't, so traffic goes elsewhere.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	h := Health{Status: "ready", Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		h.Checks[name] = "ok"
+		if err != nil {
+			h.Status, h.Checks[name] = "not ready", err.Error()
+		}
+	}
+
+	check("auth", s.checkAuth())
+	check("shell", s.checkShell())
+	err := checkPTY()
+	if err != nil {
+		err = fmt.Errorf("can't open a PTY: %v", err)
+	}
+	check("pty", err)
+	err = nil
+	if draining, _ := s.draining(); draining {
+		err = fmt.Errorf("draining")
+	}
+	check("drain", err)
+
+	status := http.StatusOK
+	if h.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, h)
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getHealth requests a health endpoint without a token
+func getHealth(t *testing.T, s *Server, path string) (int, Health) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var h Health
+	if err := json.NewDecoder(rec.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, h
+}
+
+func TestHealthz(t *testing.T) {
+	s := NewServer(0)
+	if code, h := getHealth(t, s, healthzPath); code != http.StatusOK || h.Status != "ok" {
+		t.Errorf("Expected a running server to be healthy, got %d %+v", code, h)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s := NewServer(0)
+	code, h := getHealth(t, s, readyzPath)
+	if code != http.StatusServiceUnavailable || h.Checks["auth"] == "ok" {
+		t.Errorf("Expected a server without a token not to be ready, got %d %+v", code, h)
+	}
+
+	s.SetAuthToken("ready-token")
+	code, h = getHealth(t, s, readyzPath)
+	if h.Checks["pty"] != "ok" {
+		t.Skipf("No PTYs here: %s", h.Checks["pty"])
+	}
+	if code != http.StatusOK || h.Status != "ready" {
+		t.Errorf("Expected the server to be ready, got %d %+v", code, h)
+	}
+	for _, name := range []string{"auth", "shell", "pty", "drain"} {
+		if h.Checks[name] != "ok" {
+			t.Errorf("Expected the %s check to pass, got %q", name, h.Checks[name])
+		}
+	}
+
+	s.Drain("")
+	if code, h = getHealth(t, s, readyzPath); code != http.StatusServiceUnavailable || h.Checks["drain"] == "ok" {
+		t.Errorf("Expected a draining server not to be ready, got %d %+v", code, h)
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// hookTimeout bounds how long a session hook may run
+const hookTimeout = 30 * time.Second
+
+// sessionHooks are scripts run when sessions start and end, e.g. to mount
+// per-user volumes or tear down scratch directories. A failing start hook
+// refuses the session; end hook failures are only logged.
+type sessionHooks struct {
+	start string
+	end   string
+}
+
+// runStart runs the start hook for a session that's about to begin,
+// stopping it if ctx is done first
+func (h sessionHooks) runStart(ctx context.Context, sess *Session) error {
+	if h.start == "" {
+		return nil
+	}
+	return runHook(ctx, h.start, hookEnv(sess))
+}
+
+// runEnd runs the end hook for a finished session. It cleans up after the
+// session, so it isn't cut short when ctx is done, only by hookTimeout.
+func (h sessionHooks) runEnd(ctx context.Context, sess *Session, exitCode int) {
+	if h.end == "" {
+		return
+	}
+	env := append(hookEnv(sess),
+		"FLYSSH_EXIT_CODE="+strconv.Itoa(exitCode),
+		fmt.Sprintf("FLYSSH_DURATION=%d", int(time.Since(sess.StartTime).Seconds())),
+	)
+	if err := runHook(context.WithoutCancel(ctx), h.end, env); err != nil {
+		log.Info.Printf("Session end hook for %s failed: %v", sess.ID, err)
+	}
+}
+
+// hookEnv describes a session to its hooks
+func hookEnv(sess *Session) []string {
+	return append(os.Environ(),
+		"FLYSSH_SESSION_ID="+sess.ID,
+		"FLYSSH_USER="+sess.User,
+		"FLYSSH_TOKEN_NAME="+sess.token,
+		"FLYSSH_REMOTE_ADDR="+sess.RemoteAddr,
+		"FLYSSH_LAUNCHER="+sess.Launcher,
+		"FLYSSH_COMMAND="+sess.Command,
+	)
+}
+
+// runHook runs a hook script until it exits, hookTimeout passes or ctx is
+// done, returning its output in the error if it fails
+func runHook(ctx context.Context, path string, env []string) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	// Hooks are configured by the server operator, not clients
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = env
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("hook %s timed out after %v", path, hookTimeout)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("hook %s stopped: %v", path, ctx.Err())
+		}
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("hook %s failed: %v: %s", path, err, msg)
+		}
+		return fmt.Errorf("hook %s failed: %v", path, err)
+	}
+	if out.Len() > 0 {
+		log.Debug.Printf("Hook %s: %s", path, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package core
+
+// jailEnv carries a jailed session's root directory to the sandbox init
+// process, which mounts its /dev and /proc and changes root before running
+// the session's command
+const jailEnv = "FLYSSH_JAIL_ROOT"
+
+// Jail confines each session's command on Linux to a directory, with a
+// minimal /dev and its own /proc, so that it can't see the host's
+// filesystem. Commands and the libraries they need must exist inside it.
+type Jail struct {
+	root string
+}
+
+// SetJail runs every session's command in j
+func (s *Server) SetJail(j *Jail) {
+	s.jail = j
+}
+
+// jailRoot returns the directory sessions are confined to, or "" if they
+// aren't
+func (s *Server) jailRoot() string {
+	if s.jail == nil {
+		return ""
+	}
+	return s.jail.root
+}
@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// jailDevices are the host devices a jail's /dev gets
+var jailDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// jailLinks are the symlinks a jail's /dev gets
+var jailLinks = map[string]string{
+	"ptmx":   "pts/ptmx",
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+}
+
+// NewJail confines sessions to root, creating the directories its /dev,
+// /proc and /tmp are mounted on. The server must run as root.
+func NewJail(root string) (*Jail, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("chroot jails need the server to run as root")
+	}
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve jail directory: %v", err)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("jail %s is not a directory", root)
+	}
+	for name, mode := range map[string]os.FileMode{"dev": 0755, "proc": 0555, "tmp": 01777} {
+		if err := os.Mkdir(filepath.Join(root, name), mode); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create jail's /%s: %v", name, err)
+		}
+	}
+	return &Jail{root: root}, nil
+}
+
+// wrap makes cmd start in the jail, through the sandbox init process. Its
+// directory is taken to be inside the jail; like sshd, it starts at the
+// jail's root when that doesn't exist.
+func (j *Jail) wrap(cmd *exec.Cmd) {
+	dir := filepath.Join(j.root, cmd.Dir)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		dir = j.root
+	}
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Env, jailEnv+"="+j.root)
+	confine(cmd)
+}
+
+// mountJailDev gives a jail a /dev holding only harmless devices, PTYs of
+// its own, the session's terminal and the usual links
+func mountJailDev(root string) error {
+	dev := filepath.Join(root, "dev")
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("failed to mount /dev: %v", err)
+	}
+	for _, name := range jailDevices {
+		path := filepath.Join(dev, name)
+		if err := os.WriteFile(path, nil, 0666); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %v", name, err)
+		}
+		if err := syscall.Mount("/dev/"+name, path, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount /dev/%s: %v", name, err)
+		}
+	}
+	// A PTY instance of the jail's own, so that the host's other terminals
+	// can't be reached from it
+	pts := filepath.Join(dev, "pts")
+	if err := os.Mkdir(pts, 0755); err != nil {
+		return fmt.Errorf("failed to create /dev/pts: %v", err)
+	}
+	if err := syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		return fmt.Errorf("failed to mount /dev/pts: %v", err)
+	}
+	// The session's terminal is the host's, so it's brought in on its own,
+	// as the jail's console. Its open file belongs to the server's mounts,
+	// so it's mounted by name from this namespace's.
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		tty, err := os.Readlink("/proc/self/fd/0")
+		if err != nil {
+			return fmt.Errorf("failed to find terminal: %v", err)
+		}
+		console := filepath.Join(dev, "console")
+		if err := os.WriteFile(console, nil, 0600); err != nil {
+			return fmt.Errorf("failed to create /dev/console: %v", err)
+		}
+		if err := syscall.Mount(tty, console, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount /dev/console: %v", err)
+		}
+	}
+	shm := filepath.Join(dev, "shm")
+	if err := os.Mkdir(shm, 01777); err != nil {
+		return fmt.Errorf("failed to create /dev/shm: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /dev/shm: %v", err)
+	}
+	for name, target := range jailLinks {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return fmt.Errorf("failed to create /dev/%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// enterJail changes root to the jail, keeping the working directory the
+// session was started in
+func enterJail(root string) error {
+	cwd, err := syscall.Getwd()
+	if err != nil {
+		cwd = root
+	}
+	if err := syscall.Chroot(root); err != nil {
+		return fmt.Errorf("failed to change root: %v", err)
+	}
+	dir := strings.TrimPrefix(cwd, root)
+	if dir == "" || !strings.HasPrefix(dir, "/") {
+		dir = "/"
+	}
+	if err := syscall.Chdir(dir); err != nil {
+		return fmt.Errorf("failed to change directory: %v", err)
+	}
+	return nil
+}
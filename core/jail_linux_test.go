@@ -0,0 +1,42 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestJailWrap(t *testing.T) {
+	j := &Jail{root: t.TempDir()}
+	os.Mkdir(filepath.Join(j.root, "work"), 0755)
+
+	for dir, want := range map[string]string{"/work": "/work", "/missing": "", "": ""} {
+		cmd := exec.Command("/bin/sh")
+		cmd.Dir = dir
+		j.wrap(cmd)
+		if cmd.Dir != filepath.Join(j.root, want) {
+			t.Errorf("wrap() in %q starts in %q, want %q inside the jail", dir, cmd.Dir, want)
+		}
+	}
+
+	// A jailed and sandboxed command goes through the sandbox init once
+	sb := &Sandbox{scratch: t.TempDir()}
+	cmd := exec.Command("/bin/sh", "-c", "true")
+	j.wrap(cmd)
+	cleanup, err := sb.wrap(cmd, "#1")
+	if err != nil {
+		t.Fatalf("wrap() error = %v", err)
+	}
+	defer cleanup()
+	if cmd.Path != "/proc/self/exe" || len(cmd.Args) != 4 || cmd.Args[1] != "/bin/sh" {
+		t.Errorf("Command isn't run through the sandbox init once: %q %q", cmd.Path, cmd.Args)
+	}
+	env := map[string]bool{}
+	for _, kv := range cmd.Env {
+		env[kv] = true
+	}
+	if !env[jailEnv+"="+j.root] || !env[sandboxEnv+"="+filepath.Join(sb.scratch, "1")] {
+		t.Errorf("Command environment %q doesn't name the jail and scratch directory", cmd.Env)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// NewJail is not available outside Linux
+func NewJail(root string) (*Jail, error) {
+	return nil, fmt.Errorf("chroot jails are only supported on Linux")
+}
+
+func (j *Jail) wrap(cmd *exec.Cmd) {}
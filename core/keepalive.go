@@ -0,0 +1,132 @@
+package core
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// DefaultKeepalive is how often each side pings the other
+const DefaultKeepalive = 15 * time.Second
+
+// keepaliveMisses is how many intervals the peer may stay silent before
+// the connection is considered dead
+const keepaliveMisses = 3
+
+// keepalive pings a connection's peer and closes the connection when the
+// peer goes silent, rather than waiting minutes for TCP to notice a dead
+// network. Anything received from the peer counts as a sign of life.
+// Peers that never answer a ping predate keepalives and are never timed
+// out, since an idle session from them is indistinguishable from a dead one.
+type keepalive struct {
+	conn     transport
+	interval time.Duration
+	link     *linkStats   // measures the round trip of pings
+	last     atomic.Int64 // when the peer was last heard from, in unix nanoseconds
+	pinged   atomic.Int64 // when the unanswered ping was sent, in unix nanoseconds
+	answered atomic.Bool  // the peer has answered a ping
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// startKeepalive starts pinging conn every interval, recording each
+// ping's round trip in link if it isn't nil. Zero only answers the peer's
+// pings.
+func startKeepalive(conn transport, interval time.Duration, link *linkStats) *keepalive {
+	k := &keepalive{conn: conn, interval: interval, link: link, stop: make(chan struct{})}
+	k.heard()
+	if interval > 0 && conn.hasControl() {
+		go k.run()
+	}
+	return k
+}
+
+func (k *keepalive) run() {
+	defer RecoverTerminal()
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	// Measuring the link starts with a ping at once, rather than after
+	// the first interval
+	if k.link != nil && !k.ping() {
+		return
+	}
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+
+		silent := time.Since(time.Unix(0, k.last.Load()))
+		if k.answered.Load() && silent >= keepaliveMisses*k.interval {
+			log.Debug.Printf("Peer silent for %v, closing connection", silent.Round(time.Second))
+			k.conn.Close()
+			return
+		}
+		if !k.ping() {
+			return
+		}
+	}
+}
+
+// ping sends a ping, reporting whether it could
+func (k *keepalive) ping() bool {
+	k.pinged.Store(time.Now().UnixNano())
+	if err := k.conn.send(controlMessage{Type: "ping"}); err != nil {
+		log.Debug.Printf("Failed to send ping: %v", err)
+		return false
+	}
+	return true
+}
+
+// heard records that the peer is alive
+func (k *keepalive) heard() {
+	k.last.Store(time.Now().UnixNano())
+}
+
+// control handles an incoming control message, answering pings. It
+// reports whether the message was a keepalive.
+func (k *keepalive) control(msg controlMessage) bool {
+	k.heard()
+	switch msg.Type {
+	case "ping":
+		if err := k.conn.send(controlMessage{Type: "pong"}); err != nil {
+			log.Debug.Printf("Failed to send pong: %v", err)
+		}
+		return true
+	case "pong":
+		k.answered.Store(true)
+		if sent := k.pinged.Swap(0); sent != 0 {
+			k.link.addRTT(time.Since(time.Unix(0, sent)))
+		}
+		return true
+	}
+	return false
+}
+
+// reader returns r, noting the peer is alive whenever data arrives
+func (k *keepalive) reader(r io.Reader) io.Reader {
+	return &keepaliveReader{k: k, r: r}
+}
+
+// Stop stops pinging
+func (k *keepalive) Stop() {
+	k.once.Do(func() { close(k.stop) })
+}
+
+type keepaliveReader struct {
+	k *keepalive
+	r io.Reader
+}
+
+func (r *keepaliveReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.k.heard()
+	}
+	return n, err
+}
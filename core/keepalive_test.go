@@ -0,0 +1,115 @@
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// pingTransport records keepalive traffic from a running keepalive
+type pingTransport struct {
+	fakeTransport
+	mu     sync.Mutex
+	pings  int
+	pongs  int
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPingTransport() *pingTransport {
+	return &pingTransport{closed: make(chan struct{})}
+}
+
+func (t *pingTransport) send(msg controlMessage) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch msg.Type {
+	case "ping":
+		t.pings++
+	case "pong":
+		t.pongs++
+	}
+	return nil
+}
+
+func (t *pingTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+func TestKeepaliveClosesSilentPeer(t *testing.T) {
+	conn := newPingTransport()
+	ka := startKeepalive(conn, 10*time.Millisecond, nil)
+	defer ka.Stop()
+
+	// The peer answers once, then goes quiet
+	ka.control(controlMessage{Type: "pong"})
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected silent peer's connection to be closed")
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.pings == 0 {
+		t.Error("Expected pings to be sent")
+	}
+}
+
+func TestKeepaliveSparesPeersWithoutKeepalive(t *testing.T) {
+	conn := newPingTransport()
+	ka := startKeepalive(conn, 10*time.Millisecond, nil)
+	defer ka.Stop()
+
+	// A peer that never answers a ping is an older version
+	select {
+	case <-conn.closed:
+		t.Fatal("Connection to peer without keepalive was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKeepaliveAnswersPings(t *testing.T) {
+	conn := newPingTransport()
+	ka := startKeepalive(conn, 0, nil)
+	defer ka.Stop()
+
+	if !ka.control(controlMessage{Type: "ping"}) {
+		t.Error("Expected ping to be handled")
+	}
+	if ka.control(controlMessage{Type: "resize"}) {
+		t.Error("Expected resize to be passed on")
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.pongs != 1 || conn.pings != 0 {
+		t.Errorf("Got %d pongs and %d pings, want 1 pong and no pings", conn.pongs, conn.pings)
+	}
+}
+
+func TestKeepaliveMeasuresRoundTrip(t *testing.T) {
+	conn := newPingTransport()
+	link := &linkStats{}
+	ka := startKeepalive(conn, time.Hour, link)
+	defer ka.Stop()
+
+	// Measuring pings at once, without waiting an interval
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn.mu.Lock()
+		pings := conn.pings
+		conn.mu.Unlock()
+		if pings > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a ping at once")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	ka.control(controlMessage{Type: "pong"})
+	if rtt := time.Duration(link.rtt.Load()); rtt < 5*time.Millisecond {
+		t.Errorf("Expected a round trip of at least 5ms, got %v", rtt)
+	}
+}
@@ -0,0 +1,362 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// HostKeyCheck says how the client treats a wss:// server whose TLS key
+// it doesn't know yet, like ssh's StrictHostKeyChecking. Servers are known
+// by URL, in ~/.flyssh/known_hosts, and a known server presenting a
+// different key is refused, unless asking and both keys came with valid
+// certificates.
+type HostKeyCheck string
+
+const (
+	// HostKeyAsk asks whether to trust a new key, when there's a terminal
+	// to ask on, and otherwise trusts it only if a certificate authority
+	// vouches for it
+	HostKeyAsk HostKeyCheck = "ask"
+	// HostKeyAcceptNew trusts new keys without asking
+	HostKeyAcceptNew HostKeyCheck = "accept-new"
+	// HostKeyStrict refuses servers that aren't already known
+	HostKeyStrict HostKeyCheck = "yes"
+	// HostKeyOff only checks certificates the usual way
+	HostKeyOff HostKeyCheck = "no"
+)
+
+// ParseHostKeyCheck parses a HostKeyCheck by name. Empty is HostKeyAsk.
+func ParseHostKeyCheck(s string) (HostKeyCheck, error) {
+	switch check := HostKeyCheck(s); check {
+	case "":
+		return HostKeyAsk, nil
+	case HostKeyAsk, HostKeyAcceptNew, HostKeyStrict, HostKeyOff:
+		return check, nil
+	}
+	return "", fmt.Errorf("unknown host key check %q (use ask, accept-new, yes or no)", s)
+}
+
+// errHostKeyChanged is returned for a known server presenting another key
+var errHostKeyChanged = errors.New("host key has changed")
+
+// hostKeyCA marks a known key whose certificate was valid when it was
+// recorded, so a certificate authority vouched for the server, not only
+// the user
+const hostKeyCA = "ca"
+
+// knownHostsPath returns the path of the known hosts file
+func knownHostsPath() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "known_hosts"), nil
+}
+
+// hostKeyName returns the name a server's key is known by: its URL's
+// scheme, host and port, since one server serves every path. IPv6
+// addresses are bracketed and written the same way however the URL
+// spells them.
+func hostKeyName(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid server URL %q", serverURL)
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = ip.String()
+	}
+	if port := u.Port(); port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return u.Scheme + "://" + host, nil
+}
+
+// keyFingerprint returns the SHA-256 fingerprint of a certificate's
+// public key, which stays the same when the certificate is renewed with
+// the same key
+func keyFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// knownHostKey returns the fingerprint recorded for a server, or "" if it
+// isn't known, and whether its certificate was valid
+func knownHostKey(name string) (string, bool, error) {
+	path, err := knownHostsPath()
+	if err != nil {
+		return "", false, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read known hosts: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) == 2 || len(fields) == 3) && fields[0] == name {
+			return fields[1], len(fields) == 3 && fields[2] == hostKeyCA, nil
+		}
+	}
+	return "", false, scanner.Err()
+}
+
+// replaceHostKey replaces a server's key in the known hosts file, marked
+// if its certificate was valid. The file is written whole and renamed into
+// place, so the server is never left without a key.
+func replaceHostKey(name, fingerprint string, ca bool) error {
+	path, err := knownHostsPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read known hosts: %v", err)
+	}
+	var b strings.Builder
+	replaced := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == name {
+			if !replaced {
+				b.WriteString(hostKeyLine(name, fingerprint, ca) + "\n")
+				replaced = true
+			}
+			continue
+		}
+		b.WriteString(line)
+	}
+	if !replaced {
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteString("\n")
+		}
+		b.WriteString(hostKeyLine(name, fingerprint, ca) + "\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write known hosts: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write known hosts: %v", err)
+	}
+	return nil
+}
+
+// addHostKey records a server's key in the known hosts file, marked if
+// its certificate was valid
+func addHostKey(name, fingerprint string, ca bool) error {
+	path, err := knownHostsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write known hosts: %v", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, hostKeyLine(name, fingerprint, ca)); err != nil {
+		return fmt.Errorf("failed to write known hosts: %v", err)
+	}
+	return nil
+}
+
+// hostKeyLine returns a server's line in the known hosts file
+func hostKeyLine(name, fingerprint string, ca bool) string {
+	if ca {
+		return name + " " + fingerprint + " " + hostKeyCA
+	}
+	return name + " " + fingerprint
+}
+
+// hostKeyVerifier checks servers' keys against the known hosts file
+type hostKeyVerifier struct {
+	check HostKeyCheck
+	// ask asks the user whether to trust a new key, replacing previous
+	// if that isn't "", reporting false if there's no one to ask. Nil
+	// never asks.
+	ask func(name, fingerprint, previous string, verifyErr error) (trust, asked bool)
+	// roots are the certificate authorities trusted, nil for the system's
+	roots *x509.CertPool
+}
+
+// tlsConfig returns the TLS settings for dialing serverURL, or nil to
+// check the certificate the usual way
+func (v *hostKeyVerifier) tlsConfig(serverURL string) (*tls.Config, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Scheme != "wss" || v.check == HostKeyOff {
+		return nil, nil
+	}
+	name, err := hostKeyName(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	// Certificates are checked below, where a known key can stand in for
+	// a certificate authority
+	return &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return v.verify(name, cs)
+		},
+	}, nil
+}
+
+// verify checks the key a server presented
+func (v *hostKeyVerifier) verify(name string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%s presented no certificate", name)
+	}
+	fingerprint := keyFingerprint(cs.PeerCertificates[0])
+	known, knownCA, err := knownHostKey(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case known == fingerprint:
+		return nil
+	case known != "" && knownCA && v.check == HostKeyAsk && verifyChain(cs, v.roots) == nil:
+		// The old key and the new one both came with valid
+		// certificates, as when a certificate is replaced along with
+		// its key. The user still has the last word, if there's one to
+		// ask.
+		if v.ask != nil {
+			if trust, asked := v.ask(name, fingerprint, known, nil); asked && !trust {
+				return fmt.Errorf("host key verification failed for %s", name)
+			}
+		}
+		if err := replaceHostKey(name, fingerprint, true); err != nil {
+			return err
+		}
+		log.Info.Printf("%s changed its key to %s, with a valid certificate; updated known hosts", name, fingerprint)
+		return nil
+	case known != "":
+		return fmt.Errorf("%w: %s now presents %s, not the %s known for it. Someone may be intercepting the connection; if the key really changed, remove %s from the known hosts file",
+			errHostKeyChanged, name, fingerprint, known, name)
+	case v.check == HostKeyStrict:
+		return fmt.Errorf("%s is not a known host (add it with flyssh keyscan)", name)
+	}
+
+	verifyErr := verifyChain(cs, v.roots)
+	trust := v.check == HostKeyAcceptNew
+	if !trust {
+		asked := false
+		if v.ask != nil {
+			trust, asked = v.ask(name, fingerprint, "", verifyErr)
+		}
+		if !asked {
+			trust = verifyErr == nil
+		}
+	}
+	if !trust {
+		if verifyErr != nil {
+			return fmt.Errorf("host key verification failed for %s: %v", name, verifyErr)
+		}
+		return fmt.Errorf("host key verification failed for %s", name)
+	}
+	if err := addHostKey(name, fingerprint, verifyErr == nil); err != nil {
+		return err
+	}
+	log.Info.Printf("Added %s (%s) to known hosts", name, fingerprint)
+	return nil
+}
+
+// verifyChain checks a server's certificate the way TLS normally would,
+// against roots, or the system's if nil
+func verifyChain(cs tls.ConnectionState, roots *x509.CertPool) error {
+	opts := x509.VerifyOptions{DNSName: cs.ServerName, Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// promptHostKey asks on a terminal whether to trust a new key, in place
+// of previous if that isn't ""
+func promptHostKey(in io.Reader, out io.Writer, name, fingerprint, previous string, verifyErr error) bool {
+	if previous != "" {
+		fmt.Fprintf(out, "%s has a new key with a valid certificate, replacing %s.\n", name, previous)
+	} else {
+		fmt.Fprintf(out, "The authenticity of %s can't be established.\n", name)
+	}
+	if verifyErr != nil {
+		fmt.Fprintf(out, "Its certificate isn't trusted: %v\n", verifyErr)
+	}
+	fmt.Fprintf(out, "Key fingerprint is %s.\n", fingerprint)
+	fmt.Fprint(out, "Are you sure you want to continue connecting (yes/no)? ")
+
+	// Read a byte at a time so nothing after the answer is taken from
+	// the session's input
+	var answer []byte
+	b := make([]byte, 1)
+	for {
+		n, err := in.Read(b)
+		if n == 0 || err != nil || b[0] == '\n' {
+			break
+		}
+		answer = append(answer, b[0])
+	}
+	return strings.EqualFold(strings.TrimSpace(string(answer)), "yes")
+}
+
+// ScanHostKey connects to a wss:// server and returns its known hosts
+// line, for adding to the known hosts file
+func ScanHostKey(serverURL string) (string, error) {
+	name, err := hostKeyName(serverURL)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL %q", serverURL)
+	}
+	if u.Scheme != "wss" {
+		return "", fmt.Errorf("%s doesn't use TLS, so has no key", serverURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: true, // only the key is wanted
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %v", name, err)
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("%s presented no certificate", name)
+	}
+	return name + " " + keyFingerprint(certs[0]), nil
+}
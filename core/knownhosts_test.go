@@ -0,0 +1,196 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHostKeyName(t *testing.T) {
+	for url, want := range map[string]string{
+		"wss://Example.com/":           "wss://example.com",
+		"wss://example.com:443/a?b=c":  "wss://example.com",
+		"wss://example.com:8443/":      "wss://example.com:8443",
+		"ws://127.0.0.1:8081/sessions": "ws://127.0.0.1:8081",
+		"wss://[FDAA::0003]/":          "wss://[fdaa::3]",
+		"wss://[fdaa:0::3]:443/":       "wss://[fdaa::3]",
+		"wss://[fdaa::3]:8443/":        "wss://[fdaa::3]:8443",
+		"ws://[::1]:8081/":             "ws://[::1]:8081",
+	} {
+		if got, err := hostKeyName(url); err != nil || got != want {
+			t.Errorf("hostKeyName(%q) = %q, %v; want %q", url, got, err, want)
+		}
+	}
+}
+
+func TestHostKeyVerifier(t *testing.T) {
+	t.Setenv("FLYSSH_HOME", t.TempDir())
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	url := "wss" + strings.TrimPrefix(server.URL, "https")
+
+	dial := func(v *hostKeyVerifier) error {
+		config, err := v.tlsConfig(url)
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), config)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// The test certificate has no trusted authority, so an unknown key is
+	// only trusted when asked or told to
+	if err := dial(&hostKeyVerifier{check: HostKeyStrict}); err == nil {
+		t.Fatal("strict check accepted an unknown host")
+	}
+	if err := dial(&hostKeyVerifier{check: HostKeyAsk}); err == nil {
+		t.Fatal("ask accepted an untrusted certificate without asking")
+	}
+	refuse := func(name, fingerprint, previous string, verifyErr error) (bool, bool) { return false, true }
+	if err := dial(&hostKeyVerifier{check: HostKeyAsk, ask: refuse}); err == nil {
+		t.Fatal("ask accepted a refused key")
+	}
+	if err := dial(&hostKeyVerifier{check: HostKeyAcceptNew}); err != nil {
+		t.Fatalf("accept-new: %v", err)
+	}
+
+	// Now it's known, strict checking accepts it
+	name, _ := hostKeyName(url)
+	scanned, err := ScanHostKey(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, ca, err := knownHostKey(name)
+	if err != nil || scanned != name+" "+known || ca {
+		t.Fatalf("known key %q, %v; keyscan says %q", known, err, scanned)
+	}
+	if err := dial(&hostKeyVerifier{check: HostKeyStrict}); err != nil {
+		t.Fatalf("strict check of a known host: %v", err)
+	}
+
+	// A different key is refused however new keys are treated
+	other := httptest.NewTLSServer(http.NotFoundHandler())
+	defer other.Close()
+	if err := addHostKey("wss://"+other.Listener.Addr().String(), "SHA256:AAAA", false); err != nil {
+		t.Fatal(err)
+	}
+	url = "wss" + strings.TrimPrefix(other.URL, "https")
+	config, _ := (&hostKeyVerifier{check: HostKeyAcceptNew}).tlsConfig(url)
+	if _, err := tls.Dial("tcp", other.Listener.Addr().String(), config); !errors.Is(err, errHostKeyChanged) {
+		t.Fatalf("changed key: err = %v, want %v", err, errHostKeyChanged)
+	}
+}
+
+func TestHostKeyRotation(t *testing.T) {
+	t.Setenv("FLYSSH_HOME", t.TempDir())
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	url := "wss" + strings.TrimPrefix(server.URL, "https")
+	name, _ := hostKeyName(url)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	dial := func(v *hostKeyVerifier) error {
+		config, err := v.tlsConfig(url)
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), config)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	// pin records another key for the server, as if it had rotated since
+	pin := func(ca bool) {
+		t.Helper()
+		if err := replaceHostKey(name, "SHA256:AAAA", ca); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A key with a valid certificate is recorded as such
+	if err := dial(&hostKeyVerifier{check: HostKeyAsk, roots: roots}); err != nil {
+		t.Fatalf("ask refused a valid certificate: %v", err)
+	}
+	fingerprint, ca, err := knownHostKey(name)
+	if err != nil || fingerprint == "" || !ca {
+		t.Fatalf("Expected the key to be recorded with its certificate, got %q, %v, %v", fingerprint, ca, err)
+	}
+
+	// Asking, it can move to another key with a valid certificate
+	pin(true)
+	if err := dial(&hostKeyVerifier{check: HostKeyAsk, roots: roots}); err != nil {
+		t.Fatalf("ask refused a rotated key with a valid certificate: %v", err)
+	}
+	if known, ca, _ := knownHostKey(name); known != fingerprint || !ca {
+		t.Errorf("Expected the new key to replace the old one, got %q, %v", known, ca)
+	}
+
+	// With a terminal, the user is asked first, and can refuse
+	pin(true)
+	var previous string
+	refuse := func(name, fingerprint, old string, verifyErr error) (bool, bool) {
+		previous = old
+		return false, true
+	}
+	if err := dial(&hostKeyVerifier{check: HostKeyAsk, roots: roots, ask: refuse}); err == nil {
+		t.Error("ask replaced a key the user refused")
+	}
+	if previous != "SHA256:AAAA" {
+		t.Errorf("Expected to be asked about replacing SHA256:AAAA, got %q", previous)
+	}
+	if known, _, _ := knownHostKey(name); known != "SHA256:AAAA" {
+		t.Errorf("Expected the refused key to be kept, got %q", known)
+	}
+
+	// But not without a valid certificate, from a key trusted without one,
+	// or when only known keys are accepted
+	for _, tt := range []struct {
+		name string
+		ca   bool
+		v    *hostKeyVerifier
+	}{
+		{"invalid certificate", true, &hostKeyVerifier{check: HostKeyAsk}},
+		{"key trusted without a certificate", false, &hostKeyVerifier{check: HostKeyAsk, roots: roots}},
+		{"strict checking", true, &hostKeyVerifier{check: HostKeyStrict, roots: roots}},
+	} {
+		pin(tt.ca)
+		if err := dial(tt.v); !errors.Is(err, errHostKeyChanged) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, errHostKeyChanged)
+		}
+	}
+}
+
+func TestReplaceHostKey(t *testing.T) {
+	t.Setenv("FLYSSH_HOME", t.TempDir())
+	for _, name := range []string{"wss://a", "wss://b", "wss://c"} {
+		if err := addHostKey(name, "SHA256:AAAA", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := replaceHostKey("wss://b", "SHA256:BBBB", true); err != nil {
+		t.Fatal(err)
+	}
+	path, err := knownHostsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entry is replaced where it was, and the others kept
+	want := "wss://a SHA256:AAAA\nwss://b SHA256:BBBB ca\nwss://c SHA256:AAAA\n"
+	if string(data) != want {
+		t.Errorf("Known hosts are %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultReadOnlyInput is the input a read-only session still accepts:
+// "q" and Ctrl+C, enough to quit pagers and tools like top
+const defaultReadOnlyInput = "q\x03"
+
+// Launcher is a named, predefined command that clients can run instead of a shell
+type Launcher struct {
+	Command []string          `json:"command"`
+	Env     map[string]string `json:"env,omitempty"`
+
+	// ReadOnly discards client input except for the bytes in AllowInput
+	ReadOnly   bool   `json:"read_only,omitempty"`
+	AllowInput string `json:"allow_input,omitempty"`
+
+	// Project, if set, runs the command in a project's devcontainer or
+	// Nix shell, starting in its directory
+	Project *Project `json:"project,omitempty"`
+
+	// StepUp requires the user to confirm the session with a security key,
+	// one of those in the config's WebAuthn settings
+	StepUp bool `json:"step_up,omitempty"`
+
+	// DualControl holds each session until a second person, with a token
+	// of their own that may run the launcher, joins to watch it
+	DualControl bool `json:"dual_control,omitempty"`
+}
+
+// inputFilter wraps client input for read-only launchers; other launchers
+// get r back unchanged
+func (l *Launcher) inputFilter(r io.Reader) io.Reader {
+	if !l.ReadOnly {
+		return r
+	}
+	allowed := l.AllowInput
+	if allowed == "" {
+		allowed = defaultReadOnlyInput
+	}
+	return &readOnlyReader{r: r, allowed: allowed}
+}
+
+// readOnlyReader drops every byte that isn't in the allowed set
+type readOnlyReader struct {
+	r       io.Reader
+	allowed string
+}
+
+func (f *readOnlyReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		kept := 0
+		for _, b := range p[:n] {
+			if strings.IndexByte(f.allowed, b) >= 0 {
+				p[kept] = b
+				kept++
+			}
+		}
+		// Keep reading rather than returning an empty read, which io.Copy
+		// would treat as a no-op but other readers may not
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// ScopedToken is an auth token restricted to a set of launchers
+type ScopedToken struct {
+	Token     string   `json:"token"`
+	Name      string   `json:"name"`
+	Launchers []string `json:"launchers"`
+	Quota     *Quota   `json:"quota,omitempty"`   // overrides the server's default quota
+	Project   *Project `json:"project,omitempty"` // overrides its launchers' projects
+}
+
+// LauncherConfig holds launcher definitions and the tokens scoped to them
+type LauncherConfig struct {
+	Launchers map[string]Launcher `json:"launchers"`
+	Tokens    []ScopedToken       `json:"tokens"`
+	WebAuthn  *WebAuthn           `json:"webauthn,omitempty"` // security keys for step_up launchers
+}
+
+// LoadLauncherConfig reads a launcher configuration from a JSON file
+func LoadLauncherConfig(path string) (*LauncherConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read launcher config: %v", err)
+	}
+
+	var cfg LauncherConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse launcher config: %v", err)
+	}
+
+	if cfg.WebAuthn != nil {
+		if err := cfg.WebAuthn.check(); err != nil {
+			return nil, err
+		}
+	}
+	for name, l := range cfg.Launchers {
+		if len(l.Command) == 0 {
+			return nil, fmt.Errorf("launcher %q has no command", name)
+		}
+		if l.StepUp && cfg.WebAuthn == nil {
+			return nil, fmt.Errorf("launcher %q needs step-up, but no webauthn settings are given", name)
+		}
+		if l.Project != nil {
+			if err := l.Project.check(); err != nil {
+				return nil, fmt.Errorf("launcher %q: %v", name, err)
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for _, t := range cfg.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("scoped token %q is empty", t.Name)
+		}
+		if t.Name == fullTokenName {
+			return nil, fmt.Errorf("scoped token can't be named %q", t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("scoped token %q is defined twice", t.Name)
+		}
+		names[t.Name] = true
+		if t.Project != nil {
+			if err := t.Project.check(); err != nil {
+				return nil, fmt.Errorf("token %q: %v", t.Name, err)
+			}
+		}
+		for _, name := range t.Launchers {
+			if _, ok := cfg.Launchers[name]; !ok {
+				return nil, fmt.Errorf("token %q references unknown launcher %q", t.Name, name)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// fullTokenName names the full access token in logs, audit events and
+// quotas, so no scoped token may take it
+const fullTokenName = "admin"
+
+// grant describes what an authenticated token is allowed to do
+type grant struct {
+	name      string
+	full      bool      // full access: shells, any launcher and the admin API
+	launchers []string  // launchers a scoped token may run
+	expires   time.Time // when a temporary token stops working, if it does
+}
+
+// allows reports whether the grant may run the named launcher
+func (g *grant) allows(launcher string) bool {
+	if g.full {
+		return true
+	}
+	for _, name := range g.launchers {
+		if name == launcher {
+			return true
+		}
+	}
+	return false
+}
+
+type grantKey struct{}
+
+// withGrant returns a context carrying the grant
+func withGrant(ctx context.Context, g *grant) context.Context {
+	return context.WithValue(ctx, grantKey{}, g)
+}
+
+// grantFrom returns the grant stored in ctx, if any
+func grantFrom(ctx context.Context) *grant {
+	g, _ := ctx.Value(grantKey{}).(*grant)
+	return g
+}
+
+// lookupLauncher resolves a launcher requested by the client, checking that
+// the grant permits it
+func (s *Server) lookupLauncher(g *grant, name string) (*Launcher, error) {
+	if s.launchers == nil {
+		return nil, fmt.Errorf("no launchers configured")
+	}
+	l, ok := s.launchers.Launchers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown launcher %q", name)
+	}
+	if g == nil || !g.allows(name) {
+		return nil, fmt.Errorf("token not permitted to run launcher %q", name)
+	}
+	return &l, nil
+}
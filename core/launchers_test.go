@@ -0,0 +1,73 @@
+package core
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadLauncherConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"valid", `{"launchers":{"logs":{"command":["tail","-f","/var/log/app.log"]}},"tokens":[{"token":"x","name":"ops","launchers":["logs"]}]}`, false},
+		{"empty command", `{"launchers":{"logs":{"command":[]}}}`, true},
+		{"unknown launcher", `{"launchers":{},"tokens":[{"token":"x","name":"ops","launchers":["logs"]}]}`, true},
+		{"empty token", `{"launchers":{},"tokens":[{"token":"","name":"ops"}]}`, true},
+		{"duplicate token name", `{"launchers":{"logs":{"command":["sh"]}},"tokens":[{"token":"x","name":"ops","launchers":["logs"]},{"token":"y","name":"ops","launchers":["logs"]}]}`, true},
+		{"full token's name", `{"launchers":{"logs":{"command":["sh"]}},"tokens":[{"token":"x","name":"admin","launchers":["logs"]}]}`, true},
+		{"step-up without webauthn", `{"launchers":{"prod":{"command":["sh"],"step_up":true}}}`, true},
+		{"invalid json", `{`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadLauncherConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadLauncherConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGrantAllows(t *testing.T) {
+	full := &grant{full: true}
+	scoped := &grant{launchers: []string{"logs"}}
+
+	if !full.allows("anything") {
+		t.Error("Expected full grant to allow any launcher")
+	}
+	if !scoped.allows("logs") || scoped.allows("psql") {
+		t.Error("Expected scoped grant to allow only its launchers")
+	}
+}
+
+func TestReadOnlyLauncherInput(t *testing.T) {
+	l := &Launcher{Command: []string{"top"}, ReadOnly: true}
+	data, err := io.ReadAll(l.inputFilter(strings.NewReader("rm -rf /\nq\x03")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "q\x03" {
+		t.Errorf("Expected only control keys to pass, got %q", data)
+	}
+
+	writable := &Launcher{Command: []string{"psql"}}
+	data, err = io.ReadAll(writable.inputFilter(strings.NewReader("select 1;\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "select 1;\n" {
+		t.Errorf("Expected input to pass unchanged, got %q", data)
+	}
+}
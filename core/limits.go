@@ -0,0 +1,186 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// rateLimiter is a per-key token bucket limiter
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate events per second per key,
+// with bursts of up to burst events
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow reports whether an event for key may proceed at time now
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets that have refilled completely so idle clients don't
+// accumulate. Must be called with mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// SetConnectionLimits caps the number of concurrent sessions and rate limits
+// new connection attempts per source IP. Zero values disable a limit.
+func (s *Server) SetConnectionLimits(maxSessions int, ratePerSecond float64, burst int) {
+	s.maxSessions = maxSessions
+	if ratePerSecond > 0 {
+		s.limiter = newRateLimiter(ratePerSecond, burst)
+	} else {
+		s.limiter = nil
+	}
+}
+
+// withLimits wraps a session handler with rate limiting and the concurrent
+// session cap. Rejected attempts are refused before the WebSocket upgrade.
+func (s *Server) withLimits(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter != nil {
+			ip := remoteIP(r.RemoteAddr)
+			if !s.limiter.allow(ip, time.Now()) {
+				log.Info.Printf("Rate limited connection from %s", r.RemoteAddr)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many connection attempts", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		// Resuming reattaches a session that's already counted, and
+		// multiplexed connections count each channel as it's opened
+		if r.URL.Query().Get("resume") == "" && !offersProtocol(r, ProtocolV3) {
+			release, err := s.acquireSession()
+			if err != nil {
+				log.Info.Printf("Refusing %s: %v", r.RemoteAddr, err)
+				http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+				return
+			}
+			defer release()
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// remoteIP strips the port from a remote address
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// acquireSession takes a slot under the session cap and memory budget. It
+// returns an error saying why if the server is full; otherwise release
+// must be called when the session ends.
+func (s *Server) acquireSession() (release func(), err error) {
+	if s.memoryLimit > 0 {
+		if used := memoryInUse(); used > s.memoryLimit {
+			return nil, fmt.Errorf("server at capacity: using %s of memory, over its %s budget", formatBytes(float64(used)), formatBytes(float64(s.memoryLimit)))
+		}
+	}
+	active := atomic.AddInt64(&s.activeSessions, 1)
+	release = func() { atomic.AddInt64(&s.activeSessions, -1) }
+	if s.maxSessions > 0 && active > int64(s.maxSessions) {
+		release()
+		return nil, fmt.Errorf("server at session capacity: session limit of %d reached", s.maxSessions)
+	}
+	return release, nil
+}
+
+// SetMemoryLimit sheds new sessions while the server uses more than limit
+// bytes, leaving room for the sessions it has rather than letting the
+// kernel's OOM killer end them all. Memory is measured for the server's
+// cgroup, which includes the sessions' processes, or without one for the
+// server process. Zero disables the budget.
+func (s *Server) SetMemoryLimit(limit uint64) {
+	s.memoryLimit = limit
+}
+
+// cgroupMemoryFiles hold the memory a cgroup uses, for cgroup v2 and v1
+var cgroupMemoryFiles = []string{
+	"/sys/fs/cgroup/memory.current",
+	"/sys/fs/cgroup/memory/memory.usage_in_bytes",
+}
+
+// memoryInUse returns how much memory the server's cgroup uses, or if
+// there's none to read, how much the Go runtime has taken from the OS
+func memoryInUse() uint64 {
+	for _, file := range cgroupMemoryFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			return n
+		}
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys
+}
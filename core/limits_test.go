@@ -0,0 +1,56 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Now()
+
+	if !l.allow("a", now) || !l.allow("a", now) {
+		t.Fatal("Expected burst of 2 to be allowed")
+	}
+	if l.allow("a", now) {
+		t.Error("Expected third attempt to be limited")
+	}
+	if !l.allow("b", now) {
+		t.Error("Expected other IPs to have their own bucket")
+	}
+	if !l.allow("a", now.Add(time.Second)) {
+		t.Error("Expected bucket to refill after one second")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1:1234": "127.0.0.1",
+		"[::1]:1234":     "::1",
+		"garbage":        "garbage",
+	}
+	for addr, want := range tests {
+		if got := remoteIP(addr); got != want {
+			t.Errorf("remoteIP(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestAcquireSessionMemoryLimit(t *testing.T) {
+	if memoryInUse() == 0 {
+		t.Fatal("Expected memory in use to be measured")
+	}
+	s := NewServer(0)
+	s.SetMemoryLimit(1)
+	if _, err := s.acquireSession(); err == nil || !strings.Contains(err.Error(), "server at capacity") {
+		t.Errorf("Expected a server over its memory budget to be at capacity, got %v", err)
+	}
+
+	s.SetMemoryLimit(1 << 50)
+	release, err := s.acquireSession()
+	if err != nil {
+		t.Fatalf("Expected a session under the memory budget, got %v", err)
+	}
+	release()
+}
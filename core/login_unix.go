@@ -0,0 +1,139 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runAs makes cmd run as the named account, in its home directory. Only a
+// server running as root can start sessions as other users.
+func runAs(cmd *exec.Cmd, name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("unknown user %s", name)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("failed to parse uid of %s: %v", name, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("failed to parse gid of %s: %v", name, err)
+	}
+
+	if int(uid) != os.Geteuid() {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("server must run as root to start sessions as %s", name)
+		}
+		var groups []uint32
+		ids, err := u.GroupIds()
+		if err != nil {
+			return fmt.Errorf("failed to look up groups of %s: %v", name, err)
+		}
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+	}
+
+	for _, kv := range []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username} {
+		cmd.Env = setEnv(cmd.Env, kv)
+	}
+	// Like sshd, start in / when the home directory is missing
+	cmd.Dir = "/"
+	if fi, err := os.Stat(u.HomeDir); err == nil && fi.IsDir() {
+		cmd.Dir = u.HomeDir
+	}
+	return nil
+}
+
+// chownForSession gives files the server creates for a session to the user
+// it runs as, if that isn't the server's
+func chownForSession(cmd *exec.Cmd, paths ...string) error {
+	cred := sessionCredential(cmd)
+	if cred == nil {
+		return nil
+	}
+	for _, path := range paths {
+		if err := os.Lchown(path, int(cred.Uid), int(cred.Gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionCredential returns the user cmd runs as, if that isn't the
+// server's. A confined command carries it in its environment instead, for
+// the sandbox init process to become.
+func sessionCredential(cmd *exec.Cmd) *syscall.Credential {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		return cmd.SysProcAttr.Credential
+	}
+	for _, kv := range cmd.Env {
+		if v, ok := strings.CutPrefix(kv, sandboxCredentialEnv+"="); ok {
+			if cred, err := parseCredential(v); err == nil {
+				return cred
+			}
+		}
+	}
+	return nil
+}
+
+// formatCredential writes a credential as uid:gid:groups, the groups
+// comma separated
+func formatCredential(cred *syscall.Credential) string {
+	groups := make([]string, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = strconv.FormatUint(uint64(g), 10)
+	}
+	return fmt.Sprintf("%d:%d:%s", cred.Uid, cred.Gid, strings.Join(groups, ","))
+}
+
+// parseCredential reads a credential written by formatCredential
+func parseCredential(s string) (*syscall.Credential, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid credential %q", s)
+	}
+	uid, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid in credential %q", s)
+	}
+	gid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid in credential %q", s)
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}
+	if fields[2] != "" {
+		for _, f := range strings.Split(fields[2], ",") {
+			g, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group in credential %q", s)
+			}
+			cred.Groups = append(cred.Groups, uint32(g))
+		}
+	}
+	return cred, nil
+}
+
+// intIDs converts user or group IDs for the syscall package's functions
+func intIDs(ids []uint32) []int {
+	out := make([]int, len(ids))
+	for i, id := range ids {
+		out[i] = int(id)
+	}
+	return out
+}
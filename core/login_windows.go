@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// runAs is not available on Windows
+func runAs(cmd *exec.Cmd, name string) error {
+	return fmt.Errorf("starting sessions as another user is not supported on Windows")
+}
+
+// chownForSession has nothing to do on Windows, where sessions run as the
+// server's user
+func chownForSession(cmd *exec.Cmd, paths ...string) error {
+	return nil
+}
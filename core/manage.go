@@ -0,0 +1,380 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"flyssh/core/log"
+)
+
+// Paths of the management API, which sets scoped tokens and the command
+// policy at runtime, for tools like Terraform
+const (
+	manageTokensPath = "/api/v1/tokens"
+	managePolicyPath = "/api/v1/policy"
+)
+
+// managedConfig is what the management API has set, as saved
+type managedConfig struct {
+	Tokens map[string]ScopedToken `json:"tokens,omitempty"` // by name
+	Policy *Policy                `json:"policy,omitempty"`
+}
+
+// Managed holds scoped tokens and a command policy set through the
+// management API, alongside those from the launcher and policy files.
+// Every request is idempotent: tokens are identified by name, and putting
+// the same thing twice changes nothing.
+type Managed struct {
+	path string
+
+	mu  sync.Mutex
+	cfg managedConfig
+}
+
+// OpenManaged keeps what the management API sets in the file at path,
+// loading what's there. An empty path keeps it in memory.
+func OpenManaged(path string) (*Managed, error) {
+	m := &Managed{path: path, cfg: managedConfig{Tokens: make(map[string]ScopedToken)}}
+	if path == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read managed config: %v", err)
+	}
+	if err := json.Unmarshal(data, &m.cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse managed config: %v", err)
+	}
+	if m.cfg.Tokens == nil {
+		m.cfg.Tokens = make(map[string]ScopedToken)
+	}
+	if m.cfg.Policy != nil {
+		m.cfg.Policy.compile()
+	}
+	return m, nil
+}
+
+// SetManaged serves the management API, keeping what it sets in m
+func (s *Server) SetManaged(m *Managed) {
+	s.managed = m
+}
+
+// save writes the managed config to its file. Must be called with mu held.
+func (m *Managed) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode managed config: %v", err)
+	}
+	// Write then rename so a crash never leaves a truncated file
+	tmp := m.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("failed to save managed config: %v", err)
+	}
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save managed config: %v", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("failed to save managed config: %v", err)
+	}
+	return nil
+}
+
+// token returns the managed token with the given value, if any
+func (m *Managed) token(value string) (ScopedToken, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(value), []byte(t.Token)) == 1 {
+			return t, true
+		}
+	}
+	return ScopedToken{}, false
+}
+
+// named returns the managed token with the given name, if any
+func (m *Managed) named(name string) (ScopedToken, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.cfg.Tokens[name]
+	return t, ok
+}
+
+// putToken creates or replaces a token, keeping its value unless a new one
+// is given. It reports whether the token is new.
+func (m *Managed) putToken(t ScopedToken) (ScopedToken, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, exists := m.cfg.Tokens[t.Name]
+	if t.Token == "" {
+		t.Token = old.Token
+	}
+	if t.Token == "" {
+		t.Token = randomID(16)
+	}
+	if exists && reflect.DeepEqual(old, t) {
+		return t, false, nil
+	}
+	for name, other := range m.cfg.Tokens {
+		if name != t.Name && other.Token == t.Token {
+			return ScopedToken{}, false, fmt.Errorf("token %q has the same value", name)
+		}
+	}
+	m.cfg.Tokens[t.Name] = t
+	if err := m.save(); err != nil {
+		if exists {
+			m.cfg.Tokens[t.Name] = old
+		} else {
+			delete(m.cfg.Tokens, t.Name)
+		}
+		return ScopedToken{}, false, err
+	}
+	return t, !exists, nil
+}
+
+// deleteToken removes a token, if it exists
+func (m *Managed) deleteToken(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.cfg.Tokens[name]
+	if !ok {
+		return nil
+	}
+	delete(m.cfg.Tokens, name)
+	if err := m.save(); err != nil {
+		m.cfg.Tokens[name] = old
+		return err
+	}
+	return nil
+}
+
+// tokens lists the managed tokens by name, without their values
+func (m *Managed) tokens() []ScopedToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]ScopedToken, 0, len(m.cfg.Tokens))
+	for _, t := range m.cfg.Tokens {
+		t.Token = ""
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// policy returns the managed policy, or nil
+func (m *Managed) policy() *Policy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg.Policy
+}
+
+// setPolicy replaces the managed policy; nil removes it
+func (m *Managed) setPolicy(p *Policy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.cfg.Policy
+	m.cfg.Policy = p
+	if err := m.save(); err != nil {
+		m.cfg.Policy = old
+		return err
+	}
+	return nil
+}
+
+// enforcedPolicy returns the policy sessions are held to: the policy file's,
+// or the one set through the management API
+func (s *Server) enforcedPolicy() *Policy {
+	if s.policy == nil && s.managed != nil {
+		return s.managed.policy()
+	}
+	return s.policy
+}
+
+// scopedToken returns the scoped token with the given name, from the
+// launcher config or the management API
+func (s *Server) scopedToken(name string) (ScopedToken, bool) {
+	if s.launchers != nil {
+		for _, t := range s.launchers.Tokens {
+			if t.Name == name {
+				return t, true
+			}
+		}
+	}
+	if s.managed != nil {
+		return s.managed.named(name)
+	}
+	return ScopedToken{}, false
+}
+
+// handleTokens lists scoped tokens set through the management API (GET
+// /api/v1/tokens), and shows (GET), creates or replaces (PUT) or deletes
+// (DELETE) one by name at /api/v1/tokens/{name}. Token values are only
+// returned by PUT; one is generated if the request doesn't give one.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if s.managed == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, manageTokensPath), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, http.StatusOK, s.managed.tokens())
+
+	case name == "" || strings.Contains(name, "/"):
+		http.Error(w, "Not found", http.StatusNotFound)
+
+	case r.Method == http.MethodGet:
+		t, ok := s.managed.named(name)
+		if !ok {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		t.Token = ""
+		writeJSON(w, http.StatusOK, t)
+
+	case r.Method == http.MethodPut:
+		var t ScopedToken
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&t); err != nil {
+			http.Error(w, "Invalid token: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Name = name
+		if err := s.checkManagedToken(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, created, err := s.managed.putToken(t)
+		if err != nil {
+			log.Info.Printf("Failed to set token %s: %v", name, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+			log.Info.Printf("Token %s created by %s", name, r.RemoteAddr)
+		}
+		s.audit.Log(AuditEvent{Event: AuditTokenSet, RemoteAddr: r.RemoteAddr, Token: name, Launcher: strings.Join(t.Launchers, ","), TraceID: traceID(r.Context())})
+		writeJSON(w, status, t)
+
+	case r.Method == http.MethodDelete:
+		if err := s.managed.deleteToken(name); err != nil {
+			log.Info.Printf("Failed to delete token %s: %v", name, err)
+			http.Error(w, "Failed to delete token", http.StatusInternalServerError)
+			return
+		}
+		log.Info.Printf("Token %s deleted by %s", name, r.RemoteAddr)
+		s.audit.Log(AuditEvent{Event: AuditTokenDelete, RemoteAddr: r.RemoteAddr, Token: name, TraceID: traceID(r.Context())})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkManagedToken returns an error if a token can't be set through the
+// management API
+func (s *Server) checkManagedToken(t ScopedToken) error {
+	if t.Name == fullTokenName {
+		return fmt.Errorf("token can't be named %q", t.Name)
+	}
+	if s.launchers != nil {
+		for _, other := range s.launchers.Tokens {
+			if other.Name == t.Name {
+				return fmt.Errorf("token %q is set in the launcher config", t.Name)
+			}
+			if t.Token != "" && other.Token == t.Token {
+				return fmt.Errorf("token %q has the same value", other.Name)
+			}
+		}
+	}
+	if t.Token != "" && t.Token == s.fullToken() {
+		return fmt.Errorf("a scoped token can't have the full access token's value")
+	}
+	if len(t.Launchers) == 0 {
+		return fmt.Errorf("token %q needs at least one launcher", t.Name)
+	}
+	for _, name := range t.Launchers {
+		if s.launchers == nil {
+			return fmt.Errorf("token %q references unknown launcher %q", t.Name, name)
+		}
+		if _, ok := s.launchers.Launchers[name]; !ok {
+			return fmt.Errorf("token %q references unknown launcher %q", t.Name, name)
+		}
+	}
+	if t.Project != nil {
+		if err := t.Project.check(); err != nil {
+			return fmt.Errorf("token %q: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// handlePolicy shows (GET), replaces (PUT) or removes (DELETE) the
+// command policy set through the management API. A server started with a
+// policy file refuses changes to it.
+func (s *Server) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if s.managed == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && s.policy != nil {
+		http.Error(w, "The policy is set by the server's policy file", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p := s.enforcedPolicy()
+		if p == nil {
+			http.Error(w, "No policy", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+
+	case http.MethodPut:
+		var p Policy
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&p); err != nil {
+			http.Error(w, "Invalid policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.compile()
+		if err := s.managed.setPolicy(&p); err != nil {
+			log.Info.Printf("Failed to set policy: %v", err)
+			http.Error(w, "Failed to set policy", http.StatusInternalServerError)
+			return
+		}
+		log.Info.Printf("Policy set by %s", r.RemoteAddr)
+		s.audit.Log(AuditEvent{Event: AuditPolicySet, RemoteAddr: r.RemoteAddr, TraceID: traceID(r.Context())})
+		writeJSON(w, http.StatusOK, &p)
+
+	case http.MethodDelete:
+		if err := s.managed.setPolicy(nil); err != nil {
+			log.Info.Printf("Failed to remove policy: %v", err)
+			http.Error(w, "Failed to remove policy", http.StatusInternalServerError)
+			return
+		}
+		log.Info.Printf("Policy removed by %s", r.RemoteAddr)
+		s.audit.Log(AuditEvent{Event: AuditPolicyRemove, RemoteAddr: r.RemoteAddr, TraceID: traceID(r.Context())})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newManagedServer serves the management API, keeping what it sets in path
+func newManagedServer(t *testing.T, path string) (*Server, *httptest.Server) {
+	t.Helper()
+	m, err := OpenManaged(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(0)
+	s.SetAuthToken("admin-token")
+	s.SetLaunchers(&LauncherConfig{
+		Launchers: map[string]Launcher{"psql": {Command: []string{"psql"}}, "deploy": {Command: []string{"deploy"}}},
+		Tokens:    []ScopedToken{{Token: "file-token", Name: "ops", Launchers: []string{"psql"}}},
+	})
+	s.SetManaged(m)
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// manageRequest makes a management API request, decoding the response into
+// v, if given, and returning its status
+func manageRequest(t *testing.T, method, url, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// managementEvents returns the management changes in an audit log
+func managementEvents(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	var events []string
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		switch ev.Event {
+		case AuditTokenSet, AuditTokenDelete, AuditPolicySet, AuditPolicyRemove:
+			events = append(events, strings.TrimSpace(ev.Event+" "+ev.Token))
+		}
+	}
+	return events
+}
+
+func TestManageTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "managed.json")
+	s, ts := newManagedServer(t, path)
+	var audit bytes.Buffer
+	s.SetAuditLog(NewAuditLog(nopWriteCloser{&audit}))
+	url := ts.URL + manageTokensPath + "/ci?token=admin-token"
+
+	var created ScopedToken
+	if status := manageRequest(t, http.MethodPut, url, `{"launchers": ["deploy"]}`, &created); status != http.StatusCreated {
+		t.Fatalf("Expected the token to be created, got %d", status)
+	}
+	if created.Name != "ci" || created.Token == "" {
+		t.Fatalf("Unexpected new token: %+v", created)
+	}
+
+	// Putting it again changes nothing, and keeps the value
+	var again ScopedToken
+	if status := manageRequest(t, http.MethodPut, url, `{"launchers": ["deploy"]}`, &again); status != http.StatusOK {
+		t.Errorf("Expected putting the same token to succeed, got %d", status)
+	}
+	if again.Token != created.Token {
+		t.Errorf("Expected the token's value to be kept, got %q then %q", created.Token, again.Token)
+	}
+	if g := s.authenticate(created.Token, s.fullToken()); g == nil || g.name != "ci" || !g.allows("deploy") || g.allows("psql") {
+		t.Errorf("Unexpected grant for a managed token: %+v", g)
+	}
+
+	var list []ScopedToken
+	if status := manageRequest(t, http.MethodGet, ts.URL+manageTokensPath+"?token=admin-token", "", &list); status != http.StatusOK {
+		t.Fatalf("Expected the tokens to be listed, got %d", status)
+	}
+	if len(list) != 1 || list[0].Name != "ci" || list[0].Token != "" {
+		t.Errorf("Expected the list to hide values, got %+v", list)
+	}
+
+	for _, tt := range []struct {
+		name, url, body string
+		status          int
+	}{
+		{"unknown launcher", url, `{"launchers": ["root-shell"]}`, http.StatusBadRequest},
+		{"no launchers", url, `{}`, http.StatusBadRequest},
+		{"launcher config name", ts.URL + manageTokensPath + "/ops?token=admin-token", `{"launchers": ["psql"]}`, http.StatusBadRequest},
+		{"full access token's name", ts.URL + manageTokensPath + "/admin?token=admin-token", `{"launchers": ["psql"]}`, http.StatusBadRequest},
+		{"launcher config value", ts.URL + manageTokensPath + "/other?token=admin-token", `{"token": "file-token", "launchers": ["psql"]}`, http.StatusBadRequest},
+		{"duplicate value", ts.URL + manageTokensPath + "/other?token=admin-token", `{"token": "` + created.Token + `", "launchers": ["psql"]}`, http.StatusConflict},
+		{"scoped token", ts.URL + manageTokensPath + "/other?token=" + created.Token, `{"launchers": ["psql"]}`, http.StatusForbidden},
+	} {
+		if status := manageRequest(t, http.MethodPut, tt.url, tt.body, nil); status != tt.status {
+			t.Errorf("Expected a token with %s to get %d, got %d", tt.name, tt.status, status)
+		}
+	}
+
+	if got := managementEvents(t, &audit); strings.Join(got, ",") != "token_set ci,token_set ci" {
+		t.Errorf("Unexpected audit events %q", got)
+	}
+
+	// What's set survives a restart
+	s2, ts2 := newManagedServer(t, path)
+	s2.SetAuditLog(NewAuditLog(nopWriteCloser{&audit}))
+	if g := s2.authenticate(created.Token, s2.fullToken()); g == nil || g.name != "ci" {
+		t.Errorf("Expected the token to be reloaded, got %+v", g)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := manageRequest(t, http.MethodDelete, ts2.URL+manageTokensPath+"/ci?token=admin-token", "", nil); status != http.StatusNoContent {
+			t.Errorf("Expected deleting the token to succeed every time, got %d", status)
+		}
+	}
+	if s2.authenticate(created.Token, s2.fullToken()) != nil {
+		t.Error("Expected a deleted token to stop working")
+	}
+	if got := managementEvents(t, &audit); strings.Join(got, ",") != "token_delete ci,token_delete ci" {
+		t.Errorf("Unexpected audit events %q", got)
+	}
+	if status := manageRequest(t, http.MethodGet, ts2.URL+manageTokensPath+"/ci?token=admin-token", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected a deleted token not to be found, got %d", status)
+	}
+}
+
+func TestManagePolicy(t *testing.T) {
+	s, ts := newManagedServer(t, "")
+	var audit bytes.Buffer
+	s.SetAuditLog(NewAuditLog(nopWriteCloser{&audit}))
+	url := ts.URL + managePolicyPath + "?token=admin-token"
+
+	if status := manageRequest(t, http.MethodGet, url, "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected no policy, got %d", status)
+	}
+	if status := manageRequest(t, http.MethodPut, url, `{"alow": ["ls"]}`, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected a misspelled policy to be refused, got %d", status)
+	}
+	if status := manageRequest(t, http.MethodPut, url, `{"allow": ["git *"]}`, nil); status != http.StatusOK {
+		t.Fatalf("Expected the policy to be set, got %d", status)
+	}
+	if err := s.enforcedPolicy().check("git log"); err != nil {
+		t.Errorf("Expected an allowed command to pass, got %v", err)
+	}
+	if err := s.enforcedPolicy().check("rm -rf /"); err == nil {
+		t.Error("Expected the managed policy to be enforced")
+	}
+	if status := manageRequest(t, http.MethodDelete, url, "", nil); status != http.StatusNoContent {
+		t.Errorf("Expected the policy to be removed, got %d", status)
+	}
+	if s.enforcedPolicy() != nil {
+		t.Error("Expected no policy after removing it")
+	}
+	if got := managementEvents(t, &audit); strings.Join(got, ",") != "policy_set,policy_remove" {
+		t.Errorf("Unexpected audit events %q", got)
+	}
+
+	// A policy file can't be changed over the API
+	s.SetPolicy(&Policy{})
+	if status := manageRequest(t, http.MethodPut, url, `{}`, nil); status != http.StatusConflict {
+		t.Errorf("Expected the policy file to be kept, got %d", status)
+	}
+}
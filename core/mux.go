@@ -0,0 +1,428 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+
+	"golang.org/x/net/websocket"
+)
+
+// frameClose tells the peer a flyssh.v3 channel is closed
+const frameClose byte = 2
+
+// muxQueue is the number of frames buffered per channel. A channel whose
+// reader falls behind stalls the connection's other channels, which is
+// fine for interactive terminals and keeps the protocol window free.
+const muxQueue = 64
+
+// muxFrame is a frame received on a channel
+type muxFrame struct {
+	typ     byte
+	payload []byte
+}
+
+// muxConn carries many terminal channels over one WebSocket (flyssh.v3).
+// Each binary message is a frame: a type byte, a four byte big endian
+// channel ID and the payload. Data and control frames work as in v2.
+type muxConn struct {
+	ws      *websocket.Conn
+	wmu     sync.Mutex     // serializes frame writes
+	faults  *faultInjector // set on servers built to inject faults
+	timeout time.Duration  // how long a write may take, 0 for no limit
+	buf     []byte         // the frame being written, reused
+
+	mu       sync.Mutex
+	channels map[uint32]*muxChannel
+	closed   bool
+}
+
+func newMuxConn(ws *websocket.Conn) *muxConn {
+	return &muxConn{ws: ws, channels: make(map[uint32]*muxChannel)}
+}
+
+// writeFrame sends a single frame as one binary message
+func (m *muxConn) writeFrame(typ byte, id uint32, payload []byte) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if m.faults.beforeWrite() {
+		return nil
+	}
+
+	m.buf = binary.BigEndian.AppendUint32(append(m.buf[:0], typ), id)
+	m.buf = append(m.buf, payload...)
+	// A write that failed, or gave up part way, leaves the connection
+	// unusable for every channel
+	if err := sendMessage(m.ws, m.buf, m.timeout); err != nil {
+		m.ws.Close()
+		return err
+	}
+	return nil
+}
+
+// newChannel registers a channel
+func (m *muxConn) newChannel(id uint32) (*muxChannel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, net.ErrClosed
+	}
+	if _, ok := m.channels[id]; ok {
+		return nil, fmt.Errorf("channel %d already open", id)
+	}
+	ch := &muxChannel{
+		m:    m,
+		id:   id,
+		in:   make(chan muxFrame, muxQueue),
+		done: make(chan struct{}),
+	}
+	m.channels[id] = ch
+	return ch, nil
+}
+
+// channel looks up an open channel
+func (m *muxConn) channel(id uint32) *muxChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channels[id]
+}
+
+// remove unregisters a channel
+func (m *muxConn) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.channels, id)
+}
+
+// run reads frames until the connection fails, handing them to their
+// channels. Control messages of type "open" on an unknown channel create
+// it and are passed to onOpen; clients pass nil to refuse them.
+func (m *muxConn) run(onOpen func(ch *muxChannel, msg controlMessage)) error {
+	defer m.closeAll()
+
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(m.ws, &msg); err != nil {
+			return err
+		}
+		if len(msg) < 5 {
+			return fmt.Errorf("short frame")
+		}
+		typ, id, payload := msg[0], binary.BigEndian.Uint32(msg[1:5]), msg[5:]
+
+		ch := m.channel(id)
+		if ch == nil {
+			// Frames for channels that were just closed are dropped
+			if typ != frameControl || onOpen == nil {
+				continue
+			}
+			var ctl controlMessage
+			if err := json.Unmarshal(payload, &ctl); err != nil {
+				return fmt.Errorf("invalid control message: %v", err)
+			}
+			if ctl.Type != "open" {
+				continue
+			}
+			ch, err := m.newChannel(id)
+			if err != nil {
+				return err
+			}
+			onOpen(ch, ctl)
+			continue
+		}
+
+		switch typ {
+		case frameData, frameControl:
+			select {
+			case ch.in <- muxFrame{typ: typ, payload: payload}:
+			case <-ch.done:
+			}
+		case frameClose:
+			ch.shutdown(false)
+		default:
+			return fmt.Errorf("unknown frame type %d", typ)
+		}
+	}
+}
+
+// closeAll closes every channel and the connection
+func (m *muxConn) closeAll() {
+	for _, ch := range m.close() {
+		ch.shutdown(false)
+	}
+	m.ws.Close()
+}
+
+// close marks the connection closed, returning its channels
+func (m *muxConn) close() []*muxChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	channels := make([]*muxChannel, 0, len(m.channels))
+	for _, ch := range m.channels {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// muxChannel is one terminal session on a muxConn. It implements
+// transport, so the session engine runs each channel like a connection.
+type muxChannel struct {
+	m    *muxConn
+	id   uint32
+	in   chan muxFrame
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *muxChannel) protocol() string { return ProtocolV3 }
+
+func (c *muxChannel) hasControl() bool { return true }
+
+func (c *muxChannel) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *muxChannel) send(msg controlMessage) error {
+	if c.isClosed() {
+		return net.ErrClosed
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode control message: %v", err)
+	}
+	return c.m.writeFrame(frameControl, c.id, data)
+}
+
+// next returns the next frame, delivering frames that arrived before the
+// channel closed first
+func (c *muxChannel) next() (muxFrame, error) {
+	select {
+	case f := <-c.in:
+		return f, nil
+	default:
+	}
+	select {
+	case f := <-c.in:
+		return f, nil
+	case <-c.done:
+		return muxFrame{}, io.EOF
+	}
+}
+
+func (c *muxChannel) receive() (controlMessage, error) {
+	var msg controlMessage
+	f, err := c.next()
+	if err != nil {
+		return msg, err
+	}
+	if f.typ != frameControl {
+		return msg, fmt.Errorf("expected control frame, got type %d", f.typ)
+	}
+	if err := json.Unmarshal(f.payload, &msg); err != nil {
+		return msg, fmt.Errorf("invalid control message: %v", err)
+	}
+	return msg, nil
+}
+
+func (c *muxChannel) notice(message string) {
+	if err := c.send(controlMessage{Type: "notice", Message: message}); err != nil {
+		log.Debug.Printf("Failed to send notice: %v", err)
+	}
+}
+
+func (c *muxChannel) input(onControl func(controlMessage)) io.Reader {
+	return &muxReader{c: c, onControl: onControl}
+}
+
+func (c *muxChannel) output() io.Writer { return c }
+
+// Write sends p as a data frame
+func (c *muxChannel) Write(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if err := c.m.writeFrame(frameData, c.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the channel, telling the peer. The connection stays open
+// for other channels.
+func (c *muxChannel) Close() error {
+	c.shutdown(true)
+	return nil
+}
+
+// shutdown closes the channel locally, notifying the peer if asked
+func (c *muxChannel) shutdown(notify bool) {
+	c.once.Do(func() {
+		close(c.done)
+		c.m.remove(c.id)
+		if notify {
+			if err := c.m.writeFrame(frameClose, c.id, nil); err != nil {
+				log.Debug.Printf("Failed to close channel %d: %v", c.id, err)
+			}
+		}
+	})
+}
+
+// muxReader adapts a channel's data frames to io.Reader
+type muxReader struct {
+	c         *muxChannel
+	onControl func(controlMessage)
+	pending   []byte
+}
+
+func (r *muxReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		f, err := r.c.next()
+		if err != nil {
+			return 0, err
+		}
+		switch f.typ {
+		case frameData:
+			r.pending = f.payload
+		case frameControl:
+			var msg controlMessage
+			if err := json.Unmarshal(f.payload, &msg); err != nil {
+				return 0, fmt.Errorf("invalid control message: %v", err)
+			}
+			if r.onControl != nil {
+				r.onControl(msg)
+			}
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// channelGroup runs the goroutines serving a multiplexed connection's
+// channels, so the connection can wait for all of them to end
+type channelGroup struct {
+	wg sync.WaitGroup
+}
+
+// run runs fn in a new goroutine
+func (g *channelGroup) run(fn func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn()
+	}()
+}
+
+// wait blocks until every goroutine has returned
+func (g *channelGroup) wait() {
+	g.wg.Wait()
+}
+
+// serveMux runs a flyssh.v3 connection. Every channel the client opens is
+// a session of its own, served as if it had connected separately with the
+// open message's launcher or resume ID.
+func (s *Server) serveMux(ws *websocket.Conn) {
+	log.Info.Printf("New multiplexed connection from %s", ws.Request().RemoteAddr)
+	m := newMuxConn(ws)
+	m.faults = s.faults
+	m.timeout = s.writeTimeout
+
+	var channels channelGroup
+	err := m.run(func(ch *muxChannel, msg controlMessage) {
+		// File transfers aren't sessions, and don't count towards the cap
+		if msg.Transfer != nil {
+			channels.run(func() {
+				s.serveTransfer(ch, ws.Request(), msg.Transfer)
+			})
+			return
+		}
+
+		r := channelRequest(ws.Request(), msg)
+
+		release, err := s.acquireSession()
+		if err != nil {
+			log.Info.Printf("Refusing channel from %s: %v", r.RemoteAddr, err)
+			ch.send(controlMessage{Type: "error", Message: err.Error()})
+			ch.Close()
+			return
+		}
+
+		channels.run(func() {
+			defer release()
+			defer ch.Close()
+			if id := r.URL.Query().Get("resume"); id != "" {
+				s.resumeSession(id, ch, r)
+				return
+			}
+			s.serveSession(ch, r)
+		})
+	})
+	if err != nil && err != io.EOF && !isConnectionClosed(err) {
+		log.Debug.Printf("Multiplexed connection from %s failed: %v", ws.Request().RemoteAddr, err)
+	}
+
+	channels.wait()
+	log.Info.Printf("Multiplexed connection from %s closed", ws.Request().RemoteAddr)
+}
+
+// channelRequest returns the request a channel's session sees: the
+// connection's request with the open message's launcher, command and
+// resume ID
+func channelRequest(r *http.Request, msg controlMessage) *http.Request {
+	r = r.Clone(r.Context())
+	q := r.URL.Query()
+	q.Del("launch")
+	q.Del("exec")
+	q.Del("resume")
+	q.Del("replay")
+	q.Del("pty")
+	q.Del("agent")
+	q.Del("env")
+	q.Del("login")
+	q.Del("dir")
+	q.Del("shell")
+	q.Del("dotfile")
+	if msg.Launcher != "" {
+		q.Set("launch", msg.Launcher)
+	}
+	if msg.Command != "" {
+		q.Set("exec", msg.Command)
+	}
+	if msg.Login != "" {
+		q.Set("login", msg.Login)
+	}
+	if msg.Dir != "" {
+		q.Set("dir", msg.Dir)
+	}
+	if msg.Shell != "" {
+		q.Set("shell", msg.Shell)
+	}
+	if msg.NoPTY {
+		q.Set("pty", "0")
+	}
+	for _, kv := range msg.Env {
+		q.Add("env", kv)
+	}
+	for _, file := range msg.Dotfiles {
+		q.Add("dotfile", file)
+	}
+	if msg.SessionID != "" {
+		q.Set("resume", msg.SessionID)
+	}
+	r.URL.RawQuery = q.Encode()
+	return r
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+
+	"flyssh/core/log"
+
+	"golang.org/x/net/websocket"
+)
+
+// MuxClient runs several terminal sessions over one flyssh.v3 connection,
+// saving a connection and auth handshake per terminal
+type MuxClient struct {
+	m *muxConn
+
+	mu     sync.Mutex
+	nextID uint32
+
+	done chan struct{}
+	err  error // why the connection ended, set before done is closed
+}
+
+// DialMux connects to a server for multiplexed sessions, giving up once
+// ctx is done
+func DialMux(ctx context.Context, serverURL, authToken string) (*MuxClient, error) {
+	dialURL := fmt.Sprintf("%s?token=%s&user=%s", serverURL, url.QueryEscape(authToken), url.QueryEscape(currentUser()))
+	config, err := websocket.NewConfig(dialURL, "http://localhost")
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %v", err)
+	}
+	config.Protocol = []string{ProtocolV3}
+	// There's no terminal to ask on, so new keys are only trusted if a
+	// certificate authority vouches for them
+	verifier := &hostKeyVerifier{check: HostKeyAsk}
+	if config.TlsConfig, err = verifier.tlsConfig(serverURL); err != nil {
+		return nil, err
+	}
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %v", err)
+	}
+	if connProtocol(ws.Config()) != ProtocolV3 {
+		ws.Close()
+		return nil, fmt.Errorf("server does not support multiplexed sessions")
+	}
+
+	c := &MuxClient{m: newMuxConn(ws), done: make(chan struct{})}
+	go func() {
+		c.err = c.m.run(nil)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// Open starts a session running the named launcher, or a shell if
+// launcher is empty
+func (c *MuxClient) Open(launcher string) (*MuxSession, error) {
+	return c.open(controlMessage{Type: "open", Launcher: launcher})
+}
+
+// Resume attaches to a detached session, replaying the output it missed
+func (c *MuxClient) Resume(sessionID string) (*MuxSession, error) {
+	return c.open(controlMessage{Type: "open", SessionID: sessionID})
+}
+
+func (c *MuxClient) open(msg controlMessage) (*MuxSession, error) {
+	ch, id, err := c.openChannel(msg, func(msg controlMessage) {
+		if msg.Type == "step_up" {
+			log.Info.Printf("Open %s to start the session", msg.URL)
+		} else {
+			log.Info.Printf("Waiting to start the session: %s", msg.Message)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &MuxSession{ID: id, ch: ch}
+	sess.r = ch.input(func(msg controlMessage) {
+		if msg.Type == "notice" {
+			log.Info.Printf("Session %s: %s", sess.ID, msg.Message)
+		}
+	})
+	return sess, nil
+}
+
+// newID returns the ID of the next channel the client opens
+func (c *MuxClient) newID() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return c.nextID
+}
+
+// openChannel sends an open message on a new channel and waits for the
+// server to start the session, returning the channel and session ID.
+// Requests to confirm the session with a security key, and notices of
+// what else it's waiting for, go to stepUp.
+func (c *MuxClient) openChannel(msg controlMessage, stepUp func(controlMessage)) (*muxChannel, string, error) {
+	ch, err := c.m.newChannel(c.newID())
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ch.send(msg); err != nil {
+		ch.shutdown(false)
+		return nil, "", fmt.Errorf("failed to open session: %v", err)
+	}
+
+	reply, err := ch.receive()
+	for err == nil && (reply.Type == "step_up" || reply.Type == "notice") {
+		stepUp(reply)
+		reply, err = ch.receive()
+	}
+	if err != nil {
+		ch.Close()
+		return nil, "", fmt.Errorf("failed to receive session ID: %v", err)
+	}
+	if reply.Type == "error" {
+		ch.Close()
+		return nil, "", &rejectedError{reason: reply.Message}
+	}
+	if reply.Type != "session" {
+		ch.Close()
+		return nil, "", fmt.Errorf("expected session message, got %s", reply.Type)
+	}
+	return ch, reply.SessionID, nil
+}
+
+// Close ends every session and the connection
+func (c *MuxClient) Close() error {
+	c.m.closeAll()
+	<-c.done
+	return nil
+}
+
+// closed reports whether the connection has ended
+func (c *MuxClient) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the connection ends and returns why
+func (c *MuxClient) Wait() error {
+	<-c.done
+	if c.err == io.EOF || (c.err != nil && isConnectionClosed(c.err)) {
+		return nil
+	}
+	return c.err
+}
+
+// MuxSession is a terminal session on a MuxClient. Reads return terminal
+// output and end with io.EOF when the session ends.
+type MuxSession struct {
+	ID string
+
+	ch *muxChannel
+	r  io.Reader
+}
+
+// Read reads terminal output
+func (s *MuxSession) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// Write sends terminal input
+func (s *MuxSession) Write(p []byte) (int, error) {
+	return s.ch.Write(p)
+}
+
+// Resize changes the session's terminal size
+func (s *MuxSession) Resize(rows, cols uint16) error {
+	return sendWindowSize(s.ch, int(cols), int(rows))
+}
+
+// Close ends the session. Other sessions on the connection keep running.
+func (s *MuxSession) Close() error {
+	if err := s.ch.send(controlMessage{Type: "close"}); err != nil {
+		log.Debug.Printf("Failed to send close: %v", err)
+	}
+	return s.ch.Close()
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Notifier types
+const (
+	NotifySlack     = "slack"
+	NotifyPagerDuty = "pagerduty"
+	NotifyEmail     = "email"
+	NotifyWebhook   = "webhook"
+)
+
+// pagerDutyURL is PagerDuty's Events API v2
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// maxNotifySends bounds each notifier's deliveries in flight, so a burst
+// of events, like a token being guessed at, can't pile up requests
+const maxNotifySends = 4
+
+// notifyEvents are the event types notifiers may send
+var notifyEvents = map[string]bool{
+	EventSessionStart:  true,
+	EventSessionUpdate: true,
+	EventSessionEnd:    true,
+	EventAuthSuccess:   true,
+	EventAuthFailure:   true,
+	EventServerStart:   true,
+	EventServerPanic:   true,
+}
+
+// Notifier sends some of the server's events somewhere people will see
+// them: a Slack channel, PagerDuty, email or a webhook
+type Notifier struct {
+	Type   string   `json:"type"`
+	Events []string `json:"events"`
+	// Template is a text/template for the message, executed with the
+	// Event. Empty uses a one-line summary of it.
+	Template string `json:"template,omitempty"`
+
+	// URL is the Slack incoming webhook or webhook to post to, or
+	// overrides PagerDuty's Events API
+	URL        string `json:"url,omitempty"`
+	RoutingKey string `json:"routing_key,omitempty"` // PagerDuty integration key
+	Severity   string `json:"severity,omitempty"`    // PagerDuty severity, error by default
+
+	// Email is sent through an SMTP server, given as host:port, which
+	// authenticates with Username and Password if they're set
+	SMTP     string   `json:"smtp,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+
+	tmpl    *template.Template
+	sending chan struct{}
+}
+
+// NotifyConfig is the notifiers file
+type NotifyConfig struct {
+	Notifiers []*Notifier `json:"notifiers"`
+}
+
+// Notifiers sends events to the notifiers configured for them
+type Notifiers struct {
+	notifiers []*Notifier
+	client    *http.Client
+	source    string // this server, as PagerDuty names it
+}
+
+// LoadNotifiers reads notifiers from a JSON file
+func LoadNotifiers(path string) (*Notifiers, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read notifiers: %v", err)
+	}
+	var cfg NotifyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse notifiers: %v", err)
+	}
+	return NewNotifiers(cfg.Notifiers)
+}
+
+// NewNotifiers checks notifiers' settings and parses their templates
+func NewNotifiers(notifiers []*Notifier) (*Notifiers, error) {
+	for i, n := range notifiers {
+		if err := n.check(); err != nil {
+			return nil, fmt.Errorf("notifier %d (%s): %v", i+1, n.Type, err)
+		}
+		if n.Template != "" {
+			tmpl, err := template.New(n.Type).Option("missingkey=error").Parse(n.Template)
+			if err != nil {
+				return nil, fmt.Errorf("notifier %d (%s): invalid template: %v", i+1, n.Type, err)
+			}
+			n.tmpl = tmpl
+		}
+		n.sending = make(chan struct{}, maxNotifySends)
+	}
+	// PagerDuty won't take an event without a source, so a server that
+	// can't find its hostname still names something
+	source, err := os.Hostname()
+	if err != nil || source == "" {
+		source = "flyssh"
+	}
+	return &Notifiers{
+		notifiers: notifiers,
+		client:    &http.Client{Timeout: webhookTimeout},
+		source:    source,
+	}, nil
+}
+
+// check reports a notifier that can't send
+func (n *Notifier) check() error {
+	if len(n.Events) == 0 {
+		return fmt.Errorf("no events")
+	}
+	for _, e := range n.Events {
+		if !notifyEvents[e] {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	switch n.Type {
+	case NotifySlack, NotifyWebhook:
+		if n.URL == "" {
+			return fmt.Errorf("no url")
+		}
+	case NotifyPagerDuty:
+		if n.RoutingKey == "" {
+			return fmt.Errorf("no routing_key")
+		}
+		switch n.Severity {
+		case "", "critical", "error", "warning", "info":
+		default:
+			return fmt.Errorf("unknown severity %q (want critical, error, warning or info)", n.Severity)
+		}
+	case NotifyEmail:
+		if n.SMTP == "" || n.From == "" || len(n.To) == 0 {
+			return fmt.Errorf("email needs smtp, from and to")
+		}
+	default:
+		return fmt.Errorf("unknown type (want slack, pagerduty, email or webhook)")
+	}
+	return nil
+}
+
+// SetNotifiers sends the server's events to notifiers, from now on
+func (s *Server) SetNotifiers(n *Notifiers) {
+	go s.runNotifiers(n, s.events.subscribe())
+}
+
+// runNotifiers hands events to the notifiers for them. Each is sent in
+// the background so a slow service never holds up the others.
+func (s *Server) runNotifiers(n *Notifiers, events chan Event) {
+	for {
+		for e := range events {
+			n.notify(e)
+		}
+		// Only a subscriber that fell behind is closed
+		log.Info.Printf("Notifiers fell behind, some events weren't sent")
+		events = s.events.subscribe()
+	}
+}
+
+// notify sends an event to each notifier configured for it
+func (ns *Notifiers) notify(e Event) {
+	for _, n := range ns.notifiers {
+		if !n.wants(e.Type) {
+			continue
+		}
+		msg, err := n.message(e)
+		if err != nil {
+			log.Info.Printf("Failed to notify %s of %s: %v", n.Type, e.Type, err)
+			continue
+		}
+		select {
+		case n.sending <- struct{}{}:
+		default:
+			log.Info.Printf("Dropped %s notification of %s, too many in flight", n.Type, e.Type)
+			continue
+		}
+		go func(n *Notifier) {
+			defer func() { <-n.sending }()
+			if err := ns.send(n, e, msg); err != nil {
+				log.Info.Printf("Failed to notify %s of %s: %v", n.Type, e.Type, err)
+			}
+		}(n)
+	}
+}
+
+// wants reports whether the notifier sends events of a type
+func (n *Notifier) wants(typ string) bool {
+	for _, e := range n.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// message renders the notifier's message for an event
+func (n *Notifier) message(e Event) (string, error) {
+	if n.tmpl == nil {
+		return eventSummary(e), nil
+	}
+	var b strings.Builder
+	if err := n.tmpl.Execute(&b, e); err != nil {
+		return "", fmt.Errorf("failed to render template: %v", err)
+	}
+	return b.String(), nil
+}
+
+// eventSummary describes an event in a line
+func eventSummary(e Event) string {
+	switch {
+	case e.Session != nil:
+		who := e.Session.User
+		if who == "" {
+			who = e.Session.RemoteAddr
+		}
+		return fmt.Sprintf("flyssh %s: session %s for %s", e.Type, e.Session.ID, who)
+	case e.RemoteAddr == "" && e.Reason != "":
+		return fmt.Sprintf("flyssh %s: %s", e.Type, e.Reason)
+	case e.Reason != "":
+		return fmt.Sprintf("flyssh %s from %s: %s", e.Type, e.RemoteAddr, e.Reason)
+	case e.RemoteAddr != "":
+		return fmt.Sprintf("flyssh %s from %s as %s", e.Type, e.RemoteAddr, e.Token)
+	}
+	return "flyssh " + e.Type
+}
+
+// send delivers a message to one notifier
+func (ns *Notifiers) send(n *Notifier, e Event, msg string) error {
+	switch n.Type {
+	case NotifySlack:
+		return ns.post(n.URL, map[string]any{"text": msg})
+	case NotifyWebhook:
+		return ns.post(n.URL, map[string]any{"message": msg, "event": e})
+	case NotifyPagerDuty:
+		url, severity := n.URL, n.Severity
+		if url == "" {
+			url = pagerDutyURL
+		}
+		if severity == "" {
+			severity = "error"
+		}
+		return ns.post(url, map[string]any{
+			"routing_key":  n.RoutingKey,
+			"event_action": "trigger",
+			"payload": map[string]any{
+				"summary":   msg,
+				"source":    ns.source,
+				"severity":  severity,
+				"timestamp": e.Time.Format(time.RFC3339),
+				"class":     e.Type,
+			},
+		})
+	case NotifyEmail:
+		return ns.mail(n, e, msg)
+	}
+	return fmt.Errorf("unknown notifier type %q", n.Type)
+}
+
+// post sends v as JSON to url
+func (ns *Notifiers) post(url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+	resp, err := ns.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// mail sends a message by email, its first line the subject
+func (ns *Notifiers) mail(n *Notifier, e Event, msg string) error {
+	subject, _, _ := strings.Cut(msg, "\n")
+	subject = strings.TrimSpace(subject)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, _ := net.SplitHostPort(n.SMTP)
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	return smtp.SendMail(n.SMTP, auth, n.From, n.To, b.Bytes())
+}
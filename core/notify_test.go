@@ -0,0 +1,151 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifiersCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		n    Notifier
+	}{
+		{"no events", Notifier{Type: NotifySlack, URL: "http://hook"}},
+		{"an unknown event", Notifier{Type: NotifySlack, URL: "http://hook", Events: []string{"server_crash"}}},
+		{"an unknown type", Notifier{Type: "pager", Events: []string{EventAuthFailure}}},
+		{"no url", Notifier{Type: NotifySlack, Events: []string{EventAuthFailure}}},
+		{"no routing key", Notifier{Type: NotifyPagerDuty, Events: []string{EventServerPanic}}},
+		{"an unknown severity", Notifier{Type: NotifyPagerDuty, RoutingKey: "key", Severity: "dire", Events: []string{EventServerPanic}}},
+		{"no recipients", Notifier{Type: NotifyEmail, SMTP: "mail:25", From: "flyssh@example.com", Events: []string{EventAuthFailure}}},
+		{"a bad template", Notifier{Type: NotifySlack, URL: "http://hook", Events: []string{EventAuthFailure}, Template: "{{.RemoteAddr"}},
+	} {
+		n := tt.n
+		if _, err := NewNotifiers([]*Notifier{&n}); err == nil {
+			t.Errorf("Expected a notifier with %s to be refused", tt.name)
+		}
+	}
+}
+
+func TestNotifiers(t *testing.T) {
+	posts := make(chan map[string]any, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		body["path"] = r.URL.Path
+		posts <- body
+	}))
+	defer hook.Close()
+
+	n, err := NewNotifiers([]*Notifier{
+		{Type: NotifySlack, URL: hook.URL + "/slack", Events: []string{EventAuthFailure}, Template: "Bad token from {{.RemoteAddr}} ({{.Reason}})"},
+		{Type: NotifyPagerDuty, URL: hook.URL + "/pagerduty", RoutingKey: "key", Events: []string{EventServerPanic}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(0)
+	s.SetNotifiers(n)
+
+	s.publishAuth(EventAuthSuccess, httptest.NewRequest(http.MethodGet, "/", nil), "ops", "")
+	s.publishAuth(EventAuthFailure, httptest.NewRequest(http.MethodGet, "/", nil), "", "invalid token")
+	s.publishServer(EventServerPanic, "boom")
+
+	got := make(map[string]map[string]any)
+	for len(got) < 2 {
+		select {
+		case body := <-posts:
+			got[body["path"].(string)] = body
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected two notifications, got %v", got)
+		}
+	}
+	if text := got["/slack"]["text"]; text != "Bad token from 192.0.2.1:1234 (invalid token)" {
+		t.Errorf("Unexpected Slack message %q", text)
+	}
+	pd := got["/pagerduty"]
+	payload, _ := pd["payload"].(map[string]any)
+	if pd["routing_key"] != "key" || pd["event_action"] != "trigger" || payload["summary"] != "flyssh server_panic: boom" || payload["severity"] != "error" {
+		t.Errorf("Unexpected PagerDuty event %v", pd)
+	}
+	select {
+	case body := <-posts:
+		t.Errorf("Expected events no notifier wants to be dropped, got %v", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifyEmail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	mail := make(chan string, 1)
+	go serveSMTP(ln, mail)
+
+	n, err := NewNotifiers([]*Notifier{{
+		Type: NotifyEmail, SMTP: ln.Addr().String(), From: "flyssh@example.com", To: []string{"ops@example.com"},
+		Events: []string{EventSessionStart}, Template: "Session {{.Session.ID}} started\nBy {{.Session.User}}",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.notify(Event{Type: EventSessionStart, Time: time.Now(), Session: &Session{ID: "#1", User: "alice"}})
+
+	select {
+	case msg := <-mail:
+		for _, want := range []string{"To: ops@example.com\r\n", "Subject: Session #1 started\r\n", "\r\n\r\nSession #1 started\r\nBy alice\r\n"} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("Expected the email to contain %q, got %q", want, msg)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No email sent")
+	}
+}
+
+// serveSMTP accepts one message over SMTP, sending its data to mail
+func serveSMTP(ln net.Listener, mail chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mail <- data.String()
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
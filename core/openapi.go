@@ -0,0 +1,170 @@
+package core
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIPath is where the server serves its OpenAPI spec
+const openAPIPath = "/api/v1/openapi.json"
+
+// apiOperation is one operation of the admin and management APIs, as
+// described in their OpenAPI spec
+type apiOperation struct {
+	path, method string
+	id, summary  string
+	body         any    // request body, if any
+	response     any    // response body, if any
+	contentType  string // of the response, if not JSON
+	statuses     []int  // besides 401 and 403
+}
+
+// apiOperations are the admin and management APIs' operations. Bodies are
+// described from the types the handlers decode and encode.
+var apiOperations = []apiOperation{
+	{adminSessionsPath, http.MethodGet, "listSessions", "List active sessions", nil, []Session{}, "", []int{200}},
+	{adminSessionsPath + "/{id}", http.MethodGet, "getSession", "Show a session", nil, Session{}, "", []int{200, 404}},
+	{adminSessionsPath + "/{id}", http.MethodDelete, "killSession", "Terminate a session", nil, nil, "", []int{204, 404}},
+	{adminSessionsPath + "/{id}/output", http.MethodGet, "getSessionOutput", "Get a session's recent output", nil, "", "application/octet-stream", []int{200, 404}},
+	{"/api/v1/events", http.MethodGet, "streamEvents", "Stream session and auth events as newline delimited JSON, or server-sent events to clients that accept text/event-stream", nil, Event{}, "application/x-ndjson", []int{200}},
+	{"/api/v1/metrics", http.MethodGet, "getMetrics", "Show session and goroutine counters", nil, Metrics{}, "", []int{200}},
+	{"/api/v1/drain", http.MethodGet, "getDrain", "Show whether the server is draining", nil, DrainStatus{}, "", []int{200}},
+	{"/api/v1/drain", http.MethodPost, "startDrain", "Stop taking new sessions, sending clients to the replacement, if given", DrainStatus{}, DrainStatus{}, "", []int{200, 400}},
+	{"/api/v1/drain", http.MethodDelete, "stopDrain", "Take new sessions again", nil, DrainStatus{}, "", []int{200}},
+	{manageTokensPath, http.MethodGet, "listTokens", "List scoped tokens set through the management API, without their values", nil, []ScopedToken{}, "", []int{200, 404}},
+	{manageTokensPath + "/{name}", http.MethodGet, "getToken", "Show a scoped token, without its value", nil, ScopedToken{}, "", []int{200, 404}},
+	{manageTokensPath + "/{name}", http.MethodPut, "putToken", "Create or replace a scoped token, generating its value if none is given and it has none", ScopedToken{}, ScopedToken{}, "", []int{200, 201, 400, 404, 409}},
+	{manageTokensPath + "/{name}", http.MethodDelete, "deleteToken", "Delete a scoped token, if it exists", nil, nil, "", []int{204, 404}},
+	{managePolicyPath, http.MethodGet, "getPolicy", "Show the command policy", nil, Policy{}, "", []int{200, 404}},
+	{managePolicyPath, http.MethodPut, "putPolicy", "Replace the command policy", Policy{}, Policy{}, "", []int{200, 400, 404, 409}},
+	{managePolicyPath, http.MethodDelete, "deletePolicy", "Remove the command policy", nil, nil, "", []int{204, 404, 409}},
+}
+
+// pathParam matches the parameters in an operation's path
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// OpenAPI returns an OpenAPI 3 spec for the admin and management APIs,
+// for generating clients and infrastructure-as-code providers from
+func OpenAPI() map[string]any {
+	paths := make(map[string]any)
+	for _, op := range apiOperations {
+		item, _ := paths[op.path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[op.path] = item
+		}
+
+		responses := map[string]any{
+			"401": map[string]any{"description": "Missing or invalid token"},
+			"403": map[string]any{"description": "Not a full access token"},
+		}
+		for _, status := range op.statuses {
+			resp := map[string]any{"description": http.StatusText(status)}
+			if op.response != nil && status < 300 && status != http.StatusNoContent {
+				resp["content"] = content(op.contentType, op.response)
+			}
+			responses[strconv.Itoa(status)] = resp
+		}
+
+		params := []any{map[string]any{
+			"name": "token", "in": "query", "required": true,
+			"description": "Full access token",
+			"schema":      map[string]any{"type": "string"},
+		}}
+		for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		operation := map[string]any{
+			"operationId": op.id,
+			"summary":     op.summary,
+			"parameters":  params,
+			"responses":   responses,
+		}
+		if op.body != nil {
+			operation["requestBody"] = map[string]any{"content": content("", op.body)}
+		}
+		item[strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "flyssh admin API",
+			"description": "Every operation needs a full access token. Tokens and the policy are only served with -manage.",
+			"version":     "v1",
+		},
+		"paths": paths,
+	}
+}
+
+// handleOpenAPI serves the OpenAPI spec, which describes the API but holds
+// nothing secret, so is served without a token for API explorers
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, OpenAPI())
+}
+
+// content describes a body of the given type, JSON if empty, holding v
+func content(contentType string, v any) map[string]any {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	schema := jsonSchema(reflect.TypeOf(v))
+	if contentType == "application/octet-stream" {
+		schema["format"] = "binary"
+	}
+	return map[string]any{contentType: map[string]any{"schema": schema}}
+}
+
+// timeType is described as a date-time string, as encoding/json encodes it
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes how encoding/json encodes a type: its exported
+// fields, by their JSON names
+func jsonSchema(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Uint, reflect.Uint64, reflect.Uint32, reflect.Uint16:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64, reflect.Float32:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]any)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if !f.IsExported() || tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = jsonSchema(f.Type)
+		}
+		return map[string]any{"type": "object", "properties": properties}
+	}
+	return map[string]any{}
+}
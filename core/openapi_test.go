@@ -0,0 +1,72 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	spec := OpenAPI()
+	if _, err := json.Marshal(spec); err != nil {
+		t.Fatal(err)
+	}
+	paths := spec["paths"].(map[string]any)
+	put := paths[manageTokensPath+"/{name}"].(map[string]any)["put"].(map[string]any)
+	if put["operationId"] != "putToken" {
+		t.Errorf("Unexpected operation ID %v", put["operationId"])
+	}
+	schema := put["requestBody"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+	props := schema["properties"].(map[string]any)
+	for _, name := range []string{"token", "name", "launchers", "quota", "project"} {
+		if _, ok := props[name]; !ok {
+			t.Errorf("Expected the token schema to have %q, got %v", name, props)
+		}
+	}
+
+	get := paths[adminSessionsPath+"/{id}"].(map[string]any)["get"].(map[string]any)
+	params := get["parameters"].([]any)
+	if len(params) != 2 || params[1].(map[string]any)["name"] != "id" {
+		t.Errorf("Expected token and id parameters, got %v", params)
+	}
+	session := get["responses"].(map[string]any)["200"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+	if start := session["properties"].(map[string]any)["start_time"]; start.(map[string]any)["format"] != "date-time" {
+		t.Errorf("Expected times to be date-time strings, got %v", start)
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	_, ts := newManagedServer(t, "")
+
+	// The spec needs no token
+	var spec map[string]any
+	if status := manageRequest(t, http.MethodGet, ts.URL+openAPIPath, "", &spec); status != http.StatusOK {
+		t.Fatalf("Expected the spec to be served, got %d", status)
+	}
+	if spec["openapi"] != "3.0.3" {
+		t.Errorf("Unexpected spec: %v", spec["openapi"])
+	}
+
+	// Every operation it describes is served, answering with a status it
+	// lists. Events stream until the client goes, and deleting or draining
+	// would change the server, so they aren't tried.
+	for _, op := range apiOperations {
+		if op.id == "streamEvents" || op.method == http.MethodDelete || op.method == http.MethodPost {
+			continue
+		}
+		path := pathParam.ReplaceAllString(op.path, "missing")
+		body := ""
+		if op.body != nil {
+			body = "{}"
+		}
+		status := manageRequest(t, op.method, ts.URL+path+"?token=admin-token", body, nil)
+		found := false
+		for _, want := range op.statuses {
+			found = found || status == want
+		}
+		if !found {
+			t.Errorf("%s %s: got %d, want one of %v", op.method, strings.ReplaceAll(op.path, "{", ":"), status, op.statuses)
+		}
+	}
+}
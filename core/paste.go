@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Bracketed paste markers, which tell a program that understands them
+// that text was pasted rather than typed
+var (
+	pasteStart = []byte("\x1b[200~")
+	pasteEnd   = []byte("\x1b[201~")
+)
+
+// pasteGap is how soon after a paste more input counts as the rest of it.
+// Pastes bigger than a read arrive in several.
+const pasteGap = 100 * time.Millisecond
+
+// pasteGuard keeps a large paste into a shell from running line by line
+// as it arrives. Pasted text is recognized by arriving in one large read,
+// where typing arrives a key or so at a time. If the program turned on
+// bracketed paste, the paste is wrapped in its markers so the program
+// waits for Enter; otherwise it's held until the user confirms it. Full
+// screen programs get pastes unchanged.
+type pasteGuard struct {
+	r      io.Reader
+	limit  int            // smallest read taken for a paste
+	screen *screenTracker // the modes the program's output set
+	notice func(string)
+
+	buf       []byte
+	out       []byte    // input ready to be read
+	err       error     // from r, returned once out is drained
+	held      []byte    // a paste awaiting confirmation
+	wrapped   bool      // the last paste was wrapped in markers
+	bracketed bool      // the client's terminal is sending a bracketed paste
+	last      time.Time // when the last paste arrived
+}
+
+func newPasteGuard(r io.Reader, limit int, screen *screenTracker, notice func(string)) *pasteGuard {
+	return &pasteGuard{r: r, limit: limit, screen: screen, notice: notice, buf: make([]byte, 32*1024)}
+}
+
+func (g *pasteGuard) Read(p []byte) (int, error) {
+	for len(g.out) == 0 && g.err == nil {
+		n, err := g.r.Read(g.buf)
+		g.filter(g.buf[:n], time.Now())
+		g.err = err
+	}
+	if len(g.out) == 0 {
+		return 0, g.err
+	}
+	n := copy(p, g.out)
+	g.out = g.out[n:]
+	return n, nil
+}
+
+// filter decides what to do with one read of input
+func (g *pasteGuard) filter(in []byte, now time.Time) {
+	if len(in) == 0 {
+		return
+	}
+	continued := now.Sub(g.last) < pasteGap
+
+	// Terminals that bracket pastes themselves need no help
+	if i := bytes.LastIndex(in, pasteStart); i >= 0 {
+		g.bracketed = !bytes.Contains(in[i:], pasteEnd)
+	} else if bytes.Contains(in, pasteEnd) {
+		g.bracketed = false
+	}
+
+	switch {
+	case g.held != nil && continued:
+		g.held = append(g.held, in...)
+		g.last = now
+	case g.held != nil:
+		// The first key answers; the rest is typed as usual
+		if in[0] == 'y' || in[0] == 'Y' {
+			g.out = append(g.out, g.held...)
+			g.notice("paste sent")
+		} else {
+			g.notice("paste discarded")
+		}
+		g.held = nil
+		g.out = append(g.out, in[1:]...)
+	case g.wrapped && continued, !g.bracketed && g.isPaste(in) && g.screen.isSet("2004"):
+		// Each piece is a paste of its own, so the program shows it
+		// without waiting for the rest
+		g.out = append(g.out, pasteStart...)
+		g.out = append(g.out, in...)
+		g.out = append(g.out, pasteEnd...)
+		g.wrapped = true
+		g.last = now
+	case g.bracketed || !g.isPaste(in):
+		g.out = append(g.out, in...)
+	default:
+		g.held = append([]byte(nil), in...)
+		g.wrapped = false
+		g.last = now
+		g.notice(fmt.Sprintf("held a paste of %s with line breaks; press y to send it, or any other key to discard it", formatBytes(float64(len(in)))))
+	}
+}
+
+// isPaste reports whether a read is a paste that could run commands: a
+// large one with line breaks, into a shell rather than a full screen
+// program such as an editor
+func (g *pasteGuard) isPaste(in []byte) bool {
+	return len(in) >= g.limit && bytes.ContainsAny(in, "\r\n") &&
+		!g.screen.isSet("1049") && !g.screen.isSet("1047") && !g.screen.isSet("47")
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasteGuard(t *testing.T) {
+	paste := strings.Repeat("echo hi\r", 16)
+	type read struct {
+		in    string
+		after time.Duration // since the previous read
+	}
+	tests := []struct {
+		name    string
+		output  string // what the program wrote first
+		reads   []read
+		want    string
+		notices int
+	}{
+		{"typing", "", []read{{"l", 0}, {"s", time.Second}, {"\r", time.Second}}, "ls\r", 0},
+		{"long line without breaks", "", []read{{strings.Repeat("x", 200), 0}}, strings.Repeat("x", 200), 0},
+		{"paste confirmed", "", []read{{paste, 0}, {"yls", time.Second}}, paste + "ls", 2},
+		{"paste discarded", "", []read{{paste, 0}, {"nls", time.Second}}, "ls", 2},
+		{"rest of paste held", "", []read{{paste, 0}, {"echo more\r", time.Millisecond}, {"y", time.Second}}, paste + "echo more\r", 2},
+		{"bracketed by the server", "\x1b[?2004h", []read{{paste, 0}, {"echo more\r", time.Millisecond}, {"\r", time.Second}},
+			"\x1b[200~" + paste + "\x1b[201~\x1b[200~echo more\r\x1b[201~\r", 0},
+		{"bracketed by the terminal", "\x1b[?2004h", []read{{"\x1b[200~" + paste, 0}, {"echo more\r\x1b[201~", time.Millisecond}},
+			"\x1b[200~" + paste + "echo more\r\x1b[201~", 0},
+		{"full screen program", "\x1b[?1049h", []read{{paste, 0}}, paste, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			screen := newScreenTracker(io.Discard)
+			screen.Write([]byte(tt.output))
+			notices := 0
+			g := newPasteGuard(nil, 64, screen, func(string) { notices++ })
+			now := time.Now()
+			for _, r := range tt.reads {
+				now = now.Add(r.after)
+				g.filter([]byte(r.in), now)
+			}
+			if got := string(g.out); got != tt.want {
+				t.Errorf("passed %q, want %q", got, tt.want)
+			}
+			if notices != tt.notices {
+				t.Errorf("sent %d notices, want %d", notices, tt.notices)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"flyssh/core/log"
+)
+
+// pipeTerminal runs a command on plain pipes instead of a PTY, for input
+// that comes from a file or another program rather than a person. Output
+// and errors share one stream, as they would on a terminal, unless the
+// client can take errors separately.
+type pipeTerminal struct {
+	stdin  *os.File // write end of the command's stdin
+	output *os.File // read end of the command's stdout, and stderr if shared
+	errors *os.File // read end of the command's stderr if separate, or nil
+}
+
+// startPipes starts cmd with its stdin, stdout and stderr on pipes. With
+// separate set, stderr gets a pipe of its own.
+func startPipes(cmd *exec.Cmd, separate bool) (*pipeTerminal, error) {
+	var opened []*os.File
+	pipe := func(what string) (*os.File, *os.File, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			for _, f := range opened {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to create %s pipe: %v", what, err)
+		}
+		opened = append(opened, r, w)
+		return r, w, nil
+	}
+	inR, inW, err := pipe("stdin")
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := pipe("output")
+	if err != nil {
+		return nil, err
+	}
+	p := &pipeTerminal{stdin: inW, output: outR}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, outW
+	var errW *os.File
+	if separate {
+		if p.errors, errW, err = pipe("stderr"); err != nil {
+			return nil, err
+		}
+		cmd.Stderr = errW
+	}
+
+	// Without a terminal, signals from the client are sent to the group
+	newProcessGroup(cmd)
+	err = cmd.Start()
+	// The child has its own copies; ours would keep the pipes from
+	// reporting EOF
+	inR.Close()
+	outW.Close()
+	if errW != nil {
+		errW.Close()
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// stderrWriter sends a command's errors to the attached client in stderr
+// control messages, so they don't mix with output that may be binary.
+// Errors written while no client is attached are lost.
+type stderrWriter struct {
+	ctl *sessionControl
+}
+
+func (w stderrWriter) Write(p []byte) (int, error) {
+	if conn, _ := w.ctl.current(); conn != nil {
+		if err := conn.send(controlMessage{Type: "stderr", Data: p}); err != nil {
+			log.Debug.Printf("Failed to send stderr: %v", err)
+		}
+	}
+	return len(p), nil
+}
+
+// Read reads the command's output
+func (p *pipeTerminal) Read(b []byte) (int, error) {
+	return p.output.Read(b)
+}
+
+// Write writes to the command's stdin
+func (p *pipeTerminal) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+// closeInput closes the command's stdin so it reads EOF
+func (p *pipeTerminal) closeInput() {
+	p.stdin.Close()
+}
+
+// Close closes the pipes
+func (p *pipeTerminal) Close() error {
+	p.stdin.Close()
+	if p.errors != nil {
+		p.errors.Close()
+	}
+	return p.output.Close()
+}
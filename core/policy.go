@@ -0,0 +1,121 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"flyssh/core/log"
+)
+
+// shellOperators are the characters that let one command line run several
+// commands, or build one from substitutions
+const shellOperators = ";&|`$<>(){}\n"
+
+// Policy restricts what full access tokens may run: whether they get
+// interactive shells, and which commands they may run through the shell.
+// Launchers are configured by the operator and aren't restricted.
+type Policy struct {
+	// Shell permits interactive shells. Unset permits them.
+	Shell *bool `json:"shell,omitempty"`
+	// Allow lists the commands that may be run, as patterns where * matches
+	// anything and ? one character. Empty allows any command not denied.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists commands that may never be run, checked before Allow
+	Deny []string `json:"deny,omitempty"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// LoadPolicy reads a command policy from a JSON file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %v", err)
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %v", err)
+	}
+	p.compile()
+	return &p, nil
+}
+
+// compile turns the policy's command patterns into regexps
+func (p *Policy) compile() {
+	p.allow, p.deny = nil, nil
+	for _, pattern := range p.Allow {
+		p.allow = append(p.allow, compileCommandPattern(pattern))
+	}
+	for _, pattern := range p.Deny {
+		p.deny = append(p.deny, compileCommandPattern(pattern))
+	}
+}
+
+// compileCommandPattern turns a command pattern into an anchored regexp
+func compileCommandPattern(pattern string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(normalizeCommand(pattern))
+	expr = strings.ReplaceAll(expr, `\*`, `.*`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	return regexp.MustCompile(`^` + expr + `$`)
+}
+
+// checkTransfers returns an error if the policy forbids file transfers,
+// which it does when it limits what may run, since they could get around
+// the limits
+func (p *Policy) checkTransfers() error {
+	if p != nil && (len(p.allow) > 0 || (p.Shell != nil && !*p.Shell)) {
+		return fmt.Errorf("file transfers are not permitted by policy")
+	}
+	return nil
+}
+
+// auditPreview logs and audits something the previewed policy would have
+// refused, which goes ahead anyway
+func (s *Server) auditPreview(what string, ev AuditEvent, err error) {
+	log.Info.Printf("Policy preview would refuse %s: %v", what, err)
+	ev.Event, ev.Reason = AuditWouldDeny, err.Error()
+	s.audit.Log(ev)
+}
+
+// normalizeCommand collapses whitespace so spacing can't dodge a pattern
+func normalizeCommand(command string) string {
+	return strings.Join(strings.Fields(command), " ")
+}
+
+// check returns an error if the policy forbids a command, or an
+// interactive shell if command is empty
+func (p *Policy) check(command string) error {
+	if p == nil {
+		return nil
+	}
+	if command == "" {
+		if p.Shell != nil && !*p.Shell {
+			return fmt.Errorf("interactive shells are not permitted by policy")
+		}
+		return nil
+	}
+
+	normalized := normalizeCommand(command)
+	for _, re := range p.deny {
+		if re.MatchString(normalized) {
+			return fmt.Errorf("command %q is denied by policy", command)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	// A pattern like "git *" would otherwise admit "git log; rm -rf ~"
+	if strings.ContainsAny(command, shellOperators) {
+		return fmt.Errorf("command %q uses shell operators, which policy only allows without an allow list", command)
+	}
+	for _, re := range p.allow {
+		if re.MatchString(normalized) {
+			return nil
+		}
+	}
+	return fmt.Errorf("command %q is not allowed by policy", command)
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	config := `{"shell": false, "allow": ["git *", "ls", "ls -?"], "deny": ["git push*"]}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"", false},
+		{"git status", true},
+		{"  git   log  ", true},
+		{"git push origin main", false},
+		{"git  push", false},
+		{"ls", true},
+		{"ls -l", true},
+		{"ls -la", false},
+		{"git log; rm -rf ~", false},
+		{"git log $(rm -rf ~)", false},
+		{"rm -rf /", false},
+	}
+	for _, tt := range tests {
+		if err := p.check(tt.command); (err == nil) != tt.allowed {
+			t.Errorf("check(%q) = %v, want allowed %v", tt.command, err, tt.allowed)
+		}
+	}
+}
+
+func TestPolicyDenyOnly(t *testing.T) {
+	p := &Policy{Deny: []string{"*shutdown*"}}
+	p.deny = append(p.deny, compileCommandPattern(p.Deny[0]))
+
+	if err := p.check(""); err != nil {
+		t.Errorf("Shells should be allowed by default: %v", err)
+	}
+	if err := p.check("echo a && shutdown -h now"); err == nil {
+		t.Error("Denied command was allowed")
+	}
+	if err := p.check("echo a && echo b"); err != nil {
+		t.Errorf("Shell operators should be allowed without an allow list: %v", err)
+	}
+	if err := (*Policy)(nil).check("anything"); err != nil {
+		t.Errorf("No policy should allow everything: %v", err)
+	}
+}
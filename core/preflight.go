@@ -0,0 +1,146 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// PreflightCheck is the outcome of one check made before the server starts
+type PreflightCheck struct {
+	Name  string
+	Err   error  // nil if the check passed
+	Fatal bool   // the server can't run as configured without it
+	Note  string // what doesn't work, for a failure that isn't fatal
+}
+
+// Preflight checks that the server can run as configured: that its port
+// is free, clients can authenticate, sessions have a shell and a terminal,
+// and the directories it writes to are writable. Problems that only
+// affect some features aren't fatal.
+func (s *Server) Preflight() []PreflightCheck {
+	var checks []PreflightCheck
+	check := func(name string, fatal bool, note string, err error) {
+		checks = append(checks, PreflightCheck{Name: name, Err: err, Fatal: fatal, Note: note})
+	}
+
+	// The old server has the port, and hands it over, in an upgrade
+	if !upgrading() {
+		ln, err := s.listen()
+		if err == nil {
+			ln.Close()
+		} else if s.addr == "" {
+			err = fmt.Errorf("can't listen on port %d: %v (use -port to pick another)", s.port, err)
+		} else {
+			err = fmt.Errorf("can't listen on %s: %v (use -ws-addr to pick another)", s.addr, err)
+		}
+		check("port", true, "", err)
+	}
+
+	check("auth", true, "", s.checkAuth())
+	check("shell", true, "", s.checkShell())
+
+	// Jailed launchers' commands are looked up inside the jail, when
+	// they run
+	if s.launchers != nil && s.jail == nil {
+		names := make([]string, 0, len(s.launchers.Launchers))
+		for name := range s.launchers.Launchers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			command := s.launchers.Launchers[name].Command[0]
+			if _, err := exec.LookPath(command); err != nil {
+				check("launcher "+name, false, "the launcher can't start", fmt.Errorf("%s not found", command))
+			}
+		}
+	}
+
+	err := checkPTY()
+	if err != nil {
+		err = fmt.Errorf("can't open a PTY: %v", err)
+	}
+	check("pty", false, "only commands without a terminal (client -c with piped input) will work", err)
+
+	if s.tmpDir != "" && s.jail == nil && s.sandbox == nil {
+		check("tmp-dir", true, "", checkWritable(s.tmpDir))
+	}
+	if s.recordDir != "" {
+		check("record-dir", true, "", checkWritable(s.recordDir))
+	}
+	if s.quotas != nil && s.quotas.path != "" {
+		check("quota-file", true, "", checkWritable(filepath.Dir(s.quotas.path)))
+	}
+	if s.cluster != nil {
+		check("cluster-dir", true, "", checkWritable(s.cluster.dir))
+	}
+	return checks
+}
+
+// checkAuth checks that clients have a token to authenticate with
+func (s *Server) checkAuth() error {
+	if s.fullToken() == "" && (s.launchers == nil || len(s.launchers.Tokens) == 0) {
+		return fmt.Errorf("no auth token: set WSS_AUTH_TOKEN, or give launcher tokens with -launchers")
+	}
+	return nil
+}
+
+// checkShell checks that the server's shell exists, inside the jail for
+// jailed sessions. Windows has no executable bits to check.
+func (s *Server) checkShell() error {
+	cmd := shellCommand(s.shell, "")
+	if cmd.Err != nil {
+		return fmt.Errorf("no %s shell: %v", s.shell, cmd.Err)
+	}
+	shell := filepath.Join(s.jailRoot(), cmd.Path)
+	fi, err := os.Stat(shell)
+	if err != nil {
+		return fmt.Errorf("no shell at %s: %v", shell, err)
+	}
+	if fi.IsDir() || (fi.Mode()&0111 == 0 && runtime.GOOS != "windows") {
+		return fmt.Errorf("%s is not executable", shell)
+	}
+	return nil
+}
+
+// checkWritable checks that files can be created in dir, creating it if
+// need be, as the server would
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("can't create %s: %v", dir, err)
+	}
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("can't write to %s: %v", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// PreflightReport writes a report of the checks to w, one line each, and
+// returns an error listing the fatal failures, if any
+func PreflightReport(w io.Writer, checks []PreflightCheck) error {
+	var fatal []string
+	fmt.Fprintln(w, "Preflight checks:")
+	for _, c := range checks {
+		switch {
+		case c.Err == nil:
+			fmt.Fprintf(w, "  ok    %s\n", c.Name)
+		case c.Fatal:
+			fmt.Fprintf(w, "  FAIL  %s: %v\n", c.Name, c.Err)
+			fatal = append(fatal, c.Name)
+		default:
+			fmt.Fprintf(w, "  warn  %s: %v; %s\n", c.Name, c.Err, c.Note)
+		}
+	}
+	if len(fatal) > 0 {
+		return fmt.Errorf("not starting, preflight checks failed: %s", strings.Join(fatal, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failedChecks returns the names of the checks that failed
+func failedChecks(checks []PreflightCheck) []string {
+	var failed []string
+	for _, c := range checks {
+		if c.Err != nil {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+func TestPreflight(t *testing.T) {
+	t.Setenv("WSS_AUTH_TOKEN", "test-token")
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	s := NewServer(port)
+	s.SetRecording(filepath.Join(t.TempDir(), "recordings"), DefaultRecordingName, false)
+	for _, c := range s.Preflight() {
+		// Not every machine running tests can open a PTY
+		if c.Err != nil && c.Fatal {
+			t.Errorf("Expected %s to pass, got %v", c.Name, c.Err)
+		}
+	}
+
+	// A port in use, no token and a record directory that's a file
+	if ln, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	os.Unsetenv("WSS_AUTH_TOKEN")
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0600)
+	s.SetRecording(file, DefaultRecordingName, false)
+	checks := s.Preflight()
+	failed := strings.Join(failedChecks(checks), " ")
+	for _, name := range []string{"port", "auth", "record-dir"} {
+		if !strings.Contains(failed, name) {
+			t.Errorf("Expected %s to fail, failed: %s", name, failed)
+		}
+	}
+
+	var report bytes.Buffer
+	err = PreflightReport(&report, checks)
+	if err == nil || !strings.Contains(err.Error(), "port, auth") {
+		t.Errorf("Expected the report to refuse to start, got %v", err)
+	}
+	if !strings.Contains(report.String(), "FAIL  port: can't listen on port") || !strings.Contains(report.String(), "ok    shell") {
+		t.Errorf("Unexpected report:\n%s", report.String())
+	}
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Project environments
+const (
+	ProjectAuto         = "auto"
+	ProjectDevcontainer = "devcontainer"
+	ProjectNix          = "nix"
+)
+
+// Project is a directory on the server whose development environment a
+// launcher's command runs in, so sessions start inside it
+type Project struct {
+	Dir string `json:"dir"`
+	// Environment is devcontainer, nix or auto (the default), which uses
+	// whichever one the directory defines, if any
+	Environment string `json:"environment,omitempty"`
+}
+
+// check reports a project that can't be used
+func (p *Project) check() error {
+	if !filepath.IsAbs(p.Dir) {
+		return fmt.Errorf("project directory %q is not absolute", p.Dir)
+	}
+	switch p.Environment {
+	case "", ProjectAuto, ProjectDevcontainer, ProjectNix:
+		return nil
+	}
+	return fmt.Errorf("unknown project environment %q (want devcontainer, nix or auto)", p.Environment)
+}
+
+// command returns argv wrapped to run in the project's environment, which
+// is looked for when each session starts so it can change between them.
+// The project is inside root for jailed sessions.
+func (p *Project) command(argv []string, root string) ([]string, error) {
+	dir := filepath.Join(root, p.Dir)
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	devcontainer := exists(".devcontainer/devcontainer.json") || exists(".devcontainer.json")
+	flake := exists("flake.nix")
+	nixShell := ""
+	for _, name := range []string{"shell.nix", "default.nix"} {
+		if exists(name) {
+			nixShell = filepath.Join(p.Dir, name)
+			break
+		}
+	}
+
+	env := p.Environment
+	if env == "" || env == ProjectAuto {
+		switch {
+		case devcontainer:
+			env = ProjectDevcontainer
+		case flake || nixShell != "":
+			env = ProjectNix
+		default:
+			return argv, nil
+		}
+	}
+
+	var wrapped []string
+	switch {
+	case env == ProjectDevcontainer && devcontainer:
+		// The container is started if it isn't running, showing progress
+		// in the terminal
+		script := `devcontainer up --workspace-folder "$0" >&2 && exec devcontainer exec --workspace-folder "$0" "$@"`
+		wrapped = append([]string{"/bin/sh", "-c", script, p.Dir}, argv...)
+	case env == ProjectNix && flake:
+		wrapped = append([]string{"nix", "develop", p.Dir, "--command"}, argv...)
+	case env == ProjectNix && nixShell != "":
+		wrapped = []string{"nix-shell", nixShell, "--run", "exec " + shellJoin(argv)}
+	default:
+		return nil, fmt.Errorf("%s defines no %s environment", p.Dir, env)
+	}
+
+	// Jailed sessions look for it inside the jail, when they start
+	if root == "" && wrapped[0] != "/bin/sh" {
+		if _, err := exec.LookPath(wrapped[0]); err != nil {
+			return nil, fmt.Errorf("%s isn't installed on the server", wrapped[0])
+		}
+	}
+	return wrapped, nil
+}
+
+// shellJoin quotes argv as one POSIX shell command
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// projectFor returns the project a launcher runs in for a grant: its
+// token's, if the token has one, or else the launcher's own
+func (s *Server) projectFor(g *grant, l *Launcher) *Project {
+	if g != nil && !g.full {
+		if t, ok := s.scopedToken(g.name); ok && t.Project != nil {
+			return t.Project
+		}
+	}
+	return l.Project
+}
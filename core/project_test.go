@@ -0,0 +1,79 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProjectCommand(t *testing.T) {
+	// Jailed, so the tools are looked for when the session starts
+	root := t.TempDir()
+	project := func(files ...string) string {
+		dir, err := os.MkdirTemp(root, "project")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files {
+			os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+			os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644)
+		}
+		return "/" + filepath.Base(dir)
+	}
+	argv := []string{"bash", "-l", "it's"}
+
+	plain := project()
+	devcontainer := project(".devcontainer/devcontainer.json", "flake.nix")
+	flake := project("flake.nix", "shell.nix")
+	shell := project("shell.nix")
+	tests := []struct {
+		name    string
+		project Project
+		want    []string
+	}{
+		{"nothing defined", Project{Dir: plain}, argv},
+		{"devcontainer first", Project{Dir: devcontainer}, append([]string{"/bin/sh", "-c", `devcontainer up --workspace-folder "$0" >&2 && exec devcontainer exec --workspace-folder "$0" "$@"`, devcontainer}, argv...)},
+		{"nix chosen", Project{Dir: devcontainer, Environment: ProjectNix}, append([]string{"nix", "develop", devcontainer, "--command"}, argv...)},
+		{"flake", Project{Dir: flake}, append([]string{"nix", "develop", flake, "--command"}, argv...)},
+		{"nix-shell", Project{Dir: shell, Environment: ProjectAuto}, []string{"nix-shell", shell + "/shell.nix", "--run", `exec 'bash' '-l' 'it'\''s'`}},
+	}
+	for _, tt := range tests {
+		got, err := tt.project.command(argv, root)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// An environment asked for must be there
+	if _, err := (&Project{Dir: shell, Environment: ProjectDevcontainer}).command(argv, root); err == nil {
+		t.Error("Expected a missing devcontainer to be refused")
+	}
+}
+
+func TestProjectConfig(t *testing.T) {
+	for _, p := range []Project{{Dir: "relative"}, {Dir: "/srv/app", Environment: "docker"}} {
+		if err := p.check(); err == nil {
+			t.Errorf("Expected %+v to be refused", p)
+		}
+	}
+
+	// A token's project replaces its launchers'
+	launcher := &Launcher{Command: []string{"bash"}, Project: &Project{Dir: "/srv/app"}}
+	s := NewServer(0)
+	s.SetLaunchers(&LauncherConfig{
+		Launchers: map[string]Launcher{"dev": *launcher},
+		Tokens: []ScopedToken{
+			{Token: "a", Name: "web", Launchers: []string{"dev"}, Project: &Project{Dir: "/srv/web"}},
+			{Token: "b", Name: "ops", Launchers: []string{"dev"}},
+		},
+	})
+	if got := s.projectFor(&grant{name: "web"}, launcher); got.Dir != "/srv/web" {
+		t.Errorf("Expected the token's project, got %s", got.Dir)
+	}
+	if got := s.projectFor(&grant{name: "ops"}, launcher); got.Dir != "/srv/app" {
+		t.Errorf("Expected the launcher's project, got %s", got.Dir)
+	}
+}
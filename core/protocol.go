@@ -0,0 +1,218 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket subprotocols negotiated via Sec-WebSocket-Protocol.
+//
+// flyssh.v1 is a raw byte stream: after the JSON session message every
+// WebSocket message is terminal data. Clients that don't offer a protocol
+// get v1.
+//
+// flyssh.v2 frames every binary message with a one byte type. Data frames
+// carry terminal I/O and control frames carry JSON messages (session,
+// error, resize, notice, exit, eof, stderr, close, redirect, ping, pong,
+// bookmark, and the open, data and close messages of agent and x11
+// forwarding), so control traffic never mixes with the stream. Unlike v1
+// sessions, v2 sessions can be resumed after a dropped connection.
+//
+// flyssh.v3 multiplexes: every frame also carries a channel ID, and each
+// channel the client opens is an independent session that resizes, ends
+// and resumes like a v2 connection.
+const (
+	ProtocolV1 = "flyssh.v1"
+	ProtocolV2 = "flyssh.v2"
+	ProtocolV3 = "flyssh.v3"
+)
+
+// Frame types for flyssh.v2
+const (
+	frameData    byte = 0
+	frameControl byte = 1
+)
+
+// controlMessage is the JSON payload of a v2 control frame
+type controlMessage struct {
+	Type      string   `json:"type"`
+	SessionID string   `json:"session_id,omitempty"`
+	Message   string   `json:"message,omitempty"`
+	Rows      uint16   `json:"rows,omitempty"`
+	Cols      uint16   `json:"cols,omitempty"`
+	Launcher  string   `json:"launcher,omitempty"`
+	Command   string   `json:"command,omitempty"`
+	Login     string   `json:"login,omitempty"`
+	Dir       string   `json:"dir,omitempty"`
+	Shell     string   `json:"shell,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	ExitCode  *int     `json:"exit_code,omitempty"`
+	Core      bool     `json:"core_dumped,omitempty"` // the signal that killed the command dumped core
+	NoPTY     bool     `json:"no_pty,omitempty"`
+	Data      []byte   `json:"data,omitempty"`
+	Env       []string `json:"env,omitempty"`
+	Dotfiles  []string `json:"dotfiles,omitempty"`
+	Forward   uint32   `json:"forward,omitempty"` // forwarded agent or X11 connection
+	Signal    string   `json:"signal,omitempty"`  // for the command, named as in SSH: INT, TERM...
+
+	// File transfers
+	Transfer *transferRequest `json:"transfer,omitempty"`
+	File     *FileInfo        `json:"file,omitempty"`
+	Files    []FileInfo       `json:"files,omitempty"`
+}
+
+// negotiateProtocol selects the subprotocol for a server connection,
+// preferring the newest offered. It keeps the origin check done by websocket.Handler.
+func negotiateProtocol(config *websocket.Config, req *http.Request) (err error) {
+	_, sp := startSpan(req.Context(), "handshake")
+	defer func() {
+		if err != nil {
+			sp.fail(err)
+		} else {
+			sp.setAttr("protocol", connProtocol(config))
+		}
+		sp.end()
+	}()
+
+	config.Origin, err = websocket.Origin(config, req)
+	if err == nil && config.Origin == nil {
+		return fmt.Errorf("null origin")
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(config.Protocol) == 0 {
+		return nil
+	}
+	for _, preferred := range []string{ProtocolV3, ProtocolV2, ProtocolV1} {
+		for _, offered := range config.Protocol {
+			if offered == preferred {
+				config.Protocol = []string{preferred}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unsupported subprotocols %v", config.Protocol)
+}
+
+// connProtocol returns the protocol negotiated for a connection. A
+// connection without an agreed protocol (an old peer) speaks v1.
+func connProtocol(config *websocket.Config) string {
+	if p := config.Protocol; len(p) == 1 {
+		return p[0]
+	}
+	return ProtocolV1
+}
+
+// offersProtocol reports whether a WebSocket handshake request offers the
+// given subprotocol
+func offersProtocol(r *http.Request, protocol string) bool {
+	for _, header := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, offered := range strings.Split(header, ",") {
+			if strings.TrimSpace(offered) == protocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frameConn reads and writes flyssh.v2 frames on a WebSocket
+type frameConn struct {
+	ws      *websocket.Conn
+	mu      sync.Mutex     // serializes frame writes
+	faults  *faultInjector // set on servers built to inject faults
+	timeout time.Duration  // how long a write may take, 0 for no limit
+	buf     []byte         // the frame being written, reused
+}
+
+func newFrameConn(ws *websocket.Conn) *frameConn {
+	return &frameConn{ws: ws}
+}
+
+// writeFrame sends a single frame as one binary message
+func (fc *frameConn) writeFrame(typ byte, payload []byte) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.faults.beforeWrite() {
+		return nil
+	}
+
+	fc.buf = append(append(fc.buf[:0], typ), payload...)
+	return sendMessage(fc.ws, fc.buf, fc.timeout)
+}
+
+// writeControl sends a control message
+func (fc *frameConn) writeControl(msg controlMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode control message: %v", err)
+	}
+	return fc.writeFrame(frameControl, data)
+}
+
+// readFrame receives the next frame
+func (fc *frameConn) readFrame() (byte, []byte, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(fc.ws, &msg); err != nil {
+		return 0, nil, err
+	}
+	if len(msg) == 0 {
+		return 0, nil, fmt.Errorf("empty frame")
+	}
+	return msg[0], msg[1:], nil
+}
+
+// Write sends p as a data frame
+func (fc *frameConn) Write(p []byte) (int, error) {
+	if err := fc.writeFrame(frameData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// dataReader returns a reader over the payloads of incoming data frames.
+// Control frames are passed to onControl as they arrive.
+func (fc *frameConn) dataReader(onControl func(controlMessage)) *frameReader {
+	return &frameReader{fc: fc, onControl: onControl}
+}
+
+// frameReader adapts a frame stream to io.Reader
+type frameReader struct {
+	fc        *frameConn
+	onControl func(controlMessage)
+	pending   []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		typ, payload, err := r.fc.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case frameData:
+			r.pending = payload
+		case frameControl:
+			var msg controlMessage
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				return 0, fmt.Errorf("invalid control message: %v", err)
+			}
+			if r.onControl != nil {
+				r.onControl(msg)
+			}
+		default:
+			return 0, fmt.Errorf("unknown frame type %d", typ)
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
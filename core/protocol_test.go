@@ -0,0 +1,56 @@
+package core
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// BenchmarkFrameRead measures receiving terminal output as flyssh.v2 data
+// frames. Each message is read whole by x/net/websocket, which allocates
+// it afresh; frameReader itself copies each byte once and allocates
+// nothing.
+func BenchmarkFrameRead(b *testing.B) {
+	for _, size := range []int{64, 4 << 10, maxChunk} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			frames := b.N
+			ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+				fc := newFrameConn(ws)
+				data := bytes.Repeat([]byte("x"), size)
+				for i := 0; i < frames; i++ {
+					if _, err := fc.Write(data); err != nil {
+						return
+					}
+				}
+				ws.Close()
+			}))
+			defer ts.Close()
+			ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", "http://localhost")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ws.Close()
+
+			r := newFrameConn(ws).dataReader(nil)
+			buf := make([]byte, maxChunk)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			var got int
+			for {
+				n, err := r.Read(buf)
+				got += n
+				if err != nil {
+					break
+				}
+			}
+			if got != frames*size {
+				b.Fatalf("read %d bytes, want %d", got, frames*size)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"flyssh/core/log"
+
+	"golang.org/x/net/websocket"
+)
+
+// proxyPath is where stdio proxy connections are served. They speak
+// flyssh.v2: the server answers with a proxy message, or an error, then
+// data frames carry the stream each way and an eof control message ends
+// a direction, so each side's EOF reaches the other while the rest of
+// the stream still flows.
+const proxyPath = "/proxy"
+
+// proxyAllowed reports why a connection may not be proxied, if it may not
+func (s *Server) proxyAllowed(g *grant) error {
+	if s.sshTarget == "" {
+		return fmt.Errorf("this server does not proxy to SSH (see -ssh-target)")
+	}
+	if g == nil || !g.full {
+		return fmt.Errorf("proxying needs a full access token")
+	}
+	return nil
+}
+
+// handleProxy relays a stdio proxy connection to the SSH target
+func (s *Server) handleProxy(ws *websocket.Conn) {
+	defer ws.Close()
+	r := ws.Request()
+	if connProtocol(ws.Config()) != ProtocolV2 {
+		log.Info.Printf("Proxy connection from %s doesn't speak %s", r.RemoteAddr, ProtocolV2)
+		return
+	}
+	fc := newFrameConn(ws)
+	fc.faults = s.faults
+	g := grantFrom(r.Context())
+	tokenName := ""
+	if g != nil {
+		tokenName = g.name
+	}
+	fail := func(err error) {
+		log.Info.Printf("Proxy from %s failed: %v", r.RemoteAddr, err)
+		if err := fc.writeControl(controlMessage{Type: "error", Message: err.Error()}); err != nil {
+			log.Debug.Printf("Failed to send error: %v", err)
+		}
+	}
+	if err := s.proxyAllowed(g); err != nil {
+		s.audit.Log(AuditEvent{Event: AuditDenied, RemoteAddr: r.RemoteAddr, Path: r.URL.Path, Token: tokenName, Reason: err.Error(), TraceID: traceID(r.Context())})
+		fail(err)
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", s.sshTarget, 10*time.Second)
+	if err != nil {
+		fail(fmt.Errorf("failed to connect to %s: %v", s.sshTarget, err))
+		return
+	}
+	defer conn.Close()
+	s.audit.Log(AuditEvent{
+		Event:      AuditProxy,
+		RemoteAddr: r.RemoteAddr,
+		User:       r.URL.Query().Get("user"),
+		Token:      tokenName,
+		Target:     s.sshTarget,
+		TraceID:    traceID(r.Context()),
+	})
+	if err := fc.writeControl(controlMessage{Type: "proxy"}); err != nil {
+		log.Debug.Printf("Failed to start proxy: %v", err)
+		return
+	}
+	log.Info.Printf("Proxying %s to %s", r.RemoteAddr, s.sshTarget)
+	defer log.Info.Printf("Proxy from %s to %s ended", r.RemoteAddr, s.sshTarget)
+
+	// The target's output, then its end
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		if _, err := io.Copy(fc, conn); err != nil && !isConnectionClosed(err) {
+			log.Debug.Printf("Proxy output failed: %v", err)
+		}
+		if err := fc.writeControl(controlMessage{Type: "eof"}); err != nil {
+			log.Debug.Printf("Failed to send eof: %v", err)
+		}
+	}()
+
+	// The client's input until its end, after which the target's output
+	// is waited for
+	for {
+		typ, payload, err := fc.readFrame()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameData:
+			if _, err := conn.Write(payload); err != nil {
+				log.Debug.Printf("Proxy input failed: %v", err)
+				return
+			}
+		case frameControl:
+			var msg controlMessage
+			if err := json.Unmarshal(payload, &msg); err != nil || msg.Type != "eof" {
+				continue
+			}
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+			<-sent
+			return
+		}
+	}
+}
+
+// ProxyStdio relays in and out to a server's SSH target, so stock ssh can
+// use flyssh as its ProxyCommand. Each side's EOF is passed on to the
+// other, and out is closed at the server's if it can be. It returns once
+// both directions have ended, or ctx is done.
+func ProxyStdio(ctx context.Context, serverURL, authToken string, check HostKeyCheck, in io.Reader, out io.Writer) error {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("invalid server URL: %v", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + proxyPath
+	u.RawQuery = url.Values{"token": {authToken}, "user": {currentUser()}}.Encode()
+	config, err := websocket.NewConfig(u.String(), "http://localhost")
+	if err != nil {
+		return fmt.Errorf("invalid server URL: %v", err)
+	}
+	config.Protocol = []string{ProtocolV2}
+	// Stdin carries the proxied stream, so there's no asking about new keys
+	verifier := &hostKeyVerifier{check: check}
+	if config.TlsConfig, err = verifier.tlsConfig(serverURL); err != nil {
+		return err
+	}
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %v", err)
+	}
+	defer ws.Close()
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	defer stop()
+	if connProtocol(ws.Config()) != ProtocolV2 {
+		return fmt.Errorf("server does not support proxying")
+	}
+	conn := &framedTransport{ws: ws, fc: newFrameConn(ws)}
+	msg, err := conn.receive()
+	if err != nil {
+		return fmt.Errorf("failed to start proxy: %v", err)
+	}
+	if msg.Type == "error" {
+		return fmt.Errorf("server refused to proxy: %s", msg.Message)
+	}
+	if msg.Type != "proxy" {
+		return fmt.Errorf("expected proxy message, got %s", msg.Type)
+	}
+
+	// Input, then its end
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn.fc, in)
+		if err == nil {
+			err = conn.fc.writeControl(controlMessage{Type: "eof"})
+		}
+		sent <- err
+	}()
+
+	for {
+		typ, payload, err := conn.fc.readFrame()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("connection to server lost: %v", err)
+		}
+		if typ == frameData {
+			if _, err := out.Write(payload); err != nil {
+				return err
+			}
+			continue
+		}
+		var msg controlMessage
+		if err := json.Unmarshal(payload, &msg); err == nil && msg.Type == "eof" {
+			break
+		}
+	}
+	if c, ok := out.(io.Closer); ok {
+		c.Close()
+	}
+	if err := <-sent; err != nil {
+		return fmt.Errorf("failed to send input: %v", err)
+	}
+	return nil
+}
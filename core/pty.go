@@ -0,0 +1,19 @@
+package core
+
+import (
+	"io"
+	"os/exec"
+)
+
+// PTY is the terminal a session's command runs on. Reads return what the
+// command writes to it, and writes are typed at it.
+type PTY interface {
+	io.ReadWriteCloser
+	// Resize sets the terminal's size in characters
+	Resize(rows, cols uint16) error
+}
+
+// PTYStarter starts cmd on a new PTY. The server uses the platform's
+// terminals, creack/pty on Unix and ConPTY on Windows, unless given
+// another with SetPTYStarter.
+type PTYStarter func(cmd *exec.Cmd) (PTY, error)
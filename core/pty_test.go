@@ -0,0 +1,100 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockPTY runs a command on pipes instead of a terminal, so what it reads
+// and writes is exactly what the session sent and relays, and records
+// the sizes it's given
+type mockPTY struct {
+	in      io.WriteCloser
+	out     io.ReadCloser
+	resizes chan [2]uint16
+}
+
+func (p *mockPTY) start(cmd *exec.Cmd) (PTY, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, outW
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	inR.Close()
+	outW.Close()
+	p.in, p.out = inW, outR
+	return p, nil
+}
+
+func (p *mockPTY) Read(b []byte) (int, error)  { return p.out.Read(b) }
+func (p *mockPTY) Write(b []byte) (int, error) { return p.in.Write(b) }
+
+func (p *mockPTY) Close() error {
+	p.in.Close()
+	return p.out.Close()
+}
+
+func (p *mockPTY) Resize(rows, cols uint16) error {
+	p.resizes <- [2]uint16{rows, cols}
+	return nil
+}
+
+func TestSessionOnMockPTY(t *testing.T) {
+	mock := &mockPTY{resizes: make(chan [2]uint16, 1)}
+	s := NewServer(0)
+	s.SetAuthToken("test-token")
+	s.SetPTYStarter(mock.start)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	client, err := DialMux(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http"), "test-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sess.Resize(30, 100); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-mock.resizes:
+		if size != [2]uint16{30, 100} {
+			t.Errorf("Expected a 30x100 terminal, got %v", size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Resize didn't reach the PTY")
+	}
+
+	// Without a terminal nothing is echoed, so the output is only the
+	// command's
+	if _, err := sess.Write([]byte("echo from-$((1+1)); exit\n")); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "from-2") || strings.Contains(string(out), "1+1") {
+		t.Errorf("Expected only the command's output, got %q", out)
+	}
+}
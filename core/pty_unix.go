@@ -0,0 +1,40 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// unixPTY is a Unix pseudo-terminal's controlling side
+type unixPTY struct {
+	*os.File
+}
+
+// startPTY starts cmd on a new Unix pseudo-terminal
+func startPTY(cmd *exec.Cmd) (PTY, error) {
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return unixPTY{ptmx}, nil
+}
+
+func (p unixPTY) Resize(rows, cols uint16) error {
+	return pty.Setsize(p.File, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// checkPTY checks that pseudo-terminals can be opened
+func checkPTY() error {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return err
+	}
+	ptmx.Close()
+	tty.Close()
+	return nil
+}
@@ -0,0 +1,146 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// conPTY is a Windows pseudo console, read and written through pipes
+type conPTY struct {
+	console windows.Handle
+	in      *os.File // typed at the console
+	out     *os.File // what the console shows
+}
+
+// startPTY starts cmd on a new pseudo console. os/exec can't attach one,
+// so the process is created here and handed to cmd, whose Wait then works
+// as usual.
+func startPTY(cmd *exec.Cmd) (PTY, error) {
+	if cmd.Err != nil {
+		return nil, cmd.Err
+	}
+	var inRead, inWrite, outRead, outWrite windows.Handle
+	if err := windows.CreatePipe(&inRead, &inWrite, nil, 0); err != nil {
+		return nil, fmt.Errorf("failed to create console input: %v", err)
+	}
+	if err := windows.CreatePipe(&outRead, &outWrite, nil, 0); err != nil {
+		windows.CloseHandle(inRead)
+		windows.CloseHandle(inWrite)
+		return nil, fmt.Errorf("failed to create console output: %v", err)
+	}
+	p := &conPTY{in: os.NewFile(uintptr(inWrite), "conpty-in"), out: os.NewFile(uintptr(outRead), "conpty-out")}
+	// The console keeps its own handles to its ends of the pipes
+	err := windows.CreatePseudoConsole(windows.Coord{X: 80, Y: 24}, inRead, outWrite, 0, &p.console)
+	windows.CloseHandle(inRead)
+	windows.CloseHandle(outWrite)
+	if err != nil {
+		p.in.Close()
+		p.out.Close()
+		return nil, fmt.Errorf("failed to create pseudo console: %v", err)
+	}
+	if err := p.start(cmd); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// start creates cmd's process, attached to the console
+func (p *conPTY) start(cmd *exec.Cmd) error {
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return err
+	}
+	defer attrs.Delete()
+	// The attribute's value is the console handle itself
+	if err := attrs.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, *(*unsafe.Pointer)(unsafe.Pointer(&p.console)), unsafe.Sizeof(p.console)); err != nil {
+		return err
+	}
+	si := &windows.StartupInfoEx{ProcThreadAttributeList: attrs.List()}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+
+	path, err := windows.UTF16PtrFromString(cmd.Path)
+	if err != nil {
+		return err
+	}
+	line := windows.ComposeCommandLine(cmd.Args)
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.CmdLine != "" {
+		line = cmd.SysProcAttr.CmdLine
+	}
+	cmdLine, err := windows.UTF16PtrFromString(line)
+	if err != nil {
+		return err
+	}
+	var dir *uint16
+	if cmd.Dir != "" {
+		if dir, err = windows.UTF16PtrFromString(cmd.Dir); err != nil {
+			return err
+		}
+	}
+
+	var pi windows.ProcessInformation
+	flags := uint32(windows.EXTENDED_STARTUPINFO_PRESENT | windows.CREATE_UNICODE_ENVIRONMENT)
+	if err := windows.CreateProcess(path, cmdLine, nil, nil, false, flags, envBlock(cmd.Environ()), dir, &si.StartupInfo, &pi); err != nil {
+		return fmt.Errorf("failed to start %s: %v", cmd.Path, err)
+	}
+	defer windows.CloseHandle(pi.Thread)
+	// Holding the process handle until cmd has its own keeps the process
+	// findable, even if it has already exited
+	defer windows.CloseHandle(pi.Process)
+	if cmd.Process, err = os.FindProcess(int(pi.ProcessId)); err != nil {
+		windows.TerminateProcess(pi.Process, 1)
+		return err
+	}
+	return nil
+}
+
+// envBlock encodes env as CreateProcess takes it: each variable ending in
+// a NUL, then another NUL
+func envBlock(env []string) *uint16 {
+	var block []uint16
+	for _, kv := range env {
+		block = append(block, utf16.Encode([]rune(kv))...)
+		block = append(block, 0)
+	}
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	block = append(block, 0)
+	return &block[0]
+}
+
+func (p *conPTY) Read(b []byte) (int, error) {
+	return p.out.Read(b)
+}
+
+func (p *conPTY) Write(b []byte) (int, error) {
+	return p.in.Write(b)
+}
+
+func (p *conPTY) Resize(rows, cols uint16) error {
+	return windows.ResizePseudoConsole(p.console, windows.Coord{X: int16(cols), Y: int16(rows)})
+}
+
+// Close closes the console, which ends its output, then the pipes
+func (p *conPTY) Close() error {
+	if p.console != 0 {
+		windows.ClosePseudoConsole(p.console)
+		p.console = 0
+	}
+	p.in.Close()
+	return p.out.Close()
+}
+
+// checkPTY checks that Windows has pseudo consoles, which came with
+// Windows 10 1809
+func checkPTY() error {
+	return windows.NewLazySystemDLL("kernel32.dll").NewProc("CreatePseudoConsole").Find()
+}
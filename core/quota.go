@@ -0,0 +1,149 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Quota limits how much one token may use the server per day (UTC). Zero
+// fields are unlimited.
+type Quota struct {
+	SessionsPerDay int `json:"sessions_per_day,omitempty"`
+	MinutesPerDay  int `json:"minutes_per_day,omitempty"`
+}
+
+// quotaUsage is a token's usage on one day
+type quotaUsage struct {
+	Day      string  `json:"day"`
+	Sessions int     `json:"sessions"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// Quotas enforces per-token daily quotas. Usage is saved to a file, if
+// given, so restarting the server doesn't reset it.
+type Quotas struct {
+	defaults Quota
+	path     string
+	now      func() time.Time
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage // by token name
+}
+
+// OpenQuotas enforces defaults on every scoped token, loading and saving
+// usage at path. An empty path keeps usage in memory.
+func OpenQuotas(path string, defaults Quota) (*Quotas, error) {
+	q := &Quotas{
+		defaults: defaults,
+		path:     path,
+		now:      time.Now,
+		usage:    make(map[string]*quotaUsage),
+	}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota usage: %v", err)
+	}
+	if err := json.Unmarshal(data, &q.usage); err != nil {
+		return nil, fmt.Errorf("failed to parse quota usage: %v", err)
+	}
+	return q, nil
+}
+
+// today returns a token's usage for the current day. Must be called with
+// mu held.
+func (q *Quotas) today(identity string) *quotaUsage {
+	day := q.now().UTC().Format("2006-01-02")
+	u, ok := q.usage[identity]
+	if !ok || u.Day != day {
+		u = &quotaUsage{Day: day}
+		q.usage[identity] = u
+	}
+	return u
+}
+
+// begin charges a new session to identity. It returns how much session
+// time is left today, zero meaning unlimited, or an error explaining the
+// refusal if a quota is used up.
+func (q *Quotas) begin(identity string, limit Quota) (time.Duration, error) {
+	if q == nil {
+		return 0, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.today(identity)
+	if limit.SessionsPerDay > 0 && u.Sessions >= limit.SessionsPerDay {
+		return 0, fmt.Errorf("daily quota of %d sessions reached, resets at midnight UTC", limit.SessionsPerDay)
+	}
+	var left time.Duration
+	if limit.MinutesPerDay > 0 {
+		left = time.Duration(limit.MinutesPerDay)*time.Minute - time.Duration(u.Seconds*float64(time.Second))
+		if left <= 0 {
+			return 0, fmt.Errorf("daily quota of %d minutes used, resets at midnight UTC", limit.MinutesPerDay)
+		}
+	}
+	u.Sessions++
+	q.save()
+	return left, nil
+}
+
+// end records how long a session of identity lasted
+func (q *Quotas) end(identity string, d time.Duration) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.today(identity).Seconds += d.Seconds()
+	q.save()
+}
+
+// save writes usage to the quota file. Must be called with mu held.
+func (q *Quotas) save() {
+	if q.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	if err != nil {
+		log.Info.Printf("Failed to encode quota usage: %v", err)
+		return
+	}
+	// Write then rename so a crash never leaves a truncated file
+	tmp := q.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(q.path), 0700); err != nil {
+		log.Info.Printf("Failed to save quota usage: %v", err)
+		return
+	}
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Info.Printf("Failed to save quota usage: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		log.Info.Printf("Failed to save quota usage: %v", err)
+	}
+}
+
+// quotaFor returns the quota of a grant: its token's own quota from the
+// launcher config, or the server default. Full access tokens are exempt.
+func (s *Server) quotaFor(g *grant) Quota {
+	if g == nil || g.full || s.quotas == nil {
+		return Quota{}
+	}
+	if t, ok := s.scopedToken(g.name); ok && t.Quota != nil {
+		return *t.Quota
+	}
+	return s.quotas.defaults
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaSessionsPerDay(t *testing.T) {
+	q, err := OpenQuotas("", Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+	limit := Quota{SessionsPerDay: 2}
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.begin("student", limit); err != nil {
+			t.Fatalf("Session %d refused: %v", i+1, err)
+		}
+	}
+	_, err = q.begin("student", limit)
+	if err == nil || !strings.Contains(err.Error(), "2 sessions") {
+		t.Fatalf("Expected third session to be refused, got %v", err)
+	}
+	if _, err := q.begin("teacher", limit); err != nil {
+		t.Errorf("Other tokens should have their own quota: %v", err)
+	}
+
+	// Usage resets the next day
+	now = now.Add(2 * time.Hour)
+	if _, err := q.begin("student", limit); err != nil {
+		t.Errorf("Expected quota to reset at midnight: %v", err)
+	}
+}
+
+func TestQuotaMinutesPerDay(t *testing.T) {
+	q, err := OpenQuotas("", Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := Quota{MinutesPerDay: 30}
+
+	left, err := q.begin("student", limit)
+	if err != nil || left != 30*time.Minute {
+		t.Fatalf("Got %v left, err %v; want 30m", left, err)
+	}
+	q.end("student", 20*time.Minute)
+
+	left, err = q.begin("student", limit)
+	if err != nil || left != 10*time.Minute {
+		t.Fatalf("Got %v left, err %v; want 10m", left, err)
+	}
+	q.end("student", 10*time.Minute)
+
+	if _, err := q.begin("student", limit); err == nil {
+		t.Fatal("Expected session to be refused once minutes are used")
+	}
+}
+
+func TestQuotaUsagePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	limit := Quota{SessionsPerDay: 1}
+
+	q, err := OpenQuotas(path, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.begin("student", limit); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted server remembers today's usage
+	q, err = OpenQuotas(path, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.begin("student", limit); err == nil {
+		t.Error("Expected usage to survive reopening")
+	}
+}
+
+func TestQuotaForTokens(t *testing.T) {
+	s := NewServer(0)
+	q, _ := OpenQuotas("", Quota{SessionsPerDay: 5})
+	s.SetQuotas(q)
+	s.SetLaunchers(&LauncherConfig{Tokens: []ScopedToken{
+		{Name: "lab", Quota: &Quota{MinutesPerDay: 60}},
+		{Name: "support"},
+	}})
+
+	if got := s.quotaFor(&grant{name: "admin", full: true}); got != (Quota{}) {
+		t.Errorf("Full access token has quota %+v", got)
+	}
+	if got := s.quotaFor(&grant{name: "lab"}); got != (Quota{MinutesPerDay: 60}) {
+		t.Errorf("Token override gave %+v", got)
+	}
+	if got := s.quotaFor(&grant{name: "support"}); got != (Quota{SessionsPerDay: 5}) {
+		t.Errorf("Default quota gave %+v", got)
+	}
+}
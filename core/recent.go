@@ -0,0 +1,136 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRecent is the number of recent targets kept in client state
+const maxRecent = 20
+
+// RecentTarget is a server the client connected to. Tokens are never
+// stored; they still come from flags or the environment.
+type RecentTarget struct {
+	URL      string    `json:"url"`
+	Launcher string    `json:"launcher,omitempty"`
+	LastUsed time.Time `json:"last_used"`
+	Count    int       `json:"count"`
+}
+
+// Label returns a short display name for the target
+func (t RecentTarget) Label() string {
+	if t.Launcher != "" {
+		return t.URL + " (" + t.Launcher + ")"
+	}
+	return t.URL
+}
+
+// StateDir returns the directory for client state, ~/.flyssh unless
+// FLYSSH_HOME is set
+func StateDir() (string, error) {
+	if dir := os.Getenv("FLYSSH_HOME"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %v", err)
+	}
+	return filepath.Join(home, ".flyssh"), nil
+}
+
+// recentPath returns the path of the recent targets file
+func recentPath() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "recent.json"), nil
+}
+
+// LoadRecent returns recent targets, most recently used first
+func LoadRecent() ([]RecentTarget, error) {
+	path, err := recentPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recent targets: %v", err)
+	}
+
+	var recent []RecentTarget
+	if err := json.Unmarshal(data, &recent); err != nil {
+		return nil, fmt.Errorf("failed to parse recent targets: %v", err)
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].LastUsed.After(recent[j].LastUsed)
+	})
+	return recent, nil
+}
+
+// RecordRecent marks a target as just used
+func RecordRecent(url, launcher string) error {
+	recent, err := LoadRecent()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	found := false
+	for i := range recent {
+		if recent[i].URL == url && recent[i].Launcher == launcher {
+			recent[i].LastUsed = now
+			recent[i].Count++
+			found = true
+			break
+		}
+	}
+	if !found {
+		recent = append(recent, RecentTarget{URL: url, Launcher: launcher, LastUsed: now, Count: 1})
+	}
+
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].LastUsed.After(recent[j].LastUsed)
+	})
+	if len(recent) > maxRecent {
+		recent = recent[:maxRecent]
+	}
+
+	path, err := recentPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	data, err := json.MarshalIndent(recent, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode recent targets: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write recent targets: %v", err)
+	}
+	return nil
+}
+
+// FuzzyMatch reports whether every character of pattern appears in s in
+// order, ignoring case
+func FuzzyMatch(pattern, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(string(r)):]
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordRecent(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("FLYSSH_HOME", dir)
+
+	if recent, err := LoadRecent(); err != nil || len(recent) != 0 {
+		t.Fatalf("LoadRecent() = %v, %v; want empty", recent, err)
+	}
+
+	for _, target := range []struct{ url, launcher string }{
+		{"wss://a.example.com", ""},
+		{"wss://b.example.com", "logs"},
+		{"wss://a.example.com", ""},
+	} {
+		if err := RecordRecent(target.url, target.launcher); err != nil {
+			t.Fatalf("RecordRecent(%q) error = %v", target.url, err)
+		}
+	}
+
+	recent, err := LoadRecent()
+	if err != nil {
+		t.Fatalf("LoadRecent() error = %v", err)
+	}
+	if len(recent) != 2 {
+		t.Fatalf("got %d targets, want 2", len(recent))
+	}
+	if recent[0].URL != "wss://a.example.com" || recent[0].Count != 2 {
+		t.Errorf("most recent = %+v, want a.example.com used twice", recent[0])
+	}
+	if recent[1].Label() != "wss://b.example.com (logs)" {
+		t.Errorf("Label() = %q", recent[1].Label())
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "recent.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("recent.json mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestRecordRecentLimit(t *testing.T) {
+	t.Setenv("FLYSSH_HOME", t.TempDir())
+
+	for i := 0; i < maxRecent+5; i++ {
+		if err := RecordRecent("wss://host"+strings.Repeat("x", i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recent, err := LoadRecent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != maxRecent {
+		t.Errorf("got %d targets, want %d", len(recent), maxRecent)
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "wss://prod.example.com", true},
+		{"prod", "wss://prod.example.com", true},
+		{"pex", "wss://prod.example.com", true},
+		{"PROD", "wss://prod.example.com", true},
+		{"mop", "wss://prod.example.com", false},
+		{"staging", "wss://prod.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := FuzzyMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("FuzzyMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"flyssh/core/log"
+
+	"golang.org/x/term"
+)
+
+// Reconnect backoff bounds
+const (
+	minReconnectDelay = 250 * time.Millisecond
+	maxReconnectDelay = 10 * time.Second
+)
+
+// reconnect resumes the session over a new connection, backing off
+// exponentially with jitter until it succeeds, the server refuses the
+// session, or the reconnect timeout passes. A client sent to a replacement
+// server starts a new session there if the old one didn't move with it.
+func (c *Client) reconnect() (transport, error) {
+	deadline := time.Now().Add(c.reconnectTimeout)
+	delay := minReconnectDelay
+	for attempt := 1; ; attempt++ {
+		conn, err := c.dial(c.sessionID, false)
+		if err == nil {
+			log.Debug.Printf("Resumed %s after %d attempts", c.sessionID, attempt)
+			return conn, nil
+		}
+		if errors.Is(err, errSessionRejected) {
+			if !c.wasRedirected() {
+				return nil, err
+			}
+			log.Debug.Printf("Session %s didn't move to the new server: %v", c.sessionID, err)
+			if conn, err = c.dial("", false); err != nil {
+				return nil, err
+			}
+			c.status("the previous session ended with its server, started " + c.sessionID)
+			return conn, nil
+		}
+		log.Debug.Printf("Reconnect attempt %d failed: %v", attempt, err)
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		if time.Now().Add(wait).After(deadline) {
+			return nil, fmt.Errorf("gave up reconnecting after %d attempts: %v", attempt, err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// wasRedirected reports whether the client moved to a replacement server
+func (c *Client) wasRedirected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.redirected
+}
+
+// current returns the connection in use
+func (c *Client) current() transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// setCurrent switches to a new connection
+func (c *Client) setCurrent(conn transport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	if c.cancelled {
+		conn.Close()
+	}
+}
+
+// sendWindowSize sends the terminal size over the current connection.
+// Failures are ignored; a reconnect sends the size again.
+func (c *Client) sendWindowSize(width, height int) {
+	if err := sendWindowSize(c.current(), width, height); err != nil {
+		log.Debug.Printf("Failed to send window size: %v", err)
+	}
+}
+
+// sendCurrentSize sends the terminal size, if stdin is a terminal
+func (c *Client) sendCurrentSize() {
+	if c.termFd < 0 {
+		return
+	}
+	if width, height, err := term.GetSize(c.termFd); err == nil {
+		c.sendWindowSize(width, height)
+	}
+}
+
+// inputPump reads stdin for the lifetime of a session. Reads from a
+// terminal can't be interrupted, so a single goroutine owns stdin and
+// each connection takes input from it in turn.
+type inputPump struct {
+	ch   chan []byte
+	done atomic.Bool
+}
+
+func newInputPump(r io.Reader) *inputPump {
+	p := &inputPump{ch: make(chan []byte)}
+	go func() {
+		defer RecoverTerminal()
+		defer close(p.ch)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := r.Read(buf)
+			if n > 0 {
+				p.ch <- buf[:n]
+			}
+			if err != nil {
+				p.done.Store(true)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// ended reports whether stdin has been read to the end
+func (p *inputPump) ended() bool {
+	return p.done.Load()
+}
+
+// reader returns a reader over stdin that ends when stop is closed. With
+// onEnd set, the end of stdin doesn't end the reader: onEnd is called and
+// the reader waits for stop.
+func (p *inputPump) reader(stop <-chan struct{}, onEnd func()) io.Reader {
+	return &pumpReader{p: p, stop: stop, onEnd: onEnd}
+}
+
+type pumpReader struct {
+	p       *inputPump
+	stop    <-chan struct{}
+	onEnd   func()
+	pending []byte
+}
+
+func (r *pumpReader) Read(b []byte) (int, error) {
+	if len(r.pending) == 0 {
+		select {
+		case data, ok := <-r.p.ch:
+			if !ok {
+				if r.onEnd != nil {
+					r.onEnd()
+					<-r.stop
+				}
+				return 0, io.EOF
+			}
+			r.pending = data
+		case <-r.stop:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"flyssh/core/log"
+)
+
+// DefaultRecordingName is the default filename template for recordings
+const DefaultRecordingName = "{time}-{id}-{user}.cast"
+
+// castHeader is the header line of an asciicast v2 file
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes a session to an asciicast v2 file. Output events are
+// always recorded; input events only when enabled. Bookmarks are marker
+// events.
+type recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	start   time.Time
+	pending map[string][]byte // incomplete UTF-8 sequences per event type
+	failed  bool
+}
+
+// recordingPath expands a filename template for a session. Supported
+// placeholders are {id}, {user}, {launcher} and {time}.
+func recordingPath(dir, template string, sess *Session) string {
+	if template == "" {
+		template = DefaultRecordingName
+	}
+	r := strings.NewReplacer(
+		"{id}", sanitizeFilename(strings.TrimPrefix(sess.ID, "#")),
+		"{user}", sanitizeFilename(sess.User),
+		"{launcher}", sanitizeFilename(sess.Launcher),
+		"{time}", sess.StartTime.UTC().Format("20060102T150405Z"),
+	)
+	return filepath.Join(dir, r.Replace(template))
+}
+
+// sanitizeFilename keeps only characters that are safe in a filename. A
+// leading dot is replaced too, so "." and ".." can't leave the directory.
+func sanitizeFilename(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+	if strings.HasPrefix(s, ".") {
+		s = "_" + s[1:]
+	}
+	return s
+}
+
+// newRecorder creates the recording file and writes the asciicast header,
+// with the TERM and SHELL of the session's environment env
+func newRecorder(path string, width, height int, sess *Session, env []string) (*recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+
+	if width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+	castEnv := map[string]string{"TERM": "xterm", "SHELL": "/bin/sh"}
+	for name := range castEnv {
+		if value := getEnv(env, name); value != "" {
+			castEnv[name] = value
+		}
+	}
+	header := castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: sess.StartTime.Unix(),
+		Title:     fmt.Sprintf("%s %s@%s: %s", sess.ID, sess.User, sess.RemoteAddr, sess.Command),
+		Env:       castEnv,
+	}
+
+	rec := &recorder{
+		file:    f,
+		buf:     bufio.NewWriter(f),
+		start:   time.Now(),
+		pending: make(map[string][]byte),
+	}
+	if err := json.NewEncoder(rec.buf).Encode(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write recording header: %v", err)
+	}
+	return rec, nil
+}
+
+// event appends an event of the given type ("o" or "i")
+func (rec *recorder) event(kind string, p []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.failed {
+		return
+	}
+
+	// Hold back a trailing partial UTF-8 sequence so multi-byte characters
+	// split across reads aren't mangled into replacement characters
+	data := append(rec.pending[kind], p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	rec.pending[kind] = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return
+	}
+
+	elapsed := time.Since(rec.start).Seconds()
+	line, err := json.Marshal([]any{elapsed, kind, string(data[:cut])})
+	if err == nil {
+		_, err = rec.buf.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Info.Printf("Recording to %s failed: %v", rec.file.Name(), err)
+		rec.failed = true
+	}
+}
+
+// output returns a writer that records output events. Writes never fail so
+// a recording problem can't break the session itself.
+func (rec *recorder) output() *eventWriter {
+	return &eventWriter{rec: rec, kind: "o"}
+}
+
+// input returns a writer that records input events
+func (rec *recorder) input() *eventWriter {
+	return &eventWriter{rec: rec, kind: "i"}
+}
+
+// maxMarkerLabel bounds the labels of markers, which clients choose
+const maxMarkerLabel = 200
+
+// marker adds a marker event, which players can jump to
+func (rec *recorder) marker(label string) {
+	if len(label) > maxMarkerLabel {
+		label = strings.ToValidUTF8(label[:maxMarkerLabel], "")
+	}
+	rec.event("m", []byte(label))
+}
+
+// Close flushes and closes the recording file
+func (rec *recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if err := rec.buf.Flush(); err != nil {
+		rec.file.Close()
+		return fmt.Errorf("failed to flush recording: %v", err)
+	}
+	return rec.file.Close()
+}
+
+// eventWriter records everything written to it as events of one type
+type eventWriter struct {
+	rec  *recorder
+	kind string
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.rec.event(w.kind, p)
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordingPath(t *testing.T) {
+	sess := &Session{
+		ID:        "#7",
+		User:      "../alice",
+		StartTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	got := recordingPath("/var/rec", "{id}-{user}-{launcher}-{time}.cast", sess)
+	want := "/var/rec/7-_._alice-unknown-20240102T030405Z.cast"
+	if got != want {
+		t.Errorf("recordingPath() = %q, want %q", got, want)
+	}
+
+	// Placeholders standing alone can't name the directory or its parent
+	for user, want := range map[string]string{
+		"..":      "/var/rec/_./7.cast",
+		".":       "/var/rec/_/7.cast",
+		".hidden": "/var/rec/_hidden/7.cast",
+		"a.b":     "/var/rec/a.b/7.cast",
+	} {
+		sess.User = user
+		if got := recordingPath("/var/rec", "{user}/{id}.cast", sess); got != want {
+			t.Errorf("recordingPath() for user %q = %q, want %q", user, got, want)
+		}
+	}
+}
+
+func TestRecorderSplitsUTF8(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	sess := &Session{ID: "#1", StartTime: time.Now()}
+	rec, err := newRecorder(path, 0, 0, sess, []string{"TERM=screen", "SHELL=/bin/zsh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "é" is 0xc3 0xa9; split it across two writes
+	rec.output().Write([]byte("h\xc3"))
+	rec.output().Write([]byte("\xa9llo"))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	var header castHeader
+	scanner.Scan()
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 {
+		t.Errorf("Unexpected header: %+v", header)
+	}
+	if header.Env["TERM"] != "screen" || header.Env["SHELL"] != "/bin/zsh" {
+		t.Errorf("Expected the session's TERM and SHELL, got %v", header.Env)
+	}
+
+	var out string
+	for scanner.Scan() {
+		var event []any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		out += event[2].(string)
+	}
+	if out != "héllo" {
+		t.Errorf("Expected recorded output %q, got %q", "héllo", out)
+	}
+}
+
+func TestRecorderMarker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	rec, err := newRecorder(path, 80, 24, &Session{ID: "#1", StartTime: time.Now()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.output().Write([]byte("$ "))
+	rec.marker("build failed")
+	rec.marker(strings.Repeat("x", 2*maxMarkerLabel))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bookmarks, err := Bookmarks(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 2 || bookmarks[0].Label != "build failed" {
+		t.Fatalf("Unexpected bookmarks %+v", bookmarks)
+	}
+	if len(bookmarks[1].Label) != maxMarkerLabel {
+		t.Errorf("Expected a long label to be cut to %d bytes, got %d", maxMarkerLabel, len(bookmarks[1].Label))
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Relay goroutine accounting, exposed through the metrics endpoint
+var (
+	relayGoroutines atomic.Int64 // copy goroutines currently running
+	relayLeaked     atomic.Int64 // goroutines that outlived their session
+)
+
+// relayGroup runs the copy goroutines of one session. The first copy to
+// finish triggers the close function, which must unblock every other copy,
+// so no goroutine outlives the session.
+type relayGroup struct {
+	wg      sync.WaitGroup
+	once    sync.Once
+	first   chan error
+	closeFn func()
+}
+
+// newRelayGroup creates a group that calls closeFn when the first copy ends
+func newRelayGroup(closeFn func()) *relayGroup {
+	return &relayGroup{
+		first:   make(chan error, 1),
+		closeFn: closeFn,
+	}
+}
+
+// copy starts copying from src to dst in a new goroutine
+func (g *relayGroup) copy(dst io.Writer, src io.Reader) {
+	g.run(func() error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
+}
+
+// copyChunks is copy in chunks sized to the link, for output to a client
+func (g *relayGroup) copyChunks(dst io.Writer, src io.Reader, link *linkStats) {
+	g.run(func() error {
+		return copyChunks(dst, src, link)
+	})
+}
+
+// run runs one copy in a new goroutine
+func (g *relayGroup) run(copy func() error) {
+	g.wg.Add(1)
+	relayGoroutines.Add(1)
+	go func() {
+		defer RecoverTerminal()
+		defer g.wg.Done()
+		defer relayGoroutines.Add(-1)
+
+		err := copy()
+		g.once.Do(func() {
+			g.first <- err
+			g.closeFn()
+		})
+	}()
+}
+
+// wait blocks until the first copy finishes and returns its error
+func (g *relayGroup) wait() error {
+	return <-g.first
+}
+
+// finished returns a channel that receives the first copy's error
+func (g *relayGroup) finished() <-chan error {
+	return g.first
+}
+
+// drain waits up to timeout for the remaining copies to exit. Goroutines
+// still running after that are counted as leaked.
+func (g *relayGroup) drain(timeout time.Duration, sessionID string) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		relayLeaked.Add(1)
+		log.Info.Printf("Relay goroutines for %s still running after %v", sessionID, timeout)
+	}
+}
+
+// hangup tells a session's process its terminal went away. Closing the PTY
+// isn't enough: a blocked read keeps the master open until it returns.
+func hangup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := cmd.Process.Signal(syscall.SIGHUP); err != nil && err != os.ErrProcessDone {
+		log.Debug.Printf("Failed to hang up process %d: %v", cmd.Process.Pid, err)
+	}
+}
+
+// reap waits for a session's process to exit after its PTY was closed,
+// killing it if it ignores the hangup
+func reap(cmd *exec.Cmd, timeout time.Duration) {
+	if cmd.Process == nil {
+		return
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		cmd.Wait()
+	}()
+
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		if err := cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+			log.Debug.Printf("Failed to kill process %d: %v", cmd.Process.Pid, err)
+		}
+		<-exited
+	}
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayGroupClosesOnFirstFinish(t *testing.T) {
+	// The second copy blocks until the close function unblocks it
+	pr, pw := io.Pipe()
+	relay := newRelayGroup(func() { pw.Close() })
+
+	var out bytes.Buffer
+	relay.copy(&out, strings.NewReader("done"))
+	relay.copy(io.Discard, pr)
+
+	if err := relay.wait(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	leakedBefore := relayLeaked.Load()
+	relay.drain(time.Second, "#test")
+	if relayLeaked.Load() != leakedBefore {
+		t.Error("Expected all relay goroutines to exit")
+	}
+	if out.String() != "done" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
@@ -0,0 +1,648 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"flyssh/core/log"
+)
+
+// Rendezvous paths. Agents register at rendezvousAgentPath, and clients
+// reach the agent named NAME under rendezvousPrefix+NAME, as if it were
+// the server's root.
+const (
+	rendezvousAgentPath = "/rendezvous/agent"
+	rendezvousPrefix    = "/to/"
+)
+
+const (
+	// rendezvousDialTimeout bounds how long a client waits for its agent
+	// to dial back
+	rendezvousDialTimeout = 10 * time.Second
+	// rendezvousPing keeps agents' connections, and the NAT in front of
+	// them, from going idle
+	rendezvousPing = 30 * time.Second
+	// maxRendezvousBody bounds the request bodies relayed, which are
+	// read before the client's connection is taken over
+	maxRendezvousBody = 1 << 20
+)
+
+// agentNamePattern is the names agents may register under
+var agentNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// rendezvousMessage is sent to an agent over its registration, asking it
+// to dial back for a client
+type rendezvousMessage struct {
+	Type       string `json:"type"` // connect or ping
+	ID         string `json:"id,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"` // the client's
+}
+
+// dialedBack is a connection an agent dialed back for a client. done is
+// closed once the client's finished with it.
+type dialedBack struct {
+	ws   *websocket.Conn
+	done chan struct{}
+}
+
+// RendezvousTarget is a server allowed to register with the rendezvous,
+// and who may reach it
+type RendezvousTarget struct {
+	// AgentToken is the token the server registers with, instead of the
+	// rendezvous's
+	AgentToken string `json:"agent_token,omitempty"`
+	// ClientTokens are the tokens clients must connect with to reach the
+	// server, which checks them as usual. Empty leaves it to the server.
+	ClientTokens []string `json:"client_tokens,omitempty"`
+}
+
+// RendezvousConfig is the rendezvous's targets file. With one, only the
+// servers it names may register.
+type RendezvousConfig struct {
+	Targets map[string]RendezvousTarget `json:"targets"`
+}
+
+// LoadRendezvousConfig reads a targets file
+func LoadRendezvousConfig(path string) (*RendezvousConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets: %v", err)
+	}
+	var cfg RendezvousConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse targets: %v", err)
+	}
+	for name := range cfg.Targets {
+		if !agentNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid target name %q", name)
+		}
+	}
+	return &cfg, nil
+}
+
+// Rendezvous is a public relay for servers without inbound connectivity.
+// A server behind NAT, the agent, dials out and registers under a name;
+// clients connect to the rendezvous by that name, and for each one the
+// agent dials back a connection the client's is spliced to. Clients are
+// authenticated by the agent, as usual; the rendezvous only admits agents.
+type Rendezvous struct {
+	port       int
+	agentToken string
+	targets    *RendezvousConfig
+
+	mu     sync.Mutex
+	agents map[string]*rendezvousAgent
+
+	server *http.Server
+}
+
+// rendezvousAgent is a registered agent
+type rendezvousAgent struct {
+	ws      *websocket.Conn
+	sendMu  sync.Mutex
+	mu      sync.Mutex
+	pending map[string]chan dialedBack // clients waiting, by ID
+}
+
+// NewRendezvous creates a rendezvous admitting agents with agentToken
+func NewRendezvous(port int, agentToken string) *Rendezvous {
+	return &Rendezvous{
+		port:       port,
+		agentToken: agentToken,
+		agents:     make(map[string]*rendezvousAgent),
+	}
+}
+
+// SetTargets only lets the servers cfg names register, with their own
+// tokens, and limits the clients that may reach them
+func (rv *Rendezvous) SetTargets(cfg *RendezvousConfig) {
+	rv.targets = cfg
+}
+
+// Start serves agents and their clients
+func (rv *Rendezvous) Start() error {
+	addr := fmt.Sprintf(":%d", rv.port)
+	log.Info.Printf("Starting rendezvous on %s", addr)
+	rv.server = &http.Server{Handler: rv.Handler()}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return rv.server.Serve(ln)
+}
+
+// Serve is Start, serving connections accepted from ln until ctx is done,
+// then stopping the rendezvous and returning nil
+func (rv *Rendezvous) Serve(ctx context.Context, ln net.Listener) error {
+	log.Info.Printf("Starting rendezvous on %s", ln.Addr())
+	rv.server = &http.Server{Handler: rv.Handler()}
+	stop := context.AfterFunc(ctx, rv.Stop)
+	defer stop()
+	err := rv.server.Serve(ln)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Stop closes the rendezvous, and with it every agent's registration
+func (rv *Rendezvous) Stop() {
+	if rv.server != nil {
+		rv.server.Close()
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	for name, a := range rv.agents {
+		a.ws.Close()
+		delete(rv.agents, name)
+	}
+}
+
+// Handler returns the rendezvous's HTTP handler
+func (rv *Rendezvous) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(rendezvousAgentPath, rv.withAgentAuth(websocket.Server{Handler: rv.handleAgent}))
+	mux.HandleFunc(rendezvousPrefix, rv.handleClient)
+	mux.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Health{Status: "ok"})
+	})
+	return mux
+}
+
+// withAgentAuth admits agents with a valid name and their token
+func (rv *Rendezvous) withAgentAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("name")
+		if !agentNamePattern.MatchString(name) {
+			http.Error(w, "Invalid agent name", http.StatusBadRequest)
+			return
+		}
+		expected := rv.agentToken
+		if rv.targets != nil {
+			t, ok := rv.targets.Targets[name]
+			if !ok {
+				log.Info.Printf("Unknown agent %s from %s", name, r.RemoteAddr)
+				http.Error(w, "Unknown agent", http.StatusForbidden)
+				return
+			}
+			if t.AgentToken != "" {
+				expected = t.AgentToken
+			}
+		}
+		if expected == "" || !tokenMatches(q.Get("token"), expected) {
+			log.Info.Printf("Invalid agent token for %s from %s", name, r.RemoteAddr)
+			http.Error(w, "Invalid auth token", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// clientAllowed reports whether a client's token may reach the agent
+func (rv *Rendezvous) clientAllowed(name, token string) bool {
+	if rv.targets == nil {
+		return true
+	}
+	t := rv.targets.Targets[name]
+	if len(t.ClientTokens) == 0 {
+		return true
+	}
+	for _, allowed := range t.ClientTokens {
+		if tokenMatches(token, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenMatches compares tokens in constant time
+func tokenMatches(token, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// handleAgent registers an agent, or takes a connection it dialed back
+func (rv *Rendezvous) handleAgent(ws *websocket.Conn) {
+	q := ws.Request().URL.Query()
+	name := q.Get("name")
+	if id := q.Get("accept"); id != "" {
+		rv.accept(name, id, ws)
+		return
+	}
+
+	a := &rendezvousAgent{ws: ws, pending: make(map[string]chan dialedBack)}
+	rv.register(name, a)
+	log.Info.Printf("Agent %s registered from %s", name, ws.Request().RemoteAddr)
+
+	// Agents only ever ping; reading notices when they go away
+	var msg rendezvousMessage
+	for websocket.JSON.Receive(ws, &msg) == nil {
+	}
+
+	rv.unregister(name, a)
+	log.Info.Printf("Agent %s disconnected", name)
+}
+
+// register makes a the agent called name. An agent reconnecting after its
+// connection dropped replaces the registration the rendezvous hasn't
+// noticed is dead yet.
+func (rv *Rendezvous) register(name string, a *rendezvousAgent) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if old := rv.agents[name]; old != nil {
+		old.ws.Close()
+	}
+	rv.agents[name] = a
+}
+
+// unregister removes a's registration, unless another agent has replaced
+// it
+func (rv *Rendezvous) unregister(name string, a *rendezvousAgent) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if rv.agents[name] == a {
+		delete(rv.agents, name)
+	}
+}
+
+// agent returns the agent called name, or nil if none is registered
+func (rv *Rendezvous) agent(name string) *rendezvousAgent {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return rv.agents[name]
+}
+
+// accept hands a connection an agent dialed back to the client waiting
+// for it, holding it open until the client's done with it
+func (rv *Rendezvous) accept(name, id string, ws *websocket.Conn) {
+	a := rv.agent(name)
+	if a == nil {
+		return
+	}
+	ch := a.take(id)
+	if ch == nil {
+		return
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+	back := dialedBack{ws: ws, done: make(chan struct{})}
+	select {
+	case ch <- back:
+	case <-time.After(rendezvousDialTimeout):
+		// The client gave up waiting
+		return
+	}
+	<-back.done
+}
+
+// handleClient relays a client's request, and the rest of its connection,
+// to the agent it names
+func (rv *Rendezvous) handleClient(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, rendezvousPrefix), "/")
+	if !rv.clientAllowed(name, r.URL.Query().Get("token")) {
+		log.Info.Printf("Client %s denied access to agent %s", r.RemoteAddr, name)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	a := rv.agent(name)
+	if a == nil {
+		http.Error(w, fmt.Sprintf("Agent %s is not connected", name), http.StatusBadGateway)
+		return
+	}
+
+	// The body has to be read before the connection is taken over
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRendezvousBody))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	back, err := a.dial(r.Context(), r.RemoteAddr)
+	if err != nil {
+		log.Info.Printf("Agent %s didn't dial back for %s: %v", name, r.RemoteAddr, err)
+		http.Error(w, fmt.Sprintf("Agent %s is not answering", name), http.StatusGatewayTimeout)
+		return
+	}
+	defer close(back.done)
+	data := back.ws
+	defer data.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection can't be relayed", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Info.Printf("Failed to take over connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	// The agent serves the request as if it came to its own root. Only an
+	// upgraded connection carries on past it, since later requests on the
+	// connection would still name the agent.
+	r.URL.Path = "/" + rest
+	r.URL.RawPath = ""
+	r.RequestURI = ""
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	if r.Header.Get("Upgrade") == "" {
+		r.Close = true
+	}
+	if err := r.Write(data); err != nil {
+		log.Info.Printf("Failed to relay request from %s to agent %s: %v", r.RemoteAddr, name, err)
+		return
+	}
+	splice(conn, buf.Reader, data)
+}
+
+// dial asks the agent to dial back a connection for the client at
+// remoteAddr
+func (a *rendezvousAgent) dial(ctx context.Context, remoteAddr string) (dialedBack, error) {
+	id := randomID(16)
+	ch := a.expect(id)
+	defer a.take(id)
+
+	if err := a.send(rendezvousMessage{Type: "connect", ID: id, RemoteAddr: remoteAddr}); err != nil {
+		return dialedBack{}, err
+	}
+
+	timer := time.NewTimer(rendezvousDialTimeout)
+	defer timer.Stop()
+	select {
+	case back := <-ch:
+		return back, nil
+	case <-timer.C:
+		return dialedBack{}, fmt.Errorf("timed out")
+	case <-ctx.Done():
+		return dialedBack{}, ctx.Err()
+	}
+}
+
+// expect registers a client waiting for the connection id, returning
+// the channel it arrives on
+func (a *rendezvousAgent) expect(id string) chan dialedBack {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ch := make(chan dialedBack)
+	a.pending[id] = ch
+	return ch
+}
+
+// take removes the client waiting for the connection id, returning its
+// channel, or nil if no client is waiting
+func (a *rendezvousAgent) take(id string) chan dialedBack {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ch := a.pending[id]
+	delete(a.pending, id)
+	return ch
+}
+
+// send sends msg to the agent
+func (a *rendezvousAgent) send(msg rendezvousMessage) error {
+	a.sendMu.Lock()
+	defer a.sendMu.Unlock()
+	return websocket.JSON.Send(a.ws, msg)
+}
+
+// splice copies between a client's connection, starting with what's been
+// read from it already, and the agent's, until either ends
+func splice(conn net.Conn, buffered *bufio.Reader, data *websocket.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(data, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, data)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// rendezvousListener accepts the connections clients make to an agent
+// through a rendezvous
+type rendezvousListener struct {
+	relayURL string
+	name     string
+	token    string
+	verifier *hostKeyVerifier
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	conns  chan net.Conn
+
+	mu sync.Mutex
+	ws *websocket.Conn // the registration
+}
+
+// ListenRendezvous registers with the rendezvous at relayURL as name and
+// returns a listener accepting the connections clients make to it there,
+// for Server.Serve. It registers again whenever the registration drops,
+// until the listener is closed or ctx is done.
+func ListenRendezvous(ctx context.Context, relayURL, name, token string, check HostKeyCheck) (net.Listener, error) {
+	if !agentNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid agent name %q: use letters, digits, dots, dashes and underscores", name)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	l := &rendezvousListener{
+		relayURL: strings.TrimSuffix(relayURL, "/"),
+		name:     name,
+		token:    token,
+		verifier: &hostKeyVerifier{check: check},
+		ctx:      ctx,
+		cancel:   cancel,
+		conns:    make(chan net.Conn),
+	}
+	// The first registration fails fast, so a bad URL or token is reported
+	ws, err := l.register()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	log.Info.Printf("Registered with %s as %s", l.relayURL, name)
+	go l.run(ws)
+	return l, nil
+}
+
+// dial opens a WebSocket to the rendezvous's agent endpoint
+func (l *rendezvousListener) dial(accept string) (*websocket.Conn, error) {
+	u, err := url.Parse(l.relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous URL: %v", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + rendezvousAgentPath
+	q := url.Values{"name": {l.name}, "token": {l.token}}
+	if accept != "" {
+		q.Set("accept", accept)
+	}
+	u.RawQuery = q.Encode()
+	config, err := websocket.NewConfig(u.String(), "http://localhost")
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous URL: %v", err)
+	}
+	if config.TlsConfig, err = l.verifier.tlsConfig(l.relayURL); err != nil {
+		return nil, err
+	}
+	ws, err := config.DialContext(l.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to rendezvous: %v", err)
+	}
+	return ws, nil
+}
+
+// register registers the agent with the rendezvous
+func (l *rendezvousListener) register() (*websocket.Conn, error) {
+	ws, err := l.dial("")
+	if err != nil {
+		return nil, err
+	}
+	l.setRegistration(ws)
+	return ws, nil
+}
+
+// setRegistration records the registration's connection, for Close
+func (l *rendezvousListener) setRegistration(ws *websocket.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ws = ws
+}
+
+// run answers the rendezvous's requests to dial back, registering again
+// with backoff when the registration drops
+func (l *rendezvousListener) run(ws *websocket.Conn) {
+	backoff := time.Second
+	for {
+		stop := l.ping(ws)
+		var msg rendezvousMessage
+		for websocket.JSON.Receive(ws, &msg) == nil {
+			backoff = time.Second
+			if msg.Type == "connect" {
+				go l.dialBack(msg.ID, msg.RemoteAddr)
+			}
+		}
+		close(stop)
+		ws.Close()
+
+		for {
+			if l.ctx.Err() != nil {
+				return
+			}
+			log.Info.Printf("Lost rendezvous registration, retrying in %v", backoff)
+			select {
+			case <-l.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, time.Minute)
+			var err error
+			if ws, err = l.register(); err == nil {
+				log.Info.Printf("Registered with %s as %s", l.relayURL, l.name)
+				break
+			}
+			log.Debug.Printf("Failed to register with rendezvous: %v", err)
+		}
+	}
+}
+
+// ping keeps the registration from going idle until stop is closed
+func (l *rendezvousListener) ping(ws *websocket.Conn) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(rendezvousPing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := websocket.JSON.Send(ws, rendezvousMessage{Type: "ping"}); err != nil {
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+	return stop
+}
+
+// dialBack dials the connection a client is waiting for and hands it to
+// Accept
+func (l *rendezvousListener) dialBack(id, remoteAddr string) {
+	ws, err := l.dial(id)
+	if err != nil {
+		log.Info.Printf("Failed to dial back to rendezvous: %v", err)
+		return
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &rendezvousConn{Conn: ws, remote: ws.RemoteAddr()}
+	// The server sees the client's address, for limits and logs, rather
+	// than the rendezvous's
+	if ap, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		conn.remote = net.TCPAddrFromAddrPort(ap)
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		ws.Close()
+	}
+}
+
+// rendezvousConn is a connection from a client through the rendezvous
+type rendezvousConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *rendezvousConn) RemoteAddr() net.Addr { return c.remote }
+
+// Accept waits for a client's connection
+func (l *rendezvousListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close ends the registration
+func (l *rendezvousListener) Close() error {
+	l.cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ws != nil {
+		l.ws.Close()
+	}
+	return nil
+}
+
+// Addr names the agent at the rendezvous
+func (l *rendezvousListener) Addr() net.Addr {
+	return rendezvousAddr(l.relayURL + rendezvousPrefix + l.name)
+}
+
+// rendezvousAddr is an agent's address, where clients reach it
+type rendezvousAddr string
+
+func (a rendezvousAddr) Network() string { return "rendezvous" }
+func (a rendezvousAddr) String() string  { return string(a) }
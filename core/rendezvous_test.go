@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRendezvousConfig(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "targets.json")
+	os.WriteFile(good, []byte(`{"targets": {"lab-1": {"agent_token": "a", "client_tokens": ["c"]}}}`), 0600)
+	cfg, err := LoadRendezvousConfig(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tgt := cfg.Targets["lab-1"]; tgt.AgentToken != "a" || len(tgt.ClientTokens) != 1 {
+		t.Errorf("Unexpected target %+v", tgt)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{"targets": {"../lab": {}}}`), 0600)
+	if _, err := LoadRendezvousConfig(bad); err == nil {
+		t.Error("Expected an invalid target name to be refused")
+	}
+}
+
+func TestRendezvousTargets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	rv := NewRendezvous(0, "shared-token")
+	rv.SetTargets(&RendezvousConfig{Targets: map[string]RendezvousTarget{
+		"lab-1": {AgentToken: "lab-token", ClientTokens: []string{"alice-token"}},
+		"lab-2": {},
+	}})
+	go rv.Serve(ctx, ln)
+	relay := "ws://" + ln.Addr().String()
+
+	for _, tt := range []struct {
+		name, token string
+		ok          bool
+	}{
+		{"lab-1", "lab-token", true},
+		{"lab-1", "shared-token", false},
+		{"lab-2", "shared-token", true},
+		{"lab-3", "shared-token", false},
+	} {
+		agent, err := ListenRendezvous(ctx, relay, tt.name, tt.token, HostKeyAsk)
+		if (err == nil) != tt.ok {
+			t.Errorf("Expected %s registering with %s to succeed: %v, got %v", tt.name, tt.token, tt.ok, err)
+		}
+		if err != nil {
+			continue
+		}
+		s := NewServer(0)
+		s.SetAuthToken("alice-token")
+		go s.Serve(ctx, agent)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/to/lab-1/healthz?token=alice-token", http.StatusOK},
+		{"/to/lab-1/healthz?token=bob-token", http.StatusForbidden},
+		{"/to/lab-1/healthz", http.StatusForbidden},
+		{"/to/lab-2/healthz", http.StatusOK},
+	} {
+		resp, err := http.Get("http://" + ln.Addr().String() + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("Expected %s to get %d, got %d", tt.path, tt.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ReplayOptions controls playback of a recorded session
+type ReplayOptions struct {
+	// Speed multiplies playback speed; values <= 0 mean real time
+	Speed float64
+
+	// IdleLimit caps pauses between events; zero leaves them unchanged
+	IdleLimit time.Duration
+
+	// From starts playback at a bookmark, given by number or label
+	From string
+}
+
+// Bookmark is a marker in a recording, made by a client's bookmark
+// escape command
+type Bookmark struct {
+	Number int           // counting from 1
+	At     time.Duration // into the recording
+	Label  string
+}
+
+// Replay plays an asciicast v2 recording to out, honoring the recorded
+// timing. Playback ends early when stop is closed.
+func Replay(r io.Reader, out io.Writer, opts ReplayOptions, stop <-chan struct{}) error {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	// Output before the bookmark played from is written straight away,
+	// so the screen is as it was there
+	seeking := opts.From != ""
+	markers := 0
+	last := 0.0
+	err := readCast(r, func(at float64, kind, data string) error {
+		if kind == "m" {
+			markers++
+			if seeking && (data == opts.From || strconv.Itoa(markers) == opts.From) {
+				seeking = false
+				last = at
+			}
+			return nil
+		}
+		if kind != "o" {
+			return nil
+		}
+
+		delay := time.Duration((at - last) * float64(time.Second))
+		last = at
+		if opts.IdleLimit > 0 && delay > opts.IdleLimit {
+			delay = opts.IdleLimit
+		}
+		delay = time.Duration(float64(delay) / speed)
+
+		if delay > 0 && !seeking {
+			timer := time.NewTimer(delay)
+			select {
+			case <-stop:
+				timer.Stop()
+				return errReplayStopped
+			case <-timer.C:
+			}
+		}
+
+		if _, err := io.WriteString(out, data); err != nil {
+			return fmt.Errorf("failed to write output: %v", err)
+		}
+		return nil
+	})
+	if err == errReplayStopped {
+		return nil
+	}
+	if err == nil && seeking {
+		return fmt.Errorf("no bookmark %s in the recording", opts.From)
+	}
+	return err
+}
+
+// errReplayStopped ends playback when it's stopped
+var errReplayStopped = errors.New("replay stopped")
+
+// Bookmarks lists the bookmarks in an asciicast v2 recording
+func Bookmarks(r io.Reader) ([]Bookmark, error) {
+	var bookmarks []Bookmark
+	err := readCast(r, func(at float64, kind, data string) error {
+		if kind == "m" {
+			bookmarks = append(bookmarks, Bookmark{
+				Number: len(bookmarks) + 1,
+				At:     time.Duration(at * float64(time.Second)),
+				Label:  data,
+			})
+		}
+		return nil
+	})
+	return bookmarks, err
+}
+
+// readCast reads an asciicast v2 recording, calling event for each event
+// in it until it returns an error
+func readCast(r io.Reader, event func(at float64, kind, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read recording header: %v", err)
+		}
+		return fmt.Errorf("recording is empty")
+	}
+	var header castHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return fmt.Errorf("invalid recording header: %v", err)
+	}
+	if header.Version != 2 {
+		return fmt.Errorf("unsupported recording version %d", header.Version)
+	}
+
+	for line := 2; scanner.Scan(); line++ {
+		var ev []json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || len(ev) != 3 {
+			return fmt.Errorf("invalid event on line %d", line)
+		}
+		var at float64
+		var kind, data string
+		if err := json.Unmarshal(ev[0], &at); err != nil {
+			return fmt.Errorf("invalid event time on line %d: %v", line, err)
+		}
+		if err := json.Unmarshal(ev[1], &kind); err != nil {
+			return fmt.Errorf("invalid event type on line %d: %v", line, err)
+		}
+		if err := json.Unmarshal(ev[2], &data); err != nil {
+			return fmt.Errorf("invalid event data on line %d: %v", line, err)
+		}
+		if err := event(at, kind, data); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read recording: %v", err)
+	}
+	return nil
+}
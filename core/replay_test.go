@@ -0,0 +1,93 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	cast := `{"version":2,"width":80,"height":24,"timestamp":0}
+[0.0,"o","$ "]
+[0.1,"i","ls\n"]
+[5.0,"o","ls\r\nfile\r\n"]
+`
+	var out bytes.Buffer
+	start := time.Now()
+	err := Replay(strings.NewReader(cast), &out, ReplayOptions{
+		Speed:     2,
+		IdleLimit: 100 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "$ ls\r\nfile\r\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+	// The 5s pause is capped at 100ms and halved by the speed multiplier
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected idle limit to shorten playback, took %v", elapsed)
+	}
+}
+
+func TestReplayInvalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":       "",
+		"bad header":  "not json\n",
+		"old version": `{"version":1}` + "\n",
+		"bad event":   `{"version":2}` + "\n[1]\n",
+	}
+	for name, cast := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := Replay(strings.NewReader(cast), &bytes.Buffer{}, ReplayOptions{}, nil); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	cast := `{"version":2,"width":80,"height":24,"timestamp":0}
+[0.0,"o","$ make\r\n"]
+[1.5,"m","2026-10-15T10:00:00Z"]
+[2.0,"o","error: missing file\r\n"]
+[60.0,"m","deploy"]
+[60.1,"o","$ "]
+`
+	bookmarks, err := Bookmarks(strings.NewReader(cast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Bookmark{
+		{Number: 1, At: 1500 * time.Millisecond, Label: "2026-10-15T10:00:00Z"},
+		{Number: 2, At: time.Minute, Label: "deploy"},
+	}
+	if len(bookmarks) != len(want) {
+		t.Fatalf("Expected %d bookmarks, got %+v", len(want), bookmarks)
+	}
+	for i := range want {
+		if bookmarks[i] != want[i] {
+			t.Errorf("Expected bookmark %+v, got %+v", want[i], bookmarks[i])
+		}
+	}
+
+	// Playing from a bookmark skips the wait for what came before it
+	for _, from := range []string{"2", "deploy"} {
+		var out bytes.Buffer
+		start := time.Now()
+		if err := Replay(strings.NewReader(cast), &out, ReplayOptions{From: from}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != "$ make\r\nerror: missing file\r\n$ " {
+			t.Errorf("Unexpected output from bookmark %s: %q", from, out.String())
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected playback from bookmark %s to skip ahead, took %v", from, elapsed)
+		}
+	}
+	if err := Replay(strings.NewReader(cast), &bytes.Buffer{}, ReplayOptions{From: "3"}, nil); err == nil {
+		t.Error("Expected an error for a bookmark not in the recording")
+	}
+}
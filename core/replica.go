@@ -0,0 +1,285 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// DefaultReplicaIdleTimeout is how long a replica waits for an event or
+// heartbeat before reconnecting: three of the server's keepalive intervals
+const DefaultReplicaIdleTimeout = 3 * DefaultKeepalive
+
+// Replica serves a read-only copy of a server's session admin API, kept up
+// to date from the server's event stream. Dashboards can poll it as often
+// as they like without adding load or risk to the server handling sessions.
+type Replica struct {
+	port      int
+	upstream  string // server's admin base URL
+	authToken string
+	idle      time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]Session
+	total     uint64
+	connected bool
+
+	server *http.Server
+	ctx    context.Context // cancelled by Stop
+	cancel context.CancelFunc
+}
+
+// NewReplica creates a replica of the server at upstream, an http(s) base
+// URL. It stops following the server once ctx is done.
+func NewReplica(ctx context.Context, port int, upstream, authToken string) *Replica {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Replica{
+		port:      port,
+		upstream:  strings.TrimSuffix(upstream, "/"),
+		authToken: authToken,
+		idle:      DefaultReplicaIdleTimeout,
+		sessions:  make(map[string]Session),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// SetIdleTimeout reconnects to the server when neither events nor
+// heartbeats arrive for d, as when a connection dies without closing.
+// Zero waits as long as it takes.
+func (rp *Replica) SetIdleTimeout(d time.Duration) {
+	rp.idle = d
+}
+
+// Start follows the upstream event stream and serves the read-only API
+func (rp *Replica) Start() error {
+	go rp.follow()
+	addr := fmt.Sprintf(":%d", rp.port)
+	log.Info.Printf("Starting replica of %s on %s", rp.upstream, addr)
+	rp.server = &http.Server{Addr: addr, Handler: rp.handler()}
+	return rp.server.ListenAndServe()
+}
+
+// Serve is Start, serving connections accepted from ln until ctx is done,
+// then stopping the replica and returning nil
+func (rp *Replica) Serve(ctx context.Context, ln net.Listener) error {
+	go rp.follow()
+	log.Info.Printf("Starting replica of %s on %s", rp.upstream, ln.Addr())
+	rp.server = &http.Server{Handler: rp.handler()}
+	stop := context.AfterFunc(ctx, rp.Stop)
+	defer stop()
+	err := rp.server.Serve(ln)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// handler returns the read-only API's handler
+func (rp *Replica) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(adminSessionsPath, rp.withAuth(http.HandlerFunc(rp.handleSessions)))
+	mux.Handle(adminSessionsPath+"/", rp.withAuth(http.HandlerFunc(rp.handleSessions)))
+	mux.Handle("/api/v1/metrics", rp.withAuth(http.HandlerFunc(rp.handleMetrics)))
+	return mux
+}
+
+// Stop stops following the server and shuts down the replica's API
+func (rp *Replica) Stop() {
+	rp.cancel()
+	if rp.server != nil {
+		rp.server.Close()
+	}
+}
+
+// follow consumes the event stream until the replica is stopped,
+// reconnecting with backoff. Every connection starts with a snapshot, so
+// nothing missed while disconnected is lost.
+func (rp *Replica) follow() {
+	delay := minReconnectDelay
+	for {
+		start := time.Now()
+		err := rp.stream()
+		rp.setConnected(false)
+		if rp.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		log.Info.Printf("Event stream from %s ended: %v, reconnecting in %v", rp.upstream, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-rp.ctx.Done():
+			return
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// stream reads events from one connection to the upstream server, giving
+// up on it if it goes quiet
+func (rp *Replica) stream() error {
+	ctx, cancel := context.WithCancel(rp.ctx)
+	defer cancel()
+	var idle *time.Timer
+	if rp.idle > 0 {
+		idle = time.AfterFunc(rp.idle, cancel)
+		defer idle.Stop()
+	}
+	quiet := func(err error) error {
+		if ctx.Err() != nil && rp.ctx.Err() == nil {
+			return fmt.Errorf("nothing received for %v", rp.idle)
+		}
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/api/v1/events?token=%s", rp.upstream, url.QueryEscape(rp.authToken))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return quiet(fmt.Errorf("failed to connect: %v", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to subscribe: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		if idle != nil {
+			idle.Reset(rp.idle)
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("invalid event: %v", err)
+		}
+		rp.apply(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return quiet(err)
+	}
+	return fmt.Errorf("closed by server")
+}
+
+// apply updates the replica's state with an event
+func (rp *Replica) apply(e Event) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if e.SessionsTotal > rp.total {
+		rp.total = e.SessionsTotal
+	}
+	switch e.Type {
+	case EventSnapshot:
+		rp.sessions = make(map[string]Session, len(e.Sessions))
+		for _, sess := range e.Sessions {
+			rp.sessions[sess.ID] = sess
+		}
+		rp.connected = true
+		log.Info.Printf("Replicating %d sessions from %s", len(e.Sessions), rp.upstream)
+	case EventSessionStart, EventSessionUpdate:
+		if e.Session != nil {
+			rp.sessions[e.Session.ID] = *e.Session
+		}
+	case EventSessionEnd:
+		if e.Session != nil {
+			delete(rp.sessions, e.Session.ID)
+		}
+	}
+}
+
+func (rp *Replica) setConnected(connected bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.connected = connected
+}
+
+// list returns the replicated sessions ordered by start time, and whether
+// they're current
+func (rp *Replica) list() ([]Session, bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	list := make([]Session, 0, len(rp.sessions))
+	for _, sess := range rp.sessions {
+		list = append(list, sess)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+	return list, rp.connected
+}
+
+// withAuth only admits requests carrying the replica's token
+func (rp *Replica) withAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(rp.authToken)) != 1 {
+			http.Error(w, "Invalid auth token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Replica is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// handleSessions lists sessions or shows one. Responses say whether the
+// replica is currently following the server, since while it isn't they
+// may be stale.
+func (rp *Replica) handleSessions(w http.ResponseWriter, r *http.Request) {
+	list, connected := rp.list()
+	if !connected {
+		w.Header().Set("X-Flyssh-Replica-Stale", "true")
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, adminSessionsPath), "/")
+	if id == "" {
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+	if !strings.HasPrefix(id, "#") {
+		id = "#" + id
+	}
+	for _, sess := range list {
+		if sess.ID == id {
+			writeJSON(w, http.StatusOK, sess)
+			return
+		}
+	}
+	http.Error(w, "Session not found", http.StatusNotFound)
+}
+
+// handleMetrics reports the replicated session counters
+func (rp *Replica) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	list, connected := rp.list()
+	if !connected {
+		w.Header().Set("X-Flyssh-Replica-Stale", "true")
+	}
+	rp.mu.Lock()
+	total := rp.total
+	rp.mu.Unlock()
+	writeJSON(w, http.StatusOK, Metrics{
+		SessionsActive: len(list),
+		SessionsTotal:  total,
+		Goroutines:     runtime.NumGoroutine(),
+	})
+}
@@ -0,0 +1,283 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// attachment is a client connection handed to a running session
+type attachment struct {
+	conn   transport
+	replay bool          // send the whole scrollback, not just missed output
+	done   chan struct{} // closed once the session is finished with conn
+}
+
+// sessionControl lets a session outlive its connection. It delivers PTY
+// output to the attached client, keeps recent output as scrollback so
+// a resuming client gets what it missed, and receives resumed connections.
+type sessionControl struct {
+	wmu sync.Mutex // keeps output in order across attachments
+
+	mu         sync.Mutex              // guards the fields below, never held during I/O
+	conn       transport               // attached client, nil while detached
+	w          io.Writer               // conn's output stream
+	scrollback *ringBuffer             // recent output
+	sent       int64                   // scrollback offset the last client has seen
+	rows, cols uint16                  // PTY size, tracked here so it's never read from a closing PTY
+	observers  map[transport]io.Writer // watching a dual-control session
+
+	resume  chan *attachment
+	ended   chan struct{}
+	endOnce sync.Once
+}
+
+// newSessionControl creates a detached session control keeping up to
+// scrollback bytes of output
+func newSessionControl(scrollback int) *sessionControl {
+	return &sessionControl{
+		scrollback: newRingBuffer(scrollback),
+		resume:     make(chan *attachment),
+		ended:      make(chan struct{}),
+	}
+}
+
+// Write sends PTY output to the attached client. It never fails: output
+// that can't be delivered stays in the scrollback for a resuming client.
+func (c *sessionControl) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	conn, w := c.current()
+	delivered := false
+	if w != nil {
+		if _, err := w.Write(p); err == nil {
+			delivered = true
+		} else {
+			// The client went away; closing the connection ends its
+			// input copy, which detaches the session
+			conn.Close()
+			c.detach(conn)
+		}
+	}
+
+	c.mu.Lock()
+	c.scrollback.Write(p)
+	if delivered {
+		c.sent = c.scrollback.Offset()
+	}
+	observers := make(map[transport]io.Writer, len(c.observers))
+	for conn, w := range c.observers {
+		observers[conn] = w
+	}
+	c.mu.Unlock()
+
+	// Observers that can't keep up are disconnected
+	for conn, w := range observers {
+		if _, err := w.Write(p); err != nil {
+			conn.Close()
+			c.unobserve(conn)
+		}
+	}
+	return len(p), nil
+}
+
+// observe sends output to an observer as well as the attached client,
+// starting with the scrollback
+func (c *sessionControl) observe(conn transport, w io.Writer) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if out := c.output(); len(out) > 0 {
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.observers == nil {
+		c.observers = make(map[transport]io.Writer)
+	}
+	c.observers[conn] = w
+	return nil
+}
+
+// unobserve stops sending output to an observer
+func (c *sessionControl) unobserve(conn transport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.observers, conn)
+}
+
+// current returns the attached client and its output stream
+func (c *sessionControl) current() (transport, io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.w
+}
+
+// attach directs output to conn. It first sends the output the previous
+// client missed, or with replay set, all of the scrollback.
+func (c *sessionControl) attach(conn transport, w io.Writer, replay bool) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	missed := c.scrollback.Since(c.sent)
+	if replay {
+		missed = c.scrollback.Bytes()
+	}
+	offset := c.scrollback.Offset()
+	c.mu.Unlock()
+
+	if len(missed) > 0 {
+		if _, err := w.Write(missed); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn, c.w = conn, w
+	c.sent = offset
+	return nil
+}
+
+// setSize records the PTY size
+func (c *sessionControl) setSize(rows, cols uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rows, c.cols = rows, cols
+}
+
+// size returns the PTY size
+func (c *sessionControl) size() (uint16, uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rows, c.cols
+}
+
+// output returns a copy of the scrollback
+func (c *sessionControl) output() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scrollback.Bytes()
+}
+
+// detach stops sending output to conn if it's still attached
+func (c *sessionControl) detach(conn transport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		c.conn, c.w = nil, nil
+	}
+}
+
+// attached reports whether a client is attached
+func (c *sessionControl) attached() bool {
+	conn, _ := c.current()
+	return conn != nil
+}
+
+// notice shows a message to the attached client, if any
+func (c *sessionControl) notice(message string) {
+	if conn, _ := c.current(); conn != nil {
+		conn.notice(message)
+	}
+}
+
+// closeConn disconnects the attached client, if any
+func (c *sessionControl) closeConn() {
+	if conn, _ := c.current(); conn != nil {
+		conn.Close()
+	}
+}
+
+// finish tells the attached client the session is over, so it doesn't try
+// to resume, and disconnects it. The command's exit message is passed on
+// if it exited.
+func (c *sessionControl) finish(exit *controlMessage) {
+	conn, _ := c.current()
+	if conn == nil {
+		return
+	}
+	if exit == nil {
+		exit = &controlMessage{Type: "exit"}
+	}
+	if conn.hasControl() {
+		if err := conn.send(*exit); err != nil {
+			log.Debug.Printf("Failed to send exit: %v", err)
+		}
+	}
+	conn.Close()
+}
+
+// end marks the session as ending, so it no longer waits for a resume
+func (c *sessionControl) end() {
+	c.endOnce.Do(func() { close(c.ended) })
+}
+
+// isEnded reports whether end has been called
+func (c *sessionControl) isEnded() bool {
+	select {
+	case <-c.ended:
+		return true
+	default:
+		return false
+	}
+}
+
+// resumeSession hands a new connection to a detached (or stale) session.
+// Only the token and user that started a session may resume it.
+func (s *Server) resumeSession(id string, conn transport, r *http.Request) {
+	reject := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		log.Info.Printf("Rejected resume of %s from %s: %s", id, r.RemoteAddr, msg)
+		if err := conn.send(controlMessage{Type: "error", Message: msg}); err != nil {
+			log.Debug.Printf("Failed to send error: %v", err)
+		}
+	}
+
+	sess, ok := s.sessions.Get(id)
+	if !ok || sess.ctl == nil || !conn.hasControl() {
+		reject("session %s not found", id)
+		return
+	}
+	g := grantFrom(r.Context())
+	if g == nil || g.name != sess.token || g.full != sess.full || r.URL.Query().Get("user") != sess.User {
+		reject("not permitted to resume session %s", sess.ID)
+		return
+	}
+
+	// A client that reconnects before the server noticed the old
+	// connection drop takes over from it
+	sess.ctl.closeConn()
+
+	att := &attachment{
+		conn:   conn,
+		replay: r.URL.Query().Get("replay") != "",
+		done:   make(chan struct{}),
+	}
+	select {
+	case sess.ctl.resume <- att:
+	case <-sess.ctl.ended:
+		reject("session %s has ended", sess.ID)
+		return
+	case <-time.After(5 * time.Second):
+		reject("session %s is busy", sess.ID)
+		return
+	}
+
+	s.audit.Log(AuditEvent{
+		Event:      AuditResume,
+		SessionID:  sess.ID,
+		RemoteAddr: r.RemoteAddr,
+		User:       sess.User,
+		Token:      g.name,
+		TraceID:    traceID(r.Context()),
+	})
+	<-att.done
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeTransport is a transport that records output and control messages
+type fakeTransport struct {
+	out     bytes.Buffer
+	sent    []controlMessage
+	failing bool
+	closed  bool
+}
+
+func (t *fakeTransport) protocol() string { return ProtocolV2 }
+func (t *fakeTransport) hasControl() bool { return true }
+func (t *fakeTransport) send(msg controlMessage) error {
+	t.sent = append(t.sent, msg)
+	return nil
+}
+func (t *fakeTransport) receive() (controlMessage, error)     { return controlMessage{}, io.EOF }
+func (t *fakeTransport) notice(message string)                {}
+func (t *fakeTransport) input(func(controlMessage)) io.Reader { return strings.NewReader("") }
+func (t *fakeTransport) output() io.Writer                    { return t }
+func (t *fakeTransport) Close() error                         { t.closed = true; return nil }
+
+func (t *fakeTransport) Write(p []byte) (int, error) {
+	if t.failing {
+		return 0, errors.New("connection reset")
+	}
+	return t.out.Write(p)
+}
+
+func TestSessionControlBuffersWhileDetached(t *testing.T) {
+	ctl := newSessionControl(DefaultScrollback)
+	first := &fakeTransport{}
+	if err := ctl.attach(first, first, false); err != nil {
+		t.Fatal(err)
+	}
+	ctl.Write([]byte("one "))
+
+	// A failed write detaches the client and keeps the output
+	first.failing = true
+	ctl.Write([]byte("two "))
+	if !first.closed || ctl.attached() {
+		t.Fatal("Expected failed client to be closed and detached")
+	}
+	ctl.Write([]byte("three"))
+
+	second := &fakeTransport{}
+	if err := ctl.attach(second, second, false); err != nil {
+		t.Fatal(err)
+	}
+	if first.out.String() != "one " {
+		t.Errorf("First client got %q", first.out.String())
+	}
+	if second.out.String() != "two three" {
+		t.Errorf("Resumed client got %q, want buffered output", second.out.String())
+	}
+
+	ctl.finish(nil)
+	if len(second.sent) != 1 || second.sent[0].Type != "exit" || !second.closed {
+		t.Errorf("Expected exit message and close on finish, got %v", second.sent)
+	}
+}
+
+func TestSessionControlReplay(t *testing.T) {
+	ctl := newSessionControl(8)
+	first := &fakeTransport{}
+	if err := ctl.attach(first, first, false); err != nil {
+		t.Fatal(err)
+	}
+	ctl.Write([]byte("hello "))
+	ctl.Write([]byte("world"))
+	ctl.detach(first)
+
+	// Only the most recent output fits in the scrollback
+	second := &fakeTransport{}
+	if err := ctl.attach(second, second, true); err != nil {
+		t.Fatal(err)
+	}
+	if second.out.String() != "lo world" {
+		t.Errorf("Replayed %q, want the last 8 bytes", second.out.String())
+	}
+	if string(ctl.output()) != "lo world" {
+		t.Errorf("output() = %q", ctl.output())
+	}
+}
+
+func TestSessionControlObservers(t *testing.T) {
+	ctl := newSessionControl(DefaultScrollback)
+	client := &fakeTransport{}
+	if err := ctl.attach(client, client, false); err != nil {
+		t.Fatal(err)
+	}
+	ctl.Write([]byte("before "))
+
+	watcher, stalled := &fakeTransport{}, &fakeTransport{}
+	for _, o := range []*fakeTransport{watcher, stalled} {
+		if err := ctl.observe(o, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stalled.failing = true
+	ctl.Write([]byte("after"))
+
+	if client.out.String() != "before after" {
+		t.Errorf("Client got %q", client.out.String())
+	}
+	if watcher.out.String() != "before after" {
+		t.Errorf("Observer got %q, want the scrollback then new output", watcher.out.String())
+	}
+	// An observer that fails is dropped without detaching the client
+	if !stalled.closed || !ctl.attached() {
+		t.Error("Expected the failed observer to be closed, and the client kept")
+	}
+
+	ctl.unobserve(watcher)
+	ctl.Write([]byte(" more"))
+	if watcher.out.String() != "before after" {
+		t.Errorf("Observer got output after leaving: %q", watcher.out.String())
+	}
+}
@@ -0,0 +1,28 @@
+package core
+
+// sandboxEnv carries a sandboxed session's scratch directory to the
+// sandbox init process, which sets up the session's mounts before
+// running its command. Jailed sessions start through it too.
+const sandboxEnv = "FLYSSH_SANDBOX_SCRATCH"
+
+// sandboxCredentialEnv carries the user a confined session runs as, as
+// uid:gid:groups. The sandbox init process needs root to set up mounts, so
+// it starts as the server's user and becomes this one just before running
+// the session's command.
+const sandboxCredentialEnv = "FLYSSH_SANDBOX_CREDENTIAL"
+
+// Sandbox confines each session's command on Linux: it runs in its own
+// mount and PID namespaces, sees the filesystem read-only except for a
+// scratch directory of its own mounted at /tmp, and can be held to CPU and
+// memory limits with a cgroup.
+type Sandbox struct {
+	scratch    string  // parent of the sessions' scratch directories
+	cpus       float64 // CPU limit in cores, zero for none
+	memory     int64   // memory limit in bytes, zero for none
+	cgroupRoot string  // cgroup v2 mount
+}
+
+// SetSandbox runs every session's command in sb
+func (s *Server) SetSandbox(sb *Sandbox) {
+	s.sandbox = sb
+}
@@ -0,0 +1,349 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"flyssh/core/log"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupPeriod is the CPU accounting period of sandboxed sessions
+const cgroupPeriod = 100000
+
+// sandboxArg names the sandbox init process in its argv
+const sandboxArg = "flyssh-sandbox"
+
+// NewSandbox confines sessions, giving each a scratch directory under
+// scratch. Limits of zero are unlimited. The server must run as root, and
+// limits need cgroup v2.
+func NewSandbox(scratch string, cpus float64, memoryMiB int) (*Sandbox, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("sandboxing needs the server to run as root")
+	}
+	if err := os.MkdirAll(scratch, 0711); err != nil {
+		return nil, fmt.Errorf("failed to create sandbox directory: %v", err)
+	}
+	sb := &Sandbox{
+		scratch:    scratch,
+		cpus:       cpus,
+		memory:     int64(memoryMiB) << 20,
+		cgroupRoot: "/sys/fs/cgroup",
+	}
+	if sb.limited() {
+		if _, err := os.Stat(filepath.Join(sb.cgroupRoot, "cgroup.controllers")); err != nil {
+			return nil, fmt.Errorf("sandbox limits need cgroup v2 mounted at %s", sb.cgroupRoot)
+		}
+	}
+	return sb, nil
+}
+
+// limited reports whether sessions get a cgroup
+func (sb *Sandbox) limited() bool {
+	return sb.cpus > 0 || sb.memory > 0
+}
+
+// wrap makes cmd start in the sandbox, through the sandbox init process.
+// The returned function removes the session's scratch directory and
+// cgroup once its process has exited.
+func (sb *Sandbox) wrap(cmd *exec.Cmd, sessionID string) (func(), error) {
+	name := sanitizeFilename(strings.TrimPrefix(sessionID, "#"))
+	scratch := filepath.Join(sb.scratch, name)
+	if err := os.Mkdir(scratch, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	cmd.Env = append(cmd.Env, sandboxEnv+"="+scratch)
+	confine(cmd)
+	if cred := sessionCredential(cmd); cred != nil {
+		if err := os.Chown(scratch, int(cred.Uid), int(cred.Gid)); err != nil {
+			os.RemoveAll(scratch)
+			return nil, fmt.Errorf("failed to create scratch directory: %v", err)
+		}
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(scratch); err != nil {
+			log.Info.Printf("Failed to remove scratch directory of %s: %v", sessionID, err)
+		}
+	}
+
+	if sb.limited() {
+		group, err := sb.cgroup(name)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		fd, err := syscall.Open(group, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			os.Remove(group)
+			cleanup()
+			return nil, fmt.Errorf("failed to open cgroup: %v", err)
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = fd
+		removeScratch := cleanup
+		cleanup = func() {
+			syscall.Close(fd)
+			if err := os.Remove(group); err != nil {
+				log.Info.Printf("Failed to remove cgroup of %s: %v", sessionID, err)
+			}
+			removeScratch()
+		}
+	}
+	return cleanup, nil
+}
+
+// confine makes cmd start in new mount and PID namespaces, through the
+// sandbox init process, which sets up what the environment asks for. The
+// init process keeps the server's privileges, which making mounts needs,
+// and drops to the session's user itself. Sessions that would run as root
+// run as nobody instead, since root could undo the confinement.
+func confine(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	cred := cmd.SysProcAttr.Credential
+	if cred == nil && sessionCredential(cmd) == nil {
+		cred = nobodyCredential()
+	}
+	if cred != nil {
+		cmd.Env = append(cmd.Env, sandboxCredentialEnv+"="+formatCredential(cred))
+		cmd.SysProcAttr.Credential = nil
+	}
+	if cmd.Args[0] == sandboxArg {
+		return // already jailed, or sandboxed
+	}
+	cmd.Args = append([]string{sandboxArg, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/proc/self/exe"
+}
+
+// nobodyCredential returns the credential of the nobody account, or its
+// usual ids where it can't be looked up
+func nobodyCredential() *syscall.Credential {
+	cred := &syscall.Credential{Uid: 65534, Gid: 65534, Groups: []uint32{}}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		return cred
+	}
+	if uid, err := strconv.ParseUint(u.Uid, 10, 32); err == nil {
+		cred.Uid = uint32(uid)
+	}
+	if gid, err := strconv.ParseUint(u.Gid, 10, 32); err == nil {
+		cred.Gid = uint32(gid)
+	}
+	return cred
+}
+
+// cgroup creates a session's cgroup with the sandbox's limits
+func (sb *Sandbox) cgroup(name string) (string, error) {
+	parent := filepath.Join(sb.cgroupRoot, "flyssh")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	// Controllers may already be enabled, or unavailable, which writing
+	// the limits below reports
+	os.WriteFile(filepath.Join(sb.cgroupRoot, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+	os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+
+	group := filepath.Join(parent, name)
+	if err := os.Mkdir(group, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	limits := map[string]string{}
+	if sb.cpus > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(sb.cpus*cgroupPeriod), cgroupPeriod)
+	}
+	if sb.memory > 0 {
+		limits["memory.max"] = strconv.FormatInt(sb.memory, 10)
+	}
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(group, file), []byte(value), 0644); err != nil {
+			os.Remove(group)
+			return "", fmt.Errorf("failed to set %s: %v", file, err)
+		}
+	}
+	return group, nil
+}
+
+func init() {
+	if len(os.Args) > 1 && os.Args[0] == sandboxArg && (os.Getenv(sandboxEnv) != "" || os.Getenv(jailEnv) != "") {
+		sandboxInit(os.Getenv(sandboxEnv), os.Getenv(jailEnv))
+	}
+}
+
+// sandboxInit runs in the confined process's new namespaces. A sandboxed
+// session gets every mount made read-only and its scratch directory
+// mounted at /tmp; a jailed one gets its /dev set up and its root changed.
+// Both get a /proc for the new PID namespace. It then becomes the
+// session's user without any capabilities, and the session's command, and
+// never returns.
+func sandboxInit(scratch, root string) {
+	fail := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "flyssh: sandbox: "+format+"\r\n", args...)
+		os.Exit(126)
+	}
+	// Capabilities are per thread, and the command must start from the
+	// thread that dropped them
+	runtime.LockOSThread()
+
+	// Keep mount changes in this namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		fail("failed to make mounts private: %v", err)
+	}
+	if scratch != "" {
+		readOnlyMounts(fail)
+	}
+	if root != "" {
+		if err := mountJailDev(root); err != nil {
+			fail("%v", err)
+		}
+	}
+	tmp := filepath.Join(root, "/tmp")
+	if scratch != "" {
+		// A bind mount starts with the flags of the mount it comes from
+		if err := syscall.Mount(scratch, tmp, "", syscall.MS_BIND, ""); err != nil {
+			fail("failed to mount scratch directory: %v", err)
+		}
+		if err := syscall.Mount("", tmp, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+			fail("failed to make scratch directory writable: %v", err)
+		}
+	}
+	if err := syscall.Mount("proc", filepath.Join(root, "/proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		fail("failed to mount /proc: %v", err)
+	}
+	if root != "" {
+		if err := enterJail(root); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	if err := dropPrivileges(os.Getenv(sandboxCredentialEnv)); err != nil {
+		fail("%v", err)
+	}
+
+	os.Unsetenv(sandboxEnv)
+	os.Unsetenv(jailEnv)
+	os.Unsetenv(sandboxCredentialEnv)
+	if err := syscall.Exec(os.Args[1], os.Args[1:], os.Environ()); err != nil {
+		fail("failed to run %s: %v", os.Args[1], err)
+	}
+}
+
+// dropPrivileges becomes the user in credential, and gives up every
+// capability for good: none are left to this process or to anything it
+// runs, setuid programs included
+func dropPrivileges(credential string) error {
+	// The bounding set limits what running a program can grant, and
+	// dropping from it needs a capability, so it goes first
+	for c := 0; ; c++ {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err == unix.EINVAL {
+			break // past the last capability
+		} else if err != nil {
+			return fmt.Errorf("failed to drop capabilities: %v", err)
+		}
+	}
+	// Kernels without ambient capabilities have none to clear
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("failed to drop capabilities: %v", err)
+	}
+
+	if credential != "" {
+		cred, err := parseCredential(credential)
+		if err != nil {
+			return err
+		}
+		// Groups first, while there are still the privileges to
+		if err := syscall.Setgroups(intIDs(cred.Groups)); err != nil {
+			return fmt.Errorf("failed to set groups: %v", err)
+		}
+		if err := syscall.Setgid(int(cred.Gid)); err != nil {
+			return fmt.Errorf("failed to set gid: %v", err)
+		}
+		if err := syscall.Setuid(int(cred.Uid)); err != nil {
+			return fmt.Errorf("failed to set uid: %v", err)
+		}
+	}
+
+	// Becoming another user leaves the inheritable set
+	var data [2]unix.CapUserData
+	if err := unix.Capset(&unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}, &data[0]); err != nil {
+		return fmt.Errorf("failed to drop capabilities: %v", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+	return nil
+}
+
+// readOnlyMounts remounts every mount read-only
+func readOnlyMounts(fail func(string, ...any)) {
+	mounts, err := mountPoints()
+	if err != nil {
+		fail("failed to list mounts: %v", err)
+	}
+	for _, mp := range mounts {
+		// Flags the mount already has must be kept
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mp, &st); err != nil {
+			continue // gone since it was listed
+		}
+		flags := uintptr(syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY) | uintptr(st.Flags)&(syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC)
+		if err := syscall.Mount("", mp, "", flags, ""); err != nil {
+			fail("failed to make %s read-only: %v", mp, err)
+		}
+	}
+}
+
+// mountPoints lists this process's mount points
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mp := unescapeMountPoint(fields[4])
+		if !seen[mp] {
+			seen[mp] = true
+			mounts = append(mounts, mp)
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes mountinfo uses for spaces
+// and other special characters
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSandboxCgroupLimits(t *testing.T) {
+	root := t.TempDir()
+	sb := &Sandbox{scratch: t.TempDir(), cpus: 0.5, memory: 256 << 20, cgroupRoot: root}
+
+	cmd := exec.Command("/bin/sh", "-c", "true")
+	cleanup, err := sb.wrap(cmd, "#a-7")
+	if err != nil {
+		t.Fatalf("wrap() error = %v", err)
+	}
+
+	group := filepath.Join(root, "flyssh", "a-7")
+	for file, want := range map[string]string{"cpu.max": "50000 100000", "memory.max": "268435456"} {
+		got, err := os.ReadFile(filepath.Join(group, file))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q (%v), want %q", file, got, err, want)
+		}
+	}
+	if !cmd.SysProcAttr.UseCgroupFD {
+		t.Error("Command isn't started in its cgroup")
+	}
+	if cmd.Path != "/proc/self/exe" || cmd.Args[1] != "/bin/sh" || cmd.Args[len(cmd.Args)-1] != "true" {
+		t.Errorf("Command isn't run through the sandbox init: %q %q", cmd.Path, cmd.Args)
+	}
+
+	// A real cgroup directory is empty once its processes are gone; this
+	// one still holds the limit files
+	for _, file := range []string{"cpu.max", "memory.max"} {
+		os.Remove(filepath.Join(group, file))
+	}
+	cleanup()
+	if _, err := os.Stat(group); !os.IsNotExist(err) {
+		t.Error("Cgroup wasn't removed")
+	}
+	if entries, _ := os.ReadDir(sb.scratch); len(entries) != 0 {
+		t.Error("Scratch directory wasn't removed")
+	}
+}
+
+func TestUnescapeMountPoint(t *testing.T) {
+	if got := unescapeMountPoint(`/mnt/my\040disk\134x`); got != `/mnt/my disk\x` {
+		t.Errorf("unescapeMountPoint() = %q", got)
+	}
+}
+
+func TestConfineKeepsPrivileges(t *testing.T) {
+	cmd := exec.Command("/bin/sh")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 1000, Gid: 100, Groups: []uint32{100, 27}}}
+	confine(cmd)
+
+	// The init process starts as the server's user, knowing who to become
+	if cmd.SysProcAttr.Credential != nil {
+		t.Error("Expected the sandbox init process to keep the server's privileges")
+	}
+	cred := sessionCredential(cmd)
+	if cred == nil || cred.Uid != 1000 || cred.Gid != 100 || len(cred.Groups) != 2 || cred.Groups[1] != 27 {
+		t.Errorf("Expected the session's user to be passed on, got %+v", cred)
+	}
+}
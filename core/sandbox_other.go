@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// NewSandbox is not available outside Linux
+func NewSandbox(scratch string, cpus float64, memoryMiB int) (*Sandbox, error) {
+	return nil, fmt.Errorf("sandboxing is only supported on Linux")
+}
+
+func (sb *Sandbox) wrap(cmd *exec.Cmd, sessionID string) (func(), error) {
+	return nil, fmt.Errorf("sandboxing is only supported on Linux")
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// screenResets are the sequences that undo the modes a full screen
+// program may leave set, in the order they're undone: leaving the
+// alternate screen, showing the cursor, turning off mouse reporting and
+// bracketed paste, and resetting text attributes
+var screenResets = []struct{ mode, reset string }{
+	{"1049", "\x1b[?1049l"},
+	{"1047", "\x1b[?1047l"},
+	{"47", "\x1b[?47l"},
+	{"25", "\x1b[?25h"},
+	{"1000", "\x1b[?1000l"},
+	{"1002", "\x1b[?1002l"},
+	{"1003", "\x1b[?1003l"},
+	{"1006", "\x1b[?1006l"},
+	{"2004", "\x1b[?2004l"},
+	{"sgr", "\x1b[0m"},
+}
+
+// screenTracker passes terminal output through, watching for the modes a
+// full screen program sets, so a session that ends while they're set,
+// because the program died or the connection did, can put the terminal
+// back
+type screenTracker struct {
+	w io.Writer
+
+	mu     sync.Mutex
+	state  int    // where the parser is in an escape sequence
+	params []byte // the current control sequence's parameters
+	dirty  map[string]bool
+}
+
+// Parser states
+const (
+	screenText = iota
+	screenEscape
+	screenCSI
+)
+
+func newScreenTracker(w io.Writer) *screenTracker {
+	return &screenTracker{w: w, dirty: make(map[string]bool)}
+}
+
+func (s *screenTracker) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range p {
+		s.scan(b)
+	}
+	return s.w.Write(p)
+}
+
+// scan follows one byte of output. Control sequences may be split across
+// writes.
+func (s *screenTracker) scan(b byte) {
+	switch s.state {
+	case screenText:
+		if b == 0x1b {
+			s.state = screenEscape
+		}
+	case screenEscape:
+		s.state = screenText
+		if b == '[' {
+			s.state = screenCSI
+			s.params = s.params[:0]
+		}
+	case screenCSI:
+		switch {
+		case b >= 0x20 && b <= 0x3f:
+			if len(s.params) < 64 {
+				s.params = append(s.params, b)
+			}
+		case b >= 0x40 && b <= 0x7e:
+			s.state = screenText
+			s.sequence(string(s.params), b)
+		default:
+			s.state = screenText
+		}
+	}
+}
+
+// sequence records the effect of a complete control sequence
+func (s *screenTracker) sequence(params string, final byte) {
+	switch final {
+	case 'm':
+		// Attributes are set by anything but a plain reset
+		s.dirty["sgr"] = params != "" && params != "0"
+	case 'h', 'l':
+		modes, private := strings.CutPrefix(params, "?")
+		if !private {
+			return
+		}
+		for _, mode := range strings.Split(modes, ";") {
+			switch mode {
+			case "47", "1047", "1049", "1000", "1002", "1003", "1006", "2004":
+				s.dirty[mode] = final == 'h'
+			case "25":
+				s.dirty[mode] = final == 'l' // hidden cursor
+			}
+		}
+	}
+}
+
+// isSet reports whether the output left a mode set
+func (s *screenTracker) isSet(mode string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dirty[mode]
+}
+
+// reset undoes the modes the output left set. Only those are reset, since
+// leaving the alternate screen when not in it can move the cursor.
+func (s *screenTracker) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var seq strings.Builder
+	for _, r := range screenResets {
+		if s.dirty[r.mode] {
+			seq.WriteString(r.reset)
+		}
+	}
+	s.dirty = make(map[string]bool)
+	if seq.Len() > 0 {
+		io.WriteString(s.w, seq.String())
+	}
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestScreenTrackerReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		output []string
+		reset  string
+	}{
+		{"plain output", []string{"hello\r\n"}, ""},
+		{"colors reset", []string{"\x1b[1;31mred\x1b[0m"}, ""},
+		{"colors left on", []string{"\x1b[1;31mred"}, "\x1b[0m"},
+		{"program exited cleanly", []string{"\x1b[?1049h\x1b[?25l", "\x1b[?25h\x1b[?1049l"}, ""},
+		{"program died", []string{"\x1b[?1049h\x1b[?25l\x1b[7m"}, "\x1b[?1049l\x1b[?25h\x1b[0m"},
+		{"split sequences", []string{"\x1b", "[?10", "49h\x1b[?1000;", "1006h"}, "\x1b[?1049l\x1b[?1000l\x1b[?1006l"},
+		{"not private modes", []string{"\x1b[4h"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			s := newScreenTracker(&out)
+			for _, chunk := range tt.output {
+				s.Write([]byte(chunk))
+			}
+			out.Reset()
+			s.reset()
+			if got := out.String(); got != tt.reset {
+				t.Errorf("reset wrote %q, want %q", got, tt.reset)
+			}
+
+			// Once reset, there's nothing left to undo
+			out.Reset()
+			s.reset()
+			if out.Len() != 0 {
+				t.Errorf("Second reset wrote %q", out.String())
+			}
+		})
+	}
+}
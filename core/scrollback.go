@@ -0,0 +1,73 @@
+package core
+
+// DefaultScrollback is the default amount of PTY output kept per session
+const DefaultScrollback = 256 << 10
+
+// ringBuffer keeps the most recent output of a session. It remembers how
+// much was ever written, so callers can ask for everything after a point
+// they've already seen.
+type ringBuffer struct {
+	data  []byte // grows up to cap(data), then wraps
+	next  int    // oldest byte once the buffer is full
+	total int64  // bytes ever written
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{data: make([]byte, 0, size)}
+}
+
+// Write appends p, overwriting the oldest output once the buffer is full
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	r.total += int64(n)
+
+	size := cap(r.data)
+	if size == 0 {
+		return n, nil
+	}
+	if len(p) >= size {
+		r.data = append(r.data[:0], p[len(p)-size:]...)
+		r.next = 0
+		return n, nil
+	}
+	if room := size - len(r.data); room > 0 {
+		if len(p) <= room {
+			r.data = append(r.data, p...)
+			return n, nil
+		}
+		r.data = append(r.data, p[:room]...)
+		p = p[room:]
+	}
+	for len(p) > 0 {
+		c := copy(r.data[r.next:], p)
+		p = p[c:]
+		r.next = (r.next + c) % size
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the retained output, oldest first
+func (r *ringBuffer) Bytes() []byte {
+	out := make([]byte, 0, len(r.data))
+	out = append(out, r.data[r.next:]...)
+	return append(out, r.data[:r.next]...)
+}
+
+// Since returns the retained output written after offset. If some of it
+// has already been overwritten, whatever is left is returned.
+func (r *ringBuffer) Since(offset int64) []byte {
+	missing := r.total - offset
+	if missing <= 0 {
+		return nil
+	}
+	out := r.Bytes()
+	if missing < int64(len(out)) {
+		out = out[int64(len(out))-missing:]
+	}
+	return out
+}
+
+// Offset returns the number of bytes ever written
+func (r *ringBuffer) Offset() int64 {
+	return r.total
+}
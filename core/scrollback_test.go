@@ -0,0 +1,59 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{"empty", 8, nil, ""},
+		{"partial", 8, []string{"abc", "de"}, "abcde"},
+		{"exactly full", 4, []string{"ab", "cd"}, "abcd"},
+		{"wraps", 4, []string{"abc", "def"}, "cdef"},
+		{"wraps repeatedly", 4, []string{"ab", "cd", "ef", "g"}, "defg"},
+		{"oversized write", 4, []string{"ab", "cdefgh"}, "efgh"},
+		{"disabled", 0, []string{"abc"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRingBuffer(tt.size)
+			total := 0
+			for _, w := range tt.writes {
+				r.Write([]byte(w))
+				total += len(w)
+			}
+			if got := string(r.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+			if r.Offset() != int64(total) {
+				t.Errorf("Offset() = %d, want %d", r.Offset(), total)
+			}
+		})
+	}
+}
+
+func TestRingBufferSince(t *testing.T) {
+	r := newRingBuffer(8)
+	r.Write([]byte("hello "))
+	seen := r.Offset()
+	r.Write([]byte("world"))
+
+	if got := string(r.Since(seen)); got != "world" {
+		t.Errorf("Since(%d) = %q, want %q", seen, got, "world")
+	}
+	if got := r.Since(r.Offset()); len(got) != 0 {
+		t.Errorf("Since(end) = %q, want nothing", got)
+	}
+
+	// Output that has been overwritten is skipped
+	r.Write([]byte(strings.Repeat("x", 10)))
+	if got := string(r.Since(seen)); got != "xxxxxxxx" {
+		t.Errorf("Since(%d) = %q after overflow", seen, got)
+	}
+}
@@ -1,19 +1,21 @@
 package core
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"flyssh/core/log"
 
-	"github.com/creack/pty"
 	"golang.org/x/net/websocket"
 )
 
@@ -26,143 +28,485 @@ func GenerateDevToken() string {
 
 // Server represents a WebSocket server that handles PTY connections
 type Server struct {
-	port         int
-	mux          *http.ServeMux
-	ptys         sync.Map // map[string]*os.File to track PTYs by session
-	sessionCount uint64   // atomic counter for session IDs
-	server       *http.Server
+	port          int
+	addr          string // overrides port: host:port, or a Unix socket
+	authToken     string
+	mux           *http.ServeMux
+	routes        sync.Once
+	sessions      SessionRegistry
+	sessionCount  uint64 // atomic counter for session IDs
+	events        eventBus
+	drain         drainState
+	upgrading     atomic.Bool // handing the listener to a new server
+	upgraded      atomic.Bool // handed it over, so draining sessions
+	server        *http.Server
+	idleTimeout   time.Duration
+	maxSession    time.Duration
+	resumeTimeout time.Duration
+	keepalive     time.Duration
+	writeTimeout  time.Duration
+	scrollback    int
+	acceptEnv     []string
+	agentForward  bool
+	x11Forward    bool
+	pasteGuard    int
+	sshTarget     string
+	startPTY      PTYStarter
+	shell         string
+	launchers     *LauncherConfig
+	policy        *Policy
+	policyPreview *Policy
+	stepUps       stepUps
+	dualControls  dualControls
+
+	maxSessions    int
+	memoryLimit    uint64 // bytes; 0 for no budget
+	activeSessions int64  // atomic count of connected sessions
+	limiter        *rateLimiter
+
+	tmpDir       string
+	tmpRetention time.Duration
+
+	recordDir      string
+	recordTemplate string
+	recordInput    bool
+
+	hooks      sessionHooks
+	quotas     *Quotas
+	access     *AccessRequests
+	managed    *Managed
+	cluster    *Cluster
+	sandbox    *Sandbox
+	jail       *Jail
+	audit      *AuditLog
+	tracer     *Tracer
+	activation *Activation
+	faults     *faultInjector // only with the faults build tag
 }
 
 // NewServer creates a new server instance
 func NewServer(port int) *Server {
 	mux := http.NewServeMux()
 	return &Server{
-		port: port,
-		mux:  mux,
-		ptys: sync.Map{},
+		port:         port,
+		mux:          mux,
+		keepalive:    DefaultKeepalive,
+		writeTimeout: DefaultWriteTimeout,
+		scrollback:   DefaultScrollback,
+		acceptEnv:    DefaultAcceptEnv,
+		agentForward: true,
+		startPTY:     startPTY,
+		shell:        shells[0],
+		faults:       newFaultInjector(),
+	}
+}
+
+// SetListenAddr listens on addr instead of every interface: a host:port,
+// such as 127.0.0.1:8081, or the path of a Unix socket, optionally
+// prefixed with unix:, for servers only reached through a local proxy
+func (s *Server) SetListenAddr(addr string) {
+	s.addr = addr
+}
+
+// listenAddr returns the network and address the server listens on
+func (s *Server) listenAddr() (string, string) {
+	switch {
+	case strings.HasPrefix(s.addr, "unix:"):
+		return "unix", strings.TrimPrefix(s.addr, "unix:")
+	case strings.Contains(s.addr, "/"):
+		return "unix", s.addr
+	case s.addr != "":
+		return "tcp", s.addr
+	}
+	return "tcp", fmt.Sprintf(":%d", s.port)
+}
+
+// listen listens on the server's address. A Unix socket left behind by a
+// server that's gone is replaced, and the socket isn't removed on close,
+// so a server taking over in an upgrade keeps it.
+func (s *Server) listen() (net.Listener, error) {
+	network, address := s.listenAddr()
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", address); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("%s is in use by another server", address)
+			}
+			os.Remove(address)
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return ln, nil
+}
+
+// SetSessionTimeouts configures the idle timeout and maximum lifetime of
+// sessions. A zero duration disables the corresponding limit.
+func (s *Server) SetSessionTimeouts(idle, maxSession time.Duration) {
+	s.idleTimeout = idle
+	s.maxSession = maxSession
+}
+
+// SetResumeTimeout keeps sessions whose connection drops running for d, so
+// the client can reconnect and resume them. Zero ends sessions on
+// disconnect.
+func (s *Server) SetResumeTimeout(d time.Duration) {
+	s.resumeTimeout = d
+}
+
+// SetKeepalive pings clients every interval and drops connections whose
+// client stops answering, detaching the session so it can be resumed.
+// Zero disables pinging.
+func (s *Server) SetKeepalive(interval time.Duration) {
+	s.keepalive = interval
+}
+
+// SetWriteTimeout disconnects clients that take longer than d to accept a
+// chunk of output, detaching their sessions so they can be resumed. Zero
+// waits for slow clients however long they take.
+func (s *Server) SetWriteTimeout(d time.Duration) {
+	s.writeTimeout = d
+}
+
+// SetScrollback sets how many bytes of recent output each session keeps.
+// Resuming clients are sent what they missed from it, and the admin API
+// can show it. Zero keeps no output.
+func (s *Server) SetScrollback(size int) {
+	s.scrollback = size
+}
+
+// SetAcceptEnv sets which environment variables clients may pass to their
+// sessions, by name with * and ? wildcards. Variables sent by clients that
+// match none are dropped. Launchers' own variables always win.
+func (s *Server) SetAcceptEnv(patterns []string) {
+	s.acceptEnv = patterns
+}
+
+// SetAgentForwarding sets whether clients may forward their SSH agent to
+// their sessions, which it is by default. Only full access tokens can.
+func (s *Server) SetAgentForwarding(allow bool) {
+	s.agentForward = allow
+}
+
+// SetPasteGuard guards shells against large pastes, whose lines would
+// otherwise each run as they arrive: pastes of limit bytes or more are
+// held until the user confirms them, or bracketed so the shell waits for
+// Enter if it supports that. Zero disables the guard.
+func (s *Server) SetPasteGuard(limit int) {
+	s.pasteGuard = limit
+}
+
+// SetX11Forwarding sets whether clients may forward their X display to
+// their sessions, which like sshd it isn't by default. Only full access
+// tokens can.
+func (s *Server) SetX11Forwarding(allow bool) {
+	s.x11Forward = allow
+}
+
+// SetSSHTarget relays stdio proxy connections to the SSH server at addr,
+// such as localhost:22, so stock ssh, scp and rsync can reach it with
+// flyssh stdio-proxy as their ProxyCommand. Only full access tokens can.
+// Empty, the default, refuses them.
+func (s *Server) SetSSHTarget(addr string) {
+	s.sshTarget = addr
+}
+
+// SetPTYStarter replaces the platform's terminals, which sessions run on,
+// for instance with fakes in tests
+func (s *Server) SetPTYStarter(start PTYStarter) {
+	s.startPTY = start
+}
+
+// SetLaunchers configures named launchers and the tokens scoped to them
+func (s *Server) SetLaunchers(cfg *LauncherConfig) {
+	s.launchers = cfg
+}
+
+// SetPolicy restricts the shells and commands full access tokens may run.
+// Refused sessions are audited.
+func (s *Server) SetPolicy(p *Policy) {
+	s.policy = p
+}
+
+// SetPolicyPreview tries a policy out without enforcing it: sessions and
+// file transfers it would refuse go ahead, and are logged and audited as
+// would_deny. It can be previewed alongside the enforced policy, as its
+// replacement.
+func (s *Server) SetPolicyPreview(p *Policy) {
+	s.policyPreview = p
+}
+
+// SetRecording enables asciicast v2 recording of every session into dir.
+// The filename template supports {id}, {user}, {launcher} and {time}.
+func (s *Server) SetRecording(dir, template string, recordInput bool) {
+	s.recordDir = dir
+	s.recordTemplate = template
+	s.recordInput = recordInput
+}
+
+// SetSessionHooks runs scripts when sessions start and end. Hooks get the
+// session's details in FLYSSH_* environment variables; a start hook that
+// fails refuses the session. An empty path disables that hook.
+func (s *Server) SetSessionHooks(start, end string) {
+	s.hooks = sessionHooks{start: start, end: end}
+}
+
+// SetQuotas enforces daily session and time quotas on scoped tokens
+func (s *Server) SetQuotas(q *Quotas) {
+	s.quotas = q
+}
+
+// SetCluster shares which sessions this instance holds with the other
+// instances of a cluster, so clients resuming a session are routed to the
+// instance running it. Session IDs include the instance name.
+func (s *Server) SetCluster(c *Cluster) {
+	s.cluster = c
+}
+
+// SetAuditLog enables structured audit logging of connections and commands
+func (s *Server) SetAuditLog(a *AuditLog) {
+	s.audit = a
+}
+
+// SetAuthToken sets the token that grants full access. Without one, the
+// WSS_AUTH_TOKEN environment variable's is used.
+func (s *Server) SetAuthToken(token string) {
+	s.authToken = token
+}
+
+// fullToken returns the token that grants full access, if any
+func (s *Server) fullToken() string {
+	if s.authToken != "" {
+		return s.authToken
 	}
+	return os.Getenv("WSS_AUTH_TOKEN")
+}
+
+// SetTracer enables export of spans covering the connection lifecycle
+func (s *Server) SetTracer(t *Tracer) {
+	s.tracer = t
 }
 
 // Start starts the WebSocket server
 func (s *Server) Start() error {
-	// Set up WebSocket handler with auth wrapper
-	s.mux.Handle("/", s.withAuth(websocket.Handler(s.handleConnection)))
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+	log.Info.Printf("Starting WebSocket server on %s", ln.Addr())
+	s.server = &http.Server{Handler: s.Handler()}
+	s.startCluster()
+	s.publishServer(EventServerStart, "")
+	return s.server.Serve(ln)
+}
 
-	// Start HTTP server
-	addr := fmt.Sprintf(":%d", s.port)
-	log.Info.Printf("Starting WebSocket server on %s", addr)
-	s.server = &http.Server{Addr: addr, Handler: s.mux}
-	return s.server.ListenAndServe()
+// Serve serves connections accepted from ln until ctx is done, then stops
+// the server and returns nil. For programs embedding the server.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	log.Info.Printf("Starting WebSocket server on %s", ln.Addr())
+	s.server = &http.Server{Handler: s.Handler()}
+	s.startCluster()
+	s.publishServer(EventServerStart, "")
+	stop := context.AfterFunc(ctx, s.Stop)
+	defer stop()
+	err := s.server.Serve(ln)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if s.upgraded.Load() {
+		s.waitSessions(ctx)
+		return nil
+	}
+	return err
+}
+
+// Handler returns the server's HTTP handler, for programs serving it
+// themselves, alongside their own handlers
+func (s *Server) Handler() http.Handler {
+	s.routes.Do(func() {
+		// Set up WebSocket handler with auth wrapper
+		s.mux.Handle("/", s.withLimits(s.withAuth(s.withCluster(websocket.Server{
+			Handler:   s.handleConnection,
+			Handshake: negotiateProtocol,
+		}))))
+		s.mux.Handle(proxyPath, s.withLimits(s.withAuth(websocket.Server{
+			Handler:   s.handleProxy,
+			Handshake: negotiateProtocol,
+		})))
+		s.mux.Handle(adminSessionsPath, s.withAdminAuth(http.HandlerFunc(s.handleSessions)))
+		s.mux.Handle(adminSessionsPath+"/", s.withAdminAuth(http.HandlerFunc(s.handleSessions)))
+		s.mux.Handle("/api/v1/metrics", s.withAdminAuth(http.HandlerFunc(s.handleMetrics)))
+		s.mux.Handle("/api/v1/events", s.withAdminAuth(http.HandlerFunc(s.handleEvents)))
+		s.mux.Handle("/api/v1/drain", s.withAdminAuth(http.HandlerFunc(s.handleDrain)))
+		s.mux.Handle(manageTokensPath, s.withAdminAuth(http.HandlerFunc(s.handleTokens)))
+		s.mux.Handle(manageTokensPath+"/", s.withAdminAuth(http.HandlerFunc(s.handleTokens)))
+		s.mux.Handle(managePolicyPath, s.withAdminAuth(http.HandlerFunc(s.handlePolicy)))
+		s.mux.Handle(healthzPath, http.HandlerFunc(s.handleHealthz))
+		s.mux.Handle(readyzPath, http.HandlerFunc(s.handleReadyz))
+		s.mux.Handle(openAPIPath, http.HandlerFunc(s.handleOpenAPI))
+		s.mux.Handle(accessPath, http.HandlerFunc(s.handleAccess))
+		s.mux.Handle(accessPath+"/", http.HandlerFunc(s.handleAccess))
+		s.mux.Handle(webAuthnPath, http.HandlerFunc(s.handleWebAuthn))
+		s.registerFaults()
+	})
+	return s.mux
+}
+
+// startCluster starts keeping the cluster's directory up to date
+func (s *Server) startCluster() {
+	if s.cluster != nil {
+		go s.syncCluster()
+	}
 }
 
 // withAuth wraps a handler with token authentication
 func (s *Server) withAuth(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		expectedToken := os.Getenv("WSS_AUTH_TOKEN")
-		if expectedToken == "" {
-			log.Info.Printf("WSS_AUTH_TOKEN not set")
+		// The connection span lasts until the session ends
+		ctx, conn := s.tracer.startRequestSpan(r, "connection")
+		defer conn.end()
+		conn.setAttr("remote_addr", r.RemoteAddr)
+		conn.setAttr("path", r.URL.Path)
+		r = r.WithContext(ctx)
+		trace := conn.TraceID
+
+		expectedToken := s.fullToken()
+		if expectedToken == "" && (s.launchers == nil || len(s.launchers.Tokens) == 0) {
+			log.Info.Printf("No auth token set")
+			conn.fail(fmt.Errorf("no auth token configured"))
 			http.Error(w, "Server configuration error", http.StatusInternalServerError)
 			return
 		}
 
+		s.audit.Log(AuditEvent{Event: AuditConnect, RemoteAddr: r.RemoteAddr, Path: r.URL.Path, TraceID: trace})
+
+		_, auth := startSpan(ctx, "auth")
 		token := r.URL.Query().Get("token")
 		if token == "" {
-			log.Info.Printf("Missing token from %s", r.RemoteAddr)
+			log.Info.Printf("Missing token from %s (trace %s)", r.RemoteAddr, trace)
+			s.audit.Log(AuditEvent{Event: AuditAuthFailure, RemoteAddr: r.RemoteAddr, Path: r.URL.Path, Reason: "missing token", TraceID: trace})
+			s.publishAuth(EventAuthFailure, r, "", "missing token")
+			auth.fail(fmt.Errorf("missing token"))
+			auth.end()
+			conn.fail(fmt.Errorf("unauthorized"))
 			http.Error(w, "Missing auth token", http.StatusUnauthorized)
 			return
 		}
 
-		if token != expectedToken {
-			log.Info.Printf("Invalid token from %s", r.RemoteAddr)
+		g := s.authenticate(token, expectedToken)
+		if g == nil {
+			log.Info.Printf("Invalid token from %s (trace %s)", r.RemoteAddr, trace)
+			s.audit.Log(AuditEvent{Event: AuditAuthFailure, RemoteAddr: r.RemoteAddr, Path: r.URL.Path, Reason: "invalid token", TraceID: trace})
+			s.publishAuth(EventAuthFailure, r, "", "invalid token")
+			auth.fail(fmt.Errorf("invalid token"))
+			auth.end()
+			conn.fail(fmt.Errorf("unauthorized"))
 			http.Error(w, "Invalid auth token", http.StatusUnauthorized)
 			return
 		}
+		s.audit.Log(AuditEvent{Event: AuditAuthSuccess, RemoteAddr: r.RemoteAddr, Path: r.URL.Path, Token: g.name, TraceID: trace})
+		s.publishAuth(EventAuthSuccess, r, g.name, "")
+		auth.setAttr("token", g.name)
+		auth.end()
 
-		handler.ServeHTTP(w, r)
+		handler.ServeHTTP(w, r.WithContext(withGrant(r.Context(), g)))
 	})
 }
 
+// withAdminAuth wraps a handler with token authentication, only admitting
+// tokens with full access
+func (s *Server) withAdminAuth(handler http.Handler) http.Handler {
+	return s.withAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g := grantFrom(r.Context()); g == nil || !g.full {
+			log.Info.Printf("Scoped token denied admin access from %s", r.RemoteAddr)
+			s.audit.Log(AuditEvent{Event: AuditDenied, RemoteAddr: r.RemoteAddr, Path: r.URL.Path, Reason: "admin access requires a full access token", TraceID: traceID(r.Context())})
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// authenticate maps a token to its grant, returning nil for unknown tokens
+func (s *Server) authenticate(token, expectedToken string) *grant {
+	if expectedToken != "" && token == expectedToken {
+		return &grant{name: fullTokenName, full: true}
+	}
+	if s.launchers != nil {
+		for _, t := range s.launchers.Tokens {
+			if token == t.Token {
+				return &grant{name: t.Name, launchers: t.Launchers}
+			}
+		}
+	}
+	if s.managed != nil {
+		if t, ok := s.managed.token(token); ok {
+			return &grant{name: t.Name, launchers: t.Launchers}
+		}
+	}
+	if s.access != nil {
+		return s.access.authenticate(token)
+	}
+	return nil
+}
+
 // handleConnection handles a new WebSocket connection
 func (s *Server) handleConnection(ws *websocket.Conn) {
-	// Generate session ID
-	sessionID := fmt.Sprintf("#%d", atomic.AddUint64(&s.sessionCount, 1))
-
-	// Get connection details
-	remoteAddr := ws.Request().RemoteAddr
-	localAddr := ws.Request().Host
-	log.Info.Printf("New connection %s from %s to %s", sessionID, remoteAddr, localAddr)
-
-	// Send session ID to client
-	if err := websocket.JSON.Send(ws, struct {
-		Type      string `json:"type"`
-		SessionID string `json:"session_id"`
-	}{
-		Type:      "session",
-		SessionID: sessionID,
-	}); err != nil {
-		log.Info.Printf("Failed to send session ID: %v", err)
+	// net/http recovers the panic and carries on, but someone should know
+	defer func() {
+		if r := recover(); r != nil {
+			s.publishServer(EventServerPanic, fmt.Sprint(r))
+			panic(r)
+		}
+	}()
+	if connProtocol(ws.Config()) == ProtocolV3 {
+		s.serveMux(ws)
 		return
 	}
-
-	// Start a new shell using /bin/sh
-	// This is intentionally using a basic shell for PTY functionality
-	// The shell is isolated with restricted PATH and HOME=/tmp for security
-	// nosemgrep: no-system-exec
-	cmd := exec.Command("/bin/sh")
-	cmd.Env = []string{
-		"TERM=xterm",
-		"PATH=/usr/local/bin:/usr/bin:/bin",
-		"HOME=/tmp",
-		"SHELL=/bin/sh",
-		"PS1=\\$ ",
+	conn := newTransport(ws)
+	switch t := conn.(type) {
+	case *framedTransport:
+		t.fc.faults = s.faults
+		t.fc.timeout = s.writeTimeout
+	case *rawTransport:
+		t.timeout = s.writeTimeout
 	}
-
-	// Create PTY
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		log.Info.Printf("Failed to start PTY: %v", err)
-		ws.Close()
+	if id := ws.Request().URL.Query().Get("resume"); id != "" {
+		s.resumeSession(id, conn, ws.Request())
 		return
 	}
-	defer func() {
-		ptmx.Close()
-		s.ptys.Delete(sessionID)
-	}()
-
-	// Store PTY for future use (e.g., file upload channel)
-	s.ptys.Store(sessionID, ptmx)
-
-	// Forward data in both directions
-	errc := make(chan error, 1)
-
-	// Terminal -> PTY
-	go func(ptmx *os.File, ws *websocket.Conn) {
-		_, err := io.Copy(ptmx, ws)
-		errc <- err
-	}(ptmx, ws)
-
-	// PTY -> Terminal
-	go func(ws *websocket.Conn, ptmx *os.File) {
-		_, err := io.Copy(ws, ptmx)
-		errc <- err
-	}(ws, ptmx)
-
-	// Wait for either direction to finish
-	if err := <-errc; err != nil && err != io.EOF && !isConnectionClosed(err) {
-		log.Debug.Printf("IO error %s: %v", sessionID, err)
+	if id := ws.Request().URL.Query().Get("observe"); id != "" {
+		s.observeSession(id, conn, ws.Request())
+		return
 	}
-	log.Info.Printf("Connection closed %s", sessionID)
+	s.serveSession(conn, ws.Request())
 }
 
 // isConnectionClosed checks if an error is due to normal connection closure
 func isConnectionClosed(err error) bool {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed) {
+		return true
+	}
 	return err.Error() == "use of closed network connection" ||
 		err.Error() == "EOF" ||
 		err.Error() == "websocket: close 1000 (normal)"
 }
 
+// Sessions returns the registry of active sessions
+func (s *Server) Sessions() *SessionRegistry {
+	return &s.sessions
+}
+
 // Stop gracefully shuts down the server
 func (s *Server) Stop() {
+	if s.cluster != nil {
+		s.cluster.close()
+	}
 	if s.server != nil {
 		s.server.Close()
 	}
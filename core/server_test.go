@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListenAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr, network, address string
+	}{
+		{"", "tcp", ":8081"},
+		{"127.0.0.1:9000", "tcp", "127.0.0.1:9000"},
+		{"[::1]:9000", "tcp", "[::1]:9000"},
+		{"unix:flyssh.sock", "unix", "flyssh.sock"},
+		{"/run/flyssh.sock", "unix", "/run/flyssh.sock"},
+	} {
+		s := NewServer(8081)
+		s.SetListenAddr(tt.addr)
+		if network, address := s.listenAddr(); network != tt.network || address != tt.address {
+			t.Errorf("listenAddr() for %q = %s %s, want %s %s", tt.addr, network, address, tt.network, tt.address)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flyssh.sock")
+	s := NewServer(0)
+	s.SetAuthToken("unix-token")
+	s.SetListenAddr("unix:" + path)
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, s.Handler())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://flyssh/api/v1/metrics?token=unix-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the API over the socket, got %s", resp.Status)
+	}
+
+	// A socket in use isn't taken over, but one left behind is
+	if _, err := s.listen(); err == nil {
+		t.Error("Expected listening on a socket in use to fail")
+	}
+	ln.Close()
+	ln, err = s.listen()
+	if err != nil {
+		t.Fatalf("Expected a stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+}
+
+func TestListenDualStack(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("No IPv6 loopback: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	// Without an address the server listens on every interface, reachable
+	// over IPv4 and IPv6 alike
+	s := NewServer(0)
+	s.SetAuthToken("dual-token")
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, s.Handler())
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		u := "ws://" + net.JoinHostPort(host, port) + "/"
+		mux, err := DialMux(context.Background(), u, "dual-token")
+		if err != nil {
+			t.Errorf("Expected a client to connect to %s, got %v", u, err)
+			continue
+		}
+		mux.Close()
+	}
+
+	// An IPv6 address binds only that address
+	s.SetListenAddr("[::1]:0")
+	ln6, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln6.Close()
+	if addr := ln6.Addr().(*net.TCPAddr); !addr.IP.Equal(net.IPv6loopback) {
+		t.Errorf("Expected to listen on ::1, got %s", addr)
+	}
+}
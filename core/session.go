@@ -0,0 +1,650 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// serveSession runs a terminal session over a transport. It's the single
+// session engine behind every wire protocol the server speaks.
+func (s *Server) serveSession(conn transport, r *http.Request) {
+	// Generate session ID, unique across the cluster if there is one
+	n := atomic.AddUint64(&s.sessionCount, 1)
+	sessionID := fmt.Sprintf("#%d", n)
+	if s.cluster != nil {
+		sessionID = fmt.Sprintf("#%s-%d", s.cluster.instance, n)
+	}
+
+	// Get connection details
+	remoteAddr := r.RemoteAddr
+	localAddr := r.Host
+	ctx := r.Context()
+	trace := traceID(ctx)
+	log.Info.Printf("New connection %s from %s to %s (%s, trace %s)", sessionID, remoteAddr, localAddr, conn.protocol(), trace)
+	if sp := spanFrom(ctx); sp != nil {
+		sp.setAttr("session_id", sessionID)
+		sp.setAttr("protocol", conn.protocol())
+	}
+
+	// Resolve the command to run: a shell, or a launcher if one was requested
+	user := r.URL.Query().Get("user")
+	g := grantFrom(ctx)
+	tokenName := ""
+	if g != nil {
+		tokenName = g.name
+	}
+
+	// deny refuses the session. The client is sent message, which may say
+	// less than the logged reason.
+	deny := func(reason error, message string) {
+		log.Info.Printf("Rejected session %s: %v", sessionID, reason)
+		s.audit.Log(AuditEvent{
+			Event:      AuditDenied,
+			SessionID:  sessionID,
+			RemoteAddr: remoteAddr,
+			User:       user,
+			Token:      tokenName,
+			Command:    r.URL.Query().Get("exec"),
+			Launcher:   r.URL.Query().Get("launch"),
+			Reason:     reason.Error(),
+			TraceID:    trace,
+		})
+		msg := controlMessage{Type: "error", Message: message}
+		if reason == errDraining {
+			// Clients move to the replacement, if there is one
+			_, msg.URL = s.draining()
+		}
+		if err := conn.send(msg); err != nil {
+			log.Debug.Printf("Failed to send error: %v", err)
+		}
+	}
+
+	// New sessions belong on the replacement of a draining server
+	if draining, replacement := s.draining(); draining {
+		message := errDraining.Error()
+		if replacement != "" {
+			message += ", connect to " + replacement
+		}
+		deny(errDraining, message)
+		return
+	}
+
+	_, resolve := startSpan(ctx, "session.command")
+	resolve.setAttr("launcher", r.URL.Query().Get("launch"))
+	cmd, launcher, err := s.sessionCommand(r)
+	if err != nil {
+		resolve.fail(err)
+	}
+	resolve.end()
+	if err != nil {
+		deny(err, err.Error())
+		return
+	}
+
+	// Launchers can require a security key on top of the token
+	if launcher != nil && launcher.StepUp {
+		if err := s.stepUp(ctx, conn, sessionID, r.URL.Query().Get("launch")); err != nil {
+			deny(err, err.Error())
+			return
+		}
+	}
+
+	// Dual-control launchers wait for a second person to watch the session
+	var dc *dualControl
+	if launcher != nil && launcher.DualControl {
+		dc = &dualControl{
+			owner:    tokenName,
+			launcher: r.URL.Query().Get("launch"),
+			joined:   make(chan string, 1),
+			done:     make(chan struct{}),
+		}
+		s.dualControls.add(sessionID, dc)
+		defer s.dualControls.remove(sessionID)
+		if err := s.awaitObserver(conn, sessionID, dc); err != nil {
+			deny(err, err.Error())
+			return
+		}
+	}
+
+	// Launchers aren't restricted by policy, so aren't previewed either
+	if launcher == nil {
+		if err := s.policyPreview.check(r.URL.Query().Get("exec")); err != nil {
+			s.auditPreview("session "+sessionID, AuditEvent{
+				SessionID:  sessionID,
+				RemoteAddr: remoteAddr,
+				User:       user,
+				Token:      tokenName,
+				Command:    r.URL.Query().Get("exec"),
+				TraceID:    trace,
+			}, err)
+		}
+	}
+
+	// Sessions are charged to the token's daily quota, and may only run
+	// for the time it has left
+	var allowance time.Duration
+	if quota := s.quotaFor(g); quota != (Quota{}) {
+		allowance, err = s.quotas.begin(tokenName, quota)
+		if err != nil {
+			deny(err, err.Error())
+			return
+		}
+		started := time.Now()
+		defer func() { s.quotas.end(tokenName, time.Since(started)) }()
+	}
+
+	sess := &Session{
+		ID:         sessionID,
+		User:       user,
+		RemoteAddr: remoteAddr,
+		StartTime:  time.Now(),
+		Command:    strings.Join(cmd.Args, " "),
+		Launcher:   r.URL.Query().Get("launch"),
+		token:      tokenName,
+		full:       g != nil && g.full,
+		ctl:        newSessionControl(s.scrollback),
+		cmd:        cmd,
+	}
+	if dc != nil {
+		dc.start(sess.ctl)
+	}
+
+	// Confine the command if jailing or sandboxing is enabled
+	if s.jail != nil {
+		s.jail.wrap(cmd)
+	}
+	if s.sandbox != nil {
+		cleanup, err := s.sandbox.wrap(cmd, sessionID)
+		if err != nil {
+			deny(err, "failed to set up sandbox")
+			return
+		}
+		defer cleanup()
+	}
+
+	// Each session has its own temporary directory
+	removeTmp, err := s.sessionTmp(cmd, sessionID)
+	if err != nil {
+		deny(err, "failed to set up session")
+		return
+	}
+	defer removeTmp()
+
+	// Full screen programs refuse to run on a terminal type the server has
+	// no description of, so an exotic one is swapped for a common one
+	var termNote string
+	if r.URL.Query().Get("pty") != "0" {
+		termNote = fixTerm(cmd, s.jailRoot())
+	}
+
+	// A client can forward its agent and X display, which need the
+	// control channel. The session goes ahead without any that aren't
+	// allowed.
+	var forwards []*forwardRelay
+	var refused []error
+	if conn.hasControl() {
+		var cleanup func()
+		forwards, cleanup, refused = s.startForwards(r, cmd, sess.ctl)
+		defer cleanup()
+		for _, err := range refused {
+			log.Info.Printf("Not forwarding for %s: %v", sessionID, err)
+		}
+	}
+
+	// The client's own dotfiles are written for its shell. Launchers run
+	// as configured, and jailed sessions couldn't see them.
+	if dotfiles := r.URL.Query()["dotfile"]; len(dotfiles) > 0 && launcher == nil {
+		if s.jail != nil {
+			refused = append(refused, fmt.Errorf("dotfiles aren't available in jailed sessions"))
+		} else {
+			// Sandboxed sessions only see their scratch directory, as /tmp
+			var base, seen string
+			if s.sandbox != nil {
+				base, seen = getEnv(cmd.Env, sandboxEnv), "/tmp"
+			}
+			cleanup, err := installDotfiles(cmd, dotfiles, base, seen)
+			if err != nil {
+				deny(err, err.Error())
+				return
+			}
+			defer cleanup()
+		}
+	}
+
+	// Record the session if enabled. Sessions that can't be recorded are
+	// refused, before anything runs, so the audit trail has no gaps.
+	var rec *recorder
+	if s.recordDir != "" {
+		rec, err = s.startRecording(sess, cmd.Env)
+		if err != nil {
+			deny(err, "session recording failed")
+			return
+		}
+		defer rec.Close()
+	}
+
+	// The start hook prepares the session and can refuse it
+	if err := s.hooks.runStart(ctx, sess); err != nil {
+		deny(err, "session start hook failed")
+		return
+	}
+
+	// Send session ID to client
+	if err := conn.send(controlMessage{Type: "session", SessionID: sessionID}); err != nil {
+		log.Info.Printf("Failed to send session ID: %v", err)
+		s.hooks.runEnd(ctx, sess, -1)
+		return
+	}
+	if termNote != "" {
+		conn.notice(termNote)
+	}
+	for _, err := range refused {
+		conn.notice(err.Error())
+	}
+
+	// Create PTY, or plain pipes for a command fed from a pipe or file,
+	// whose input must reach it unaltered and can end. Clients that can
+	// take its errors separately get them in control messages, keeping
+	// the output exactly what the command wrote.
+	_, execSpan := startSpan(ctx, "session.exec")
+	execSpan.setAttr("command", sess.Command)
+	var term io.ReadWriteCloser
+	var pipes *pipeTerminal
+	if r.URL.Query().Get("pty") == "0" {
+		pipes, err = startPipes(cmd, conn.hasControl() && r.URL.Query().Get("stderr") == "1")
+		term = pipes
+	} else {
+		sess.pty, err = s.startPTY(cmd)
+		term = sess.pty
+	}
+	if err != nil {
+		execSpan.fail(err)
+		execSpan.end()
+		log.Info.Printf("Failed to start PTY: %v", err)
+		conn.Close()
+		s.hooks.runEnd(ctx, sess, -1)
+		return
+	}
+	execSpan.setAttr("pid", cmd.Process.Pid)
+	execSpan.end()
+	defer func() {
+		term.Close()
+		s.sessions.Remove(sessionID)
+		s.publishSession(EventSessionEnd, sess)
+	}()
+
+	// Register session so it can be listed and killed via the admin API
+	ctl := sess.ctl
+	s.sessions.Add(sess)
+	s.publishSession(EventSessionStart, sess)
+	s.audit.Log(AuditEvent{
+		Event:      AuditExec,
+		SessionID:  sessionID,
+		RemoteAddr: remoteAddr,
+		User:       user,
+		Token:      tokenName,
+		Command:    sess.Command,
+		Launcher:   sess.Launcher,
+		TraceID:    trace,
+	})
+
+	// Enforce idle and lifetime limits, warning the client before disconnecting
+	timer := newSessionTimer(s.idleTimeout, s.maxSession)
+	timer.allowance = allowance
+	if g != nil {
+		timer.expires = g.expires
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go timer.watch(done, func(reason string) {
+		log.Info.Printf("Closing session %s: %s", sessionID, reason)
+		ctl.end()
+		ctl.notice(reason + ", disconnecting")
+		ctl.finish(nil)
+	})
+	go s.faults.watch(sess, done)
+
+	// Resize requests arrive on the control channel, if the protocol has one.
+	// A client leaving on purpose says so, so the session isn't kept for it,
+	// and one whose piped input ended says so, so the command reads EOF.
+	// Signals, such as the client's own interrupts, go to the command.
+	onControl := func(msg controlMessage) {
+		for _, relay := range forwards {
+			if relay.handle(msg) {
+				return
+			}
+		}
+		switch msg.Type {
+		case "resize":
+			if sess.pty == nil {
+				return
+			}
+			if err := sess.pty.Resize(msg.Rows, msg.Cols); err != nil {
+				log.Info.Printf("Failed to resize PTY %s: %v", sessionID, err)
+				return
+			}
+			ctl.setSize(msg.Rows, msg.Cols)
+			s.publishSession(EventSessionUpdate, sess)
+		case "eof":
+			if pipes != nil {
+				pipes.closeInput()
+			}
+		case "close":
+			ctl.end()
+		case "signal":
+			if err := signalProcess(cmd, msg.Signal); err != nil {
+				log.Info.Printf("Failed to signal %s: %v", sessionID, err)
+			}
+		case "bookmark":
+			if rec != nil {
+				rec.marker(msg.Message)
+			}
+		default:
+			log.Debug.Printf("Ignoring control message %q on %s", msg.Type, sessionID)
+		}
+	}
+
+	// PTY output goes to whichever client is attached
+	var output io.Writer = ctl
+
+	// The recording takes output too, and bookmarks are marked in it
+	if rec != nil {
+		output = io.MultiWriter(output, rec.output())
+	}
+
+	// The paste guard follows the modes the program sets, to tell a shell
+	// from a full screen program and see whether it takes bracketed pastes
+	var screen *screenTracker
+	if s.pasteGuard > 0 && sess.pty != nil {
+		screen = newScreenTracker(output)
+		output = screen
+	}
+
+	// attachInput builds the input stream of a client connection and starts
+	// checking the client is still there. Read-only launchers only pass
+	// through a few control keys.
+	// Each connection's link is measured afresh, to size output chunks.
+	// Output without a terminal is sent in the largest.
+	link := &linkStats{bulk: pipes != nil}
+	attachInput := func(conn transport) (io.Reader, *keepalive) {
+		link.reset()
+		ka := startKeepalive(conn, s.keepalive, link)
+		input := timer.reader(ka.reader(conn.input(func(msg controlMessage) {
+			if !ka.control(msg) {
+				onControl(msg)
+			}
+		})))
+		if launcher != nil {
+			input = launcher.inputFilter(input)
+		}
+		if screen != nil {
+			input = newPasteGuard(input, s.pasteGuard, screen, conn.notice)
+		}
+		if rec != nil && s.recordInput {
+			input = io.TeeReader(input, rec.input())
+		}
+		return input, ka
+	}
+
+	// Output is pumped for the whole session, across reconnects. It ends
+	// when the process exits.
+	pump := newRelayGroup(ctl.end)
+	pump.copyChunks(output, term, link) // PTY -> Terminal
+	errPump := newRelayGroup(func() {})
+	if pipes != nil && pipes.errors != nil {
+		var errOut io.Writer = stderrWriter{ctl}
+		if rec != nil {
+			errOut = io.MultiWriter(errOut, rec.output())
+		}
+		errPump.copy(errOut, pipes.errors)
+	}
+
+	att := &attachment{conn: conn, done: make(chan struct{})}
+	for resumed := false; ; resumed = true {
+		conn := att.conn
+		if resumed {
+			log.Info.Printf("Resumed session %s from %s", sessionID, conn.protocol())
+			if err := conn.send(controlMessage{Type: "session", SessionID: sessionID}); err != nil {
+				log.Debug.Printf("Failed to send session ID: %v", err)
+			}
+		}
+
+		// Forward input until the connection drops or the process exits
+		if err := ctl.attach(conn, conn.output(), att.replay); err != nil {
+			conn.Close()
+		}
+		if resumed {
+			s.publishSession(EventSessionUpdate, sess)
+			s.sendRedirect(conn)
+		}
+		relay := newRelayGroup(func() {
+			ctl.detach(conn)
+			conn.Close()
+		})
+		input, ka := attachInput(conn)
+		relay.copy(term, input) // Terminal -> PTY
+
+		exited := false
+		var err error
+		select {
+		case err = <-pump.finished():
+			exited = true
+		case err = <-relay.finished():
+		}
+		if err != nil && err != io.EOF && !isConnectionClosed(err) {
+			log.Debug.Printf("IO error %s: %v", sessionID, err)
+		}
+		if exited {
+			// Wait for the process so the client learns its exit code,
+			// after the last of its errors
+			reap(cmd, 5*time.Second)
+			errPump.drain(time.Second, sessionID)
+			ctl.finish(exitMessage(cmd))
+		}
+		ka.Stop()
+		relay.drain(5*time.Second, sessionID)
+		for _, relay := range forwards {
+			relay.closeAll()
+		}
+		close(att.done)
+
+		// Clients that can resume get a grace period after a dropped
+		// connection, unless the session is ending anyway
+		if exited || s.resumeTimeout <= 0 || !conn.hasControl() || ctl.isEnded() {
+			break
+		}
+		log.Info.Printf("Session %s detached, waiting %v for the client to resume", sessionID, s.resumeTimeout)
+		s.publishSession(EventSessionUpdate, sess)
+		next, ok := s.awaitResume(ctl, pump)
+		if !ok {
+			log.Info.Printf("Session %s was not resumed", sessionID)
+			break
+		}
+		att = next
+	}
+
+	// The session is over: make sure the process is gone and the pump has
+	// stopped
+	ctl.end()
+	hangup(cmd)
+	term.Close()
+	reap(cmd, 5*time.Second)
+	pump.drain(5*time.Second, sessionID)
+	errPump.drain(5*time.Second, sessionID)
+
+	code, signal := exitStatus(cmd)
+	s.audit.Log(AuditEvent{Event: AuditExit, SessionID: sessionID, User: user, ExitCode: &code, Signal: signal, TraceID: trace})
+	s.hooks.runEnd(ctx, sess, code)
+	if sp := spanFrom(ctx); sp != nil {
+		sp.setAttr("exit_code", code)
+	}
+	s.audit.Log(AuditEvent{
+		Event:      AuditDisconnect,
+		SessionID:  sessionID,
+		RemoteAddr: remoteAddr,
+		User:       user,
+		Duration:   time.Since(sess.StartTime).Seconds(),
+		TraceID:    trace,
+	})
+	log.Info.Printf("Connection closed %s", sessionID)
+}
+
+// awaitResume waits for a client to resume a detached session. It gives up
+// when the process exits, the session is ended or the resume window passes.
+func (s *Server) awaitResume(ctl *sessionControl, pump *relayGroup) (*attachment, bool) {
+	timer := time.NewTimer(s.resumeTimeout)
+	defer timer.Stop()
+
+	select {
+	case att := <-ctl.resume:
+		return att, true
+	case <-pump.finished():
+	case <-ctl.ended:
+	case <-timer.C:
+	}
+	return nil, false
+}
+
+// exitStatus returns the exit code of a finished command and, if it was
+// killed by a signal, the signal's name
+func exitStatus(cmd *exec.Cmd) (int, string) {
+	state := cmd.ProcessState
+	if state == nil {
+		return -1, ""
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), ws.Signal().String()
+	}
+	return state.ExitCode(), ""
+}
+
+// exitMessage returns the exit message for a finished command: its exit
+// code and, if a signal killed it, the signal, so clients can tell that
+// from the command exiting with the same code
+func exitMessage(cmd *exec.Cmd) *controlMessage {
+	code, _ := exitStatus(cmd)
+	msg := &controlMessage{Type: "exit", ExitCode: &code}
+	msg.Signal, msg.Core = exitSignal(cmd)
+	return msg
+}
+
+// sessionCommand builds the command for a new session. Tokens with full
+// access get a shell, or run a command through it, unless they request a
+// launcher; scoped tokens must request a launcher they are permitted to run.
+// Shells can be started as another user, in another directory, or be
+// another of the platform's shells.
+func (s *Server) sessionCommand(r *http.Request) (*exec.Cmd, *Launcher, error) {
+	shell := s.shell
+	if name := r.URL.Query().Get("shell"); name != "" {
+		if err := checkShell(name); err != nil {
+			return nil, nil, err
+		}
+		shell = name
+	}
+	env := shellEnv(shell)
+	// Variables the client passed override the defaults
+	for _, kv := range s.clientEnv(r) {
+		env = setEnv(env, kv)
+	}
+
+	g := grantFrom(r.Context())
+	name := r.URL.Query().Get("launch")
+	command := r.URL.Query().Get("exec")
+	login := r.URL.Query().Get("login")
+	dir := r.URL.Query().Get("dir")
+	if name != "" && command != "" {
+		return nil, nil, fmt.Errorf("a command can't be run with a launcher")
+	}
+	if name != "" && (login != "" || dir != "" || r.URL.Query().Get("shell") != "") {
+		return nil, nil, fmt.Errorf("launchers run as configured, without -login, -dir or -shell")
+	}
+	if name == "" {
+		if g == nil || !g.full {
+			return nil, nil, fmt.Errorf("token is restricted to launchers, use -launch")
+		}
+		if err := s.enforcedPolicy().check(command); err != nil {
+			return nil, nil, err
+		}
+		cmd := shellCommand(shell, command)
+		if cmd.Err != nil {
+			return nil, nil, fmt.Errorf("shell %s is not available on the server", shell)
+		}
+		cmd.Env = env
+		if login != "" {
+			if err := runAs(cmd, login); err != nil {
+				return nil, nil, err
+			}
+		}
+		if dir != "" {
+			if err := chdir(cmd, dir, s.jailRoot()); err != nil {
+				return nil, nil, err
+			}
+		}
+		return cmd, nil, nil
+	}
+
+	l, err := s.lookupLauncher(g, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Launchers run exactly the configured argv, never through a shell,
+	// other than their project environment's
+	argv := l.Command
+	project := s.projectFor(g, l)
+	if project != nil {
+		if argv, err = project.command(argv, s.jailRoot()); err != nil {
+			return nil, nil, err
+		}
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	if project != nil {
+		cmd.Dir = project.Dir
+	}
+	cmd.Env = env
+	for k, v := range l.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	return cmd, l, nil
+}
+
+// chdir starts cmd in dir, which is inside root for jailed sessions.
+// Relative directories are taken from the session's home directory.
+func chdir(cmd *exec.Cmd, dir, root string) error {
+	if !filepath.IsAbs(dir) {
+		home := "/"
+		for _, kv := range cmd.Env {
+			if v, ok := strings.CutPrefix(kv, "HOME="); ok {
+				home = v
+			}
+		}
+		dir = filepath.Join(home, dir)
+	}
+	fi, err := os.Stat(filepath.Join(root, dir))
+	if err != nil || !fi.IsDir() {
+		return fmt.Errorf("no such directory %s", dir)
+	}
+	cmd.Dir = dir
+	return nil
+}
+
+// startRecording opens a recording for a session running with env
+func (s *Server) startRecording(sess *Session, env []string) (*recorder, error) {
+	snapshot := sess.Snapshot()
+	path := recordingPath(s.recordDir, s.recordTemplate, sess)
+	rec, err := newRecorder(path, int(snapshot.Cols), int(snapshot.Rows), sess, env)
+	if err != nil {
+		return nil, err
+	}
+	log.Info.Printf("Recording session %s to %s", sess.ID, path)
+	return rec, nil
+}
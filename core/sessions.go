@@ -0,0 +1,104 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session describes an active terminal session
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartTime  time.Time `json:"start_time"`
+	Command    string    `json:"command"`
+	Launcher   string    `json:"launcher,omitempty"`
+	Rows       uint16    `json:"rows"`
+	Cols       uint16    `json:"cols"`
+	Detached   bool      `json:"detached,omitempty"`
+
+	token string // name of the token that started the session
+	full  bool   // whether that token has full access
+	ctl   *sessionControl
+	pty   PTY
+	cmd   *exec.Cmd
+}
+
+// Kill terminates the session's process and closes its connection
+func (sess *Session) Kill() error {
+	if sess.ctl != nil {
+		sess.ctl.end()
+	}
+	if sess.cmd != nil && sess.cmd.Process != nil {
+		if err := sess.cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+			return fmt.Errorf("failed to kill process for %s: %v", sess.ID, err)
+		}
+	}
+	if sess.ctl != nil {
+		sess.ctl.finish(nil)
+	}
+	return nil
+}
+
+// Snapshot returns a copy of the session with its current PTY size
+func (sess *Session) Snapshot() Session {
+	snapshot := *sess
+	if sess.ctl != nil {
+		snapshot.Detached = !sess.ctl.attached()
+		snapshot.Rows, snapshot.Cols = sess.ctl.size()
+	}
+	return snapshot
+}
+
+// SessionRegistry tracks active sessions by ID
+type SessionRegistry struct {
+	sessions sync.Map // map[string]*Session
+}
+
+// Add registers a session
+func (r *SessionRegistry) Add(sess *Session) {
+	r.sessions.Store(sess.ID, sess)
+}
+
+// Remove unregisters a session
+func (r *SessionRegistry) Remove(id string) {
+	r.sessions.Delete(id)
+}
+
+// Get looks up a session by ID. The leading "#" is optional.
+func (r *SessionRegistry) Get(id string) (*Session, bool) {
+	if !strings.HasPrefix(id, "#") {
+		id = "#" + id
+	}
+	v, ok := r.sessions.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Session), true
+}
+
+// each calls fn for every active session
+func (r *SessionRegistry) each(fn func(*Session)) {
+	r.sessions.Range(func(_, v any) bool {
+		fn(v.(*Session))
+		return true
+	})
+}
+
+// List returns a snapshot of all active sessions ordered by start time
+func (r *SessionRegistry) List() []Session {
+	list := []Session{}
+	r.sessions.Range(func(_, v any) bool {
+		list = append(list, v.(*Session).Snapshot())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+	return list
+}
@@ -0,0 +1,30 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	var r SessionRegistry
+	now := time.Now()
+	r.Add(&Session{ID: "#2", User: "bob", StartTime: now.Add(time.Second)})
+	r.Add(&Session{ID: "#1", User: "alice", StartTime: now})
+
+	if sess, ok := r.Get("1"); !ok || sess.User != "alice" {
+		t.Errorf("Expected to find session #1 without prefix, got %v", sess)
+	}
+	if _, ok := r.Get("#2"); !ok {
+		t.Error("Expected to find session #2")
+	}
+
+	list := r.List()
+	if len(list) != 2 || list[0].ID != "#1" || list[1].ID != "#2" {
+		t.Errorf("Expected sessions ordered by start time, got %v", list)
+	}
+
+	r.Remove("#1")
+	if _, ok := r.Get("#1"); ok {
+		t.Error("Expected session #1 to be removed")
+	}
+}
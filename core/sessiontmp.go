@@ -0,0 +1,77 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// sessionTmpPrefix starts the names of sessions' temporary directories
+const sessionTmpPrefix = "flyssh-session-"
+
+// SetSessionTmp sets where sessions' temporary directories are made, ""
+// for the system's, and how long each is kept after its session ends, so
+// what a session left can be looked at. Jailed sessions' are always in the
+// jail's /tmp.
+func (s *Server) SetSessionTmp(dir string, retention time.Duration) {
+	s.tmpDir = dir
+	s.tmpRetention = retention
+}
+
+// sessionTmp gives cmd a temporary directory of its own as TMPDIR, so
+// sessions on a shared host don't see each other's temporary files.
+// Sandboxed sessions have a /tmp of their own already. The returned
+// function removes the directory, once the retention period has passed.
+func (s *Server) sessionTmp(cmd *exec.Cmd, sessionID string) (func(), error) {
+	if s.sandbox != nil {
+		cmd.Env = setEnv(cmd.Env, "TMPDIR=/tmp")
+		return func() {}, nil
+	}
+	base := s.tmpDir
+	if base == "" {
+		base = os.TempDir()
+	}
+	root := s.jailRoot()
+	if root != "" {
+		base = filepath.Join(root, "/tmp")
+	}
+	name := sessionTmpPrefix + sanitizeFilename(strings.TrimPrefix(sessionID, "#")) + "-"
+	dir, err := os.MkdirTemp(base, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	if err := chownForSession(cmd, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+
+	// Jailed sessions see the directory from inside the jail
+	path := dir
+	if root != "" {
+		path = filepath.Join("/", strings.TrimPrefix(dir, root))
+	}
+	cmd.Env = setEnv(cmd.Env, "TMPDIR="+path)
+	if runtime.GOOS == "windows" {
+		cmd.Env = setEnv(cmd.Env, "TEMP="+path)
+		cmd.Env = setEnv(cmd.Env, "TMP="+path)
+	}
+
+	remove := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Info.Printf("Failed to remove temporary directory of %s: %v", sessionID, err)
+		}
+	}
+	return func() {
+		if s.tmpRetention > 0 {
+			time.AfterFunc(s.tmpRetention, remove)
+			return
+		}
+		remove()
+	}, nil
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tmpOf returns cmd's TMPDIR
+func tmpOf(cmd *exec.Cmd) string {
+	for _, kv := range cmd.Env {
+		if v, ok := strings.CutPrefix(kv, "TMPDIR="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func TestSessionTmp(t *testing.T) {
+	base := t.TempDir()
+	s := NewServer(0)
+	s.SetSessionTmp(base, 0)
+
+	first, second := exec.Command("true"), exec.Command("true")
+	removeFirst, err := s.sessionTmp(first, "#1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeSecond, err := s.sessionTmp(second, "#2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := tmpOf(first)
+	if filepath.Dir(dir) != base || !strings.HasPrefix(filepath.Base(dir), sessionTmpPrefix+"1-") {
+		t.Errorf("Expected a session directory in %s, got %q", base, dir)
+	}
+	if dir == tmpOf(second) {
+		t.Error("Expected sessions to have their own directories")
+	}
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("Expected a private directory, got %v", err)
+	}
+	removeFirst()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory to be removed at the session's end, got %v", err)
+	}
+
+	// Retained directories go later
+	s.SetSessionTmp(base, 50*time.Millisecond)
+	removeSecond()
+	if _, err := os.Stat(tmpOf(second)); err != nil {
+		t.Errorf("Expected the directory to be retained, got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(tmpOf(second)); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory to be removed after retention, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Shells sessions can run in, on the platforms in shells
+const (
+	ShellSh         = "sh"
+	ShellCmd        = "cmd"
+	ShellPowerShell = "powershell"
+	ShellPwsh       = "pwsh"
+)
+
+// powerShellExit ends a PowerShell command with the exit code of the
+// program it ran last, or 1 if it failed in PowerShell itself, rather than
+// PowerShell's own, which only says whether the last statement succeeded
+const powerShellExit = "\nif (-not $?) { if ($LASTEXITCODE) { exit $LASTEXITCODE }; exit 1 }\nexit $LASTEXITCODE"
+
+// checkShell checks that name is one of the platform's shells
+func checkShell(name string) error {
+	for _, sh := range shells {
+		if sh == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown shell %s (use %s)", name, strings.Join(shells, ", "))
+}
+
+// SetShell sets the shell sessions run in unless they ask for another:
+// sh by default on Unix, and cmd on Windows
+func (s *Server) SetShell(name string) error {
+	if err := checkShell(name); err != nil {
+		return err
+	}
+	s.shell = name
+	return nil
+}
+
+// powerShellCommand runs PowerShell, or command in it. PowerShell joins
+// the arguments after -Command into its script, so the command survives
+// the usual argument quoting.
+func powerShellCommand(exe, command string) *exec.Cmd {
+	if command == "" {
+		return exec.Command(exe, "-NoLogo")
+	}
+	return exec.Command(exe, "-NoLogo", "-Command", command+powerShellExit)
+}
+
+// ShellCommand runs command in the platform's default shell, sh on Unix
+// and cmd on Windows
+func ShellCommand(command string) *exec.Cmd {
+	return shellCommand(shells[0], command)
+}
@@ -0,0 +1,33 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShellCommand(t *testing.T) {
+	if got := shellCommand(ShellSh, "echo hi").Args; !reflect.DeepEqual(got, []string{"/bin/sh", "-c", "echo hi"}) {
+		t.Errorf("sh runs %q", got)
+	}
+	if got := shellCommand(ShellSh, "").Args; !reflect.DeepEqual(got, []string{"/bin/sh"}) {
+		t.Errorf("An interactive sh runs %q", got)
+	}
+
+	// PowerShell exits with the status of the program it ran
+	args := powerShellCommand("pwsh", "git status").Args
+	if len(args) != 4 || args[2] != "-Command" || !strings.HasPrefix(args[3], "git status\n") || !strings.HasSuffix(args[3], "exit $LASTEXITCODE") {
+		t.Errorf("pwsh runs %q", args)
+	}
+
+	s := NewServer(0)
+	if err := s.SetShell(ShellPowerShell); err == nil {
+		t.Error("Expected Windows PowerShell to be refused on Unix")
+	}
+	if err := s.SetShell(ShellPwsh); err != nil || s.shell != ShellPwsh {
+		t.Errorf("Expected pwsh to be accepted, got %v", err)
+	}
+}
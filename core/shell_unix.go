@@ -0,0 +1,44 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"os/exec"
+)
+
+// shells are the shells Unix servers run, the default first
+var shells = []string{ShellSh, ShellPwsh}
+
+// shellCommand runs the named shell, or command through it
+func shellCommand(name, command string) *exec.Cmd {
+	if name == ShellPwsh {
+		return powerShellCommand("pwsh", command)
+	}
+	// This is intentionally using a basic shell for PTY functionality
+	// nosemgrep: no-system-exec
+	cmd := exec.Command("/bin/sh")
+	if command != "" {
+		// nosemgrep: no-system-exec
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	return cmd
+}
+
+// shellEnv returns the environment sessions start with. The shell is
+// isolated with restricted PATH and HOME=/tmp for security.
+func shellEnv(name string) []string {
+	shell := "/bin/sh"
+	if name == ShellPwsh {
+		if path, err := exec.LookPath("pwsh"); err == nil {
+			shell = path
+		}
+	}
+	return []string{
+		"TERM=xterm",
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"HOME=/tmp",
+		"SHELL=" + shell,
+		"PS1=\\$ ",
+	}
+}
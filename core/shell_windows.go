@@ -0,0 +1,44 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// shells are the shells Windows servers run, the default first
+var shells = []string{ShellCmd, ShellPowerShell, ShellPwsh}
+
+// shellCommand runs the named shell, or command through it
+func shellCommand(name, command string) *exec.Cmd {
+	switch name {
+	case ShellPowerShell:
+		return powerShellCommand("powershell.exe", command)
+	case ShellPwsh:
+		return powerShellCommand("pwsh.exe", command)
+	}
+	cmd := exec.Command("cmd.exe")
+	if command != "" {
+		// cmd.exe parses its command line itself rather than as the
+		// arguments Go would quote, so the command is passed as given.
+		// With /s the quotes around it are all cmd.exe removes.
+		cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd.exe /d /s /c "` + command + `"`}
+	}
+	return cmd
+}
+
+// shellEnv returns the environment sessions start with: the variables
+// Windows programs need to find the system and its programs, from the
+// server's environment
+func shellEnv(name string) []string {
+	env := []string{"TERM=xterm"}
+	for _, k := range []string{"SystemRoot", "SystemDrive", "windir", "ComSpec", "PATH", "PATHEXT", "TEMP", "TMP", "USERPROFILE", "ProgramData", "ProgramFiles"} {
+		if v := os.Getenv(k); v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
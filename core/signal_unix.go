@@ -0,0 +1,73 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// sessionSignals are the signals a client may send a session's command,
+// and that commands are reported killed by, by their names in SSH
+var sessionSignals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// newProcessGroup starts cmd in a process group of its own, so signals
+// sent to it reach the programs it starts too. Commands on a PTY lead a
+// session of their own already.
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// exitSignal returns the SSH name of the signal that killed a finished
+// command, if one did, and whether it dumped core. Signals SSH has no name
+// for are named by number, as SIG12.
+func exitSignal(cmd *exec.Cmd) (string, bool) {
+	if cmd.ProcessState == nil {
+		return "", false
+	}
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return "", false
+	}
+	for name, sig := range sessionSignals {
+		if sig == ws.Signal() {
+			return name, ws.CoreDump()
+		}
+	}
+	return fmt.Sprintf("SIG%d", int(ws.Signal())), ws.CoreDump()
+}
+
+// signalProcess sends the named signal to cmd's process group
+func signalProcess(cmd *exec.Cmd, name string) error {
+	sig, ok := sessionSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return fmt.Errorf("unknown signal %q", name)
+	}
+	if cmd.Process == nil {
+		return fmt.Errorf("no process to signal")
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil {
+		return fmt.Errorf("failed to signal process %d: %v", cmd.Process.Pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// newProcessGroup does nothing on Windows, whose processes have no
+// process groups to signal
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// exitSignal reports no signal, since Windows processes aren't killed by
+// them
+func exitSignal(cmd *exec.Cmd) (string, bool) {
+	return "", false
+}
+
+// signalProcess ends cmd for KILL. Windows has no other signals to send.
+func signalProcess(cmd *exec.Cmd, name string) error {
+	if strings.TrimPrefix(strings.ToUpper(name), "SIG") != "KILL" {
+		return fmt.Errorf("signal %q isn't supported on Windows", name)
+	}
+	if cmd.Process == nil {
+		return fmt.Errorf("no process to signal")
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fallbackTerm is the terminal type sessions get when the server has no
+// description of the client's
+const fallbackTerm = "xterm-256color"
+
+// terminfoDirs are where terminal descriptions are looked for after
+// $TERMINFO, ~/.terminfo and $TERMINFO_DIRS, as ncurses does
+var terminfoDirs = []string{
+	"/etc/terminfo",
+	"/lib/terminfo",
+	"/usr/share/terminfo",
+	"/usr/lib/terminfo",
+	"/usr/local/share/terminfo",
+	"/usr/share/lib/terminfo",
+}
+
+// fixTerm swaps a session's terminal type for fallbackTerm if the server
+// has no description of it, since full screen programs refuse to run on
+// an unknown terminal. Paths are looked up under root, for jailed
+// sessions. It returns a note for the client when it swaps.
+func fixTerm(cmd *exec.Cmd, root string) string {
+	env := make(map[string]string)
+	for _, kv := range cmd.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		env[name] = value
+	}
+	term := env["TERM"]
+	if term == "" || term == fallbackTerm {
+		return ""
+	}
+
+	var dirs []string
+	if dir := env["TERMINFO"]; dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if home := env["HOME"]; home != "" {
+		dirs = append(dirs, filepath.Join(home, ".terminfo"))
+	}
+	for _, dir := range strings.Split(env["TERMINFO_DIRS"], ":") {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	dirs = append(dirs, terminfoDirs...)
+
+	// Without descriptions of common terminals either, there's no telling
+	if knownTerm(term, dirs, root) || !knownTerm(fallbackTerm, dirs, root) {
+		return ""
+	}
+	cmd.Env = setEnv(cmd.Env, "TERM="+fallbackTerm)
+	return fmt.Sprintf("terminal type %s is unknown on the server, using %s", term, fallbackTerm)
+}
+
+// knownTerm reports whether any of dirs describes the terminal type. Entries
+// are filed under their first letter, or its hex code on macOS.
+func knownTerm(term string, dirs []string, root string) bool {
+	if strings.ContainsAny(term, `/\`) {
+		return false
+	}
+	for _, dir := range dirs {
+		for _, sub := range []string{term[:1], fmt.Sprintf("%x", term[0])} {
+			if _, err := os.Stat(filepath.Join(root, dir, sub, term)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFixTerm(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"usr/share/terminfo/x/xterm-256color", "usr/share/terminfo/78/xterm-mac", "home/me/.terminfo/k/kitty"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755)
+		os.WriteFile(filepath.Join(root, path), nil, 0644)
+	}
+
+	tests := []struct {
+		term string
+		want string
+	}{
+		{"xterm-256color", "xterm-256color"},
+		{"xterm-mac", "xterm-mac"},
+		{"kitty", "kitty"},
+		{"xterm-exotic", fallbackTerm},
+		{"../x/xterm-256color", fallbackTerm},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("/bin/sh")
+		cmd.Env = []string{"TERM=" + tt.term, "HOME=/home/me"}
+		note := fixTerm(cmd, root)
+		if got := cmd.Env[0]; got != "TERM="+tt.want {
+			t.Errorf("fixTerm(%s) set %s, want TERM=%s", tt.term, got, tt.want)
+		}
+		if swapped := tt.want != tt.term; swapped != strings.Contains(note, "unknown on the server") {
+			t.Errorf("fixTerm(%s) noted %q", tt.term, note)
+		}
+	}
+
+	// Without a description of the fallback either, nothing can be known
+	cmd := exec.Command("/bin/sh")
+	cmd.Env = []string{"TERM=xterm-exotic"}
+	if note := fixTerm(cmd, t.TempDir()); note != "" || cmd.Env[0] != "TERM=xterm-exotic" {
+		t.Errorf("Expected TERM left alone without terminfo, got %v, %q", cmd.Env, note)
+	}
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// sessionTimer enforces idle and maximum lifetime limits for a session.
+// A zero duration disables the corresponding limit.
+type sessionTimer struct {
+	idle         time.Duration
+	maxLifetime  time.Duration
+	allowance    time.Duration // time left in the token's daily quota
+	expires      time.Time     // when a temporary token's access ends
+	start        time.Time
+	lastActivity atomic.Int64 // unix nanos of the client's last input
+}
+
+// newSessionTimer creates a timer starting now
+func newSessionTimer(idle, maxLifetime time.Duration) *sessionTimer {
+	t := &sessionTimer{
+		idle:        idle,
+		maxLifetime: maxLifetime,
+		start:       time.Now(),
+	}
+	t.touch()
+	return t
+}
+
+// touch records activity on the session. Only the client's input counts:
+// a command printing output doesn't keep an abandoned session open.
+func (t *sessionTimer) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// enabled reports whether any limit is configured
+func (t *sessionTimer) enabled() bool {
+	return t.idle > 0 || t.maxLifetime > 0 || t.allowance > 0 || !t.expires.IsZero()
+}
+
+// expired returns a human readable reason if a limit has been exceeded
+func (t *sessionTimer) expired(now time.Time) (string, bool) {
+	if t.maxLifetime > 0 && now.Sub(t.start) >= t.maxLifetime {
+		return "maximum session duration of " + t.maxLifetime.String() + " reached", true
+	}
+	if t.allowance > 0 && now.Sub(t.start) >= t.allowance {
+		return "daily time quota used", true
+	}
+	if !t.expires.IsZero() && !now.Before(t.expires) {
+		return "temporary access expired", true
+	}
+	last := time.Unix(0, t.lastActivity.Load())
+	if t.idle > 0 && now.Sub(last) >= t.idle {
+		return "session idle for " + t.idle.String(), true
+	}
+	return "", false
+}
+
+// watch checks the limits periodically until done is closed, calling
+// onExpire once with the reason when a limit is exceeded
+func (t *sessionTimer) watch(done <-chan struct{}, onExpire func(reason string)) {
+	if !t.enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if reason, ok := t.expired(now); ok {
+				onExpire(reason)
+				return
+			}
+		}
+	}
+}
+
+// reader wraps r so every successful read counts as activity
+func (t *sessionTimer) reader(r io.Reader) io.Reader {
+	return activityReader{r: r, t: t}
+}
+
+type activityReader struct {
+	r io.Reader
+	t *sessionTimer
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.t.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionTimerExpired(t *testing.T) {
+	timer := newSessionTimer(time.Minute, time.Hour)
+	now := time.Now()
+
+	if _, ok := timer.expired(now); ok {
+		t.Error("Expected fresh session not to be expired")
+	}
+	if reason, ok := timer.expired(now.Add(2 * time.Minute)); !ok {
+		t.Error("Expected idle session to be expired")
+	} else if reason != "session idle for 1m0s" {
+		t.Errorf("Unexpected reason: %s", reason)
+	}
+
+	timer.touch()
+	if _, ok := timer.expired(time.Now().Add(30 * time.Second)); ok {
+		t.Error("Expected activity to reset idle timeout")
+	}
+	if _, ok := timer.expired(now.Add(2 * time.Hour)); !ok {
+		t.Error("Expected session past max lifetime to be expired")
+	}
+}
+
+func TestSessionTimerAccessExpiry(t *testing.T) {
+	timer := newSessionTimer(0, 0)
+	timer.expires = time.Now().Add(time.Hour)
+	if !timer.enabled() {
+		t.Fatal("Expected temporary access to enable the timer")
+	}
+	if _, ok := timer.expired(time.Now()); ok {
+		t.Error("Expected a session within its access not to be expired")
+	}
+	if reason, ok := timer.expired(timer.expires); !ok || reason != "temporary access expired" {
+		t.Errorf("Expected the session to end with its access, got %q, %v", reason, ok)
+	}
+}
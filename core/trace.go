@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Tracer exports spans covering the lifecycle of a connection (accept,
+// auth, handshake, command resolution and exec) as JSON lines. Span and
+// trace IDs follow W3C Trace Context, so a traceparent header sent by a
+// proxy or client ties the session into an existing trace.
+type Tracer struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// OpenTracer appends spans to the file at path
+func OpenTracer(path string) (*Tracer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace log: %v", err)
+	}
+	return &Tracer{w: f}, nil
+}
+
+// NewTracer writes spans to w
+func NewTracer(w io.WriteCloser) *Tracer {
+	return &Tracer{w: w}
+}
+
+// Close closes the underlying writer
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.Close()
+}
+
+// export writes a finished span. Failures are reported on the info log
+// but never interrupt the session being traced.
+func (t *Tracer) export(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.w.Write(append(data, '\n')); err != nil {
+		log.Info.Printf("Failed to write span: %v", err)
+	}
+}
+
+// span is a single timed operation. Spans are created even without a
+// tracer so trace IDs can still be used to correlate logs.
+type span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_span_id,omitempty"`
+	Name       string         `json:"name"`
+	Start      time.Time      `json:"start_time"`
+	End        time.Time      `json:"end_time"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type spanKey struct{}
+
+// spanFrom returns the current span of a context, or nil
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// traceID returns the trace ID of the context's span, or "" if untraced
+func traceID(ctx context.Context) string {
+	if s := spanFrom(ctx); s != nil {
+		return s.TraceID
+	}
+	return ""
+}
+
+// startRequestSpan starts the root span of an incoming request, continuing
+// the trace from its traceparent header when there is a valid one
+func (t *Tracer) startRequestSpan(r *http.Request, name string) (context.Context, *span) {
+	s := &span{tracer: t, Name: name, Start: time.Now(), SpanID: randomID(8)}
+	if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.TraceID = traceID
+		s.ParentID = parentID
+	} else {
+		s.TraceID = randomID(16)
+	}
+	return context.WithValue(r.Context(), spanKey{}, s), s
+}
+
+// startSpan starts a child of the context's span. Without a parent it
+// starts a new, unexported trace.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	s := &span{Name: name, Start: time.Now(), SpanID: randomID(8)}
+	if parent := spanFrom(ctx); parent != nil {
+		s.tracer = parent.tracer
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = randomID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// setAttr records an attribute on the span
+func (s *span) setAttr(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]any)
+	}
+	s.Attributes[key] = value
+}
+
+// fail marks the span as failed
+func (s *span) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = "error"
+	s.Error = err.Error()
+}
+
+// end finishes the span and exports it
+func (s *span) end() {
+	s.mu.Lock()
+	s.End = time.Now()
+	if s.Status == "" {
+		s.Status = "ok"
+	}
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+
+	if s.tracer == nil {
+		return
+	}
+	if err != nil {
+		log.Info.Printf("Failed to encode span: %v", err)
+		return
+	}
+	s.tracer.export(data)
+}
+
+// parseTraceparent extracts the trace and parent span IDs from a W3C
+// traceparent header ("00-<trace id>-<span id>-<flags>")
+func parseTraceparent(h string) (string, string, bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, spanID := parts[1], parts[2]
+	if len(traceID) != 32 || len(spanID) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	for _, id := range []string{parts[0], traceID, spanID, parts[3]} {
+		if _, err := hex.DecodeString(id); err != nil || id != strings.ToLower(id) {
+			return "", "", false
+		}
+	}
+	if traceID == strings.Repeat("0", 32) || spanID == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+// randomID returns n random bytes, hex encoded
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
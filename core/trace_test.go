@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+	}
+	for _, tt := range tests {
+		traceID, spanID, ok := parseTraceparent(tt.header)
+		if ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			continue
+		}
+		if ok && (traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spanID != "00f067aa0ba902b7") {
+			t.Errorf("parseTraceparent(%q) = %q, %q", tt.header, traceID, spanID)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(nopWriteCloser{&buf})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tracer.startRequestSpan(r, "connection")
+	_, child := startSpan(ctx, "auth")
+	child.fail(errors.New("invalid token"))
+	child.end()
+	root.setAttr("remote_addr", "192.0.2.1:1234")
+	root.end()
+
+	dec := json.NewDecoder(&buf)
+	var auth, conn span
+	if err := dec.Decode(&auth); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || conn.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("connection span didn't continue the trace: %+v", &conn)
+	}
+	if auth.TraceID != conn.TraceID || auth.ParentID != conn.SpanID {
+		t.Errorf("auth span isn't a child of the connection span: %+v", &auth)
+	}
+	if auth.Status != "error" || auth.Error != "invalid token" {
+		t.Errorf("auth span status = %q %q, want error", auth.Status, auth.Error)
+	}
+	if conn.Status != "ok" || conn.Attributes["remote_addr"] != "192.0.2.1:1234" {
+		t.Errorf("unexpected connection span: %+v", &conn)
+	}
+	if conn.End.Before(conn.Start) {
+		t.Errorf("span ends before it starts: %+v", &conn)
+	}
+}
+
+func TestSpansWithoutTracer(t *testing.T) {
+	// Without a tracer spans still carry trace IDs for log correlation
+	var tracer *Tracer
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx, root := tracer.startRequestSpan(r, "connection")
+	if len(root.TraceID) != 32 || traceID(ctx) != root.TraceID {
+		t.Errorf("trace ID = %q, want a new 32 character ID", root.TraceID)
+	}
+	root.end()
+}
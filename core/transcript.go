@@ -0,0 +1,195 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A transcript is a session's output as plain text, each line stamped
+// with the time it started:
+//
+//	# session #3 on wss://server, 2024-01-02T03:04:05Z
+//	2024-01-02T03:04:06Z	$ make
+//	2024-01-02T03:04:09Z	error: missing file
+//
+// Escape sequences are stripped, and backspaces and carriage returns
+// applied to the line, so it reads as the screen did.
+const transcriptTime = time.RFC3339
+
+// Transcript parser states
+const (
+	transcriptText = iota
+	transcriptEscape
+	transcriptCSI
+	transcriptOSC
+	transcriptOSCEscape
+)
+
+// maxTranscriptLine bounds a line held while waiting for its newline
+const maxTranscriptLine = 64 * 1024
+
+// transcript appends a session's output to a transcript file
+type transcript struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	state int
+	line  []byte
+	start time.Time // when the line started
+	cr    bool      // the cursor went back to the line's start
+	now   func() time.Time
+}
+
+// newTranscript opens a transcript file for appending, starting the
+// session's part of it with a header
+func newTranscript(path string, sess *Session) (*transcript, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transcript: %v", err)
+	}
+	t := &transcript{f: f, w: bufio.NewWriter(f), now: time.Now}
+	fmt.Fprintf(t.w, "# session %s on %s, %s\n", sess.ID, sess.RemoteAddr, sess.StartTime.UTC().Format(transcriptTime))
+	return t, nil
+}
+
+// Write takes output, writing each line to the transcript once it ends
+func (t *transcript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range p {
+		t.scan(b)
+	}
+	return len(p), t.w.Flush()
+}
+
+// scan follows one byte of output
+func (t *transcript) scan(b byte) {
+	switch t.state {
+	case transcriptEscape:
+		switch b {
+		case '[':
+			t.state = transcriptCSI
+		case ']':
+			t.state = transcriptOSC
+		default:
+			t.state = transcriptText
+		}
+		return
+	case transcriptCSI:
+		// Parameters and intermediates until the final byte
+		if b >= 0x40 && b <= 0x7e {
+			t.state = transcriptText
+		}
+		return
+	case transcriptOSC:
+		switch b {
+		case '\a':
+			t.state = transcriptText
+		case 0x1b:
+			t.state = transcriptOSCEscape
+		}
+		return
+	case transcriptOSCEscape:
+		t.state = transcriptText
+		return
+	}
+
+	switch {
+	case b == 0x1b:
+		t.state = transcriptEscape
+	case b == '\n':
+		t.endLine()
+	case b == '\r':
+		// Usually before a newline; otherwise the line is redrawn, as
+		// by a progress bar, and only what ends up on it is kept
+		t.cr = true
+	case b == '\b':
+		if len(t.line) > 0 && !t.cr {
+			_, size := utf8.DecodeLastRune(t.line)
+			t.line = t.line[:len(t.line)-size]
+		}
+	case b == '\t' || b >= 0x20 && b != 0x7f:
+		if t.cr {
+			t.line, t.cr = t.line[:0], false
+		}
+		if len(t.line) == 0 {
+			t.start = t.now()
+		}
+		if len(t.line) < maxTranscriptLine {
+			t.line = append(t.line, b)
+		}
+	}
+}
+
+// endLine writes the line, if it has anything on it
+func (t *transcript) endLine() {
+	line := strings.TrimRight(string(t.line), " \t")
+	t.line, t.cr = t.line[:0], false
+	if line == "" {
+		return
+	}
+	fmt.Fprintf(t.w, "%s\t%s\n", t.start.UTC().Format(transcriptTime), strings.ToValidUTF8(line, "�"))
+}
+
+// note writes a line from flyssh itself, such as a bookmark
+func (t *transcript) note(text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "# %s %s\n", t.now().UTC().Format(transcriptTime), text)
+	t.w.Flush()
+}
+
+// Close writes the last line, if it didn't end, and closes the file
+func (t *transcript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endLine()
+	if err := t.w.Flush(); err != nil {
+		t.f.Close()
+		return fmt.Errorf("failed to write transcript: %v", err)
+	}
+	return t.f.Close()
+}
+
+// GrepTranscripts writes the lines of transcripts whose text matches re,
+// prefixed by the file's name when there's more than one, and returns how
+// many matched
+func GrepTranscripts(w io.Writer, re *regexp.Regexp, paths []string) (int, error) {
+	matches := 0
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return matches, fmt.Errorf("failed to open transcript: %v", err)
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 2*maxTranscriptLine)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			_, text, _ := strings.Cut(line, "\t")
+			if !re.MatchString(text) {
+				continue
+			}
+			matches++
+			if len(paths) > 1 {
+				fmt.Fprintf(w, "%s:", path)
+			}
+			fmt.Fprintln(w, line)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return matches, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tr, err := newTranscript(path, &Session{ID: "#3", RemoteAddr: "wss://server", StartTime: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.now = func() time.Time { return start.Add(time.Second) }
+
+	// Colours, a title, a typo corrected, a progress bar redrawn and an
+	// unfinished prompt, split across writes
+	for _, out := range []string{
+		"\x1b]0;user@host\a\x1b[1;32m$ \x1b[0mmakr",
+		"\b \be\r\n",
+		"10%\r50%\r100%\r\n",
+		"\x1b[31merror:\x1b[0m missing file\r\n\r\n",
+		"$ ",
+	} {
+		tr.Write([]byte(out))
+	}
+	tr.note("bookmark 1")
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# session #3 on wss://server, 2024-01-02T03:04:05Z\n" +
+		"2024-01-02T03:04:06Z\t$ make\n" +
+		"2024-01-02T03:04:06Z\t100%\n" +
+		"2024-01-02T03:04:06Z\terror: missing file\n" +
+		"# 2024-01-02T03:04:06Z bookmark 1\n" +
+		"2024-01-02T03:04:06Z\t$\n"
+	if string(data) != want {
+		t.Errorf("Unexpected transcript:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestGrepTranscripts(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.log")
+	b := filepath.Join(dir, "b.log")
+	os.WriteFile(a, []byte("# session #1 on ws://a, 2024-01-02T03:04:05Z\n2024-01-02T03:04:06Z\tError: disk full\n2024-01-02T03:04:07Z\tok\n"), 0600)
+	os.WriteFile(b, []byte("# session #2 on ws://b (error), 2024-01-03T03:04:05Z\n2024-01-03T03:04:06Z\tno errors\n"), 0600)
+
+	var out bytes.Buffer
+	n, err := GrepTranscripts(&out, regexp.MustCompile("(?i)error"), []string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 matches, got %d", n)
+	}
+	want := a + ":2024-01-02T03:04:06Z\tError: disk full\n" + b + ":2024-01-03T03:04:06Z\tno errors\n"
+	if out.String() != want {
+		t.Errorf("Unexpected matches %q, want %q", out.String(), want)
+	}
+
+	// One file's matches aren't prefixed, and timestamps aren't searched
+	out.Reset()
+	if n, _ := GrepTranscripts(&out, regexp.MustCompile("2024"), []string{a}); n != 0 || out.Len() != 0 {
+		t.Errorf("Expected timestamps not to match, got %q", out.String())
+	}
+	if n, _ := GrepTranscripts(&out, regexp.MustCompile("ok"), []string{a}); n != 1 || strings.HasPrefix(out.String(), a) {
+		t.Errorf("Expected one unprefixed match, got %q", out.String())
+	}
+}
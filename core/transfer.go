@@ -0,0 +1,299 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"flyssh/core/log"
+)
+
+// Transfer operations. Each runs on a flyssh.v3 channel of its own.
+const (
+	transferStat  = "stat"  // describe a file, or report that it's missing
+	transferHash  = "hash"  // hash the first Size bytes of a file
+	transferList  = "list"  // list a directory tree
+	transferGet   = "get"   // send a file from Offset on
+	transferPut   = "put"   // receive a file from Offset on
+	transferMkdir = "mkdir" // create a directory
+)
+
+// transferRequest asks for a file operation instead of a session
+type transferRequest struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"` // where get starts reading or put starts writing
+	Size   int64  `json:"size,omitempty"`   // bytes hash covers
+	Mode   uint32 `json:"mode,omitempty"`   // permissions put and mkdir create with
+}
+
+// FileInfo describes a file being transferred
+type FileInfo struct {
+	Path string `json:"path"` // relative to the listed directory in listings
+	Size int64  `json:"size"`
+	Mode uint32 `json:"mode"` // permission bits
+	Dir  bool   `json:"dir,omitempty"`
+	Hash string `json:"hash,omitempty"` // hex SHA-256 of the bytes hashed
+}
+
+// fileInfo describes fi as a FileInfo
+func fileInfo(path string, fi fs.FileInfo) *FileInfo {
+	return &FileInfo{Path: path, Size: fi.Size(), Mode: uint32(fi.Mode().Perm()), Dir: fi.IsDir()}
+}
+
+// hashPrefix returns the SHA-256 of the first n bytes of a file, and how
+// many bytes that was if the file is shorter
+func hashPrefix(path string, n int64) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	copied, err := io.Copy(h, io.LimitReader(f, n))
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), copied, nil
+}
+
+// transferReader reads a channel's data frames until the sender's eof. A
+// channel that closes first was abandoned, which ErrUnexpectedEOF reports,
+// unless the sender said why.
+type transferReader struct {
+	ch      *muxChannel
+	pending []byte
+	eof     bool
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		f, err := r.ch.next()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		switch f.typ {
+		case frameData:
+			r.pending = f.payload
+		case frameControl:
+			var msg controlMessage
+			if err := json.Unmarshal(f.payload, &msg); err != nil {
+				return 0, fmt.Errorf("invalid control message: %v", err)
+			}
+			switch msg.Type {
+			case "eof":
+				r.eof = true
+			case "error":
+				return 0, errors.New(msg.Message)
+			}
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// transfersAllowed returns an error if file transfers aren't permitted:
+// they need a full access token, and can't be confined by a jail, sandbox
+// or command policy the way sessions are
+func (s *Server) transfersAllowed(g *grant) error {
+	if g == nil || !g.full {
+		return fmt.Errorf("file transfers need a full access token")
+	}
+	if s.jail != nil || s.sandbox != nil {
+		return fmt.Errorf("file transfers are not available on confined servers")
+	}
+	return s.enforcedPolicy().checkTransfers()
+}
+
+// serveTransfer runs a file operation on a channel. Paths are the
+// server's, relative ones taken from its working directory, where shells
+// start too.
+func (s *Server) serveTransfer(ch *muxChannel, r *http.Request, req *transferRequest) {
+	defer ch.Close()
+	g := grantFrom(r.Context())
+	tokenName := ""
+	if g != nil {
+		tokenName = g.name
+	}
+	fail := func(err error) {
+		log.Info.Printf("Transfer %s %s from %s failed: %v", req.Op, req.Path, r.RemoteAddr, err)
+		if err := ch.send(controlMessage{Type: "error", Message: err.Error()}); err != nil {
+			log.Debug.Printf("Failed to send error: %v", err)
+		}
+	}
+	if err := s.transfersAllowed(g); err != nil {
+		s.audit.Log(AuditEvent{Event: AuditDenied, RemoteAddr: r.RemoteAddr, Token: tokenName, File: req.Path, Reason: err.Error(), TraceID: traceID(r.Context())})
+		fail(err)
+		return
+	}
+	if req.Path == "" {
+		fail(fmt.Errorf("no path given"))
+		return
+	}
+
+	switch req.Op {
+	case transferGet, transferPut, transferMkdir:
+		ev := AuditEvent{
+			Event:      AuditTransfer,
+			RemoteAddr: r.RemoteAddr,
+			User:       r.URL.Query().Get("user"),
+			Token:      tokenName,
+			Command:    req.Op,
+			File:       req.Path,
+			TraceID:    traceID(r.Context()),
+		}
+		s.audit.Log(ev)
+		if err := s.policyPreview.checkTransfers(); err != nil {
+			s.auditPreview("transfer of "+req.Path, ev, err)
+		}
+	}
+
+	reply := controlMessage{Type: "transfer"}
+	var err error
+	switch req.Op {
+	case transferStat:
+		var fi fs.FileInfo
+		if fi, err = os.Stat(req.Path); err == nil {
+			reply.File = fileInfo(req.Path, fi)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			err = nil // no file in the reply says so
+		}
+	case transferHash:
+		file := &FileInfo{Path: req.Path}
+		file.Hash, file.Size, err = hashPrefix(req.Path, req.Size)
+		reply.File = file
+	case transferList:
+		reply.Files, err = listTree(req.Path)
+	case transferMkdir:
+		err = os.MkdirAll(req.Path, fs.FileMode(req.Mode).Perm()|0700)
+	case transferGet:
+		err = sendFile(ch, req)
+		if err == nil {
+			log.Info.Printf("Sent %s to %s", req.Path, r.RemoteAddr)
+			return
+		}
+	case transferPut:
+		reply.File, err = receiveFile(ch, req)
+		if err == nil {
+			log.Info.Printf("Received %s from %s", req.Path, r.RemoteAddr)
+		}
+	default:
+		err = fmt.Errorf("unknown transfer operation %q", req.Op)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := ch.send(reply); err != nil {
+		log.Debug.Printf("Failed to send transfer reply: %v", err)
+	}
+}
+
+// listTree lists a directory and everything under it, directories before
+// their contents. Symlinked files are listed as files; symlinked
+// directories are skipped so loops can't trap the walk.
+func listTree(root string) ([]FileInfo, error) {
+	var files []FileInfo
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			if !d.IsDir() {
+				return fmt.Errorf("%s is not a directory", root)
+			}
+			return nil
+		}
+		fi, err := os.Stat(path)
+		if err != nil || (fi.IsDir() && !d.IsDir()) || !(fi.IsDir() || fi.Mode().IsRegular()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, *fileInfo(filepath.ToSlash(rel), fi))
+		return nil
+	})
+	return files, err
+}
+
+// sendFile answers a get: the file's details, then its contents from the
+// requested offset, then eof
+func sendFile(ch *muxChannel, req *transferRequest) error {
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", req.Path)
+	}
+	if req.Offset < 0 || req.Offset > fi.Size() {
+		return fmt.Errorf("offset %d is outside %s", req.Offset, req.Path)
+	}
+	if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := ch.send(controlMessage{Type: "transfer", File: fileInfo(req.Path, fi)}); err != nil {
+		return err
+	}
+	// The client checks it got the whole file, so a file changing as it's
+	// read is sent as far as it goes
+	if _, err := io.Copy(ch, io.LimitReader(f, fi.Size()-req.Offset)); err != nil {
+		return err
+	}
+	return ch.send(controlMessage{Type: "eof"})
+}
+
+// receiveFile answers a put: once the client is told to go ahead, it
+// writes what arrives from the requested offset on, and describes the
+// result. A put that's cut short leaves what arrived, to be resumed.
+func receiveFile(ch *muxChannel, req *transferRequest) (*FileInfo, error) {
+	f, err := os.OpenFile(req.Path, os.O_WRONLY|os.O_CREATE, fs.FileMode(req.Mode).Perm())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if req.Offset < 0 || req.Offset > fi.Size() {
+		return nil, fmt.Errorf("offset %d is outside %s", req.Offset, req.Path)
+	}
+	if err := f.Truncate(req.Offset); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := ch.send(controlMessage{Type: "transfer"}); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, &transferReader{ch: ch}); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if fi, err = f.Stat(); err != nil {
+		return nil, err
+	}
+	return fileInfo(req.Path, fi), nil
+}
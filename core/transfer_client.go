@@ -0,0 +1,366 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// transferChunk is the most file data sent in one frame
+const transferChunk = 32 << 10
+
+// Transfer copies files to and from a server over a multiplexed
+// connection. A copy cut short is resumed by the next copy of the same
+// file: when the destination holds the start of the source, checked by
+// hash, only the rest is sent.
+type Transfer struct {
+	mux       *MuxClient
+	recursive bool
+	progress  io.Writer // nil for no progress display
+}
+
+// NewTransfer creates a transfer over mux
+func NewTransfer(mux *MuxClient) *Transfer {
+	return &Transfer{mux: mux}
+}
+
+// SetRecursive lets directories be copied with everything in them
+func (t *Transfer) SetRecursive(recursive bool) {
+	t.recursive = recursive
+}
+
+// SetProgress shows each file's progress on w, which should be a terminal
+func (t *Transfer) SetProgress(w io.Writer) {
+	t.progress = w
+}
+
+// request runs a file operation on a channel of its own, returning the
+// channel and the server's first reply. The caller closes the channel.
+func (t *Transfer) request(req transferRequest) (*muxChannel, controlMessage, error) {
+	ch, err := t.mux.m.newChannel(t.mux.newID())
+	if err != nil {
+		return nil, controlMessage{}, err
+	}
+	if err := ch.send(controlMessage{Type: "open", Transfer: &req}); err != nil {
+		ch.shutdown(false)
+		return nil, controlMessage{}, fmt.Errorf("failed to send %s request: %v", req.Op, err)
+	}
+	reply, err := ch.receive()
+	if err != nil {
+		ch.Close()
+		return nil, controlMessage{}, fmt.Errorf("%s %s: no reply from server: %v", req.Op, req.Path, err)
+	}
+	if reply.Type == "error" {
+		ch.Close()
+		return nil, controlMessage{}, fmt.Errorf("%s: %s", req.Path, reply.Message)
+	}
+	if reply.Type != "transfer" {
+		ch.Close()
+		return nil, controlMessage{}, fmt.Errorf("expected transfer message, got %s", reply.Type)
+	}
+	return ch, reply, nil
+}
+
+// call runs a file operation that completes with its first reply
+func (t *Transfer) call(req transferRequest) (controlMessage, error) {
+	ch, reply, err := t.request(req)
+	if err != nil {
+		return reply, err
+	}
+	ch.Close()
+	return reply, nil
+}
+
+// stat describes a file on the server, or returns nil if it doesn't exist
+func (t *Transfer) stat(remote string) (*FileInfo, error) {
+	reply, err := t.call(transferRequest{Op: transferStat, Path: remote})
+	return reply.File, err
+}
+
+// resumeOffset returns how much of a file the destination already holds:
+// its size, if that's no more than the source's and it matches the start
+// of the source, and otherwise zero
+func (t *Transfer) resumeOffset(local, remote string, have, want int64) (int64, error) {
+	if have <= 0 || have > want {
+		return 0, nil
+	}
+	reply, err := t.call(transferRequest{Op: transferHash, Path: remote, Size: have})
+	if err != nil {
+		return 0, err
+	}
+	hash, n, err := hashPrefix(local, have)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", local, err)
+	}
+	if n != have || reply.File == nil || reply.File.Size != have || reply.File.Hash != hash {
+		return 0, nil
+	}
+	return have, nil
+}
+
+// Upload copies a local file, or with recursion a directory, to the
+// server. A remote directory receives it under its own name.
+func (t *Transfer) Upload(local, remote string) error {
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && !t.recursive {
+		return fmt.Errorf("%s is a directory (use -r)", local)
+	}
+	target, err := t.stat(remote)
+	if err != nil {
+		return err
+	}
+	if target != nil && target.Dir {
+		remote = path.Join(remote, filepath.Base(filepath.Clean(local)))
+	}
+	if !fi.IsDir() {
+		return t.put(local, remote, fi)
+	}
+
+	return filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(remote, filepath.ToSlash(rel))
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir() && !d.IsDir():
+			return nil // symlinked directories could loop
+		case fi.IsDir():
+			_, err = t.call(transferRequest{Op: transferMkdir, Path: dest, Mode: uint32(fi.Mode().Perm())})
+			return err
+		case fi.Mode().IsRegular():
+			return t.put(p, dest, fi)
+		}
+		return nil
+	})
+}
+
+// put uploads one file
+func (t *Transfer) put(local, remote string, fi fs.FileInfo) error {
+	var offset int64
+	existing, err := t.stat(remote)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.Dir {
+			return fmt.Errorf("%s is a directory", remote)
+		}
+		if offset, err = t.resumeOffset(local, remote, existing.Size, fi.Size()); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	ch, _, err := t.request(transferRequest{Op: transferPut, Path: remote, Offset: offset, Mode: uint32(fi.Mode().Perm())})
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	prog := t.startProgress(filepath.Base(local), fi.Size(), offset)
+	defer prog.finish()
+	buf := make([]byte, transferChunk)
+	if _, err := io.CopyBuffer(io.MultiWriter(ch, prog), io.LimitReader(f, fi.Size()-offset), buf); err != nil {
+		return fmt.Errorf("failed to send %s: %v", local, err)
+	}
+	if err := ch.send(controlMessage{Type: "eof"}); err != nil {
+		return fmt.Errorf("failed to send %s: %v", local, err)
+	}
+	reply, err := ch.receive()
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %v", local, err)
+	}
+	if reply.Type == "error" {
+		return fmt.Errorf("%s: %s", remote, reply.Message)
+	}
+	if reply.File == nil || reply.File.Size != fi.Size() {
+		return fmt.Errorf("failed to send %s: server didn't get all of it", local)
+	}
+	return nil
+}
+
+// Download copies a file, or with recursion a directory, from the server.
+// A local directory receives it under its own name.
+func (t *Transfer) Download(remote, local string) error {
+	fi, err := t.stat(remote)
+	if err != nil {
+		return err
+	}
+	if fi == nil {
+		return fmt.Errorf("%s: no such file or directory", remote)
+	}
+	if fi.Dir && !t.recursive {
+		return fmt.Errorf("%s is a directory (use -r)", remote)
+	}
+	if lfi, err := os.Stat(local); err == nil && lfi.IsDir() {
+		local = filepath.Join(local, path.Base(strings.TrimSuffix(remote, "/")))
+	}
+	if !fi.Dir {
+		return t.get(remote, local, fi)
+	}
+
+	reply, err := t.call(transferRequest{Op: transferList, Path: remote})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(local, fs.FileMode(fi.Mode).Perm()|0700); err != nil {
+		return err
+	}
+	for i := range reply.Files {
+		entry := &reply.Files[i]
+		dest := filepath.Join(local, filepath.FromSlash(entry.Path))
+		// The server's paths must stay inside the destination
+		if rel, err := filepath.Rel(local, dest); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("server listed %s, outside %s", entry.Path, remote)
+		}
+		if entry.Dir {
+			if err := os.MkdirAll(dest, fs.FileMode(entry.Mode).Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := t.get(path.Join(remote, entry.Path), dest, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get downloads one file
+func (t *Transfer) get(remote, local string, fi *FileInfo) error {
+	var offset int64
+	if lfi, err := os.Stat(local); err == nil {
+		if lfi.IsDir() {
+			return fmt.Errorf("%s is a directory", local)
+		}
+		if offset, err = t.resumeOffset(local, remote, lfi.Size(), fi.Size); err != nil {
+			return err
+		}
+	}
+
+	// Only permission bits are taken from the server, never setuid and
+	// the like
+	f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE, fs.FileMode(fi.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	ch, reply, err := t.request(transferRequest{Op: transferGet, Path: remote, Offset: offset})
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if reply.File == nil {
+		return fmt.Errorf("failed to receive %s: server didn't say how big it is", remote)
+	}
+
+	size := reply.File.Size
+	prog := t.startProgress(path.Base(remote), size, offset)
+	defer prog.finish()
+	n, err := io.Copy(io.MultiWriter(f, prog), &transferReader{ch: ch})
+	if err != nil {
+		return fmt.Errorf("failed to receive %s: %v", remote, err)
+	}
+	if offset+n != size {
+		return fmt.Errorf("failed to receive %s: got %d of %d bytes", remote, offset+n, size)
+	}
+	return f.Sync()
+}
+
+// progress shows a file's transfer on one terminal line, redrawn as it
+// goes
+type progress struct {
+	w           io.Writer
+	name        string
+	total, done int64
+	resumed     int64
+	start, last time.Time
+}
+
+// startProgress starts showing a file's progress, if enabled
+func (t *Transfer) startProgress(name string, total, resumed int64) *progress {
+	p := &progress{w: t.progress, name: name, total: total, done: resumed, resumed: resumed, start: time.Now()}
+	p.draw()
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.last) >= 100*time.Millisecond {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+// finish draws the final state, however far the transfer got, and ends
+// the line
+func (p *progress) finish() {
+	p.draw()
+	if p.w != nil {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *progress) draw() {
+	if p.w == nil {
+		return
+	}
+	p.last = time.Now()
+	percent := int64(100)
+	if p.total > 0 {
+		percent = p.done * 100 / p.total
+	}
+	rate := float64(p.done-p.resumed) / max(time.Since(p.start).Seconds(), 0.001)
+	note := ""
+	if p.resumed > 0 {
+		note = " (resumed)"
+	}
+	name := p.name
+	if len(name) > 32 {
+		name = name[:29] + "..."
+	}
+	fmt.Fprintf(p.w, "\r%-32s %3d%% %9s %9s/s%s\x1b[K", name, percent, formatBytes(float64(p.done)), formatBytes(rate), note)
+}
+
+// formatBytes formats a byte count for people
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
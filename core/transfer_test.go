@@ -0,0 +1,78 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, []byte("hello, world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	hash, n, err := hashPrefix(path, 5)
+	if err != nil || n != 5 || hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("hashPrefix(5) = %s, %d, %v", hash, n, err)
+	}
+
+	// A prefix longer than the file covers what there is
+	sum = sha256.Sum256([]byte("hello, world"))
+	hash, n, err = hashPrefix(path, 100)
+	if err != nil || n != 12 || hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("hashPrefix(100) = %s, %d, %v", hash, n, err)
+	}
+}
+
+func TestTransfersAllowed(t *testing.T) {
+	full := &grant{name: "admin", full: true}
+	s := NewServer(0)
+	if err := s.transfersAllowed(full); err != nil {
+		t.Errorf("Expected transfers with a full token, got %v", err)
+	}
+	if err := s.transfersAllowed(&grant{name: "scoped", launchers: []string{"logs"}}); err == nil {
+		t.Error("Expected scoped tokens to be refused")
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"deny": ["rm *"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPolicy(p)
+	if err := s.transfersAllowed(full); err != nil {
+		t.Errorf("Expected a deny-only policy to allow transfers, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"allow": ["ls"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = LoadPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+	s.SetPolicy(p)
+	if err := s.transfersAllowed(full); err == nil {
+		t.Error("Expected an allow list to refuse transfers")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[float64]string{
+		0:       "0B",
+		1023:    "1023B",
+		1536:    "1.5KB",
+		5 << 20: "5.0MB",
+		3 << 30: "3.0GB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%v) = %q, want %q", n, got, want)
+		}
+	}
+}
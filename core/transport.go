@@ -0,0 +1,130 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"flyssh/core/log"
+
+	"golang.org/x/net/websocket"
+)
+
+// transport carries one terminal session over a connection. The session
+// engine only talks to this interface, so resize, auth and lifecycle
+// behavior is the same whichever wire protocol the peer negotiated.
+type transport interface {
+	// protocol returns the negotiated subprotocol name
+	protocol() string
+
+	// hasControl reports whether control messages can be sent once the
+	// terminal stream has started
+	hasControl() bool
+
+	// send delivers a control message
+	send(msg controlMessage) error
+
+	// receive waits for the next control message. It's only used before
+	// the terminal stream starts.
+	receive() (controlMessage, error)
+
+	// notice shows a message to the user
+	notice(message string)
+
+	// input returns the incoming terminal stream. Control messages that
+	// arrive in-band are passed to onControl.
+	input(onControl func(controlMessage)) io.Reader
+
+	// output returns the outgoing terminal stream
+	output() io.Writer
+
+	// Close closes the underlying connection
+	Close() error
+}
+
+// newTransport wraps a WebSocket in the transport for its negotiated protocol
+func newTransport(ws *websocket.Conn) transport {
+	if connProtocol(ws.Config()) == ProtocolV2 {
+		return &framedTransport{ws: ws, fc: newFrameConn(ws)}
+	}
+	return &rawTransport{ws: ws}
+}
+
+// rawTransport implements flyssh.v1: JSON messages before the stream
+// starts, then raw bytes with no control channel
+type rawTransport struct {
+	ws      *websocket.Conn
+	timeout time.Duration // how long an output write may take, 0 for no limit
+}
+
+func (t *rawTransport) protocol() string { return ProtocolV1 }
+
+func (t *rawTransport) hasControl() bool { return false }
+
+func (t *rawTransport) send(msg controlMessage) error {
+	return websocket.JSON.Send(t.ws, msg)
+}
+
+func (t *rawTransport) receive() (controlMessage, error) {
+	var msg controlMessage
+	err := websocket.JSON.Receive(t.ws, &msg)
+	return msg, err
+}
+
+// notice writes the message into the terminal stream, since v1 has no
+// other way to reach the user
+func (t *rawTransport) notice(message string) {
+	if _, err := fmt.Fprintf(t.ws, "\r\n[flyssh] %s\r\n", message); err != nil {
+		log.Debug.Printf("Failed to send notice: %v", err)
+	}
+}
+
+func (t *rawTransport) input(func(controlMessage)) io.Reader { return t.ws }
+
+func (t *rawTransport) output() io.Writer { return deadlineWriter{t.ws, t.timeout} }
+
+func (t *rawTransport) Close() error { return t.ws.Close() }
+
+// framedTransport implements flyssh.v2 with separate data and control frames
+type framedTransport struct {
+	ws *websocket.Conn
+	fc *frameConn
+}
+
+func (t *framedTransport) protocol() string { return ProtocolV2 }
+
+func (t *framedTransport) hasControl() bool { return true }
+
+func (t *framedTransport) send(msg controlMessage) error {
+	return t.fc.writeControl(msg)
+}
+
+func (t *framedTransport) receive() (controlMessage, error) {
+	var msg controlMessage
+	typ, payload, err := t.fc.readFrame()
+	if err != nil {
+		return msg, err
+	}
+	if typ != frameControl {
+		return msg, fmt.Errorf("expected control frame, got type %d", typ)
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return msg, fmt.Errorf("invalid control message: %v", err)
+	}
+	return msg, nil
+}
+
+func (t *framedTransport) notice(message string) {
+	if err := t.fc.writeControl(controlMessage{Type: "notice", Message: message}); err != nil {
+		log.Debug.Printf("Failed to send notice: %v", err)
+	}
+}
+
+func (t *framedTransport) input(onControl func(controlMessage)) io.Reader {
+	return t.fc.dataReader(onControl)
+}
+
+func (t *framedTransport) output() io.Writer { return t.fc }
+
+func (t *framedTransport) Close() error { return t.ws.Close() }
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// upgradeEnv tells a server started by Upgrade which file descriptor the
+// old server hands its listener over on
+const upgradeEnv = "FLYSSH_UPGRADE_FD"
+
+// upgradeTimeout is how long the new server has to take over the listener
+const upgradeTimeout = 30 * time.Second
+
+// upgrading reports whether this server was started by an upgrade, and
+// has yet to take over the old server's listener
+func upgrading() bool {
+	return os.Getenv(upgradeEnv) != ""
+}
+
+// waitSessions waits for the sessions of a server that has handed its
+// listener over to end, or for ctx to be done
+func (s *Server) waitSessions(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		n := len(s.sessions.List())
+		if n == 0 {
+			log.Info.Printf("Sessions drained, exiting")
+			return
+		}
+		log.Debug.Printf("Waiting for %d sessions to end", n)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
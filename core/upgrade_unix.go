@@ -0,0 +1,229 @@
+//go:build unix
+// +build unix
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// Listen listens on the server's port or, in a server started by Upgrade,
+// takes over the old server's listener and tells it this server is ready.
+// With activation, the port only opens once activated.
+func (s *Server) Listen() (net.Listener, error) {
+	if s.activation != nil {
+		network, address := s.listenAddr()
+		if network != "tcp" {
+			return nil, fmt.Errorf("activation needs a TCP address, not %s", address)
+		}
+		return s.activation.listen(address)
+	}
+	if !upgrading() {
+		return s.listen()
+	}
+	fd, err := strconv.Atoi(os.Getenv(upgradeEnv))
+	// Sessions and later upgrades mustn't see it
+	os.Unsetenv(upgradeEnv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", upgradeEnv, err)
+	}
+	conn, err := unixConn(os.NewFile(uintptr(fd), "upgrade"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over listener: %v", err)
+	}
+	defer conn.Close()
+	ln, err := receiveListener(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over listener: %v", err)
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to tell the old server we're ready: %v", err)
+	}
+	log.Info.Printf("Took over listener on %s from the old server", ln.Addr())
+	return ln, nil
+}
+
+// Upgrade replaces the server with a new copy of its binary, run with the
+// same arguments, without dropping sessions. The new server takes over ln,
+// passed to it over a Unix socket, and once it's ready this one stops
+// accepting connections; Serve returns when its sessions have ended. If
+// the new server doesn't start, this one carries on as it was. Waiting
+// for the HTTP server to shut down stops when ctx is done.
+func (s *Server) Upgrade(ctx context.Context, ln net.Listener) error {
+	if s.server == nil {
+		return fmt.Errorf("server isn't serving")
+	}
+	if !s.upgrading.CompareAndSwap(false, true) {
+		return fmt.Errorf("already upgrading")
+	}
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			s.upgrading.Store(false)
+		}
+	}()
+
+	fileListener, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("can't hand over a %T", ln)
+	}
+	lnFile, err := fileListener.File()
+	if err != nil {
+		return fmt.Errorf("failed to get listener's file: %v", err)
+	}
+	defer lnFile.Close()
+
+	ours, theirs, err := socketPair()
+	if err != nil {
+		return fmt.Errorf("failed to create socket pair: %v", err)
+	}
+	conn, err := unixConn(ours)
+	if err != nil {
+		theirs.Close()
+		return fmt.Errorf("failed to create socket pair: %v", err)
+	}
+	defer conn.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		theirs.Close()
+		return fmt.Errorf("failed to find server binary: %v", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeEnv+"=3")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{theirs}
+	err = cmd.Start()
+	theirs.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new server: %v", err)
+	}
+
+	// The new server acknowledges the listener once it's ready, or exits
+	// and so closes the socket
+	rights := syscall.UnixRights(int(lnFile.Fd()))
+	if _, _, err = conn.WriteMsgUnix([]byte{0}, rights, nil); err == nil {
+		conn.SetReadDeadline(time.Now().Add(upgradeTimeout))
+		_, err = io.ReadFull(conn, make([]byte, 1))
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new server didn't start: %v", err)
+	}
+
+	handedOff = true
+	log.Info.Printf("Handed listener to new server (pid %d), draining %d sessions", cmd.Process.Pid, len(s.sessions.List()))
+	cmd.Process.Release()
+	s.upgraded.Store(true)
+	// Sessions' connections have been taken from the HTTP server, so
+	// carry on after it shuts down. Requests still going when it's been
+	// given long enough are cut off.
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, upgradeTimeout)
+		defer cancel()
+		if err := s.server.Shutdown(ctx); err != nil {
+			s.server.Close()
+		}
+	}()
+	return nil
+}
+
+// UpgradeOnSignal upgrades the server, as Upgrade does, on SIGUSR2 until
+// ctx is done
+func (s *Server) UpgradeOnSignal(ctx context.Context, ln net.Listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				log.Info.Printf("Upgrading on SIGUSR2")
+				if err := s.Upgrade(ctx, ln); err != nil {
+					log.Info.Printf("Upgrade failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// socketPair returns two connected Unix sockets, ours closed on exec
+func socketPair() (ours, theirs *os.File, err error) {
+	fds, err := cloexecSocketpair()
+	if err != nil {
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "upgrade"), os.NewFile(uintptr(fds[1]), "upgrade"), nil
+}
+
+// cloexecSocketpair makes a socket pair closed on exec, holding off
+// forks until it is, so no child inherits it
+func cloexecSocketpair() ([2]int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return fds, err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	return fds, nil
+}
+
+// unixConn makes a Unix socket's file a connection, closing the file
+func unixConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("not a Unix socket")
+	}
+	return uc, nil
+}
+
+// receiveListener receives a listener's file descriptor sent by Upgrade
+func receiveListener(conn *net.UnixConn) (net.Listener, error) {
+	conn.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("no listener sent")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, fmt.Errorf("expected one listener, got %d", len(fds))
+	}
+	f := os.NewFile(uintptr(fds[0]), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Listen listens on the server's port or, with activation, returns a
+// listener whose port only opens once activated
+func (s *Server) Listen() (net.Listener, error) {
+	if s.activation != nil {
+		network, address := s.listenAddr()
+		if network != "tcp" {
+			return nil, fmt.Errorf("activation needs a TCP address, not %s", address)
+		}
+		return s.activation.listen(address)
+	}
+	return s.listen()
+}
+
+// Upgrade isn't supported on Windows, which can't pass sockets to a new
+// process as Unix does; restart the service instead
+func (s *Server) Upgrade(ctx context.Context, ln net.Listener) error {
+	return fmt.Errorf("hot upgrades aren't supported on Windows")
+}
+
+// UpgradeOnSignal does nothing on Windows, which has no SIGUSR2
+func (s *Server) UpgradeOnSignal(ctx context.Context, ln net.Listener) {}
@@ -0,0 +1,374 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"flyssh/core/log"
+)
+
+// stepUpTimeout is how long a session waits for its step-up
+const stepUpTimeout = 2 * time.Minute
+
+// webAuthnPath is where the browser side of step-up is served
+const webAuthnPath = "/webauthn/"
+
+// WebAuthn configures step-up authentication with security keys, which
+// launchers marked step_up require before their session starts. The
+// client opens a page on the server in the user's browser, which asks for
+// an assertion from one of the registered credentials. Browsers only give
+// assertions to pages on the origin the credential was registered for,
+// which a phishing site can't be.
+type WebAuthn struct {
+	Origin      string               `json:"origin"`          // the server's URL as browsers reach it, e.g. https://ssh.example.com
+	RPID        string               `json:"rp_id,omitempty"` // relying party ID, the origin's host by default
+	Credentials []WebAuthnCredential `json:"credentials"`
+}
+
+// WebAuthnCredential is a registered security key, as shown by the
+// server's /webauthn/register page
+type WebAuthnCredential struct {
+	Name      string `json:"name"`
+	ID        string `json:"id"`         // credential ID, base64url
+	PublicKey string `json:"public_key"` // SubjectPublicKeyInfo, base64
+
+	key crypto.PublicKey
+}
+
+// check validates the config, filling in the default RP ID and parsing
+// the credentials' keys
+func (w *WebAuthn) check() error {
+	u, err := url.Parse(w.Origin)
+	if err != nil || u.Host == "" || u.Path != "" {
+		return fmt.Errorf("webauthn origin %q is not a URL with only a scheme and host", w.Origin)
+	}
+	// Browsers only allow WebAuthn on secure origins, and localhost
+	if u.Scheme != "https" && !(u.Scheme == "http" && u.Hostname() == "localhost") {
+		return fmt.Errorf("webauthn origin %q must be https", w.Origin)
+	}
+	if w.RPID == "" {
+		w.RPID = u.Hostname()
+	}
+	if len(w.Credentials) == 0 {
+		return fmt.Errorf("webauthn has no credentials")
+	}
+	for i := range w.Credentials {
+		c := &w.Credentials[i]
+		if _, err := base64.RawURLEncoding.DecodeString(c.ID); err != nil || c.ID == "" {
+			return fmt.Errorf("webauthn credential %q has an invalid id", c.Name)
+		}
+		der, err := base64.StdEncoding.DecodeString(c.PublicKey)
+		if err != nil {
+			return fmt.Errorf("webauthn credential %q has an invalid public key: %v", c.Name, err)
+		}
+		if c.key, err = x509.ParsePKIXPublicKey(der); err != nil {
+			return fmt.Errorf("webauthn credential %q has an invalid public key: %v", c.Name, err)
+		}
+		switch c.key.(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+		default:
+			return fmt.Errorf("webauthn credential %q has an unsupported %T key", c.Name, c.key)
+		}
+	}
+	return nil
+}
+
+// webAuthnAssertion is what the step-up page posts back: the parts of the
+// browser's assertion, base64url encoded
+type webAuthnAssertion struct {
+	ID                string `json:"id"`
+	ClientData        string `json:"client_data"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+}
+
+// verify checks an assertion made for challenge, returning the credential
+// that made it and its signature counter
+func (w *WebAuthn) verify(a webAuthnAssertion, challenge []byte) (*WebAuthnCredential, uint32, error) {
+	var cred *WebAuthnCredential
+	for i := range w.Credentials {
+		if w.Credentials[i].ID == a.ID {
+			cred = &w.Credentials[i]
+		}
+	}
+	if cred == nil {
+		return nil, 0, fmt.Errorf("unknown credential %q", a.ID)
+	}
+	clientData, err1 := base64.RawURLEncoding.DecodeString(a.ClientData)
+	authData, err2 := base64.RawURLEncoding.DecodeString(a.AuthenticatorData)
+	sig, err3 := base64.RawURLEncoding.DecodeString(a.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, 0, fmt.Errorf("invalid encoding")
+	}
+
+	var client struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(clientData, &client); err != nil {
+		return nil, 0, fmt.Errorf("invalid client data: %v", err)
+	}
+	if client.Type != "webauthn.get" {
+		return nil, 0, fmt.Errorf("client data is for %q", client.Type)
+	}
+	if client.Challenge != base64.RawURLEncoding.EncodeToString(challenge) {
+		return nil, 0, fmt.Errorf("wrong challenge")
+	}
+	if client.Origin != strings.TrimSuffix(w.Origin, "/") {
+		return nil, 0, fmt.Errorf("made for origin %s", client.Origin)
+	}
+
+	// Authenticator data starts with the RP ID's hash, flags and the
+	// signature counter
+	if len(authData) < 37 {
+		return nil, 0, fmt.Errorf("authenticator data too short")
+	}
+	rpHash := sha256.Sum256([]byte(w.RPID))
+	if !bytes.Equal(authData[:32], rpHash[:]) {
+		return nil, 0, fmt.Errorf("made for another relying party")
+	}
+	if authData[32]&0x01 == 0 {
+		return nil, 0, fmt.Errorf("user wasn't present")
+	}
+	count := binary.BigEndian.Uint32(authData[33:37])
+
+	clientHash := sha256.Sum256(clientData)
+	signed := append(authData[:len(authData):len(authData)], clientHash[:]...)
+	digest := sha256.Sum256(signed)
+	ok := false
+	switch key := cred.key.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, signed, sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("bad signature from %s", cred.Name)
+	}
+	return cred, count, nil
+}
+
+// stepUp is a session waiting for a security key
+type stepUp struct {
+	launcher  string
+	challenge []byte
+	done      chan *WebAuthnCredential
+}
+
+// stepUps tracks sessions waiting for step-up, and the credentials'
+// signature counters, which only go up unless a key has been cloned
+type stepUps struct {
+	mu      sync.Mutex
+	pending map[string]*stepUp
+	counts  map[string]uint32
+}
+
+func (p *stepUps) add(id string, st *stepUp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		p.pending = make(map[string]*stepUp)
+		p.counts = make(map[string]uint32)
+	}
+	p.pending[id] = st
+}
+
+func (p *stepUps) get(id string) *stepUp {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending[id]
+}
+
+func (p *stepUps) remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+}
+
+// complete finishes a step-up with the credential that signed it at
+// count, once
+func (p *stepUps) complete(id string, cred *WebAuthnCredential, count uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.pending[id]
+	if !ok {
+		return fmt.Errorf("step-up is over")
+	}
+	if last := p.counts[cred.ID]; (count != 0 || last != 0) && count <= last {
+		return fmt.Errorf("signature counter of %s went back, from %d to %d; the key may have been cloned", cred.Name, last, count)
+	}
+	p.counts[cred.ID] = count
+	delete(p.pending, id)
+	st.done <- cred
+	return nil
+}
+
+// stepUp asks the client to have the user confirm a session running
+// launcher with a security key, waiting until they do, stepUpTimeout
+// passes or ctx, the session's request, is done
+func (s *Server) stepUp(ctx context.Context, conn transport, sessionID, launcher string) error {
+	w := s.launchers.WebAuthn
+	buf := make([]byte, 48)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("failed to make challenge: %v", err)
+	}
+	id := hex.EncodeToString(buf[:16])
+	st := &stepUp{launcher: launcher, challenge: buf[16:], done: make(chan *WebAuthnCredential, 1)}
+	s.stepUps.add(id, st)
+	defer s.stepUps.remove(id)
+
+	link := strings.TrimSuffix(w.Origin, "/") + webAuthnPath + id
+	msg := controlMessage{Type: "step_up", URL: link, Message: fmt.Sprintf("launcher %s needs your security key, confirm at %s", launcher, link)}
+	if err := conn.send(msg); err != nil {
+		return fmt.Errorf("failed to send step-up: %v", err)
+	}
+	log.Info.Printf("Session %s waiting for step-up", sessionID)
+
+	select {
+	case cred := <-st.done:
+		log.Info.Printf("Session %s stepped up with %s", sessionID, cred.Name)
+		return nil
+	case <-time.After(stepUpTimeout):
+		return fmt.Errorf("security key confirmation timed out")
+	case <-ctx.Done():
+		return fmt.Errorf("security key confirmation abandoned: %v", ctx.Err())
+	}
+}
+
+// handleWebAuthn serves the browser side of step-up: the page that asks
+// for a security key, and the assertion it posts back. /webauthn/register
+// shows a new key's credential, to add to the launcher config.
+func (s *Server) handleWebAuthn(w http.ResponseWriter, r *http.Request) {
+	if s.launchers == nil || s.launchers.WebAuthn == nil {
+		http.NotFound(w, r)
+		return
+	}
+	cfg := s.launchers.WebAuthn
+	id := strings.TrimPrefix(r.URL.Path, webAuthnPath)
+	if id == "register" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		registerPage.Execute(w, map[string]string{"RPID": cfg.RPID})
+		return
+	}
+	st := s.stepUps.get(id)
+	if st == nil {
+		http.Error(w, "No such step-up, or it's over", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ids := make([]string, len(cfg.Credentials))
+		for i, c := range cfg.Credentials {
+			ids[i] = c.ID
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		stepUpPage.Execute(w, map[string]any{
+			"Launcher":    st.launcher,
+			"RPID":        cfg.RPID,
+			"Challenge":   base64.RawURLEncoding.EncodeToString(st.challenge),
+			"Credentials": ids,
+		})
+	case http.MethodPost:
+		var a webAuthnAssertion
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&a); err != nil {
+			http.Error(w, "Invalid assertion", http.StatusBadRequest)
+			return
+		}
+		cred, count, err := cfg.verify(a, st.challenge)
+		if err == nil {
+			err = s.stepUps.complete(id, cred, count)
+		}
+		if err != nil {
+			log.Info.Printf("Refused step-up from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "Security key refused", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webAuthnScript has the helpers both pages use
+const webAuthnScript = `
+const fromB64 = s => Uint8Array.from(atob(s.replace(/-/g, '+').replace(/_/g, '/')), c => c.charCodeAt(0));
+const toB64 = b => btoa(String.fromCharCode(...new Uint8Array(b)));
+const toB64URL = b => toB64(b).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+const status = document.getElementById('status');
+`
+
+var stepUpPage = template.Must(template.New("stepup").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>flyssh: confirm with your security key</title></head>
+<body>
+<p id="status">Touch your security key to start {{.Launcher}}.</p>
+<script>` + webAuthnScript + `
+navigator.credentials.get({publicKey: {
+	challenge: fromB64({{.Challenge}}),
+	rpId: {{.RPID}},
+	timeout: 120000,
+	userVerification: 'preferred',
+	allowCredentials: {{.Credentials}}.map(id => ({type: 'public-key', id: fromB64(id)})),
+}}).then(cred => fetch(location.href, {
+	method: 'POST',
+	headers: {'Content-Type': 'application/json'},
+	body: JSON.stringify({
+		id: cred.id,
+		client_data: toB64URL(cred.response.clientDataJSON),
+		authenticator_data: toB64URL(cred.response.authenticatorData),
+		signature: toB64URL(cred.response.signature),
+	}),
+})).then(resp => {
+	status.textContent = resp.ok ? 'Confirmed. You can close this page.' : 'Refused: ' + resp.statusText;
+}).catch(err => { status.textContent = 'Failed: ' + err; });
+</script>
+</body></html>
+`))
+
+var registerPage = template.Must(template.New("register").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>flyssh: register a security key</title></head>
+<body>
+<p><input id="name" placeholder="Key name"> <button id="register">Register</button></p>
+<p id="status">Add the credential shown here to "credentials" under "webauthn" in the launcher config.</p>
+<pre id="credential"></pre>
+<script>` + webAuthnScript + `
+document.getElementById('register').onclick = () => {
+	const name = document.getElementById('name').value || 'security key';
+	navigator.credentials.create({publicKey: {
+		challenge: crypto.getRandomValues(new Uint8Array(32)),
+		rp: {id: {{.RPID}}, name: 'flyssh'},
+		user: {id: crypto.getRandomValues(new Uint8Array(16)), name: name, displayName: name},
+		pubKeyCredParams: [{type: 'public-key', alg: -7}, {type: 'public-key', alg: -8}, {type: 'public-key', alg: -257}],
+		authenticatorSelection: {userVerification: 'preferred'},
+	}}).then(cred => {
+		document.getElementById('credential').textContent = JSON.stringify({
+			name: name,
+			id: cred.id,
+			public_key: toB64(cred.response.getPublicKey()),
+		}, null, 2);
+	}).catch(err => { status.textContent = 'Failed: ' + err; });
+};
+</script>
+</body></html>
+`))
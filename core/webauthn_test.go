@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testAuthenticator signs assertions as a security key would
+type testAuthenticator struct {
+	key *ecdsa.PrivateKey
+	id  string
+}
+
+func newTestAuthenticator(t *testing.T) (*testAuthenticator, WebAuthnCredential) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testAuthenticator{key: key, id: base64.RawURLEncoding.EncodeToString([]byte("test-key"))}
+	return a, WebAuthnCredential{Name: "test key", ID: a.id, PublicKey: base64.StdEncoding.EncodeToString(der)}
+}
+
+// assert makes an assertion for challenge as a browser on origin would
+func (a *testAuthenticator) assert(t *testing.T, rpID, origin string, challenge []byte, flags byte, count uint32) webAuthnAssertion {
+	clientData, _ := json.Marshal(map[string]string{
+		"type":      "webauthn.get",
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	rpHash := sha256.Sum256([]byte(rpID))
+	authData := append(rpHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], count)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webAuthnAssertion{
+		ID:                a.id,
+		ClientData:        base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(sig),
+	}
+}
+
+func TestWebAuthnVerify(t *testing.T) {
+	key, cred := newTestAuthenticator(t)
+	w := &WebAuthn{Origin: "https://ssh.example.com", Credentials: []WebAuthnCredential{cred}}
+	if err := w.check(); err != nil {
+		t.Fatal(err)
+	}
+	if w.RPID != "ssh.example.com" {
+		t.Errorf("Expected the RP ID to default to the origin's host, got %q", w.RPID)
+	}
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+
+	got, count, err := w.verify(key.assert(t, w.RPID, w.Origin, challenge, 0x01, 7), challenge)
+	if err != nil {
+		t.Fatalf("Expected a valid assertion to verify, got %v", err)
+	}
+	if got.Name != "test key" || count != 7 {
+		t.Errorf("verify() = %q, %d, want test key, 7", got.Name, count)
+	}
+
+	other, _ := newTestAuthenticator(t)
+	for _, tt := range []struct {
+		name string
+		a    webAuthnAssertion
+	}{
+		{"another challenge", key.assert(t, w.RPID, w.Origin, []byte("another"), 0x01, 8)},
+		{"phishing origin", key.assert(t, w.RPID, "https://ssh.example.co", challenge, 0x01, 8)},
+		{"another relying party", key.assert(t, "example.co", w.Origin, challenge, 0x01, 8)},
+		{"absent user", key.assert(t, w.RPID, w.Origin, challenge, 0x04, 8)},
+		{"unregistered key", other.assert(t, w.RPID, w.Origin, challenge, 0x01, 8)},
+	} {
+		if _, _, err := w.verify(tt.a, challenge); err == nil {
+			t.Errorf("Expected an assertion with %s to be refused", tt.name)
+		}
+	}
+
+	// A signature made by another key under a registered ID is refused
+	forged := other.assert(t, w.RPID, w.Origin, challenge, 0x01, 8)
+	forged.ID = key.id
+	if _, _, err := w.verify(forged, challenge); err == nil {
+		t.Error("Expected a forged signature to be refused")
+	}
+}
+
+func TestWebAuthnCheck(t *testing.T) {
+	_, cred := newTestAuthenticator(t)
+	for _, tt := range []struct {
+		name    string
+		w       WebAuthn
+		wantErr bool
+	}{
+		{"https", WebAuthn{Origin: "https://ssh.example.com", Credentials: []WebAuthnCredential{cred}}, false},
+		{"localhost", WebAuthn{Origin: "http://localhost:8081", Credentials: []WebAuthnCredential{cred}}, false},
+		{"insecure", WebAuthn{Origin: "http://ssh.example.com", Credentials: []WebAuthnCredential{cred}}, true},
+		{"path", WebAuthn{Origin: "https://ssh.example.com/ssh", Credentials: []WebAuthnCredential{cred}}, true},
+		{"no credentials", WebAuthn{Origin: "https://ssh.example.com"}, true},
+		{"bad key", WebAuthn{Origin: "https://ssh.example.com", Credentials: []WebAuthnCredential{{Name: "x", ID: cred.ID, PublicKey: "AAAA"}}}, true},
+	} {
+		if err := tt.w.check(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: check() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStepUpCounter(t *testing.T) {
+	var p stepUps
+	cred := &WebAuthnCredential{Name: "test key", ID: "k"}
+	for _, id := range []string{"a", "b", "c"} {
+		p.add(id, &stepUp{done: make(chan *WebAuthnCredential, 1)})
+	}
+	if err := p.complete("a", cred, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.complete("a", cred, 6); err == nil {
+		t.Error("Expected a step-up to complete only once")
+	}
+	// A counter that doesn't go up means the key may have been cloned
+	if err := p.complete("b", cred, 5); err == nil {
+		t.Error("Expected a repeated signature counter to be refused")
+	}
+	if err := p.complete("c", cred, 6); err != nil {
+		t.Errorf("Expected a higher signature counter to be accepted, got %v", err)
+	}
+}
+
+func TestStepUpEndsWithRequest(t *testing.T) {
+	s := &Server{launchers: &LauncherConfig{WebAuthn: &WebAuthn{Origin: "https://example.com"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &fakeTransport{}
+	done := make(chan error, 1)
+	go func() { done <- s.stepUp(ctx, conn, "#1", "prod") }()
+
+	// Nothing waits for the key once the client's request is gone
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an abandoned step-up to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Step-up kept waiting after its request ended")
+	}
+	if len(conn.sent) != 1 || conn.sent[0].Type != "step_up" {
+		t.Errorf("Expected the client to be asked for its key, got %+v", conn.sent)
+	}
+}
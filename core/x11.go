@@ -0,0 +1,201 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// X11 forwarding works like ssh's. The client makes up a cookie and asks
+// for forwarding with it; the server gives the session a display that
+// accepts that cookie. The client relays each connection to its own
+// display, replacing the made-up cookie with the display's real one, so
+// the real one never leaves the client.
+const (
+	x11AuthProto     = "MIT-MAGIC-COOKIE-1"
+	x11DisplayOffset = 10 // first display number tried, leaving lower ones to real X servers
+	x11MaxDisplays   = 1000
+)
+
+// forwardX11 gives cmd an X display relayed to the client attached to
+// ctl. auth is the client's "protocol:hex cookie". The returned function
+// removes the display.
+func (s *Server) forwardX11(cmd *exec.Cmd, ctl *sessionControl, auth string) (*forwardRelay, func(), error) {
+	proto, hexCookie, _ := strings.Cut(auth, ":")
+	if proto != x11AuthProto {
+		return nil, nil, fmt.Errorf("unsupported X11 authentication %q", proto)
+	}
+	cookie, err := hex.DecodeString(hexCookie)
+	if err != nil || len(cookie) == 0 {
+		return nil, nil, fmt.Errorf("invalid X11 cookie")
+	}
+
+	ln, display, err := listenX11()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to allocate X11 display: %v", err)
+	}
+	dir, err := os.MkdirTemp("", "flyssh-x11-")
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	cleanup := func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+	xauthority := filepath.Join(dir, "Xauthority")
+	if err := writeXauthority(xauthority, display, cookie); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to write Xauthority: %v", err)
+	}
+	if err := chownForSession(cmd, dir, xauthority); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	relay := newForwardRelay("x11", sendForward(ctl), nil)
+	go relay.serve(ln)
+	cmd.Env = setEnv(cmd.Env, fmt.Sprintf("DISPLAY=localhost:%d.0", display))
+	cmd.Env = setEnv(cmd.Env, "XAUTHORITY="+xauthority)
+	return relay, func() {
+		cleanup()
+		relay.closeAll()
+	}, nil
+}
+
+// listenX11 listens on the first free display number on the loopback
+// interface, like sshd's X11UseLocalhost
+func listenX11() (net.Listener, int, error) {
+	var err error
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", 6000+display)); err == nil {
+			return ln, display, nil
+		}
+	}
+	return nil, 0, err
+}
+
+// writeXauthority writes an Xauthority file holding cookie for display,
+// whatever host it's reached by
+func writeXauthority(path string, display int, cookie []byte) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(0xffff)) // FamilyWild
+	for _, field := range [][]byte{nil, []byte(strconv.Itoa(display)), []byte(x11AuthProto), cookie} {
+		binary.Write(&buf, binary.BigEndian, uint16(len(field)))
+		buf.Write(field)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// dialX11 connects to an X display given as in DISPLAY: a local display
+// like :0 or unix:0, a socket path like XQuartz's, or host:0 over TCP
+func dialX11(display string) (net.Conn, error) {
+	i := strings.LastIndex(display, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid DISPLAY %q", display)
+	}
+	host, number := display[:i], display[i+1:]
+	number, _, _ = strings.Cut(number, ".") // drop the screen
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DISPLAY %q", display)
+	}
+	switch {
+	case strings.HasPrefix(host, "/"):
+		return net.Dial("unix", display)
+	case host == "" || host == "unix":
+		return net.Dial("unix", fmt.Sprintf("/tmp/.X11-unix/X%d", n))
+	}
+	return net.Dial("tcp", net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(6000+n)))
+}
+
+// localX11Auth returns the authentication the local display expects,
+// from xauth. Displays xauth doesn't know get none.
+func localX11Auth(display string) (string, []byte) {
+	out, err := exec.Command("xauth", "list", display).Output()
+	if err != nil {
+		return "", nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if cookie, err := hex.DecodeString(fields[2]); err == nil {
+			return fields[1], cookie
+		}
+	}
+	return "", nil
+}
+
+// x11AuthConn is a connection to the local display that checks the
+// forwarded client's setup request carries the made-up cookie and
+// replaces it with the display's real authentication
+type x11AuthConn struct {
+	net.Conn
+	fake       []byte
+	proto      string
+	cookie     []byte
+	setup      []byte // the setup request so far
+	authorized bool
+}
+
+func (c *x11AuthConn) Write(p []byte) (int, error) {
+	if c.authorized {
+		return c.Conn.Write(p)
+	}
+	c.setup = append(c.setup, p...)
+
+	// The setup request starts with the byte order, protocol version and
+	// the lengths of the authentication name and data that follow, each
+	// padded to four bytes
+	if len(c.setup) < 12 {
+		return len(p), nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if c.setup[0] == 'B' {
+		order = binary.BigEndian
+	}
+	nameLen, dataLen := int(order.Uint16(c.setup[6:])), int(order.Uint16(c.setup[8:]))
+	end := 12 + pad4(nameLen) + pad4(dataLen)
+	if len(c.setup) < end {
+		return len(p), nil
+	}
+	name := c.setup[12 : 12+nameLen]
+	data := c.setup[12+pad4(nameLen) : 12+pad4(nameLen)+dataLen]
+	if string(name) != x11AuthProto || !hmac.Equal(data, c.fake) {
+		return 0, fmt.Errorf("forwarded X11 connection has the wrong cookie")
+	}
+
+	setup := make([]byte, 12, 12+pad4(len(c.proto))+pad4(len(c.cookie))+len(c.setup)-end)
+	copy(setup, c.setup[:6])
+	order.PutUint16(setup[6:], uint16(len(c.proto)))
+	order.PutUint16(setup[8:], uint16(len(c.cookie)))
+	setup = append(setup, padded([]byte(c.proto))...)
+	setup = append(setup, padded(c.cookie)...)
+	setup = append(setup, c.setup[end:]...)
+	c.authorized, c.setup = true, nil
+	if _, err := c.Conn.Write(setup); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// pad4 rounds n up to a multiple of four
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// padded returns b padded with zeros to a multiple of four bytes
+func padded(b []byte) []byte {
+	return append(append([]byte(nil), b...), make([]byte, pad4(len(b))-len(b))...)
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// x11Setup builds a little endian X11 setup request
+func x11Setup(name string, data []byte) []byte {
+	setup := []byte{'l', 0, 11, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(setup[6:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(setup[8:], uint16(len(data)))
+	setup = append(setup, padded([]byte(name))...)
+	return append(setup, padded(data)...)
+}
+
+func TestX11AuthConnReplacesCookie(t *testing.T) {
+	fake := []byte("made-up-cookie!!")
+	real := []byte("the-real-cookie!")
+	local, display := net.Pipe()
+	defer local.Close()
+	conn := &x11AuthConn{Conn: local, fake: fake, proto: x11AuthProto, cookie: real}
+
+	// The request may arrive in pieces, followed by the first real request
+	request := append(x11Setup(x11AuthProto, fake), "next"...)
+	go func() {
+		conn.Write(request[:5])
+		conn.Write(request[5:30])
+		conn.Write(request[30:])
+	}()
+	want := append(x11Setup(x11AuthProto, real), "next"...)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(display, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Display got %q, want %q", got, want)
+	}
+
+	wrong := &x11AuthConn{Conn: local, fake: fake, proto: x11AuthProto, cookie: real}
+	if _, err := wrong.Write(x11Setup(x11AuthProto, []byte("guessed-cookie!!"))); err == nil {
+		t.Error("Expected a connection with the wrong cookie to be refused")
+	}
+}
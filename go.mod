@@ -5,7 +5,6 @@ go 1.21
 require (
 	github.com/creack/pty v1.1.24
 	golang.org/x/net v0.34.0
+	golang.org/x/sys v0.29.0
 	golang.org/x/term v0.28.0
 )
-
-require golang.org/x/sys v0.29.0 // indirect
@@ -4,10 +4,20 @@
 package tests
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
 )
 
 func TestClientBinary(t *testing.T) {
@@ -91,3 +101,202 @@ func TestClientBinaryWithShell(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestClientRestoresTerminalWhenKilled(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Fatalf("Failed to open PTY: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	cooked, err := term.GetState(int(tty.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to get terminal state: %v", err)
+	}
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-reconnect", "0")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer cmd.Process.Kill()
+	ptmx.Write([]byte("echo raw-$((1+1))\n"))
+	out.waitFor(t, "raw-2", 5*time.Second)
+	if raw, _ := term.GetState(int(tty.Fd())); reflect.DeepEqual(raw, cooked) {
+		t.Fatal("Expected the client to put the terminal in raw mode")
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Errorf("Expected client to exit as terminated, got %v", err)
+	}
+	if after, _ := term.GetState(int(tty.Fd())); !reflect.DeepEqual(after, cooked) {
+		t.Error("Terminal left in raw mode after the client was terminated")
+	}
+}
+
+func TestClientResetsScreenWhenProgramDies(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// A full screen program that's killed before it can clean up
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-c", `printf '\033[?1049h\033[?25lfull-screen'; kill -KILL $$`)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer ptmx.Close()
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	cmd.Wait()
+
+	out.waitFor(t, "full-screen\x1b[?1049l\x1b[?25h", 5*time.Second)
+}
+
+func TestClientUnknownTermFallsBack(t *testing.T) {
+	if _, err := os.Stat("/usr/share/terminfo/x/xterm-256color"); err != nil {
+		if _, err := os.Stat("/lib/terminfo/x/xterm-256color"); err != nil {
+			t.Skip("no terminfo for xterm-256color")
+		}
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-send-env", "TERM", "-c", "echo term=$TERM")
+	cmd.Env = append(os.Environ(), "TERM=xterm-nonexistent")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer ptmx.Close()
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	cmd.Wait()
+
+	out.waitFor(t, "terminal type xterm-nonexistent is unknown on the server", 5*time.Second)
+	out.waitFor(t, "term=xterm-256color", 5*time.Second)
+}
+
+func TestConnectUsesHostSettings(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	home := t.TempDir()
+	config := fmt.Sprintf(`Host dev
+    URL %s
+    TokenCommand echo %s
+    Term vt220
+    Command echo connected-$TERM
+`, srv.URL(), srv.AuthToken)
+	if err := os.WriteFile(filepath.Join(home, "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The token must come from the config file
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WSS_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, "FLYSSH_HOME="+home)
+
+	connect := func(args ...string) (string, error) {
+		cmd := exec.Command(ClientBinaryPath, append([]string{"connect", "-reconnect", "0"}, args...)...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	if out, err := connect("dev"); err != nil || !strings.Contains(out, "connected-vt220") {
+		t.Errorf("connect dev: %v, output %q", err, out)
+	}
+	if out, err := connect("dev", "echo", "instead"); err != nil || !strings.Contains(out, "instead") || strings.Contains(out, "connected") {
+		t.Errorf("connect dev with a command: %v, output %q", err, out)
+	}
+	if out, err := connect("prod"); err == nil || !strings.Contains(out, "not a Host") {
+		t.Errorf("connect to an unknown name: %v, output %q", err, out)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	validate := func(args ...string) (string, error) {
+		out, err := exec.Command(ClientBinaryPath, append([]string{"config", "validate"}, args...)...).CombinedOutput()
+		return string(out), err
+	}
+
+	server := write("good.yaml", "port: 8443\nidle-timeout: 30m\n")
+	client := write("good", "Host dev\n    URL wss://dev.example.com\n    ForwardAgent yes\n")
+	if out, err := validate("-server", server, "-client", client); err != nil {
+		t.Errorf("Expected valid config files to pass: %v: %s", err, out)
+	}
+
+	server = write("bad.yaml", "port: 8443\nidle-timout: 30m\nrecord-input: true\n")
+	client = write("bad", "Host dev\n    URL https://dev.example.com\n    Token t\n    TokenFile ~/t\n")
+	out, err := validate("-server", server, "-client", client)
+	if err == nil {
+		t.Errorf("Expected invalid config files to fail: %s", out)
+	}
+	for _, want := range []string{
+		"unknown option idle-timout (did you mean idle-timeout?)",
+		"record-input does nothing without record-dir",
+		"bad:2: URL https://dev.example.com is not a ws:// or wss:// URL",
+		"bad:4: TokenFile is ignored",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output: %s", want, out)
+		}
+	}
+}
+
+func TestConfigAnsible(t *testing.T) {
+	out, err := exec.Command(ClientBinaryPath, "config", "ansible").Output()
+	if err != nil {
+		t.Fatalf("config ansible failed: %v", err)
+	}
+	for _, want := range []string{
+		"ansible_ssh_executable: " + filepath.Join(filepath.Dir(ClientBinaryPath), "flyssh-ssh"),
+		"ansible_ssh_transfer_method: piped",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Output doesn't contain %q: %s", want, out)
+		}
+	}
+}
+
+func TestRsyncRunsRsyncOverSSH(t *testing.T) {
+	// An rsync that only says how it was run
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"$* $WSS_URL $WSS_AUTH_TOKEN\"\nexit 5\n"
+	os.WriteFile(filepath.Join(bin, "rsync"), []byte(script), 0755)
+
+	cmd := exec.Command(ClientBinaryPath, "rsync", "-url", "ws://example.com:8081", "-token", "rsync-token", "--", "-a", "src/", "host:dst/")
+	cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 5 {
+		t.Errorf("Expected rsync's status 5, got %v", err)
+	}
+	want := "-e " + ClientBinaryPath + " ssh -a src/ host:dst/ ws://example.com:8081 rsync-token\n"
+	if string(out) != want {
+		t.Errorf("rsync ran as %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAgent runs an ssh-agent holding a new key, returning its socket
+func startAgent(t *testing.T) string {
+	for _, tool := range []string{"ssh-agent", "ssh-add", "ssh-keygen"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "agent.sock")
+	agent := exec.Command("ssh-agent", "-D", "-a", sock)
+	if err := agent.Start(); err != nil {
+		t.Fatalf("Failed to start ssh-agent: %v", err)
+	}
+	t.Cleanup(func() {
+		agent.Process.Kill()
+		agent.Wait()
+	})
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	key := filepath.Join(dir, "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "forwarded-key", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to generate key: %v: %s", err, out)
+	}
+	add := exec.Command("ssh-add", key)
+	add.Env = append(os.Environ(), "SSH_AUTH_SOCK="+sock)
+	if out, err := add.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to add key: %v: %s", err, out)
+	}
+	return sock
+}
+
+func TestAgentForwarding(t *testing.T) {
+	sock := startAgent(t)
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	run := func(args ...string) string {
+		args = append([]string{"client", "-url", srv.URL(), "-token", srv.AuthToken}, args...)
+		cmd := exec.Command(ClientBinaryPath, args...)
+		cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+sock)
+		out, _ := cmd.CombinedOutput()
+		return string(out)
+	}
+
+	// Several requests, each on a connection of its own
+	out := run("-A", "-c", "ssh-add -l && ssh-add -L && ssh-add -l")
+	if strings.Count(out, "forwarded-key") != 3 {
+		t.Fatalf("Expected the session to list the forwarded key, got %q", out)
+	}
+
+	if out := run("-c", "echo sock=$SSH_AUTH_SOCK"); !strings.Contains(out, "sock=") || strings.Contains(out, "sock=/") {
+		t.Errorf("Expected no agent without -A, got %q", out)
+	}
+
+	srv.Server.SetAgentForwarding(false)
+	out = run("-A", "-c", "echo sock=$SSH_AUTH_SOCK")
+	if !strings.Contains(out, "agent forwarding is disabled") || strings.Contains(out, "sock=/") {
+		t.Errorf("Expected forwarding to be refused, got %q", out)
+	}
+}
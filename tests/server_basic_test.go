@@ -4,12 +4,18 @@
 package tests
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 
+	"flyssh/core"
+
 	"golang.org/x/net/websocket"
 )
 
@@ -45,3 +51,49 @@ func TestServerConnection(t *testing.T) {
 	}
 	ws.Close()
 }
+
+func TestEmbeddedServerAndClient(t *testing.T) {
+	// An embedding program's token needn't be in the environment
+	t.Setenv("WSS_AUTH_TOKEN", "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := core.NewServer(0)
+	srv.SetAuthToken("embedded-token")
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, ln) }()
+
+	url := "ws://" + ln.Addr().String()
+	var stdout bytes.Buffer
+	client := core.NewClient(context.Background(), url, "embedded-token")
+	client.SetIO(strings.NewReader(""), &stdout)
+	client.SetCommand("echo embedded")
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Session failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "embedded") {
+		t.Errorf("Expected the command's output, got %q", stdout.String())
+	}
+
+	// Cancelling ends a session that would otherwise run on
+	clientCtx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	client = core.NewClient(clientCtx, url, "embedded-token")
+	client.SetIO(strings.NewReader(""), &bytes.Buffer{})
+	client.SetCommand("sleep 30")
+	if err := client.Connect(); err != context.DeadlineExceeded {
+		t.Errorf("Expected the session to end with its context, got %v", err)
+	}
+
+	stop()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected Serve to return nil once stopped, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after its context was cancelled")
+	}
+}
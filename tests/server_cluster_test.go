@@ -0,0 +1,89 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"flyssh/core"
+
+	"github.com/creack/pty"
+)
+
+// startClusterServer starts a server that is one instance of the cluster
+// sharing dir
+func startClusterServer(t *testing.T, dir, instance string) (*core.Server, string) {
+	port, err := GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	url := fmt.Sprintf("ws://localhost:%d", port)
+	c, err := core.OpenCluster(dir, instance, url)
+	if err != nil {
+		t.Fatalf("Failed to open cluster: %v", err)
+	}
+	srv := core.NewServer(port)
+	srv.SetResumeTimeout(30 * time.Second)
+	srv.SetCluster(c)
+	go srv.Start()
+	return srv, url
+}
+
+func TestResumeIsProxiedToOwningInstance(t *testing.T) {
+	os.Setenv("WSS_AUTH_TOKEN", "test-token")
+	defer os.Unsetenv("WSS_AUTH_TOKEN")
+	dir := t.TempDir()
+	a, urlA := startClusterServer(t, dir, "a")
+	defer a.Stop()
+	b, urlB := startClusterServer(t, dir, "b")
+	defer b.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start a session on instance a, then lose its client
+	first := exec.Command(ClientBinaryPath, "client", "-url", urlA, "-token", "test-token", "-reconnect", "0")
+	ptmx, err := pty.Start(first)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer ptmx.Close()
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	time.Sleep(500 * time.Millisecond)
+	ptmx.Write([]byte("X=proxied; echo set-$X\n"))
+	out.waitFor(t, "set-proxied", 5*time.Second)
+	first.Process.Kill()
+	first.Wait()
+
+	sessions := a.Sessions().List()
+	if len(sessions) != 1 {
+		t.Fatalf("Expected one session on instance a, got %d", len(sessions))
+	}
+	id := sessions[0].ID
+
+	// Resuming through instance b reaches the shell on a
+	second := exec.Command(ClientBinaryPath, "client", "-url", urlB, "-token", "test-token", "-reconnect", "0", "-resume", id)
+	ptmx2, err := pty.Start(second)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer func() {
+		second.Process.Kill()
+		second.Wait()
+		ptmx2.Close()
+	}()
+	var out2 syncBuffer
+	go io.Copy(&out2, ptmx2)
+	time.Sleep(500 * time.Millisecond)
+	ptmx2.Write([]byte("echo still-$X\n"))
+	out2.waitFor(t, "still-proxied", 5*time.Second)
+
+	if n := len(b.Sessions().List()); n != 0 {
+		t.Errorf("Expected no sessions on instance b, got %d", n)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+func TestClientsShareControlConnection(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	proxy := newFlakyProxy(t, fmt.Sprintf("localhost:%d", srv.Port))
+	defer proxy.Close()
+	controlPath := filepath.Join(t.TempDir(), "control.sock")
+
+	start := func() (*exec.Cmd, io.Writer, *syncBuffer) {
+		cmd := exec.Command(ClientBinaryPath, "client", "-url", proxy.URL(), "-token", srv.AuthToken, "-control-path", controlPath)
+		ptmx, err := pty.Start(cmd)
+		if err != nil {
+			t.Fatalf("Failed to start client: %v", err)
+		}
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+			ptmx.Close()
+		})
+		out := &syncBuffer{}
+		go io.Copy(out, ptmx)
+		return cmd, ptmx, out
+	}
+
+	master, masterIn, masterOut := start()
+	masterIn.Write([]byte("echo master-$((1+1))\n"))
+	masterOut.waitFor(t, "master-2", 5*time.Second)
+
+	shared, sharedIn, sharedOut := start()
+	sharedIn.Write([]byte("echo shared-$((2+2))\n"))
+	sharedOut.waitFor(t, "shared-4", 5*time.Second)
+
+	if n := len(srv.Server.Sessions().List()); n != 2 {
+		t.Errorf("Expected 2 sessions, got %d", n)
+	}
+	proxy.mu.Lock()
+	conns := len(proxy.conns) / 2
+	proxy.mu.Unlock()
+	if conns != 1 {
+		t.Errorf("Expected clients to share 1 connection, got %d", conns)
+	}
+
+	// The first client waits for the sessions sharing its connection
+	masterIn.Write([]byte("exit\n"))
+	masterOut.waitFor(t, "waiting for 1 shared session", 5*time.Second)
+	sharedIn.Write([]byte("echo still-$((3+3))\n"))
+	sharedOut.waitFor(t, "still-6", 5*time.Second)
+
+	sharedIn.Write([]byte("exit\n"))
+	for _, cmd := range []*exec.Cmd{shared, master} {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Client exited with error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Client didn't exit after its session ended")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+
+	"github.com/creack/pty"
+)
+
+func TestDrainMovesClientsToReplacement(t *testing.T) {
+	blue := NewTestServer(t)
+	defer blue.Cleanup(t)
+	green := NewTestServer(t)
+	defer green.Server.Stop()
+	blue.Server.SetResumeTimeout(30 * time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	proxy := newFlakyProxy(t, fmt.Sprintf("localhost:%d", blue.Port))
+	defer proxy.Close()
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", proxy.URL(), "-token", blue.AuthToken, "-reconnect", "20s")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		ptmx.Close()
+	}()
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	time.Sleep(500 * time.Millisecond)
+	ptmx.Write([]byte("echo on-blue\n"))
+	out.waitFor(t, "on-blue", 5*time.Second)
+
+	// Drain blue, naming green as its replacement
+	body := strings.NewReader(fmt.Sprintf(`{"replacement": %q}`, green.URL()))
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/api/v1/drain?token=%s", blue.Port, blue.AuthToken), "application/json", body)
+	if err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	var status core.DrainStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if !status.Draining || status.Replacement != green.URL() || status.SessionsActive != 1 {
+		t.Fatalf("Unexpected drain status %+v", status)
+	}
+	out.waitFor(t, "reconnects go to "+green.URL(), 5*time.Second)
+
+	// New clients of blue land on green
+	exec1 := exec.Command(ClientBinaryPath, "client", "-url", blue.URL(), "-token", blue.AuthToken, "-c", "echo new-client")
+	output, err := exec1.CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "new-client") {
+		t.Fatalf("Command through draining server failed: %v: %s", err, output)
+	}
+	if n := len(green.Server.Sessions().List()); n != 0 {
+		t.Errorf("Expected finished command to leave no sessions on green, got %d", n)
+	}
+	if n := len(blue.Server.Sessions().List()); n != 1 {
+		t.Errorf("Expected only the original session on blue, got %d", n)
+	}
+
+	// Once blue goes away the client starts over on green
+	proxy.Close()
+	blue.Server.Stop()
+	out.waitFor(t, "previous session ended", 10*time.Second)
+	ptmx.Write([]byte("echo on-green\n"))
+	out.waitFor(t, "on-green", 5*time.Second)
+	if n := len(green.Server.Sessions().List()); n != 1 {
+		t.Errorf("Expected the client's new session on green, got %d", n)
+	}
+}
@@ -0,0 +1,90 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+func TestLauncherDualControl(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+
+	cfgPath := filepath.Join(t.TempDir(), "launchers.json")
+	cfg := `{
+		"launchers": {"prod": {"command": ["sh", "-c", "echo watched-start; sleep 1; echo watched-end"], "dual_control": true}},
+		"tokens": [
+			{"token": "alice-token", "name": "alice", "launchers": ["prod"]},
+			{"token": "bob-token", "name": "bob", "launchers": ["prod"]}
+		]
+	}`
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	launchers, err := core.LoadLauncherConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Server.SetLaunchers(launchers)
+	time.Sleep(100 * time.Millisecond)
+
+	// start runs a client, its input held open as a user's would be
+	start := func(args ...string) (*exec.Cmd, *syncBuffer, chan error) {
+		cmd := exec.Command(ClientBinaryPath, append([]string{"client", "-url", srv.URL()}, args...)...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { stdin.Close() })
+		out := &syncBuffer{}
+		cmd.Stdout, cmd.Stderr = out, out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cmd.Process.Kill() })
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		return cmd, out, done
+	}
+
+	_, owner, ownerDone := start("-token", "alice-token", "-launch", "prod")
+	owner.waitFor(t, "needs a second person", 5*time.Second)
+	m := regexp.MustCompile(`-observe (\S+)`).FindStringSubmatch(owner.String())
+	if m == nil {
+		t.Fatalf("No session ID to observe in %q", owner.String())
+	}
+	if strings.Contains(owner.String(), "watched-start") {
+		t.Fatal("Session started before anyone observed it")
+	}
+
+	// The owner can't watch their own session
+	_, self, selfDone := start("-token", "alice-token", "-observe", m[1])
+	select {
+	case err := <-selfDone:
+		if err == nil || !strings.Contains(self.String(), "not permitted") {
+			t.Errorf("Expected the owner to be refused as observer, got %v: %s", err, self.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Owner's observer wasn't refused")
+	}
+
+	_, observer, observerDone := start("-token", "bob-token", "-observe", m[1])
+	observer.waitFor(t, "watched-end", 5*time.Second)
+	owner.waitFor(t, "watched-end", 5*time.Second)
+	for name, done := range map[string]chan error{"owner": ownerDone, "observer": observerDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("The %s's client didn't exit after the session ended", name)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+func TestExecPropagatesExitCode(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		output string
+	}{
+		{"success", []string{"-c", "echo ran-$((1+1))"}, 0, "ran-2"},
+		{"failure", []string{"-c", "echo failing; exit 7"}, 7, "failing"},
+		{"signal", []string{"-c", "kill -TERM $$"}, 128 + 15, ""},
+		{"arguments", []string{"--", "echo", "from", "args"}, 0, "from args"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"client", "-url", srv.URL(), "-token", srv.AuthToken}, tt.args...)
+			cmd := exec.Command(ClientBinaryPath, args...)
+			out, err := cmd.Output()
+
+			code := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatalf("Failed to run client: %v", err)
+			}
+			if code != tt.code {
+				t.Errorf("Exit code %d, want %d", code, tt.code)
+			}
+			if !strings.Contains(string(out), tt.output) {
+				t.Errorf("Output %q doesn't contain %q", out, tt.output)
+			}
+		})
+	}
+}
+
+func TestExecReadsPipedInput(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// The command must see the end of its input, and get it unaltered
+	input := "one\ntwo\r\nthree\x04\n"
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-c", "wc -lc")
+	cmd.Stdin = strings.NewReader(input)
+	done := make(chan struct{})
+	var out []byte
+	var err error
+	go func() {
+		out, err = cmd.Output()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("Command didn't finish after its input ended")
+	}
+	if err != nil {
+		t.Fatalf("Failed to run client: %v", err)
+	}
+	if fields := strings.Fields(string(out)); len(fields) != 2 || fields[0] != "3" || fields[1] != strconv.Itoa(len(input)) {
+		t.Errorf("Output %q, want 3 lines and %d bytes", out, len(input))
+	}
+}
+
+func TestExecReceivesAcceptedEnv(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetAcceptEnv([]string{"TERM", "FLYSSH_TEST_*"})
+	time.Sleep(100 * time.Millisecond)
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-send-env", "TERM,FLYSSH_TEST_*,FLYSSH_SECRET", "-c", `echo "[$TERM|$FLYSSH_TEST_VAR|$FLYSSH_SECRET]"`)
+	cmd.Env = append(cmd.Environ(), "TERM=vt100", "FLYSSH_TEST_VAR=a b", "FLYSSH_SECRET=hidden")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to run client: %v", err)
+	}
+	if want := "[vt100|a b|]"; !strings.Contains(string(out), want) {
+		t.Errorf("Output %q doesn't contain %q", out, want)
+	}
+}
+
+func TestExecInDirectoryAsUser(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// Not under t.TempDir, whose parent other users can't enter
+	dir, err := os.MkdirTemp("", "flyssh-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	tests := []struct {
+		name   string
+		args   []string
+		root   bool
+		output string
+	}{
+		{"directory", []string{"-dir", dir, "-c", "pwd"}, false, dir},
+		{"relative directory", []string{"-dir", "..", "-c", "pwd"}, false, "/\n"},
+		{"user", []string{"-login", "nobody", "-c", "echo $(id -un) $HOME $PWD"}, true, "nobody /nonexistent /\n"},
+		{"user and directory", []string{"-login", "nobody", "-dir", dir, "-c", "pwd"}, true, dir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.root && os.Geteuid() != 0 {
+				t.Skip("switching users needs root")
+			}
+			args := append([]string{"client", "-url", srv.URL(), "-token", srv.AuthToken}, tt.args...)
+			out, err := exec.Command(ClientBinaryPath, args...).Output()
+			if err != nil {
+				t.Fatalf("Failed to run client: %v", err)
+			}
+			if !strings.Contains(string(out), tt.output) {
+				t.Errorf("Output %q doesn't contain %q", out, tt.output)
+			}
+		})
+	}
+}
+
+func TestExecRejectsMissingDirectory(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-reconnect", "0", "-dir", "/does/not/exist", "-c", "pwd").CombinedOutput()
+	if err == nil {
+		t.Fatalf("Expected the session to be refused, got %q", out)
+	}
+	if !strings.Contains(string(out), "no such directory /does/not/exist") {
+		t.Errorf("Output %q doesn't explain the refusal", out)
+	}
+}
+
+func TestExecInRequestedShell(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-reconnect", "0", "-shell", "sh", "-c", "echo $SHELL").Output()
+	if err != nil || !strings.Contains(string(out), "/bin/sh") {
+		t.Errorf("Expected the command to run in sh, got %v: %q", err, out)
+	}
+
+	// Windows' shells aren't on Unix servers
+	out, err = exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-reconnect", "0", "-shell", "cmd", "-c", "echo hi").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "unknown shell cmd (use sh, pwsh)") {
+		t.Errorf("Expected the shell to be refused, got %v: %q", err, out)
+	}
+}
+
+func TestExecWithDotfiles(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	inputrc := filepath.Join(t.TempDir(), ".inputrc")
+	if err := os.WriteFile(inputrc, []byte("set bell-style none\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-reconnect", "0", "-dotfiles", inputrc, "-c", "cat $INPUTRC").Output()
+	if err != nil || !strings.Contains(string(out), "set bell-style none") {
+		t.Errorf("Expected the session to have the .inputrc, got %v: %q", err, out)
+	}
+}
+
+func TestExecEnforcesPolicy(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"allow": ["echo *"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := core.LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Server.SetPolicy(policy)
+	time.Sleep(100 * time.Millisecond)
+
+	run := func(command string) (string, error) {
+		out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+			"-reconnect", "0", "-c", command).CombinedOutput()
+		return string(out), err
+	}
+	if out, err := run("echo permitted"); err != nil || !strings.Contains(out, "permitted") {
+		t.Errorf("Allowed command failed: %v, output %q", err, out)
+	}
+	if out, err := run("id"); err == nil || !strings.Contains(out, "not allowed by policy") {
+		t.Errorf("Expected the command to be refused, got %v, output %q", err, out)
+	}
+}
+
+func TestExecPreviewsPolicy(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(path, []byte(`{"allow": ["echo *"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := core.LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Server.SetPolicyPreview(policy)
+	auditPath := filepath.Join(dir, "audit.log")
+	audit, err := core.OpenAuditLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	srv.Server.SetAuditLog(audit)
+	time.Sleep(100 * time.Millisecond)
+
+	// The previewed policy would refuse this, but it runs
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-reconnect", "0", "-c", "printf 'ran-%s' preview").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "ran-preview") {
+		t.Fatalf("Command failed: %v, output %q", err, out)
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var ev core.AuditEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", line, err)
+		}
+		if ev.Event == core.AuditWouldDeny {
+			found = true
+			if !strings.Contains(ev.Reason, "not allowed by policy") || ev.Command != "printf 'ran-%s' preview" {
+				t.Errorf("Unexpected would_deny event %+v", ev)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("No would_deny event in audit log:\n%s", data)
+	}
+}
+
+func TestExecGetsClientInterrupts(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// Without a PTY the client passes its SIGINT on, to the command's
+	// children too, and exits with the command's status
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-c",
+		`trap 'echo interrupted; exit 3' INT; echo ready; sleep 30`)
+	var out syncBuffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	out.waitFor(t, "ready", 5*time.Second)
+	cmd.Process.Signal(os.Interrupt)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+			t.Errorf("Expected the command's status 3, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Command didn't end after the client was interrupted")
+	}
+	if !strings.Contains(out.String(), "interrupted") {
+		t.Errorf("Expected the command to be interrupted, got %q", out.String())
+	}
+}
+
+func TestExecReportsKillingSignal(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// Killed by SIGKILL and exiting 137 have the same status, but only
+	// one has a signal
+	tests := []struct {
+		command string
+		want    core.ExitError
+	}{
+		{"kill -KILL $$", core.ExitError{Code: 137, Signal: "KILL"}},
+		{"exit 137", core.ExitError{Code: 137}},
+	}
+	for _, tt := range tests {
+		client := core.NewClient(context.Background(), srv.URL(), srv.AuthToken)
+		client.SetIO(strings.NewReader(""), io.Discard)
+		client.SetCommand(tt.command)
+		var exitErr *core.ExitError
+		if err := client.Connect(); !errors.As(err, &exitErr) || *exitErr != tt.want {
+			t.Errorf("%s: got %v, want %+v", tt.command, err, tt.want)
+		}
+	}
+}
+
+func TestExecIdleTimeoutIgnoresOutput(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetSessionTimeouts(time.Second, 0)
+	time.Sleep(100 * time.Millisecond)
+
+	// Only the client's input keeps a session from going idle, not what
+	// the command prints
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-reconnect", "0", "-c",
+		`while :; do echo tick; sleep 0.2; done`)
+	var out syncBuffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Session printing output was never idle")
+	}
+	for _, want := range []string{"tick", "idle"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output %q doesn't contain %q", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+//go:build unix && faults
+// +build unix,faults
+
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run with go test -tags faults
+
+func setFaults(t *testing.T, srv *TestServer, faults string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:%d/api/v1/faults?token=%s", srv.Port, srv.AuthToken), strings.NewReader(faults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Setting faults returned %s", resp.Status)
+	}
+}
+
+func TestClientResumesThroughCutConnections(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetResumeTimeout(time.Minute)
+	time.Sleep(100 * time.Millisecond)
+	setFaults(t, srv, `{"cut_connections": 0.5}`)
+
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-c", "for i in 1 2 3 4 5 6; do sleep 0.5; done; echo survived-$((6*7))").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "survived-42") {
+		t.Fatalf("Session didn't survive cut connections: %v, output %q", err, out)
+	}
+}
+
+func TestClientEndsWithKilledSession(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetResumeTimeout(time.Minute)
+	time.Sleep(100 * time.Millisecond)
+	setFaults(t, srv, `{"kill_sessions": 1}`)
+
+	// The client leaves, rather than trying to resume the session
+	start := time.Now()
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-c", "sleep 10; echo not-killed").CombinedOutput()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Client took %v to end, output %q", elapsed, out)
+	}
+	if strings.Contains(string(out), "not-killed") || strings.Contains(string(out), "reconnecting") {
+		t.Fatalf("Session wasn't killed cleanly: %v, output %q", err, out)
+	}
+}
@@ -0,0 +1,116 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+// writeHook writes an executable shell script
+func writeHook(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("Failed to write hook: %v", err)
+	}
+	return path
+}
+
+func TestSessionHooksRun(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	logPath := filepath.Join(t.TempDir(), "hooks.log")
+	start := writeHook(t, `echo "start $FLYSSH_SESSION_ID $FLYSSH_COMMAND" >> `+logPath+"\n")
+	end := writeHook(t, `echo "end $FLYSSH_SESSION_ID $FLYSSH_EXIT_CODE" >> `+logPath+"\n")
+	srv.Server.SetSessionHooks(start, end)
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := core.DialMux(context.Background(), srv.URL(), srv.AuthToken)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	sess, err := client.Open("")
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	sess.Write([]byte("exit 3\n"))
+	io.Copy(io.Discard, sess)
+
+	want := "start " + sess.ID + " /bin/sh\nend " + sess.ID + " 3\n"
+	deadline := time.Now().Add(5 * time.Second)
+	var got []byte
+	for time.Now().Before(deadline) {
+		got, _ = os.ReadFile(logPath)
+		if string(got) == want {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("Hooks logged %q, want %q", got, want)
+}
+
+func TestFailingStartHookRefusesSession(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetSessionHooks(writeHook(t, "echo no volume for $FLYSSH_USER; exit 1\n"), "")
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := core.DialMux(context.Background(), srv.URL(), srv.AuthToken)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.Open("")
+	if err == nil {
+		t.Fatal("Expected session to be refused")
+	}
+	if !strings.Contains(err.Error(), "start hook failed") || strings.Contains(err.Error(), "no volume") {
+		t.Errorf("Expected generic refusal without hook output, got %v", err)
+	}
+	if n := len(srv.Server.Sessions().List()); n != 0 {
+		t.Errorf("Expected no sessions, got %d", n)
+	}
+}
+
+func TestUnrecordableSessionRunsNoHooks(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	logPath := filepath.Join(t.TempDir(), "hooks.log")
+	start := writeHook(t, `echo start >> `+logPath+"\n")
+	end := writeHook(t, `echo end >> `+logPath+"\n")
+	srv.Server.SetSessionHooks(start, end)
+
+	// Recordings can't be written under a file
+	blocker := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(blocker, nil, 0600)
+	srv.Server.SetRecording(filepath.Join(blocker, "recordings"), "", false)
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := core.DialMux(context.Background(), srv.URL(), srv.AuthToken)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.Open("")
+	if err == nil || !strings.Contains(err.Error(), "recording failed") {
+		t.Fatalf("Expected session to be refused for its recording, got %v", err)
+	}
+	if n := len(srv.Server.Sessions().List()); n != 0 {
+		t.Errorf("Expected no sessions, got %d", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got, _ := os.ReadFile(logPath); len(got) != 0 {
+		t.Errorf("Expected no hooks to run, got %q", got)
+	}
+}
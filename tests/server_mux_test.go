@@ -0,0 +1,104 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+func TestMultiplexedSessions(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := core.DialMux(context.Background(), srv.URL(), srv.AuthToken)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	first, err := client.Open("")
+	if err != nil {
+		t.Fatalf("Failed to open first session: %v", err)
+	}
+	second, err := client.Open("")
+	if err != nil {
+		t.Fatalf("Failed to open second session: %v", err)
+	}
+	if first.ID == second.ID {
+		t.Fatalf("Expected separate sessions, both are %s", first.ID)
+	}
+
+	var out1, out2 syncBuffer
+	secondDone := make(chan struct{})
+	go io.Copy(&out1, first)
+	go func() {
+		io.Copy(&out2, second)
+		close(secondDone)
+	}()
+
+	// Each channel has its own PTY and size
+	if err := second.Resize(33, 111); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	first.Write([]byte("echo first-$((1+1))\n"))
+	second.Write([]byte("echo second-$((2+2)); stty size\n"))
+	out1.waitFor(t, "first-2", 5*time.Second)
+	out2.waitFor(t, "second-4", 5*time.Second)
+	out2.waitFor(t, "33 111", 5*time.Second)
+	if strings.Contains(out1.String(), "second-4") || strings.Contains(out2.String(), "first-2") {
+		t.Error("Output leaked between channels")
+	}
+
+	// Closing one session leaves the other running
+	if err := first.Close(); err != nil {
+		t.Fatalf("Failed to close session: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Server.Sessions().List()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := len(srv.Server.Sessions().List()); n != 1 {
+		t.Fatalf("Expected 1 session after closing one, got %d", n)
+	}
+	second.Write([]byte("echo still-$((3+3))\n"))
+	out2.waitFor(t, "still-6", 5*time.Second)
+
+	// Sessions that exit end their channel
+	second.Write([]byte("exit\n"))
+	select {
+	case <-secondDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session output didn't end after exit")
+	}
+}
+
+func TestMultiplexedLauncherDenied(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := core.DialMux(context.Background(), srv.URL(), srv.AuthToken)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Open("missing"); err == nil {
+		t.Fatal("Expected unknown launcher to be rejected")
+	}
+
+	// A rejected channel doesn't affect the connection
+	sess, err := client.Open("")
+	if err != nil {
+		t.Fatalf("Failed to open session after rejection: %v", err)
+	}
+	sess.Close()
+}
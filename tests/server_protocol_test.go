@@ -0,0 +1,123 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/net/websocket"
+)
+
+func TestProtocolNegotiation(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	url := fmt.Sprintf("%s?token=%s", srv.URL(), srv.AuthToken)
+
+	// Clients that ask for no protocol aren't told one, and get v1
+	tests := []struct {
+		name      string
+		protocols []string
+		want      string
+		raw       bool // the session speaks v1
+		wantErr   bool
+	}{
+		{"no protocol falls back to v1", nil, "", true, false},
+		{"v1 only", []string{"flyssh.v1"}, "flyssh.v1", true, false},
+		{"v2 preferred", []string{"flyssh.v1", "flyssh.v2"}, "flyssh.v2", false, false},
+		{"unknown protocol", []string{"flyssh.v99"}, "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := websocket.NewConfig(url, "http://localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Protocol = tt.protocols
+			ws, err := websocket.DialConfig(config)
+			if tt.wantErr {
+				if err == nil {
+					ws.Close()
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer ws.Close()
+
+			got := ""
+			if len(ws.Config().Protocol) == 1 {
+				got = ws.Config().Protocol[0]
+			}
+			if got != tt.want {
+				t.Errorf("Expected protocol %q, got %q", tt.want, got)
+			}
+			if tt.raw {
+				checkRawSession(t, ws)
+			}
+		})
+	}
+}
+
+// checkRawSession checks a connection speaks flyssh.v1: a JSON message
+// with the session's ID, then the terminal as raw bytes
+func checkRawSession(t *testing.T, ws *websocket.Conn) {
+	t.Helper()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		Type      string `json:"type"`
+		SessionID string `json:"session_id"`
+	}
+	if err := websocket.JSON.Receive(ws, &msg); err != nil || msg.Type != "session" || msg.SessionID == "" {
+		t.Fatalf("Expected the session's ID, got %+v, %v", msg, err)
+	}
+	if _, err := ws.Write([]byte("echo raw-$((1+1))\n")); err != nil {
+		t.Fatalf("Failed to write input: %v", err)
+	}
+	var out strings.Builder
+	buf := make([]byte, 4096)
+	for !strings.Contains(out.String(), "raw-2") {
+		n, err := ws.Read(buf)
+		if err != nil {
+			t.Fatalf("Expected the command's output, got %q: %v", out.String(), err)
+		}
+		out.Write(buf[:n])
+	}
+}
+
+func TestClientResizeOverV2(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken)
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: 33, Cols: 111})
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		ptmx.Close()
+	}()
+
+	pt := &PTYTest{PTY: ptmx, Done: make(chan bool)}
+	time.Sleep(500 * time.Millisecond)
+	pt.MonitorOutput(t, "33 111")
+	if _, err := ptmx.Write([]byte("stty size\n")); err != nil {
+		t.Fatalf("Failed to write command: %v", err)
+	}
+	if err := pt.WaitForOutput(t, "33 111", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
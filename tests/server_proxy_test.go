@@ -0,0 +1,100 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+// startEchoTarget listens for one connection, echoing what it reads and
+// then "bye" once the input ends
+func startEchoTarget(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+		conn.Write([]byte("bye"))
+	}()
+	return ln.Addr().String()
+}
+
+func TestStdioProxyRelaysToSSHTarget(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetSSHTarget(startEchoTarget(t))
+	time.Sleep(100 * time.Millisecond)
+
+	// The target sees the end of the input and still gets to answer
+	cmd := exec.Command(ClientBinaryPath, "stdio-proxy", "-s", srv.URL(), "-token", srv.AuthToken)
+	cmd.Stdin = strings.NewReader("hello\n")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	done := make(chan error, 1)
+	go func() { done <- cmd.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("stdio-proxy failed: %v: %s", err, stderr.String())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("stdio-proxy didn't exit after its input ended")
+	}
+	if got := stdout.String(); got != "hello\nbye" {
+		t.Errorf("Expected the target's output only, got %q", got)
+	}
+}
+
+func TestStdioProxyRefusedWithoutSSHTarget(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	cmd := exec.Command(ClientBinaryPath, "stdio-proxy", "-s", srv.URL(), "-token", srv.AuthToken)
+	cmd.Stdin = strings.NewReader("hello\n")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "does not proxy to SSH") {
+		t.Errorf("Expected the proxy to be refused, got %v: %s", err, out)
+	}
+}
+
+func TestProxyStdioEndsWithContext(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetSSHTarget(startEchoTarget(t))
+	time.Sleep(100 * time.Millisecond)
+
+	// Input that never ends would otherwise keep the proxy open
+	in, w := io.Pipe()
+	defer w.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- core.ProxyStdio(ctx, srv.URL(), srv.AuthToken, core.HostKeyOff, in, io.Discard) }()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected the proxy to end with its context, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProxyStdio didn't return after its context was done")
+	}
+}
@@ -0,0 +1,74 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+func TestRendezvousReachesAgentBehindNAT(t *testing.T) {
+	t.Setenv("WSS_AUTH_TOKEN", "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	rv := core.NewRendezvous(0, "agent-token")
+	go rv.Serve(ctx, ln)
+	relay := "ws://" + ln.Addr().String()
+
+	if _, err := core.ListenRendezvous(ctx, relay, "box", "wrong-token", core.HostKeyAsk); err == nil {
+		t.Fatal("Expected an agent with the wrong token to be refused")
+	}
+
+	// The agent serves only through the rendezvous, listening on nothing
+	agentLn, err := core.ListenRendezvous(ctx, relay, "box", "agent-token", core.HostKeyAsk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := core.NewServer(0)
+	srv.SetAuthToken("agent-session-token")
+	go srv.Serve(ctx, agentLn)
+
+	var stdout bytes.Buffer
+	clientCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := core.NewClient(clientCtx, relay+"/to/box", "agent-session-token")
+	client.SetIO(strings.NewReader(""), &stdout)
+	client.SetCommand("echo through-$((1+1))")
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Session through the rendezvous failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "through-2") {
+		t.Errorf("Expected the command's output, got %q", stdout.String())
+	}
+
+	// The agent authenticates clients, and its HTTP API is reachable too
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/to/box/api/v1/sessions?token=agent-session-token", http.StatusOK},
+		{"/to/box/api/v1/sessions?token=agent-token", http.StatusUnauthorized},
+		{"/to/nobody/healthz", http.StatusBadGateway},
+	} {
+		resp, err := http.Get("http://" + ln.Addr().String() + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("Expected %s to get %d, got %d", tt.path, tt.status, resp.StatusCode)
+		}
+	}
+}
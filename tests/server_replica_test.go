@@ -0,0 +1,115 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+func TestReplicaFollowsSessions(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	port, err := GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	replica := core.NewReplica(context.Background(), port, fmt.Sprintf("http://localhost:%d", srv.Port), srv.AuthToken)
+	go replica.Start()
+	defer replica.Stop()
+	api := fmt.Sprintf("http://localhost:%d/api/v1/sessions?token=%s", port, srv.AuthToken)
+
+	// waitSessions polls the replica until check accepts its session list
+	waitSessions := func(what string, check func([]core.Session) bool) {
+		t.Helper()
+		var sessions []core.Session
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			sessions = nil
+			if resp, err := http.Get(api); err == nil {
+				json.NewDecoder(resp.Body).Decode(&sessions)
+				resp.Body.Close()
+				if check(sessions) {
+					return
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("Timeout waiting for replica to show %s, got %+v", what, sessions)
+	}
+
+	client, err := core.DialMux(context.Background(), srv.URL(), srv.AuthToken)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	sess, err := client.Open("")
+	if err != nil {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	waitSessions("the new session", func(list []core.Session) bool {
+		return len(list) == 1 && list[0].ID == sess.ID
+	})
+
+	if err := sess.Resize(30, 100); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	waitSessions("the resize", func(list []core.Session) bool {
+		return len(list) == 1 && list[0].Rows == 30 && list[0].Cols == 100
+	})
+
+	// The replica can't change anything
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://localhost:%d/api/v1/sessions/%s?token=%s", port, sess.ID[1:], srv.AuthToken), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send DELETE: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE on replica returned %s", resp.Status)
+	}
+
+	sess.Close()
+	waitSessions("no sessions", func(list []core.Session) bool { return len(list) == 0 })
+}
+
+func TestReplicaReconnectsWhenQuiet(t *testing.T) {
+	// An upstream whose streams send their snapshot, then nothing, as if
+	// the connection died without closing
+	var streams atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streams.Add(1)
+		json.NewEncoder(w).Encode(core.Event{Type: core.EventSnapshot, Time: time.Now()})
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	port, err := GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	replica := core.NewReplica(context.Background(), port, upstream.URL, "token")
+	replica.SetIdleTimeout(200 * time.Millisecond)
+	go replica.Start()
+	defer replica.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for streams.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := streams.Load(); n < 2 {
+		t.Fatalf("Expected the replica to reconnect to a quiet stream, got %d streams", n)
+	}
+}
@@ -0,0 +1,244 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// flakyProxy forwards TCP connections to a server and can drop them all
+// to simulate a network failure
+type flakyProxy struct {
+	ln     net.Listener
+	target string
+	mu     sync.Mutex
+	conns  []net.Conn
+}
+
+func newFlakyProxy(t *testing.T, target string) *flakyProxy {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := &flakyProxy{ln: ln, target: target}
+	go p.serve()
+	return p
+}
+
+func (p *flakyProxy) serve() {
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, client, server)
+		p.mu.Unlock()
+		go func() { io.Copy(server, client); server.Close() }()
+		go func() { io.Copy(client, server); client.Close() }()
+	}
+}
+
+// drop closes every proxied connection
+func (p *flakyProxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func (p *flakyProxy) URL() string {
+	return "ws://" + p.ln.Addr().String()
+}
+
+func (p *flakyProxy) Close() {
+	p.ln.Close()
+	p.drop()
+}
+
+// syncBuffer collects output from a reader goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) waitFor(t *testing.T, target string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if strings.Contains(b.String(), target) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for %q. Got so far: %q", target, b.String())
+}
+
+func TestClientResumesAfterConnectionDrop(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetResumeTimeout(30 * time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	proxy := newFlakyProxy(t, fmt.Sprintf("localhost:%d", srv.Port))
+	defer proxy.Close()
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", proxy.URL(), "-token", srv.AuthToken, "-reconnect", "20s")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		ptmx.Close()
+	}()
+
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	time.Sleep(500 * time.Millisecond)
+
+	// Shell state set before the drop must survive it
+	if _, err := ptmx.Write([]byte("X=resumed; echo set-$X\n")); err != nil {
+		t.Fatalf("Failed to write command: %v", err)
+	}
+	out.waitFor(t, "set-resumed", 5*time.Second)
+
+	proxy.drop()
+	out.waitFor(t, "reconnected", 10*time.Second)
+
+	if _, err := ptmx.Write([]byte("echo still-$X\n")); err != nil {
+		t.Fatalf("Failed to write command: %v", err)
+	}
+	out.waitFor(t, "still-resumed", 5*time.Second)
+
+	if n := len(srv.Server.Sessions().List()); n != 1 {
+		t.Errorf("Expected the original session to be reused, got %d sessions", n)
+	}
+}
+
+func TestServerDetachesSilentClient(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetResumeTimeout(30 * time.Second)
+	srv.Server.SetKeepalive(100 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-keepalive", "100ms")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGCONT)
+		cmd.Process.Kill()
+		cmd.Wait()
+		ptmx.Close()
+	}()
+
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	ptmx.Write([]byte("echo alive-$((1+1))\n"))
+	out.waitFor(t, "alive-2", 5*time.Second)
+
+	detached := func() bool {
+		sessions := srv.Server.Sessions().List()
+		return len(sessions) == 1 && sessions[0].Detached
+	}
+
+	// Keepalives flow both ways while the client is healthy
+	time.Sleep(500 * time.Millisecond)
+	if detached() {
+		t.Fatal("Session detached from a healthy client")
+	}
+
+	// A client that stops responding, with its TCP connection still open,
+	// is dropped after a few missed pings
+	if err := cmd.Process.Signal(syscall.SIGSTOP); err != nil {
+		t.Fatalf("Failed to stop client: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !detached() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !detached() {
+		t.Fatal("Expected session of silent client to be detached")
+	}
+}
+
+func TestServerDetachesStalledClient(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetResumeTimeout(30 * time.Second)
+	srv.Server.SetKeepalive(0)
+	srv.Server.SetWriteTimeout(300 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-keepalive", "0")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGCONT)
+		cmd.Process.Kill()
+		cmd.Wait()
+		ptmx.Close()
+	}()
+
+	var out syncBuffer
+	go io.Copy(&out, ptmx)
+	ptmx.Write([]byte("echo alive-$((1+1))\n"))
+	out.waitFor(t, "alive-2", 5*time.Second)
+
+	detached := func() bool {
+		sessions := srv.Server.Sessions().List()
+		return len(sessions) == 1 && sessions[0].Detached
+	}
+
+	// A client that stops reading while output floods in is dropped once
+	// a write takes too long, with no keepalives to notice it
+	ptmx.Write([]byte("sleep 0.5; yes\n"))
+	time.Sleep(100 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGSTOP); err != nil {
+		t.Fatalf("Failed to stop client: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !detached() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !detached() {
+		t.Fatal("Expected session of stalled client to be detached")
+	}
+}
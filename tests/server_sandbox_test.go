@@ -0,0 +1,260 @@
+//go:build linux
+// +build linux
+
+package tests
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"flyssh/core"
+
+	"github.com/creack/pty"
+)
+
+func TestSandboxConfinesSessions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandboxing needs root")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	dir := filepath.Join(t.TempDir(), "scratch")
+	sb, err := core.NewSandbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to set up sandbox: %v", err)
+	}
+	srv.Server.SetSandbox(sb)
+	time.Sleep(100 * time.Millisecond)
+
+	script := `touch /etc/flyssh-sandbox-test 2>/dev/null && echo root-writable
+echo scratch > /tmp/file && cat /tmp/file
+echo pid-$$ procs-$(ls /proc | grep -c '^[0-9]')`
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run client: %v, output %q", err, out)
+	}
+	output := string(out)
+	if strings.Contains(output, "root-writable") {
+		os.Remove("/etc/flyssh-sandbox-test")
+		t.Error("Session could write outside its scratch directory")
+	}
+	for _, want := range []string{"scratch", "pid-1 "} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output %q doesn't contain %q", output, want)
+		}
+	}
+
+	// The scratch directory goes with the session
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if entries, _ := os.ReadDir(dir); len(entries) == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("Scratch directory wasn't removed")
+}
+
+func TestSandboxedLoginSession(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandboxing needs root")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	sb, err := core.NewSandbox(filepath.Join(t.TempDir(), "scratch"), 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to set up sandbox: %v", err)
+	}
+	srv.Server.SetSandbox(sb)
+	time.Sleep(100 * time.Millisecond)
+
+	// The sandbox is set up as root, then the session becomes the user
+	script := `echo uid-$(id -u) groups-$(id -G)
+echo scratch > /tmp/file && cat /tmp/file`
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-login", "nobody", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run client: %v, output %q", err, out)
+	}
+	// Root's groups are dropped too
+	for _, want := range []string{"uid-65534 groups-65534\n", "scratch"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Output %q doesn't contain %q", out, want)
+		}
+	}
+}
+
+func TestSandboxedSessionCantRemount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandboxing needs root")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	sb, err := core.NewSandbox(filepath.Join(t.TempDir(), "scratch"), 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to set up sandbox: %v", err)
+	}
+	srv.Server.SetSandbox(sb)
+	time.Sleep(100 * time.Millisecond)
+
+	// Sessions that would be root aren't, and have no capabilities left
+	// to undo the read-only mounts with
+	script := `echo uid-$(id -u) $(grep CapBnd /proc/self/status)
+mount -o remount,rw / 2>/dev/null && echo remounted
+touch /etc/flyssh-sandbox-test 2>/dev/null && echo root-writable
+echo done`
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run client: %v, output %q", err, out)
+	}
+	output := string(out)
+	if strings.Contains(output, "remounted") || strings.Contains(output, "root-writable") {
+		os.Remove("/etc/flyssh-sandbox-test")
+		t.Errorf("Session could remount / read-write: %q", output)
+	}
+	for _, want := range []string{"uid-65534 ", "CapBnd: 0000000000000000", "done"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output %q doesn't contain %q", output, want)
+		}
+	}
+}
+
+func TestSandboxedSessionDotfiles(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandboxing needs root")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	sb, err := core.NewSandbox(filepath.Join(t.TempDir(), "scratch"), 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to set up sandbox: %v", err)
+	}
+	srv.Server.SetSandbox(sb)
+	time.Sleep(100 * time.Millisecond)
+
+	// The host's temporary directory is hidden, so the dotfiles are
+	// written where the session can see them
+	inputrc := filepath.Join(t.TempDir(), ".inputrc")
+	if err := os.WriteFile(inputrc, []byte("set bell-style none\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken,
+		"-reconnect", "0", "-login", "nobody", "-dotfiles", inputrc, "-c", "cat $INPUTRC").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "set bell-style none") {
+		t.Errorf("Expected the session to have the .inputrc, got %v: %q", err, out)
+	}
+}
+
+// buildJail makes a directory sessions can be jailed in, holding the
+// host's programs and libraries read-only
+func buildJail(t *testing.T) string {
+	root := t.TempDir()
+	for _, name := range []string{"usr", "bin", "lib", "lib64"} {
+		host := "/" + name
+		fi, err := os.Lstat(host)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(root, name)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, _ := os.Readlink(host)
+			os.Symlink(target, path)
+			continue
+		}
+		os.Mkdir(path, 0755)
+		if err := syscall.Mount(host, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			t.Fatalf("Failed to mount %s in jail: %v", host, err)
+		}
+		t.Cleanup(func() { syscall.Unmount(path, syscall.MNT_DETACH) })
+		syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	}
+	return root
+}
+
+func TestChrootConfinesSessions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot jails need root")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	j, err := core.NewJail(buildJail(t))
+	if err != nil {
+		t.Fatalf("Failed to set up jail: %v", err)
+	}
+	srv.Server.SetJail(j)
+	time.Sleep(100 * time.Millisecond)
+
+	script := `test -e /home || test -e /etc || echo host-hidden
+test -c /dev/null && test -c /dev/urandom && test -d /dev/pts && echo dev-ok
+ls /dev | grep -q -e '^sd' -e '^nvme' -e '^vd' || echo no-disks
+test "$(ls /dev/pts)" = ptmx && echo pts-private
+chroot / true 2>/dev/null && echo chrooted
+echo uid-$(id -u) pid-$$ procs-$(ls /proc | grep -c '^[0-9]') in-$(pwd)`
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-dir", "/usr", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run client: %v, output %q", err, out)
+	}
+	output := string(out)
+	if strings.Contains(output, "chrooted") {
+		t.Errorf("Session could change root again: %q", output)
+	}
+	// Sessions that would be root run as nobody
+	for _, want := range []string{"host-hidden", "dev-ok", "no-disks", "pts-private", "uid-65534 pid-1 ", "in-/usr"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output %q doesn't contain %q", output, want)
+		}
+	}
+
+	// Interactive sessions get their terminal inside the jail, as its
+	// console
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start client: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		ptmx.Close()
+	}()
+	var term syncBuffer
+	go io.Copy(&term, ptmx)
+	time.Sleep(500 * time.Millisecond)
+	ptmx.Write([]byte("tty; echo in-$(pwd)\n"))
+	term.waitFor(t, "in-/\r", 5*time.Second)
+	if !strings.Contains(term.String(), "/dev/console") {
+		t.Errorf("Session has no terminal inside the jail: %q", term.String())
+	}
+}
+
+func TestChrootedLoginSession(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot jails need root")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	j, err := core.NewJail(buildJail(t))
+	if err != nil {
+		t.Fatalf("Failed to set up jail: %v", err)
+	}
+	srv.Server.SetJail(j)
+	time.Sleep(100 * time.Millisecond)
+
+	// The jail is entered as root, then the session becomes the user
+	script := `echo uid-$(id -u) groups-$(id -G)
+test -e /etc || echo host-hidden`
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-login", "nobody", "-dir", "/usr", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run client: %v, output %q", err, out)
+	}
+	for _, want := range []string{"uid-65534 groups-65534\n", "host-hidden"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Output %q doesn't contain %q", out, want)
+		}
+	}
+}
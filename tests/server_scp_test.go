@@ -0,0 +1,259 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+func TestExecKeepsStderrSeparate(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// Piped input means no PTY, so stdout must be exactly what was written
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-c", `printf 'out\0\r\n'; printf err >&2; exit 3`)
+	cmd.Stdin = strings.NewReader("")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("Expected exit code 3, got %v", err)
+	}
+	if got := stdout.String(); got != "out\x00\r\n" {
+		t.Errorf("Stdout = %q, want exactly the command's output", got)
+	}
+	if !strings.Contains(stderr.String(), "err") {
+		t.Errorf("Stderr %q doesn't contain the command's errors", stderr.String())
+	}
+}
+
+func TestSCPThroughSSHCommand(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not installed")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// scp runs its -S program with ssh's arguments
+	dir := t.TempDir()
+	sshPath := filepath.Join(dir, "flyssh-ssh")
+	if err := os.Symlink(ClientBinaryPath, sshPath); err != nil {
+		t.Fatalf("Failed to link flyssh-ssh: %v", err)
+	}
+	scp := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("scp", append([]string{"-O", "-S", sshPath}, args...)...)
+		cmd.Env = append(os.Environ(), "WSS_URL="+srv.URL(), "WSS_AUTH_TOKEN="+srv.AuthToken)
+		return cmd.CombinedOutput()
+	}
+
+	// Every byte value must survive the trip both ways
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	src := filepath.Join(dir, "src.bin")
+	os.WriteFile(src, data, 0644)
+	remote := filepath.Join(dir, "remote")
+	os.Mkdir(remote, 0755)
+
+	if out, err := scp(src, "server:"+remote+"/"); err != nil {
+		t.Fatalf("Upload failed: %v: %s", err, out)
+	}
+	if got, _ := os.ReadFile(filepath.Join(remote, "src.bin")); !bytes.Equal(got, data) {
+		t.Fatalf("Uploaded file differs: %d bytes, want %d", len(got), len(data))
+	}
+	back := filepath.Join(dir, "back.bin")
+	if out, err := scp("server:"+filepath.Join(remote, "src.bin"), back); err != nil {
+		t.Fatalf("Download failed: %v: %s", err, out)
+	}
+	if got, _ := os.ReadFile(back); !bytes.Equal(got, data) {
+		t.Fatalf("Downloaded file differs: %d bytes, want %d", len(got), len(data))
+	}
+
+	// Failures on the server fail scp
+	out, err := scp(src, "server:"+filepath.Join(dir, "missing", "dir")+"/")
+	if err == nil {
+		t.Fatalf("Upload to a missing directory succeeded: %s", out)
+	}
+	if !strings.Contains(string(out), "No such file or directory") {
+		t.Errorf("Output %q doesn't explain the failure", out)
+	}
+}
+
+func TestExecWithoutPTYFromTerminal(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// Typed input would get the command a PTY, which turns \n into \r\n
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Fatalf("Failed to open PTY: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-T", "-c", `printf 'a\nb\r'`)
+	cmd.Stdin = tty
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	done := make(chan error, 1)
+	go func() { done <- cmd.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Client failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("Client didn't exit after its command")
+	}
+	if got := stdout.String(); got != "a\nb\r" {
+		t.Errorf("Stdout = %q, want exactly the command's output", got)
+	}
+}
+
+func TestGitThroughSSHCommand(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	dir := t.TempDir()
+	git := func(dir string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_SSH_COMMAND="+ClientBinaryPath+" ssh",
+			"WSS_URL="+srv.URL(), "WSS_AUTH_TOKEN="+srv.AuthToken,
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	remote := filepath.Join(dir, "remote.git")
+	git(dir, "init", "--bare", remote)
+
+	// Push a commit through the bridge, then clone it back
+	work := filepath.Join(dir, "work")
+	git(dir, "init", work)
+	os.WriteFile(filepath.Join(work, "file"), []byte("pushed\n"), 0644)
+	git(work, "add", "file")
+	git(work, "commit", "-m", "first")
+	git(work, "push", "server:"+remote, "HEAD:refs/heads/main")
+	clone := filepath.Join(dir, "clone")
+	git(dir, "clone", "-b", "main", "server:"+remote, clone)
+	if got, _ := os.ReadFile(filepath.Join(clone, "file")); string(got) != "pushed\n" {
+		t.Errorf("Cloned file = %q, want what was pushed", got)
+	}
+}
+
+func TestGitWrapperRoutesByConfig(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// The config file names the server; any other host goes to ssh, here
+	// one that only says how it was run
+	dir := t.TempDir()
+	home := filepath.Join(dir, "home")
+	os.Mkdir(home, 0700)
+	config := "Host bridged\n  URL " + srv.URL() + "\n  Token " + srv.AuthToken + "\n"
+	os.WriteFile(filepath.Join(home, "config"), []byte(config), 0600)
+	bin := filepath.Join(dir, "bin")
+	os.Mkdir(bin, 0755)
+	os.WriteFile(filepath.Join(bin, "ssh"), []byte("#!/bin/sh\necho \"ssh $*\"\n"), 0755)
+	env := append(os.Environ(), "FLYSSH_HOME="+home, "PATH="+bin+":"+os.Getenv("PATH"), "WSS_URL=", "WSS_AUTH_TOKEN=")
+
+	remote := filepath.Join(dir, "remote.git")
+	if out, err := exec.Command("git", "init", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v: %s", err, out)
+	}
+	clone := exec.Command("git", "-c", "core.sshCommand="+ClientBinaryPath+" git-wrapper", "clone", "bridged:"+remote, filepath.Join(dir, "clone"))
+	clone.Env = env
+	if out, err := clone.CombinedOutput(); err != nil {
+		t.Fatalf("Clone through the wrapper failed: %v: %s", err, out)
+	}
+
+	other := exec.Command(ClientBinaryPath, "git-wrapper", "-p", "2222", "github.com", "git-upload-pack 'repo.git'")
+	other.Env = env
+	out, err := other.Output()
+	if err != nil || string(out) != "ssh -p 2222 github.com git-upload-pack 'repo.git'\n" {
+		t.Errorf("Expected other hosts to go to ssh, got %v: %q", err, out)
+	}
+}
+
+func TestSSHCommandExitCodes(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	// As with ssh, the command's status is flyssh's, and flyssh's own
+	// failures are 255; stdout has nothing but the command's output
+	run := func(token string, args ...string) (string, int) {
+		cmd := exec.Command(ClientBinaryPath, append([]string{"ssh", "-o", `User=""`, "server"}, args...)...)
+		cmd.Env = append(os.Environ(), "WSS_URL="+srv.URL(), "WSS_AUTH_TOKEN="+token)
+		cmd.Stdin = strings.NewReader("")
+		out, err := cmd.Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(out), exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("Failed to run flyssh ssh: %v", err)
+		}
+		return string(out), 0
+	}
+	if out, code := run(srv.AuthToken, "printf ok"); out != "ok" || code != 0 {
+		t.Errorf("Expected exactly the command's output, got %q, status %d", out, code)
+	}
+	if _, code := run(srv.AuthToken, "exit 7"); code != 7 {
+		t.Errorf("Expected the command's status 7, got %d", code)
+	}
+	if out, code := run("wrong-token", "printf ok"); out != "" || code != 255 {
+		t.Errorf("Expected status 255 for a failed connection, got %q, status %d", out, code)
+	}
+}
+
+func TestRsyncThroughFlyssh(t *testing.T) {
+	if _, err := exec.LookPath("rsync"); err != nil {
+		t.Skip("rsync not installed")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(src, "sub", "data.bin"), data, 0644)
+
+	dst := filepath.Join(dir, "dst")
+	cmd := exec.Command(ClientBinaryPath, "rsync", "-url", srv.URL(), "-token", srv.AuthToken, "--", "-a", src+"/", "server:"+dst+"/")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("rsync failed: %v: %s", err, out)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "sub", "data.bin")); !bytes.Equal(got, data) {
+		t.Errorf("Synced file differs: %d bytes, want %d", len(got), len(data))
+	}
+}
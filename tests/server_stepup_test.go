@@ -0,0 +1,152 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"flyssh/core"
+)
+
+func TestLauncherStepUp(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := fmt.Sprintf("http://localhost:%d", srv.Port)
+	credID := base64.RawURLEncoding.EncodeToString([]byte("yubikey"))
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "launchers.json")
+	cfg := fmt.Sprintf(`{
+		"launchers": {"prod": {"command": ["echo", "stepped-up"], "step_up": true}},
+		"webauthn": {"origin": %q, "credentials": [{"name": "yubikey", "id": %q, "public_key": %q}]}
+	}`, origin, credID, base64.StdEncoding.EncodeToString(der))
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	launchers, err := core.LoadLauncherConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Server.SetLaunchers(launchers)
+	time.Sleep(100 * time.Millisecond)
+
+	// The "browser" just records the page it's asked to open
+	opened := filepath.Join(dir, "opened")
+	browser := filepath.Join(dir, "browser")
+	if err := os.WriteFile(browser, []byte("#!/bin/sh\necho \"$1\" > "+opened+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-launch", "prod")
+	cmd.Env = append(os.Environ(), "BROWSER="+browser)
+	// Input stays open, as a user's would, until the launcher exits
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	var out syncBuffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	defer cmd.Process.Kill()
+
+	out.waitFor(t, "needs your security key", 5*time.Second)
+	var page string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if data, err := os.ReadFile(opened); err == nil && len(data) > 0 {
+			page = strings.TrimSpace(string(data))
+			break
+		}
+	}
+	if !strings.HasPrefix(page, origin+"/webauthn/") {
+		t.Fatalf("Expected the browser to open the step-up page, got %q", page)
+	}
+	if strings.Contains(out.String(), "stepped-up") {
+		t.Fatal("Launcher ran before the step-up")
+	}
+
+	// Sign the page's challenge as the browser and security key would
+	resp, err := http.Get(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	m := regexp.MustCompile(`challenge: fromB64\("([^"]+)"\)`).FindSubmatch(html)
+	if m == nil {
+		t.Fatalf("No challenge in the step-up page: %s", html)
+	}
+	clientData, _ := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": string(m[1]), "origin": origin})
+	rpHash := sha256.Sum256([]byte("localhost"))
+	authData := append(rpHash[:], 0x01, 0, 0, 0, 1)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, _ := json.Marshal(map[string]string{
+		"id":                 credID,
+		"client_data":        base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticator_data": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":          base64.RawURLEncoding.EncodeToString(sig),
+	})
+	resp, err = http.Post(page, "application/json", bytes.NewReader(assertion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the assertion to be accepted, got %s", resp.Status)
+	}
+
+	out.waitFor(t, "stepped-up", 5*time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Client failed: %v: %s", err, out.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client didn't exit after the launcher ran")
+	}
+
+	// The page is gone once used
+	resp, err = http.Post(page, "application/json", bytes.NewReader(assertion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a used step-up page to be gone, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCpCopiesFilesBothWays(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	dir := t.TempDir()
+	cp := func(args ...string) (string, error) {
+		args = append([]string{"cp", "-url", srv.URL(), "-token", srv.AuthToken, "-q"}, args...)
+		out, err := exec.Command(ClientBinaryPath, args...).CombinedOutput()
+		return string(out), err
+	}
+
+	data := make([]byte, 300<<10)
+	rand.Read(data)
+	src := filepath.Join(dir, "src.bin")
+	os.WriteFile(src, data, 0600)
+
+	// Upload, then download it again
+	remote := filepath.Join(dir, "remote.bin")
+	if out, err := cp(src, ":"+remote); err != nil {
+		t.Fatalf("Upload failed: %v: %s", err, out)
+	}
+	back := filepath.Join(dir, "back.bin")
+	if out, err := cp(":"+remote, back); err != nil {
+		t.Fatalf("Download failed: %v: %s", err, out)
+	}
+	if got, _ := os.ReadFile(back); !bytes.Equal(got, data) {
+		t.Fatalf("Round trip changed the file: got %d bytes, want %d", len(got), len(data))
+	}
+
+	// A destination holding the start of the file is resumed from there
+	partial := filepath.Join(dir, "partial.bin")
+	os.WriteFile(partial, data[:len(data)/2], 0600)
+	if out, err := cp(":"+remote, partial); err != nil {
+		t.Fatalf("Resumed download failed: %v: %s", err, out)
+	}
+	if got, _ := os.ReadFile(partial); !bytes.Equal(got, data) {
+		t.Fatalf("Resumed download is wrong: got %d bytes, want %d", len(got), len(data))
+	}
+
+	// One holding something else is replaced
+	mismatched := filepath.Join(dir, "mismatched.bin")
+	os.WriteFile(mismatched, bytes.Repeat([]byte("x"), 1000), 0600)
+	if out, err := cp(src, ":"+mismatched); err != nil {
+		t.Fatalf("Upload over a different file failed: %v: %s", err, out)
+	}
+	if got, _ := os.ReadFile(mismatched); !bytes.Equal(got, data) {
+		t.Fatalf("Mismatched destination wasn't replaced: got %d bytes", len(got))
+	}
+
+	// Missing files are reported
+	if out, err := cp(":"+filepath.Join(dir, "missing"), filepath.Join(dir, "x")); err == nil || !strings.Contains(out, "no such file") {
+		t.Errorf("Expected missing file error, got %v: %s", err, out)
+	}
+}
+
+func TestCpCopiesDirectories(t *testing.T) {
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	time.Sleep(100 * time.Millisecond)
+
+	dir := t.TempDir()
+	cp := func(args ...string) (string, error) {
+		args = append([]string{"cp", "-url", srv.URL(), "-token", srv.AuthToken, "-q"}, args...)
+		out, err := exec.Command(ClientBinaryPath, args...).CombinedOutput()
+		return string(out), err
+	}
+
+	tree := filepath.Join(dir, "tree")
+	os.MkdirAll(filepath.Join(tree, "sub", "deeper"), 0755)
+	os.WriteFile(filepath.Join(tree, "top.txt"), []byte("top"), 0644)
+	os.WriteFile(filepath.Join(tree, "sub", "deeper", "leaf.txt"), []byte("leaf"), 0600)
+	os.WriteFile(filepath.Join(tree, "sub", "empty.txt"), nil, 0644)
+
+	if out, err := cp(tree, ":"+filepath.Join(dir, "up")); err == nil || !strings.Contains(out, "use -r") {
+		t.Fatalf("Expected directory without -r to fail, got %v: %s", err, out)
+	}
+
+	// Into an existing directory, under the source's name
+	up := filepath.Join(dir, "up")
+	os.Mkdir(up, 0755)
+	if out, err := cp("-r", tree, ":"+up); err != nil {
+		t.Fatalf("Recursive upload failed: %v: %s", err, out)
+	}
+	down := filepath.Join(dir, "down")
+	if out, err := cp("-r", ":"+filepath.Join(up, "tree"), down); err != nil {
+		t.Fatalf("Recursive download failed: %v: %s", err, out)
+	}
+
+	for name, want := range map[string]string{
+		"top.txt":             "top",
+		"sub/deeper/leaf.txt": "leaf",
+		"sub/empty.txt":       "",
+	} {
+		got, err := os.ReadFile(filepath.Join(down, filepath.FromSlash(name)))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(down, "sub", "deeper", "leaf.txt")); err == nil && fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected leaf.txt to keep mode 0600, got %v", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,84 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUpgradeKeepsSessions(t *testing.T) {
+	port, err := GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	authToken := "test-token"
+	var log syncBuffer
+	old := exec.Command(ServerBinaryPath, "server", "-port", fmt.Sprintf("%d", port))
+	old.Env = append(os.Environ(), "WSS_AUTH_TOKEN="+authToken)
+	old.Stdout, old.Stderr = &log, &log
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer old.Process.Kill()
+	time.Sleep(500 * time.Millisecond)
+
+	url := fmt.Sprintf("ws://localhost:%d", port)
+	var session syncBuffer
+	client := exec.Command(ClientBinaryPath, "client", "-url", url, "-token", authToken, "-c", "echo started; sleep 2; echo survived")
+	client.Stdout = &session
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Process.Kill()
+	session.waitFor(t, "started", 5*time.Second)
+
+	old.Process.Signal(syscall.SIGUSR2)
+	log.waitFor(t, "Handed listener to new server", 10*time.Second)
+	m := regexp.MustCompile(`new server \(pid (\d+)\)`).FindStringSubmatch(log.String())
+	if m == nil {
+		t.Fatalf("No new server in the log: %s", log.String())
+	}
+	pid, _ := strconv.Atoi(m[1])
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	// New sessions go to the new server while the old one drains
+	out, err := exec.Command(ClientBinaryPath, "client", "-url", url, "-token", authToken, "-c", "echo after-upgrade").Output()
+	if err != nil || !strings.Contains(string(out), "after-upgrade") {
+		t.Errorf("Expected a session on the new server, got %v: %q", err, out)
+	}
+
+	if err := client.Wait(); err != nil {
+		t.Errorf("Session failed across the upgrade: %v", err)
+	}
+	if !strings.Contains(session.String(), "survived") {
+		t.Errorf("Expected the session to carry on, got %q", session.String())
+	}
+
+	// The old server exits once its sessions have ended. Waiting on the
+	// command would wait for the new server too, which shares its output.
+	exited := make(chan *os.ProcessState, 1)
+	go func() {
+		state, _ := old.Process.Wait()
+		exited <- state
+	}()
+	select {
+	case state := <-exited:
+		if !state.Success() {
+			t.Errorf("Old server failed: %v: %s", state, log.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Old server didn't exit after its sessions ended: %s", log.String())
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Errorf("Expected the new server to be running, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+//go:build unix
+// +build unix
+
+package tests
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// x11Client connects to $DISPLAY with the cookie in $XAUTHORITY, as X
+// programs do, and prints the display's reply in hex
+const x11Client = `
+import os, socket, struct
+data = open(os.environ["XAUTHORITY"], "rb").read()
+fields, pos = [], 2
+while pos < len(data):
+    n = struct.unpack(">H", data[pos:pos+2])[0]
+    fields.append(data[pos+2:pos+2+n])
+    pos += 2 + n
+name, cookie = fields[2], fields[3]
+display = int(os.environ["DISPLAY"].split(":")[1].split(".")[0])
+pad = lambda b: b + b"\0" * (-len(b) % 4)
+s = socket.create_connection(("127.0.0.1", 6000 + display))
+s.sendall(struct.pack("<BxHHHHxx", 0x6c, 11, 0, len(name), len(cookie)) + pad(name) + pad(cookie))
+reply = b""
+while True:
+    chunk = s.recv(4096)
+    if not chunk:
+        break
+    reply += chunk
+print("reply=" + reply.hex())
+`
+
+func TestX11Forwarding(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	srv := NewTestServer(t)
+	defer srv.Cleanup(t)
+	srv.Server.SetX11Forwarding(true)
+	time.Sleep(100 * time.Millisecond)
+
+	// A local display that echoes the setup request it gets
+	display := filepath.Join(t.TempDir(), "display:0")
+	ln, err := net.Listen("unix", display)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 12)
+			if _, err := io.ReadFull(conn, buf); err == nil {
+				conn.Write(buf)
+			}
+			conn.Close()
+		}
+	}()
+
+	script := filepath.Join(t.TempDir(), "x11client.py")
+	os.WriteFile(script, []byte(x11Client), 0644)
+	cmd := exec.Command(ClientBinaryPath, "client", "-url", srv.URL(), "-token", srv.AuthToken, "-X", "-c", "python3 "+script)
+	cmd.Env = append(os.Environ(), "DISPLAY="+display)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("X11 client failed: %v: %s", err, out)
+	}
+
+	// The display has no xauth entry, so the made-up cookie is replaced by
+	// no authentication at all
+	if !strings.Contains(string(out), "reply=6c000b000000000000000000") {
+		t.Errorf("Expected the display to get the setup request without the cookie, got %q", out)
+	}
+}